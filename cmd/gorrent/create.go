@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/chrispritchard/gorrent/pkg/client"
+)
+
+// string_list is a flag that can be given multiple times, collecting each value
+type string_list []string
+
+func (sl *string_list) String() string {
+	return strings.Join(*sl, " ")
+}
+
+func (sl *string_list) Set(value string) error {
+	*sl = append(*sl, value)
+	return nil
+}
+
+func run_create(args []string) error {
+	flags := flag.NewFlagSet("create", flag.ExitOnError)
+	var trackers, web_seeds string_list
+	out_path := flags.String("o", "", "path to write the .torrent file to (defaults to <name>.torrent)")
+	piece_length := flags.Int("piece-length", 0, "piece length in bytes, a power of two (defaults to automatic)")
+	private := flags.Bool("private", false, "mark the torrent as private, restricting peers to those from its trackers")
+	comment := flags.String("comment", "", "free text comment to include")
+	created_by := flags.String("created-by", "", "creator to record (defaults to gorrent)")
+	flags.Var(&trackers, "t", "tracker tier: comma separated announce urls, repeat for additional tiers")
+	flags.Var(&web_seeds, "w", "web seed url, can be repeated")
+	flags.Usage = func() {
+		fmt.Println("Usage: gorrent create [options] <file-or-directory>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	source := flags.Arg(0)
+
+	tiers := [][]string{}
+	for _, t := range trackers {
+		tier := []string{}
+		for _, url := range strings.Split(t, ",") {
+			if url = strings.TrimSpace(url); url != "" {
+				tier = append(tier, url)
+			}
+		}
+		if len(tier) > 0 {
+			tiers = append(tiers, tier)
+		}
+	}
+
+	data, info, err := client.CreateTorrent(source, client.CreateOptions{
+		PieceLength: *piece_length,
+		Announce:    tiers,
+		WebSeeds:    web_seeds,
+		Private:     *private,
+		Comment:     *comment,
+		CreatedBy:   *created_by,
+	})
+	if err != nil {
+		return err
+	}
+
+	target := *out_path
+	if target == "" {
+		target = filepath.Base(filepath.Clean(source)) + ".torrent"
+	}
+	err = os.WriteFile(target, data, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to write torrent file: %v", err)
+	}
+
+	fmt.Printf("created %s: %d pieces of %d bytes\n", target, info.PieceCount, info.PieceLength)
+	fmt.Println(info.MagnetLink())
+	return nil
+}
@@ -0,0 +1,520 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/chrispritchard/gorrent/internal/config"
+	"github.com/chrispritchard/gorrent/internal/rpc"
+	"github.com/chrispritchard/gorrent/internal/terminal"
+)
+
+const ctl_commands = `Commands:
+  add [-paused] [-output-dir dir] [-remote] [-super-seed] <file.torrent|magnet>...
+  list
+  info <hash>
+  pause <hash>
+  resume <hash>
+  remove [-delete] <hash>
+  move <hash> <dir>
+  super-seed <hash> <on|off>
+  priority <hash> <file> <low|normal|high>
+  limits [-torrent hash] [-download-rate r] [-upload-rate r] [-peer-download-rate r] [-peer-upload-rate r]
+  seed-limits [-torrent hash] [-default] [-ratio r] [-time d] [-idle d] [-action stop|remove|delete]
+  reload-blocklist
+  stats
+  events
+A hash may be shortened to any prefix that matches only one torrent.`
+
+// ctl talks to a running daemon, printing results as text or, with -json, as the daemon returned them
+type ctl struct {
+	rpc  *rpc.Client
+	json bool
+}
+
+func run_ctl(args []string) error {
+	flags := flag.NewFlagSet("ctl", flag.ExitOnError)
+	address := flags.String("addr", rpc.DefaultAddress, "address of the daemon's control api: host:port, or unix:/path/to/socket")
+	token_file := flags.String("token-file", rpc.DefaultTokenFile(), "file holding the daemon's token")
+	json_output := flags.Bool("json", false, "print results as json")
+	flags.Usage = func() {
+		fmt.Println("Usage: gorrent ctl [options] <command> [arguments]")
+		flags.PrintDefaults()
+		fmt.Println(ctl_commands)
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	token, err := rpc.ReadToken(*token_file)
+	if err != nil {
+		return fmt.Errorf("unable to read the daemon's token: %v", err)
+	}
+	c := ctl{rpc: rpc.NewClient(*address, token), json: *json_output}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	command, rest := flags.Arg(0), flags.Args()[1:]
+	switch command {
+	case "add":
+		return c.add(ctx, rest)
+	case "list":
+		return c.list(ctx)
+	case "info":
+		return c.with_hash(rest, func(hash string) error { return c.info(ctx, hash) })
+	case "pause":
+		return c.with_hash(rest, func(hash string) error { return c.torrent(ctx, rpc.MethodTorrentPause, hash) })
+	case "resume":
+		return c.with_hash(rest, func(hash string) error { return c.torrent(ctx, rpc.MethodTorrentResume, hash) })
+	case "remove":
+		return c.remove(ctx, rest)
+	case "move":
+		return c.move(ctx, rest)
+	case "super-seed":
+		return c.super_seed(ctx, rest)
+	case "priority":
+		return c.priority(ctx, rest)
+	case "limits":
+		return c.limits(ctx, rest)
+	case "seed-limits":
+		return c.seed_limits(ctx, rest)
+	case "reload-blocklist":
+		return c.reload_blocklist(ctx)
+	case "stats":
+		return c.stats(ctx)
+	case "events":
+		return c.events(ctx)
+	}
+	return fmt.Errorf("unknown command %q\n%s", command, ctl_commands)
+}
+
+func (c ctl) with_hash(args []string, action func(string) error) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected one info hash, got %d arguments", len(args))
+	}
+	return action(args[0])
+}
+
+// print_json prints result as indented json, returning false when printing as text
+func (c ctl) print_json(result any) bool {
+	if !c.json {
+		return false
+	}
+	encoded, _ := json.MarshalIndent(result, "", "  ")
+	fmt.Println(string(encoded))
+	return true
+}
+
+func (c ctl) add(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("add", flag.ExitOnError)
+	paused := flags.Bool("paused", false, "add without starting")
+	output_dir := flags.String("output-dir", "", "directory to download to (default the daemon's)")
+	remote := flags.Bool("remote", false, "treat paths as files on the daemon's host, rather than uploading them")
+	super_seed := flags.Bool("super-seed", false, "offer the torrent to peers a piece at a time once complete")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		return fmt.Errorf("expected a torrent file or magnet link to add")
+	}
+
+	for _, source := range flags.Args() {
+		params := rpc.AddParams{DownloadDir: *output_dir, Paused: *paused, SuperSeed: *super_seed}
+		switch {
+		case strings.HasPrefix(source, "magnet:"):
+			params.Magnet = source
+		case *remote:
+			params.Path = source
+		default:
+			data, err := os.ReadFile(source)
+			if err != nil {
+				return err
+			}
+			params.Torrent = data
+		}
+		var added rpc.TorrentInfo
+		if err := c.rpc.Call(ctx, rpc.MethodTorrentAdd, params, &added); err != nil {
+			return fmt.Errorf("unable to add %s: %v", source, err)
+		}
+		if !c.print_json(added) {
+			fmt.Printf("added %s %s\n", added.InfoHash, added.Name)
+		}
+	}
+	return nil
+}
+
+func (c ctl) list(ctx context.Context) error {
+	var list []rpc.TorrentInfo
+	if err := c.rpc.Call(ctx, rpc.MethodTorrentList, nil, &list); err != nil {
+		return err
+	}
+	if c.print_json(list) {
+		return nil
+	}
+	fmt.Printf("%-8s  %-11s  %6s  %10s  %10s  %10s  %5s  %8s  %s\n", "HASH", "STATE", "DONE", "SIZE", "DOWN", "UP", "RATIO", "ETA", "NAME")
+	for _, t := range list {
+		fmt.Printf("%-8s  %-11s  %5.1f%%  %10s  %10s  %10s  %5.2f  %8s  %s\n",
+			t.InfoHash[:8], t.State, t.Progress*100, terminal.FormatBytes(t.BytesTotal),
+			terminal.FormatRate(t.DownloadRate), terminal.FormatRate(t.UploadRate), t.Ratio, eta(t), t.Name)
+	}
+	return nil
+}
+
+func eta(t rpc.TorrentInfo) string {
+	if t.ETASeconds < 0 {
+		return "-"
+	}
+	return terminal.FormatETA(time.Duration(t.ETASeconds * float64(time.Second)))
+}
+
+func (c ctl) info(ctx context.Context, hash string) error {
+	var detail rpc.TorrentDetail
+	if err := c.rpc.Call(ctx, rpc.MethodTorrentGet, rpc.TorrentRef{InfoHash: hash}, &detail); err != nil {
+		return err
+	}
+	if c.print_json(detail) {
+		return nil
+	}
+	fmt.Printf("%s\n  hash:       %s\n  state:      %s\n", detail.Name, detail.InfoHash, detail.State)
+	if detail.Error != "" {
+		fmt.Printf("  error:      %s\n", detail.Error)
+	}
+	if detail.TrackerError != "" {
+		fmt.Printf("  tracker:    %s\n", detail.TrackerError)
+	}
+	fmt.Printf("  directory:  %s\n", detail.DownloadDir)
+	fmt.Printf("  progress:   %.1f%% of %s, eta %s\n", detail.Progress*100, terminal.FormatBytes(detail.BytesTotal), eta(detail.TorrentInfo))
+	fmt.Printf("  transfer:   down %s (%s), up %s (%s), ratio %.2f\n",
+		terminal.FormatRate(detail.DownloadRate), terminal.FormatBytes(detail.Downloaded),
+		terminal.FormatRate(detail.UploadRate), terminal.FormatBytes(detail.Uploaded), detail.Ratio)
+	super_seeding := ""
+	if detail.SuperSeeding {
+		super_seeding = ", super-seeding"
+	}
+	fmt.Printf("  seeding:    %s, for %s%s\n", format_seed_limits(detail.SeedLimits, detail.OwnSeedLimits),
+		time.Duration(detail.SeedingSeconds*float64(time.Second)).Round(time.Second), super_seeding)
+	fmt.Printf("  magnet:     %s\n", detail.MagnetLink)
+
+	fmt.Printf("files:\n")
+	for i, f := range detail.Files {
+		done := 100.0
+		if f.Length > 0 {
+			done = float64(f.BytesCompleted) / float64(f.Length) * 100
+		}
+		fmt.Printf("  %3d  %5.1f%%  %10s  %-6s  %s\n", i, done, terminal.FormatBytes(f.Length), f.Priority, f.Path)
+	}
+	if detail.BannedPeers > 0 {
+		fmt.Printf("peers (%d banned):\n", detail.BannedPeers)
+	} else {
+		fmt.Printf("peers:\n")
+	}
+	for _, p := range detail.PeerList {
+		fmt.Printf("  %-22s  %10s  %10s  %s\n", p.Address, terminal.FormatRate(p.DownloadRate), terminal.FormatRate(p.UploadRate), p.Client)
+	}
+	return nil
+}
+
+// torrent calls a method that takes a torrent and returns its summary
+func (c ctl) torrent(ctx context.Context, method, hash string) error {
+	var info rpc.TorrentInfo
+	if err := c.rpc.Call(ctx, method, rpc.TorrentRef{InfoHash: hash}, &info); err != nil {
+		return err
+	}
+	if !c.print_json(info) {
+		fmt.Printf("%s %s\n", info.State, info.Name)
+	}
+	return nil
+}
+
+func (c ctl) remove(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("remove", flag.ExitOnError)
+	delete_data := flags.Bool("delete", false, "also delete the downloaded files")
+	flags.Parse(args)
+	return c.with_hash(flags.Args(), func(hash string) error {
+		return c.rpc.Call(ctx, rpc.MethodTorrentRemove, rpc.RemoveParams{InfoHash: hash, DeleteData: *delete_data}, nil)
+	})
+}
+
+// move moves a torrent's files to a directory on the daemon's host
+func (c ctl) move(ctx context.Context, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("expected an info hash and a directory")
+	}
+	var info rpc.TorrentInfo
+	if err := c.rpc.Call(ctx, rpc.MethodTorrentMove, rpc.MoveParams{InfoHash: args[0], Dir: args[1]}, &info); err != nil {
+		return err
+	}
+	if !c.print_json(info) {
+		fmt.Printf("moved %s to %s\n", info.Name, args[1])
+	}
+	return nil
+}
+
+// super_seed turns a torrent's super-seeding on or off
+func (c ctl) super_seed(ctx context.Context, args []string) error {
+	if len(args) != 2 || (args[1] != "on" && args[1] != "off") {
+		return fmt.Errorf("expected an info hash, and on or off")
+	}
+	var info rpc.TorrentInfo
+	if err := c.rpc.Call(ctx, rpc.MethodTorrentSuperSeed, rpc.SuperSeedParams{InfoHash: args[0], SuperSeeding: args[1] == "on"}, &info); err != nil {
+		return err
+	}
+	if !c.print_json(info) {
+		fmt.Printf("super-seeding %s %s\n", args[1], info.Name)
+	}
+	return nil
+}
+
+func (c ctl) priority(ctx context.Context, args []string) error {
+	if len(args) != 3 {
+		return fmt.Errorf("expected an info hash, file index and priority")
+	}
+	file, err := strconv.Atoi(args[1])
+	if err != nil {
+		return fmt.Errorf("invalid file index %q", args[1])
+	}
+	var detail rpc.TorrentDetail
+	params := rpc.PriorityParams{InfoHash: args[0], File: file, Priority: args[2]}
+	if err := c.rpc.Call(ctx, rpc.MethodTorrentPriority, params, &detail); err != nil {
+		return err
+	}
+	if !c.print_json(detail) {
+		fmt.Printf("%s %s\n", detail.Files[file].Priority, detail.Files[file].Path)
+	}
+	return nil
+}
+
+// limits sets the limits of the session, or of one torrent, leaving any not given as they are
+func (c ctl) limits(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("limits", flag.ExitOnError)
+	hash := flags.String("torrent", "", "set the limits of this torrent rather than of the session")
+	var download, upload, peer_download, peer_upload int
+	flags.Func("download-rate", "most bytes per second to download, e.g. 500K, or 0 for unlimited", rate_flag(&download))
+	flags.Func("upload-rate", "most bytes per second to upload", rate_flag(&upload))
+	flags.Func("peer-download-rate", "most bytes per second to download from each peer (session only)", rate_flag(&peer_download))
+	flags.Func("peer-upload-rate", "most bytes per second to upload to each peer (session only)", rate_flag(&peer_upload))
+	flags.Parse(args)
+	set := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	if *hash == "" {
+		var limits rpc.SessionLimits
+		if set["download-rate"] {
+			limits.DownloadRate = &download
+		}
+		if set["upload-rate"] {
+			limits.UploadRate = &upload
+		}
+		if set["peer-download-rate"] {
+			limits.PeerDownloadRate = &peer_download
+		}
+		if set["peer-upload-rate"] {
+			limits.PeerUploadRate = &peer_upload
+		}
+		var info rpc.SessionInfo
+		if err := c.rpc.Call(ctx, rpc.MethodSessionSetLimits, limits, &info); err != nil {
+			return err
+		}
+		return c.print_stats(info)
+	}
+
+	if set["peer-download-rate"] || set["peer-upload-rate"] {
+		return errors.New("per peer limits apply to the whole session")
+	}
+	var current rpc.TorrentInfo
+	if err := c.rpc.Call(ctx, rpc.MethodTorrentGet, rpc.TorrentRef{InfoHash: *hash}, &current); err != nil {
+		return err
+	}
+	limits := rpc.TorrentLimits{InfoHash: current.InfoHash, DownloadRate: current.DownloadLimit, UploadRate: current.UploadLimit}
+	if set["download-rate"] {
+		limits.DownloadRate = download
+	}
+	if set["upload-rate"] {
+		limits.UploadRate = upload
+	}
+	var info rpc.TorrentInfo
+	if err := c.rpc.Call(ctx, rpc.MethodTorrentSetLimits, limits, &info); err != nil {
+		return err
+	}
+	if !c.print_json(info) {
+		fmt.Printf("%s: download %s, upload %s\n", info.Name, format_limit(info.DownloadLimit), format_limit(info.UploadLimit))
+	}
+	return nil
+}
+
+func format_limit(limit int) string {
+	if limit == 0 {
+		return "unlimited"
+	}
+	return terminal.FormatRate(float64(limit))
+}
+
+// seed_limits sets the seed limits of the session, or of one torrent, leaving any not given as they are
+func (c ctl) seed_limits(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("seed-limits", flag.ExitOnError)
+	hash := flags.String("torrent", "", "set the seed limits of this torrent rather than of the session")
+	follow := flags.Bool("default", false, "have the torrent follow the session's seed limits again")
+	ratio := flags.Float64("ratio", 0, "stop seeding at this share ratio, or 0 for no limit")
+	seeding := flags.Duration("time", 0, "stop after seeding for this long, e.g. 48h, or 0 for no limit")
+	idle := flags.Duration("idle", 0, "stop after no peer has been interested for this long, or 0 for no limit")
+	action := flags.String("action", "", "what to do once a limit is reached: stop, remove, or delete to also delete the files")
+	flags.Parse(args)
+	set := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	update := func(limits rpc.SeedLimits) rpc.SeedLimits {
+		if set["ratio"] {
+			limits.Ratio = *ratio
+		}
+		if set["time"] {
+			limits.TimeSeconds = seeding.Seconds()
+		}
+		if set["idle"] {
+			limits.IdleSeconds = idle.Seconds()
+		}
+		if set["action"] {
+			limits.Action = *action
+		}
+		return limits
+	}
+
+	if *hash == "" {
+		if *follow {
+			return errors.New("-default needs a torrent")
+		}
+		var current rpc.SessionInfo
+		if err := c.rpc.Call(ctx, rpc.MethodSessionStats, nil, &current); err != nil {
+			return err
+		}
+		var info rpc.SessionInfo
+		if err := c.rpc.Call(ctx, rpc.MethodSessionSetSeedLimits, update(current.SeedLimits), &info); err != nil {
+			return err
+		}
+		return c.print_stats(info)
+	}
+
+	var current rpc.TorrentInfo
+	if err := c.rpc.Call(ctx, rpc.MethodTorrentGet, rpc.TorrentRef{InfoHash: *hash}, &current); err != nil {
+		return err
+	}
+	params := rpc.TorrentSeedLimits{InfoHash: current.InfoHash}
+	if !*follow {
+		limits := update(current.SeedLimits)
+		params.Limits = &limits
+	}
+	var info rpc.TorrentInfo
+	if err := c.rpc.Call(ctx, rpc.MethodTorrentSetSeedLimits, params, &info); err != nil {
+		return err
+	}
+	if !c.print_json(info) {
+		fmt.Printf("%s: %s\n", info.Name, format_seed_limits(info.SeedLimits, info.OwnSeedLimits))
+	}
+	return nil
+}
+
+func format_seed_limits(limits rpc.SeedLimits, own bool) string {
+	reached := []string{}
+	if limits.Ratio > 0 {
+		reached = append(reached, fmt.Sprintf("ratio %.2f", limits.Ratio))
+	}
+	if limits.TimeSeconds > 0 {
+		reached = append(reached, fmt.Sprintf("seeding for %s", time.Duration(limits.TimeSeconds*float64(time.Second))))
+	}
+	if limits.IdleSeconds > 0 {
+		reached = append(reached, fmt.Sprintf("idle for %s", time.Duration(limits.IdleSeconds*float64(time.Second))))
+	}
+	result := "seed without limit"
+	if len(reached) > 0 {
+		result = fmt.Sprintf("%s at %s", limits.Action, strings.Join(reached, " or "))
+	}
+	if !own {
+		result += " (the session's)"
+	}
+	return result
+}
+
+func (c ctl) stats(ctx context.Context) error {
+	var info rpc.SessionInfo
+	if err := c.rpc.Call(ctx, rpc.MethodSessionStats, nil, &info); err != nil {
+		return err
+	}
+	return c.print_stats(info)
+}
+
+// reload_blocklist has the daemon read its blocklist again
+func (c ctl) reload_blocklist(ctx context.Context) error {
+	var info rpc.SessionInfo
+	if err := c.rpc.Call(ctx, rpc.MethodSessionBlocklist, nil, &info); err != nil {
+		return err
+	}
+	return c.print_stats(info)
+}
+
+func (c ctl) print_stats(info rpc.SessionInfo) error {
+	if c.print_json(info) {
+		return nil
+	}
+	fmt.Printf("torrents:  %d\nport:      %d\n", info.Torrents, info.Port)
+	fmt.Printf("download:  %s (limit %s, per peer %s)\n", terminal.FormatRate(info.DownloadRate), format_limit(info.DownloadLimit), format_limit(info.PeerDownloadLimit))
+	fmt.Printf("upload:    %s (limit %s, per peer %s)\n", terminal.FormatRate(info.UploadRate), format_limit(info.UploadLimit), format_limit(info.PeerUploadLimit))
+	fmt.Printf("seeding:   %s\n", format_seed_limits(info.SeedLimits, true))
+	if info.BlocklistSize > 0 {
+		fmt.Printf("blocklist: %d ranges\n", info.BlocklistSize)
+	}
+	return nil
+}
+
+// events prints the daemon's events as they happen, until interrupted
+func (c ctl) events(ctx context.Context) error {
+	err := c.rpc.Events(ctx, func(e rpc.Event) error {
+		if c.print_json_line(e) {
+			return nil
+		}
+		line := fmt.Sprintf("%s  %-18s  %s", e.Time.Format(time.TimeOnly), e.Event, e.Torrent)
+		switch {
+		case e.State != "":
+			line += " " + e.State
+		case e.Piece != nil:
+			line += fmt.Sprintf(" piece %d", *e.Piece)
+		case e.Peer != "":
+			line += " " + e.Peer
+		}
+		if e.Error != "" {
+			line += ": " + e.Error
+		}
+		fmt.Println(line)
+		return nil
+	})
+	if errors.Is(err, context.Canceled) {
+		return nil
+	}
+	return err
+}
+
+// print_json_line prints result as a single line of json, so that streams stay newline delimited
+func (c ctl) print_json_line(result any) bool {
+	if !c.json {
+		return false
+	}
+	encoded, _ := json.Marshal(result)
+	fmt.Println(string(encoded))
+	return true
+}
+
+// rate_flag parses a rate in bytes per second, with an optional K, M or G suffix for multiples of 1024
+func rate_flag(target *int) func(string) error {
+	return func(value string) (err error) {
+		*target, err = config.ParseBytes(value)
+		return err
+	}
+}
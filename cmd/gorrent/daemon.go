@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/chrispritchard/gorrent/internal/config"
+	"github.com/chrispritchard/gorrent/internal/metrics"
+	"github.com/chrispritchard/gorrent/internal/rpc"
+	"github.com/chrispritchard/gorrent/internal/transmission"
+	"github.com/chrispritchard/gorrent/internal/watch"
+	"github.com/chrispritchard/gorrent/pkg/client"
+)
+
+// run_daemon runs a client controlled through the rpc api, and optionally fed from a watch directory, until interrupted
+func run_daemon(args []string) error {
+	flags := flag.NewFlagSet("daemon", flag.ExitOnError)
+	options := config.Flags(flags, true)
+	flags.Usage = func() {
+		fmt.Println("Usage: gorrent daemon [options]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	settings, err := config.Load(options)
+	if err != nil {
+		return fmt.Errorf("invalid settings:\n%v", err)
+	}
+	close_log, err := open_logger(settings, true)
+	if err != nil {
+		return err
+	}
+	defer close_log()
+	client_config := settings.ClientConfig()
+	client_config.Logger = logger
+
+	token, err := rpc.LoadOrCreateToken(settings.TokenFile)
+	if err != nil {
+		return fmt.Errorf("unable to load the token: %v", err)
+	}
+
+	c, err := client.New(client_config)
+	if err != nil {
+		return err
+	}
+	hooks_done := start_hooks(c, settings)
+	listener, err := rpc.Listen(settings.Listen)
+	if err != nil {
+		close_client(c, settings)
+		return fmt.Errorf("unable to listen for the control api: %v", err)
+	}
+	servers := []*http.Server{{Handler: rpc.NewServer(c, token, logger), ReadHeaderTimeout: 10 * time.Second}}
+	listeners := []net.Listener{listener}
+	if settings.TransmissionListen != "" {
+		listener, err := rpc.Listen(settings.TransmissionListen)
+		if err != nil {
+			listeners[0].Close()
+			close_client(c, settings)
+			return fmt.Errorf("unable to listen for transmission clients: %v", err)
+		}
+		password := token
+		if !settings.TransmissionAuth {
+			password = ""
+		}
+		servers = append(servers, &http.Server{Handler: transmission.NewServer(c, password, logger), ReadHeaderTimeout: 10 * time.Second})
+		listeners = append(listeners, listener)
+		logger.Info("serving transmission rpc", "address", listener.Addr().String()+transmission.Path, "auth", settings.TransmissionAuth)
+	}
+	if settings.MetricsListen != "" {
+		listener, err := rpc.Listen(settings.MetricsListen)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			close_client(c, settings)
+			return fmt.Errorf("unable to listen for metrics scrapes: %v", err)
+		}
+		servers = append(servers, &http.Server{Handler: metrics.Handler(c), ReadHeaderTimeout: 10 * time.Second})
+		listeners = append(listeners, listener)
+		logger.Info("serving metrics", "address", listener.Addr().String()+metrics.Path)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	served := make(chan error, len(servers))
+	for i, server := range servers {
+		go func() {
+			served <- server.Serve(listeners[i])
+		}()
+	}
+	watching := make(chan struct{})
+	if settings.WatchDir != "" {
+		w := watch.New(c, watch.Config{Dir: settings.WatchDir, DownloadDir: settings.WatchOutputDir, Logger: logger})
+		go func() {
+			defer close(watching)
+			if err := w.Run(ctx); err != nil {
+				logger.Error("unable to watch for torrents", "err", err)
+			}
+		}()
+	} else {
+		close(watching)
+	}
+	if settings.Blocklist != "" {
+		go reload_on_hangup(ctx, c)
+	}
+	logger.Info("daemon started", "api", listener.Addr().String(), "port", c.Port(), "token_file", settings.TokenFile)
+
+	select {
+	case <-ctx.Done():
+		logger.Info("shutting down")
+	case err = <-served:
+	}
+	stop()
+	<-watching // so no torrent is added as the client closes, and then marked invalid
+
+	close_client(c, settings) // first, as that ends the event streams that would otherwise hold the server open
+	<-hooks_done
+	shutdown, cancel := context.WithTimeout(context.Background(), time.Duration(settings.ShutdownTimeout))
+	defer cancel()
+	for _, server := range servers {
+		server.Shutdown(shutdown)
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// reload_on_hangup reloads the blocklist whenever the daemon is sent SIGHUP, until ctx ends
+func reload_on_hangup(ctx context.Context, c *client.Client) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	defer signal.Stop(hangups)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangups:
+			if _, err := c.ReloadBlocklist(); err != nil {
+				logger.Warn("unable to reload the blocklist", "err", err)
+			}
+		}
+	}
+}
@@ -4,192 +4,323 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io"
+	"log/slog"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
-	"github.com/chrispritchard/gorrent/internal/bitfields"
-	"github.com/chrispritchard/gorrent/internal/downloading"
-	"github.com/chrispritchard/gorrent/internal/messaging"
-	outfiles "github.com/chrispritchard/gorrent/internal/out_files"
-	"github.com/chrispritchard/gorrent/internal/peer"
+	"github.com/chrispritchard/gorrent/internal/config"
+	"github.com/chrispritchard/gorrent/internal/hooks"
 	"github.com/chrispritchard/gorrent/internal/terminal"
-	. "github.com/chrispritchard/gorrent/internal/torrent_files"
-	"github.com/chrispritchard/gorrent/internal/tracker"
-	"github.com/chrispritchard/gorrent/internal/util"
+	"github.com/chrispritchard/gorrent/pkg/client"
 )
 
-var verbose bool
+var use_tui bool
+var output string
 
-func vprintfln(format string, a ...any) {
-	if verbose {
-		fmt.Printf(format+"\n", a...)
-	}
-}
+var logger = slog.New(slog.DiscardHandler)
+var logs_on_stdout bool // in which case the progress display and full screen interface are not used
 
 func main() {
-	fmt.Print("\033[38;5;153m") // pale blue
-	defer fmt.Print("\033[0m")
+	os.Exit(run())
+}
 
-	flag.BoolVar(&verbose, "v", false, "enable verbose output")
+// run returns the exit code, once its deferred clean up has run. A panic is left to end the process as usual
+func run() int {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "create":
+			if err := run_create(os.Args[2:]); err != nil {
+				fmt.Printf("unable to create torrent file: %v\n", err)
+				return 1
+			}
+			return 0
+		case "daemon":
+			if err := run_daemon(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "daemon failed: %v\n", err)
+				return 1
+			}
+			return 0
+		case "ctl":
+			if err := run_ctl(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				return 1
+			}
+			return 0
+		}
+	}
+
+	options := config.Flags(flag.CommandLine, false)
+	flag.StringVar(&output, "output", output_auto, "auto for progress in a terminal and plain otherwise, plain for log lines, or json for newline delimited json events")
+	flag.BoolVar(&use_tui, "tui", true, "show the full screen interface when run in a terminal, seeding until quit")
 	flag.Parse()
 
 	if len(flag.Args()) == 0 {
-		fmt.Println("Usage: gorrent [options] <torrent-file>")
+		fmt.Println("Usage: gorrent [options] <torrent-file-or-magnet-link>...")
+		fmt.Println("       gorrent create [options] <file-or-directory>")
+		fmt.Println("       gorrent daemon [options]")
+		fmt.Println("       gorrent ctl [options] <command> [arguments]")
 		flag.PrintDefaults()
-		os.Exit(1)
+		return 1
 	}
 
-	file := flag.Arg(0)
-
-	err := try_download(file)
+	settings, err := config.Load(options)
 	if err != nil {
-		fmt.Printf("unable to download via torrent file: %v\n", err)
-		os.Exit(1)
+		fmt.Printf("invalid settings:\n%v\n", err)
+		return 1
 	}
-	fmt.Println("Download complete.")
-}
 
-func try_download(torrent_file_path string) error {
-	metadata, err := parse_torrent(torrent_file_path)
-	vprintfln("parsed torrent successfully")
-	tracker_info, err := tracker.CallTracker(metadata)
-	if err != nil {
-		return fmt.Errorf("failed to register with tracker: %v", err)
+	switch output {
+	case output_auto:
+		if !terminal.IsOutputTerminal() {
+			output = output_plain
+		}
+	case output_plain, output_json:
+	default:
+		fmt.Printf("unknown output %q, expected auto, plain or json\n", output)
+		return 1
+	}
+
+	if output == output_auto {
+		fmt.Print("\033[38;5;153m") // pale blue
+		defer fmt.Print("\033[0m")
 	}
-	vprintfln("registered with tracker")
 
-	out_files, err := outfiles.CreateOutFileManager(metadata, "")
+	close_log, err := open_logger(settings, false)
 	if err != nil {
-		return fmt.Errorf("failed to establish local files: %v", err)
+		fmt.Printf("unable to start logging: %v\n", err)
+		return 1
 	}
-	defer out_files.Close()
-	vprintfln("created local file(s)")
+	defer close_log()
 
-	return start_state_machine(metadata, tracker_info, out_files)
-}
+	// the first interrupt stops cleanly, restoring default handling so a second one exits at once
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	context.AfterFunc(ctx, stop)
 
-func parse_torrent(torrent_file_path string) (TorrentMetadata, error) {
-	var nil_result TorrentMetadata
-	d, err := os.ReadFile(torrent_file_path)
+	finished, err := try_download(ctx, flag.Args(), settings)
 	if err != nil {
-		return nil_result, fmt.Errorf("unable to read file at path %s: %v", torrent_file_path, err)
+		if output == output_json {
+			fmt.Fprintf(os.Stderr, "unable to download torrent: %v\n", err)
+		} else {
+			fmt.Printf("unable to download torrent: %v\n", err)
+		}
+		return 1
+	}
+	exit_code := 0
+	if ctx.Err() != nil {
+		exit_code = 130 // the shell convention for an interrupt
+	}
+	if output == output_json {
+		return exit_code
 	}
+	switch {
+	case finished:
+		fmt.Println("Download complete.")
+	case ctx.Err() != nil:
+		fmt.Println("Interrupted.")
+	default:
+		fmt.Println("Stopped.")
+	}
+	return exit_code
+}
 
-	torrent, err := ParseTorrentFile(d)
+// open_logger logs to the log file if one is given, otherwise with -v (or always) to stdout, or stderr for json
+// output. Otherwise nothing is logged
+func open_logger(settings config.Config, always bool) (func(), error) {
+	if settings.LogFile == "" && !settings.Verbose && !always {
+		return func() {}, nil
+	}
+	spec := settings.LogLevel
+	if spec == "" && settings.Verbose {
+		spec = "debug"
+	}
+	levels, err := client.ParseLogLevels(spec)
 	if err != nil {
-		return nil_result, fmt.Errorf("unable to parse torrent file: %v", err)
+		return nil, err
+	}
+
+	var out io.Writer = os.Stdout
+	close_log := func() {}
+	switch {
+	case settings.LogFile != "":
+		file, err := os.OpenFile(settings.LogFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+		out, close_log = file, func() { file.Close() }
+	case output == output_json:
+		out = os.Stderr // stdout is kept to json lines only
+	default:
+		logs_on_stdout = true
 	}
 
-	return torrent, nil
+	logger, err = client.NewLogger(out, settings.LogFormat, levels)
+	if err != nil {
+		close_log()
+		return nil, err
+	}
+	return close_log, nil
 }
 
-func start_state_machine(metadata TorrentMetadata, tracker_info tracker.TrackerResponse, out_file_manager *outfiles.OutFileManager) error {
+// try_download returns whether every torrent finished, which is not the case if interrupted by ctx or if the full
+// screen interface was quit early
+func try_download(ctx context.Context, sources []string, settings config.Config) (bool, error) {
+	infos := []client.Metainfo{}
+	magnets := []string{}
+	for _, source := range sources {
+		if strings.HasPrefix(source, "magnet:") {
+			magnets = append(magnets, source)
+			continue
+		}
+		info, err := client.LoadTorrentFile(source)
+		if err != nil {
+			return false, err
+		}
+		infos = append(infos, info)
+	}
+	logger.Debug("parsed torrent files", "count", len(infos))
 
-	current_local_field, err := out_file_manager.Bitfield()
+	client_config := settings.ClientConfig()
+	client_config.Logger = logger
+	c, err := client.New(client_config)
 	if err != nil {
-		return err
+		return false, err
+	}
+	hooks_done := start_hooks(c, settings)
+	defer func() {
+		close_client(c, settings)
+		<-hooks_done // so a completion hook is not cut short by exiting
+	}()
+	logger.Info("listening for peers", "port", c.Port())
+
+	for _, info := range infos {
+		if _, err := c.AddTorrent(info, client.AddOptions{}); err != nil {
+			return false, err
+		}
+	}
+	for _, magnet := range magnets {
+		if _, err := c.AddMagnet(magnet, client.AddOptions{}); err != nil {
+			return false, err
+		}
 	}
-	vprintfln("created local bitfield:\n\t%s", current_local_field.BitString())
 
-	peers := connect_to_peers(metadata, tracker_info, current_local_field)
-	if len(peers) == 0 {
-		return fmt.Errorf("failed to connect to a peer")
+	if output != output_auto {
+		return run_report(ctx, c, os.Stdout, output)
 	}
-	vprintfln("connected to %d peers\n", len(peers))
+	if use_tui && !logs_on_stdout && terminal.IsInteractive() {
+		return run_tui(ctx, c)
+	}
+	return wait_for_completion(ctx, c)
+}
 
-	if current_local_field.Incomplete() {
-		return request_pieces(metadata, peers, out_file_manager)
-	} else {
-		return seed_pieces(metadata, peers, out_file_manager)
+// start_hooks runs the hooks the settings ask for on the client's events, returning a channel closed once the client
+// has closed and they have finished
+func start_hooks(c *client.Client, settings config.Config) <-chan struct{} {
+	hooks_config := settings.HooksConfig()
+	if hooks_config.Command == "" && hooks_config.Webhook == "" {
+		done := make(chan struct{})
+		close(done)
+		return done
 	}
+	hooks_config.Logger = logger
+	return hooks.New(c, hooks_config).Start(context.Background())
 }
 
-func request_pieces(metadata TorrentMetadata, peers []*peer.PeerHandler, out_file_manager *outfiles.OutFileManager) error {
-	ctx := context.Background()
-	defer ctx.Done()
+// close_client stops every torrent, giving up after the shutdown timeout so that a hung disk cannot keep us running
+func close_client(c *client.Client, settings config.Config) {
+	timeout := time.Duration(settings.ShutdownTimeout)
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		c.Close()
+	}()
+	select {
+	case <-closed:
+	case <-time.After(timeout):
+		logger.Warn("gave up waiting for torrents to stop", "timeout", timeout)
+	}
+}
 
-	received_channel := make(chan messaging.Received)
-	error_channel := make(chan error)
+// wait_for_completion shows progress until every torrent has finished downloading, one has failed, or ctx ends
+func wait_for_completion(ctx context.Context, c *client.Client) (bool, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	download_state := downloading.NewDownloadState(metadata, peers, out_file_manager, vprintfln)
-	download_state.StartRequestingPieces(ctx, error_channel)
-	vprintfln("started requesting missing pieces")
+	failed := make(chan error, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, t := range c.Torrents() {
+			if err := t.Wait(ctx); err != nil {
+				failed <- err
+				return
+			}
+		}
+	}()
 
-	keep_alive := time.NewTicker(2 * time.Minute)
 	progress_ticker := time.NewTicker(250 * time.Millisecond)
 	defer progress_ticker.Stop()
 
 	ba := &terminal.BufferedArea{}
 	defer ba.Close()
 
-	for _, p := range peers {
-		p.StartReceiving(ctx, received_channel, error_channel)
-		defer p.Close()
-	}
-
 	for {
 		select {
-		case <-keep_alive.C:
-			for _, p := range peers {
-				p.SendKeepAlive()
-			}
-			vprintfln("sent keep alives")
 		case <-progress_ticker.C:
-			print_status(ba, metadata, len(peers), download_state.CompletedPieces())
-		case received := <-received_channel:
-			if received.Kind == messaging.MSG_PIECE {
-				index, begin, piece := received.AsPiece()
-				finished, err := download_state.ReceiveBlock(index, begin, piece)
-				if err != nil {
-					return err
-				}
-				vprintfln("received block: index=%d begin=%d len=%d", index, begin, len(piece))
-				if finished {
-					print_status(ba, metadata, len(peers), download_state.CompletedPieces())
-					return nil // complete
-				}
-			} else {
-				vprintfln("received an unhandled kind: %d", received.Kind)
+			print_status(ba, c)
+		case err := <-failed:
+			if ctx.Err() != nil {
+				return false, nil
 			}
-		case err := <-error_channel:
-			return err
+			return false, err
+		case <-done:
+			print_status(ba, c)
+			return true, nil
+		case <-ctx.Done():
+			return false, nil
 		}
 	}
 }
 
-func seed_pieces(metadata TorrentMetadata, peers []*peer.PeerHandler, out_file_manager *outfiles.OutFileManager) error {
-	panic("unimplemented")
-}
-
-func connect_to_peers(metadata TorrentMetadata, tracker_response tracker.TrackerResponse, local_bitfield *bitfields.BitField) []*peer.PeerHandler {
-	ops := make([]util.Op[*peer.PeerHandler], len(tracker_response.Peers))
-	for i, p := range tracker_response.Peers {
-		local_p := p
-		ops[i] = func() (*peer.PeerHandler, error) {
-			return peer.ConnectToPeer(local_p, metadata.InfoHash[:], tracker_response.LocalID, local_bitfield, vprintfln)
-		}
-	}
-
-	conns, errs := util.Concurrent(ops, 20)
-	for _, e := range errs {
-		vprintfln(e.Error())
+func print_status(ba *terminal.BufferedArea, c *client.Client) {
+	if logs_on_stdout {
+		return
 	}
-	return conns
-}
+	lines := []string{}
+	for _, t := range c.Torrents() {
+		status := t.Status()
+		max_width := len(fmt.Sprintf("%d", status.TotalPieces))
+		piece_fraction := fmt.Sprintf("%*d/%*d complete", max_width, status.CompletedPieces, max_width, status.TotalPieces)
 
-func print_status(ba *terminal.BufferedArea, metadata TorrentMetadata, connected_peers, finished_pieces int) {
-	if verbose {
-		return
+		prog_bar, _ := terminal.ProgressBar(status.CompletedPieces, status.TotalPieces, 40, piece_fraction)
+		peers := fmt.Sprintf("peers: %d", status.Peers)
+		if status.BannedPeers > 0 {
+			peers += fmt.Sprintf(", %d banned", status.BannedPeers)
+		}
+		if status.TrackerErr != nil {
+			peers += fmt.Sprintf(" (tracker: %v)", status.TrackerErr)
+		}
+		if status.State == client.FetchingMetadata {
+			peers += " (fetching metadata)"
+		}
+		transfer := fmt.Sprintf("down: %s (%s), up: %s (%s), ratio: %.2f, eta: %s",
+			terminal.FormatRate(status.DownloadRate), terminal.FormatBytes(status.Downloaded),
+			terminal.FormatRate(status.UploadRate), terminal.FormatBytes(status.Uploaded),
+			status.Ratio, terminal.FormatETA(status.ETA))
+		if status.Wasted > 0 {
+			transfer += fmt.Sprintf(", wasted: %s", terminal.FormatBytes(status.Wasted))
+		}
+		lines = append(lines,
+			"name: "+t.Name(),
+			peers,
+			transfer,
+			"progress:",
+			prog_bar,
+		)
 	}
-	total_pieces := len(metadata.Pieces)
-	max_width := len(fmt.Sprintf("%d", total_pieces))
-	piece_fraction := fmt.Sprintf("%*d/%*d complete", max_width, finished_pieces, max_width, total_pieces)
-
-	prog_bar, _ := terminal.ProgressBar(finished_pieces, total_pieces, 40, piece_fraction)
-	ba.Update([]string{
-		"name: " + metadata.Name,
-		fmt.Sprintf("peers: %d", connected_peers),
-		"progress:",
-		prog_bar,
-	})
+	ba.Update(lines)
 }
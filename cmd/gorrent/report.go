@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/chrispritchard/gorrent/internal/terminal"
+	"github.com/chrispritchard/gorrent/pkg/client"
+)
+
+// Output for logs and other programs rather than people at a terminal: no escape codes, one line per event. In json
+// mode each line is a json object with an "event" field, one of started, metadata_received, state_changed,
+// peer_connected, peer_disconnected, piece_verified, progress, completed, stopped or error.
+
+const (
+	output_auto  = "auto"
+	output_plain = "plain"
+	output_json  = "json"
+)
+
+var json_progress_interval = 1 * time.Second
+var plain_progress_interval = 5 * time.Second
+
+type report_line struct {
+	Event    string    `json:"event"`
+	Time     time.Time `json:"time"`
+	Torrent  string    `json:"torrent,omitempty"`
+	InfoHash string    `json:"info_hash,omitempty"`
+	State    string    `json:"state,omitempty"`
+	Piece    *int      `json:"piece,omitempty"`
+	Peer     string    `json:"peer,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	*report_progress
+}
+
+type report_progress struct {
+	Progress        float64 `json:"progress"`
+	CompletedPieces int     `json:"completed_pieces"`
+	TotalPieces     int     `json:"total_pieces"`
+	BytesCompleted  int64   `json:"bytes_completed"`
+	BytesTotal      int64   `json:"bytes_total"`
+	Peers           int     `json:"peers"`
+	BannedPeers     int     `json:"banned_peers"`
+	Downloaded      int64   `json:"downloaded"`
+	Uploaded        int64   `json:"uploaded"`
+	Wasted          int64   `json:"wasted"`
+	DownloadRate    float64 `json:"download_rate"`
+	UploadRate      float64 `json:"upload_rate"`
+	Ratio           float64 `json:"ratio"`
+	ETASeconds      float64 `json:"eta_seconds"` // -1 if unknown
+}
+
+type reporter struct {
+	out       io.Writer
+	json      bool
+	completed map[*client.Torrent]bool // reported once each, whether by event or because the data was already there
+}
+
+// run_report writes events and periodic progress until every torrent has finished downloading, one has failed, or ctx
+// ends, returning whether all finished
+func run_report(ctx context.Context, c *client.Client, out io.Writer, format string) (bool, error) {
+	r := &reporter{out: out, json: format == output_json, completed: map[*client.Torrent]bool{}}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	events := c.Subscribe(ctx) // before reporting the starting state, so nothing is missed
+
+	for _, t := range c.Torrents() {
+		r.write(new_report_line("started", time.Now(), t))
+	}
+
+	interval := plain_progress_interval
+	if r.json {
+		interval = json_progress_interval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if done, err := r.check(c); done {
+			return err == nil, err
+		}
+
+		select {
+		case e, ok := <-events:
+			if !ok {
+				if ctx.Err() != nil {
+					r.stopped(c)
+					return false, nil
+				}
+				return false, fmt.Errorf("client closed")
+			}
+			r.event(e)
+		case <-ticker.C:
+			for _, t := range c.Torrents() {
+				r.progress("progress", t)
+			}
+		}
+	}
+}
+
+// check reports whether every torrent is seeding, or one has failed
+func (r *reporter) check(c *client.Client) (bool, error) {
+	done := true
+	for _, t := range c.Torrents() {
+		status := t.Status()
+		if status.State == client.Failed {
+			line := new_report_line("error", time.Now(), t)
+			line.Error = fmt.Sprint(status.Err)
+			r.write(line)
+			return true, fmt.Errorf("%s: %v", t.Name(), status.Err)
+		}
+		done = done && status.State == client.Seeding
+	}
+	if done {
+		for _, t := range c.Torrents() {
+			r.complete(t)
+		}
+	}
+	return done, nil
+}
+
+func (r *reporter) event(e client.Event) {
+	line := new_report_line("", e.Time, e.Torrent)
+	switch e.Kind {
+	case client.MetadataReceived:
+		line.Event = "metadata_received"
+	case client.StateChanged:
+		line.Event, line.State = "state_changed", e.State.String()
+		if e.Err != nil {
+			line.Error = e.Err.Error()
+		}
+	case client.PeerConnected, client.PeerDisconnected:
+		line.Event, line.Peer = "peer_connected", e.Peer
+		if e.Kind == client.PeerDisconnected {
+			line.Event = "peer_disconnected"
+		}
+	case client.PieceVerified:
+		if !r.json {
+			return // far too many for a log, where progress lines say the same
+		}
+		line.Event, line.Piece = "piece_verified", &e.Piece
+	case client.TorrentCompleted:
+		r.complete(e.Torrent)
+		return
+	default:
+		return
+	}
+	r.write(line)
+}
+
+// stopped reports each unfinished torrent as stopping early, e.g. on an interrupt
+func (r *reporter) stopped(c *client.Client) {
+	for _, t := range c.Torrents() {
+		if !r.completed[t] {
+			r.progress("stopped", t)
+		}
+	}
+}
+
+func (r *reporter) complete(t *client.Torrent) {
+	if !r.completed[t] {
+		r.completed[t] = true
+		r.progress("completed", t)
+	}
+}
+
+func (r *reporter) progress(event string, t *client.Torrent) {
+	status := t.Status()
+	line := new_report_line(event, time.Now(), t)
+	line.State = status.State.String()
+	line.report_progress = &report_progress{
+		Progress:        status.Progress,
+		CompletedPieces: status.CompletedPieces,
+		TotalPieces:     status.TotalPieces,
+		BytesCompleted:  status.BytesCompleted,
+		BytesTotal:      status.BytesTotal,
+		Peers:           status.Peers,
+		BannedPeers:     status.BannedPeers,
+		Downloaded:      status.Downloaded,
+		Uploaded:        status.Uploaded,
+		Wasted:          status.Wasted,
+		DownloadRate:    status.DownloadRate,
+		UploadRate:      status.UploadRate,
+		Ratio:           status.Ratio,
+		ETASeconds:      status.ETA.Seconds(),
+	}
+	if status.ETA < 0 {
+		line.ETASeconds = -1
+	}
+	r.write(line)
+}
+
+func new_report_line(event string, at time.Time, t *client.Torrent) report_line {
+	return report_line{Event: event, Time: at, Torrent: t.Name(), InfoHash: t.InfoHash().String()}
+}
+
+func (r *reporter) write(line report_line) {
+	if r.json {
+		encoded, err := json.Marshal(line)
+		if err != nil {
+			return
+		}
+		fmt.Fprintln(r.out, string(encoded))
+		return
+	}
+	fmt.Fprintln(r.out, plain_line(line))
+}
+
+// plain_line formats a line for a log, e.g. "2024-01-02T15:04:05Z progress ubuntu.iso 42.0% 1.2 MiB/s down ..."
+func plain_line(line report_line) string {
+	text := fmt.Sprintf("%s %s %s", line.Time.Format(time.RFC3339), line.Event, line.Torrent)
+	if line.State != "" && line.report_progress == nil {
+		text += " " + line.State
+	}
+	if line.Peer != "" {
+		text += " " + line.Peer
+	}
+	if p := line.report_progress; p != nil {
+		text += fmt.Sprintf(" %.1f%% (%d/%d pieces) peers %d, down %s (%s), up %s (%s), ratio %.2f, eta %s",
+			p.Progress*100, p.CompletedPieces, p.TotalPieces, p.Peers,
+			terminal.FormatRate(p.DownloadRate), terminal.FormatBytes(p.Downloaded),
+			terminal.FormatRate(p.UploadRate), terminal.FormatBytes(p.Uploaded),
+			p.Ratio, terminal.FormatETA(time.Duration(p.ETASeconds*float64(time.Second))))
+	}
+	if line.Error != "" {
+		text += ": " + line.Error
+	}
+	return text
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/chrispritchard/gorrent/internal/terminal"
+	"github.com/chrispritchard/gorrent/pkg/client"
+)
+
+// The full screen view: a list of torrents, then for the selected one a piece map, its files and its peers. Unlike
+// the plain progress display it keeps seeding once everything is complete, until quit.
+
+const (
+	focus_torrents = iota
+	focus_files
+)
+
+const help = " q quit  p pause/resume  ↑↓ select  tab torrents/files  +/- file priority"
+
+type tui struct {
+	client   *client.Client
+	selected int // index into the client's torrents
+	file     int // index into the selected torrent's files
+	focus    int
+	message  string // the outcome of the last action, shown in the footer
+}
+
+// run_tui shows the view until the user quits or ctx ends, returning whether every torrent had finished by then
+func run_tui(ctx context.Context, c *client.Client) (bool, error) {
+	screen, err := terminal.OpenScreen()
+	if err != nil {
+		return false, err
+	}
+	defer screen.Close()
+
+	ui := &tui{client: c}
+	keys := screen.Keys()
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		width, height := screen.Size()
+		screen.Draw(ui.render(width, height))
+
+		select {
+		case <-ctx.Done():
+			return all_seeding(c), nil
+		case <-ticker.C:
+		case key, ok := <-keys:
+			if !ok || key == "q" || key == "ctrl+c" {
+				return all_seeding(c), nil
+			}
+			ui.handle(key)
+		}
+	}
+}
+
+func all_seeding(c *client.Client) bool {
+	for _, t := range c.Torrents() {
+		if t.Status().State != client.Seeding {
+			return false
+		}
+	}
+	return true
+}
+
+func (ui *tui) handle(key string) {
+	torrents := ui.client.Torrents()
+	if len(torrents) == 0 {
+		return
+	}
+	ui.selected = min(ui.selected, len(torrents)-1)
+	t := torrents[ui.selected]
+
+	switch key {
+	case "up", "k":
+		if ui.focus == focus_torrents {
+			ui.selected, ui.file = max(ui.selected-1, 0), 0
+		} else {
+			ui.file = max(ui.file-1, 0)
+		}
+	case "down", "j":
+		if ui.focus == focus_torrents {
+			ui.selected, ui.file = min(ui.selected+1, len(torrents)-1), 0
+		} else {
+			ui.file = min(ui.file+1, max(len(t.Files())-1, 0))
+		}
+	case "tab":
+		ui.focus = (ui.focus + 1) % 2
+	case "p":
+		if state := t.Status().State; state == client.Paused || state == client.Failed {
+			t.Resume()
+			ui.message = "resumed " + t.Name()
+		} else {
+			go t.Pause() // waits for peers and files to close, so kept off the drawing loop
+			ui.message = "pausing " + t.Name()
+		}
+	case "+", "=", "-":
+		files := t.Files()
+		if ui.file >= len(files) {
+			return
+		}
+		priority := files[ui.file].Priority + 1
+		if key == "-" {
+			priority = files[ui.file].Priority - 1
+		}
+		priority = max(min(priority, client.High), client.Low)
+		if err := t.SetFilePriority(ui.file, priority); err != nil {
+			ui.message = err.Error()
+		} else {
+			ui.message = fmt.Sprintf("%s is now %s priority", files[ui.file].Path, priority)
+		}
+	}
+}
+
+func (ui *tui) render(width, height int) []string {
+	torrents := ui.client.Torrents()
+	download, upload := 0.0, 0.0
+	statuses := []client.Status{}
+	for _, t := range torrents {
+		status := t.Status()
+		download += status.DownloadRate
+		upload += status.UploadRate
+		statuses = append(statuses, status)
+	}
+
+	lines := []string{terminal.Reverse(terminal.Fit(fmt.Sprintf(" gorrent  port %d  ↓ %s  ↑ %s  %d torrent(s)",
+		ui.client.Port(), terminal.FormatRate(download), terminal.FormatRate(upload), len(torrents)), width))}
+
+	if len(torrents) == 0 {
+		return ui.finish(lines, width, height)
+	}
+	ui.selected = min(ui.selected, len(torrents)-1)
+
+	name_width := max(width-67, 10)
+	lines = append(lines, terminal.Fit(fmt.Sprintf("  %-*s %-11s %6s %11s %11s %8s %6s %5s",
+		name_width, "name", "state", "done", "down", "up", "eta", "ratio", "peers"), width))
+	for i, t := range torrents {
+		status := statuses[i]
+		marker := "  "
+		if i == ui.selected {
+			marker = "> "
+		}
+		row := fmt.Sprintf("%s%-*s %-11s %5.1f%% %11s %11s %8s %6.2f %5d", marker,
+			name_width, terminal.Fit(t.Name(), name_width), terminal.Fit(status.State.String(), 11), status.Progress*100,
+			terminal.FormatRate(status.DownloadRate), terminal.FormatRate(status.UploadRate),
+			terminal.FormatETA(status.ETA), status.Ratio, status.Peers)
+		row = terminal.Fit(row, width)
+		if i == ui.selected && ui.focus == focus_torrents {
+			row = terminal.Reverse(row)
+		}
+		lines = append(lines, row)
+	}
+
+	t, status := torrents[ui.selected], statuses[ui.selected]
+	lines = append(lines, "")
+	if status.Err != nil {
+		lines = append(lines, terminal.Fit("error: "+status.Err.Error(), width))
+	}
+	if status.TrackerErr != nil {
+		lines = append(lines, terminal.Fit("tracker: "+status.TrackerErr.Error(), width))
+	}
+
+	lines = append(lines, ui.render_pieces(t, width)...)
+	lines = append(lines, ui.render_files(t, width)...)
+	lines = append(lines, ui.render_peers(t, width)...)
+	return ui.finish(lines, width, height)
+}
+
+// finish cuts the view to the screen, leaving room for the footer
+func (ui *tui) finish(lines []string, width, height int) []string {
+	if len(lines) > height-1 {
+		lines = lines[:max(height-1, 0)]
+	}
+	for len(lines) < height-1 {
+		lines = append(lines, "")
+	}
+	footer := help
+	if ui.message != "" {
+		footer += "  | " + ui.message
+	}
+	return append(lines, terminal.Reverse(terminal.Fit(footer, width)))
+}
+
+func (ui *tui) render_pieces(t *client.Torrent, width int) []string {
+	pieces := t.Pieces()
+	if len(pieces) == 0 {
+		return nil
+	}
+	title := "pieces"
+	if width >= len(title)+2+terminal.PieceMapLegendWidth() {
+		title += "  " + terminal.PieceMapLegend()
+	}
+	cells := []terminal.MapPiece{}
+	for _, p := range pieces {
+		cells = append(cells, terminal.MapPiece{Have: p.Have, Peers: p.Peers})
+	}
+	lines := []string{title}
+	for _, l := range terminal.PieceMap(cells, max(width-2, 1), 4) {
+		lines = append(lines, "  "+l)
+	}
+	return append(lines, "")
+}
+
+const max_file_rows = 6
+
+func (ui *tui) render_files(t *client.Torrent, width int) []string {
+	files := t.Files()
+	if len(files) == 0 {
+		return nil
+	}
+	ui.file = min(ui.file, len(files)-1)
+	lines := []string{terminal.Fit(fmt.Sprintf("files (%d)", len(files)), width)}
+
+	first := max(0, min(ui.file-max_file_rows/2, len(files)-max_file_rows)) // keep the selected file in view
+	for i := first; i < min(first+max_file_rows, len(files)); i++ {
+		f := files[i]
+		done := 100.0
+		if f.Length > 0 {
+			done = float64(f.BytesCompleted) / float64(f.Length) * 100
+		}
+		marker := "  "
+		if i == ui.file && ui.focus == focus_files {
+			marker = "> "
+		}
+		row := terminal.Fit(fmt.Sprintf("%s%-6s %5.1f%% %10s  %s", marker, f.Priority, done, terminal.FormatBytes(f.Length), f.Path), width)
+		if i == ui.file && ui.focus == focus_files {
+			row = terminal.Reverse(row)
+		}
+		lines = append(lines, row)
+	}
+	return append(lines, "")
+}
+
+func (ui *tui) render_peers(t *client.Torrent, width int) []string {
+	peers := t.Peers()
+	lines := []string{terminal.Fit(fmt.Sprintf("peers (%d)", len(peers)), width)}
+	if len(peers) == 0 {
+		return lines
+	}
+	lines = append(lines, terminal.Fit(fmt.Sprintf("  %-24s %-20s %11s %11s %-5s %4s", "address", "client", "down", "up", "flags", "reqs"), width))
+	for _, p := range peers {
+		lines = append(lines, terminal.Fit(fmt.Sprintf("  %-24s %-20s %11s %11s %-5s %4d",
+			terminal.Fit(p.Address, 24), terminal.Fit(p.Client, 20),
+			terminal.FormatRate(p.DownloadRate), terminal.FormatRate(p.UploadRate), peer_flags(p), p.Requests), width))
+	}
+	return lines
+}
+
+// peer_flags summarises the choke and interest state: D downloading from them, d we want to but are choked, U
+// uploading to them, u they want to but we choke them
+func peer_flags(p client.PeerStatus) string {
+	var flags strings.Builder
+	if p.AmInterested {
+		if p.Choked {
+			flags.WriteString("d")
+		} else {
+			flags.WriteString("D")
+		}
+	}
+	if p.Interested {
+		if p.Choking {
+			flags.WriteString("u")
+		} else {
+			flags.WriteString("U")
+		}
+	}
+	return flags.String()
+}
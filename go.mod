@@ -2,8 +2,9 @@ module github.com/chrispritchard/gorrent
 
 go 1.25.5
 
+require golang.org/x/term v0.28.0
+
 require (
 	golang.org/x/sync v0.19.0 // indirect
 	golang.org/x/sys v0.29.0 // indirect
-	golang.org/x/term v0.28.0 // indirect
 )
@@ -135,8 +135,8 @@ func parse_bencoded_string(data []byte, data_len int) (any, []byte, error) {
 
 	if i == 0 {
 		return nil, nil, fmt.Errorf("unrecognised start token")
-	} else if data[0] == '0' {
-		return nil, nil, fmt.Errorf("invalid string length - starts with 0")
+	} else if data[0] == '0' && i > 1 {
+		return nil, nil, fmt.Errorf("invalid string length - starts with 0") // "0:" is the only valid form, an empty string
 	}
 
 	length, _ := strconv.Atoi(string(data[0:i]))
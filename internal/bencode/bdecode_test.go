@@ -37,6 +37,14 @@ func TestParseStrings(t *testing.T) {
 			want_err: false,
 		},
 
+		{
+			name:     "empty string",
+			input:    []byte("0:rest"),
+			want:     "",
+			want_rem: []byte("rest"),
+			want_err: false,
+		},
+
 		{
 			name:     "bad length",
 			input:    []byte("02:aa"),
@@ -0,0 +1,84 @@
+package bencode
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"strconv"
+)
+
+// Code to encode values into bencode, the inverse of Decode. Dictionary keys are always written in sorted order,
+// so the output is canonical - important as info hashes are taken over the encoded bytes.
+
+func Encode(value any) ([]byte, error) {
+	var buf bytes.Buffer
+	err := encode_value(&buf, value)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func encode_value(buf *bytes.Buffer, value any) error {
+	switch v := value.(type) {
+	case string:
+		encode_string(buf, v)
+	case []byte:
+		encode_string(buf, string(v))
+	case int:
+		encode_int(buf, int64(v))
+	case int64:
+		encode_int(buf, v)
+	case uint16:
+		encode_int(buf, int64(v))
+	case bool:
+		if v {
+			encode_int(buf, 1)
+		} else {
+			encode_int(buf, 0)
+		}
+	case []string:
+		buf.WriteByte('l')
+		for _, s := range v {
+			encode_string(buf, s)
+		}
+		buf.WriteByte('e')
+	case []any:
+		buf.WriteByte('l')
+		for _, item := range v {
+			if err := encode_value(buf, item); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys) // raw byte order, as the spec requires
+		buf.WriteByte('d')
+		for _, k := range keys {
+			encode_string(buf, k)
+			if err := encode_value(buf, v[k]); err != nil {
+				return fmt.Errorf("invalid value for key %s: %v", k, err)
+			}
+		}
+		buf.WriteByte('e')
+	default:
+		return fmt.Errorf("unsupported type for bencoding: %T", value)
+	}
+	return nil
+}
+
+func encode_string(buf *bytes.Buffer, s string) {
+	buf.WriteString(strconv.Itoa(len(s)))
+	buf.WriteByte(':')
+	buf.WriteString(s)
+}
+
+func encode_int(buf *bytes.Buffer, i int64) {
+	buf.WriteByte('i')
+	buf.WriteString(strconv.FormatInt(i, 10))
+	buf.WriteByte('e')
+}
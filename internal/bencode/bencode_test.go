@@ -0,0 +1,69 @@
+package bencode
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEncode(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    any
+		want     string
+		want_err bool
+	}{
+		{name: "string", input: "spam", want: "4:spam"},
+		{name: "bytes", input: []byte{0, 1}, want: "2:\x00\x01"},
+		{name: "int", input: 42, want: "i42e"},
+		{name: "negative int", input: -3, want: "i-3e"},
+		{name: "int64", input: int64(1) << 40, want: "i1099511627776e"},
+		{name: "bool", input: true, want: "i1e"},
+		{name: "string list", input: []string{"a", "bc"}, want: "l1:a2:bce"},
+		{name: "mixed list", input: []any{"a", 1, []any{}}, want: "l1:ai1elee"},
+		{
+			name:  "dict keys sorted",
+			input: map[string]any{"zeta": 1, "alpha": "x", "Beta": []string{}},
+			want:  "d4:Betale5:alpha1:x4:zetai1ee",
+		},
+		{name: "unsupported type", input: 1.5, want_err: true},
+		{name: "unsupported nested type", input: map[string]any{"a": struct{}{}}, want_err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Encode(tt.input)
+			if (err != nil) != tt.want_err {
+				t.Fatalf("Encode() error = %v, want_err %v", err, tt.want_err)
+			}
+			if !tt.want_err && string(got) != tt.want {
+				t.Errorf("Encode() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncodeDecodeRoundTrip(t *testing.T) {
+	input := map[string]any{
+		"announce": "http://tracker/announce",
+		"info": map[string]any{
+			"length": 12345,
+			"name":   "file.bin",
+			"files":  []any{map[string]any{"path": []any{"a", "b"}, "length": 1}},
+		},
+	}
+
+	encoded, err := Encode(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, rest, err := Decode(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rest) != 0 {
+		t.Errorf("unexpected remainder: %q", rest)
+	}
+	if !reflect.DeepEqual(decoded, input) {
+		t.Errorf("round trip mismatch:\n got %v\nwant %v", decoded, input)
+	}
+}
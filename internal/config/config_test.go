@@ -0,0 +1,177 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chrispritchard/gorrent/pkg/client"
+)
+
+// load parses args as a daemon's flags, then loads with the given config file contents, if any
+func load(t *testing.T, contents string, args ...string) (Config, error) {
+	t.Helper()
+	t.Setenv(FileEnv, "")
+	t.Setenv(ProfileEnv, "")
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir()) // so no real config file is found
+	t.Setenv("HOME", t.TempDir())
+	if contents != "" {
+		path := filepath.Join(t.TempDir(), "config.json")
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		args = append([]string{"-config", path}, args...)
+	}
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	options := Flags(flags, true)
+	if err := flags.Parse(args); err != nil {
+		return Config{}, err
+	}
+	return Load(options)
+}
+
+func TestLoad_Precedence(t *testing.T) {
+	contents := `{"port": 7000, "max_peers": 10, "upload_rate": "1M", "download_rate": 2048, "profile": "metered"}`
+	t.Setenv("GORRENT_MAX_TORRENT_PEERS", "5")
+	t.Setenv("GORRENT_IDLE_TIMEOUT", "1m")
+	config, err := load(t, contents, "-port", "7001", "-v", "-transmission-auth=false")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := Default()
+	want.Port = 7001                         // the flag over the file
+	want.MaxPeers = 40                       // the profile over the file
+	want.MaxTorrentPeers = 5                 // the environment over the profile
+	want.UploadSlots = 2                     // the profile
+	want.UploadRate = 32 << 10               // the profile over the file
+	want.DownloadRate = 2048                 // the file
+	want.IdleTimeout = Duration(time.Minute) // the environment
+	want.Verbose, want.TransmissionAuth = true, false
+	if config != want {
+		t.Errorf("expected %+v, got %+v", want, config)
+	}
+}
+
+func TestLoad_Profiles(t *testing.T) {
+	contents := `{"profiles": {"lan": {"upload_slots": 16}, "quiet": {"log_level": "warn"}}}`
+	tests := []struct {
+		name  string
+		args  []string
+		check func(Config) bool
+		err   string
+	}{
+		{name: "none", check: func(c Config) bool { return c == Default() }},
+		{name: "built in", args: []string{"-profile", "metered"}, check: func(c Config) bool { return c.MaxPeers == 40 }},
+		{name: "replaced by the file", args: []string{"-profile", "lan"}, check: func(c Config) bool {
+			return c.UploadSlots == 16 && c.ConnectTimeout == Default().ConnectTimeout
+		}},
+		{name: "from the file", args: []string{"-profile", "quiet"}, check: func(c Config) bool { return c.LogLevel == "warn" }},
+		{name: "unknown", args: []string{"-profile", "fast"}, err: `unknown profile "fast", expected one of lan, metered, quiet`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := load(t, contents, tt.args...)
+			switch {
+			case tt.err != "":
+				if err == nil || err.Error() != tt.err {
+					t.Errorf("expected %q, got %v", tt.err, err)
+				}
+			case err != nil:
+				t.Fatal(err)
+			case !tt.check(config):
+				t.Errorf("unexpected config %+v", config)
+			}
+		})
+	}
+}
+
+func TestLoad_Errors(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		args     []string
+		env      string
+		want     []string
+	}{
+		{name: "unknown key", contents: `{"max_peer": 10}`, want: []string{`unknown field "max_peer"`}},
+		{name: "bare duration", contents: `{"idle_timeout": 30}`, want: []string{`expected a string such as "5s"`}},
+		{name: "bad flag", args: []string{"-download-rate", "fast"}, want: []string{`invalid size "fast"`}},
+		{name: "bad environment", env: "ten", want: []string{"invalid GORRENT_MAX_PEERS", `invalid number "ten"`}},
+		{name: "out of range", contents: `{"port": 70000, "upload_slots": 0, "block_size": "3K", "log_format": "xml"}`, want: []string{
+			"port: 70000 is not between 0 and 65535",
+			"upload_slots: must be positive",
+			"block_size: 3072 is not a power of two from 1K to 16K",
+			`log_format: "xml" is not text or json`,
+		}},
+		{name: "bad log level", args: []string{"-log-level", "peer=loud"}, want: []string{"log_level: invalid log level"}},
+		{name: "bad seed limits", contents: `{"seed_ratio": -1, "seed_action": "pause"}`, want: []string{
+			"seed_ratio: cannot be negative",
+			`seed_action: unknown seed action "pause"`,
+		}},
+		{name: "proxy only without a proxy", args: []string{"-proxy-only"}, want: []string{"proxy_only: needs a proxy"}},
+		{name: "no timeouts", args: []string{"-announce-timeout", "0s", "-shutdown-timeout", "0s"}, want: []string{
+			"announce_timeout: must be positive",
+			"shutdown_timeout: must be positive",
+		}},
+		{name: "bad proxy", args: []string{"-proxy", "ftp://host:21"}, want: []string{`proxy: unsupported proxy scheme "ftp"`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.env != "" {
+				t.Setenv("GORRENT_MAX_PEERS", tt.env)
+			}
+			_, err := load(t, tt.contents, tt.args...)
+			if err == nil {
+				t.Fatalf("expected an error")
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("expected %q in %q", want, err)
+				}
+			}
+		})
+	}
+}
+
+func TestLoad_SeedLimits(t *testing.T) {
+	config, err := load(t, `{"seed_ratio": 2}`, "-seed-ratio", "1.5", "-seed-idle", "30m", "-seed-action", "delete")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := client.SeedLimits{Ratio: 1.5, Idle: 30 * time.Minute, Action: client.SeedDelete}
+	if got := config.ClientConfig().SeedLimits; got != want {
+		t.Errorf("expected %+v, got %+v", want, got)
+	}
+}
+
+func TestLoad_MissingFile(t *testing.T) {
+	if _, err := load(t, "", "-config", filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Errorf("expected a named config file that does not exist to be an error")
+	}
+}
+
+func TestParseBytes(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int
+		err   bool
+	}{
+		{value: "500", want: 500},
+		{value: "500K", want: 500 << 10},
+		{value: "2m", want: 2 << 20},
+		{value: "1G", want: 1 << 30},
+		{value: "", err: true},
+		{value: "K", err: true},
+		{value: "-1", err: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseBytes(tt.value)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("ParseBytes(%q) = %d, %v", tt.value, got, err)
+		}
+	}
+}
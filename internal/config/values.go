@@ -0,0 +1,209 @@
+package config
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Bytes is a number of bytes, or bytes per second, written with an optional K, M or G suffix for multiples of 1024
+type Bytes int
+
+// ParseBytes reads a size such as 500, 500K or 2M
+func ParseBytes(value string) (int, error) {
+	text := strings.TrimSpace(value)
+	multiplier := 1
+	switch strings.ToUpper(text[len(text)-min(len(text), 1):]) {
+	case "K":
+		multiplier = 1 << 10
+	case "M":
+		multiplier = 1 << 20
+	case "G":
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		text = text[:len(text)-1]
+	}
+	n, err := strconv.Atoi(text)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return n * multiplier, nil
+}
+
+func (b *Bytes) UnmarshalText(text []byte) error {
+	n, err := ParseBytes(string(text))
+	*b = Bytes(n)
+	return err
+}
+
+// UnmarshalJSON takes a plain number as well as a string
+func (b *Bytes) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err != nil {
+		text = string(data)
+	}
+	return b.UnmarshalText([]byte(text))
+}
+
+func (b Bytes) String() string {
+	return strconv.Itoa(int(b))
+}
+
+// Duration is a time.Duration written as time.ParseDuration reads it, e.g. 5s or 1m30s
+type Duration time.Duration
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err != nil {
+		return fmt.Errorf("invalid duration %s, expected a string such as \"5s\"", data)
+	}
+	return d.UnmarshalText([]byte(text))
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+// field is a setting, found through the tags of Config
+type field struct {
+	index  int
+	name   string // in the config file
+	flag   string
+	env    string
+	help   string
+	arg    string // the word of help naming the flag's argument
+	daemon bool
+}
+
+func fields() []field {
+	t := reflect.TypeFor[Config]()
+	result := make([]field, t.NumField())
+	for i := range result {
+		f := t.Field(i)
+		name := f.Tag.Get("json")
+		result[i] = field{
+			index:  i,
+			name:   name,
+			flag:   strings.ReplaceAll(name, "_", "-"),
+			env:    env_prefix + strings.ToUpper(name),
+			help:   f.Tag.Get("help"),
+			arg:    f.Tag.Get("arg"),
+			daemon: f.Tag.Get("daemon") == "true",
+		}
+		if flag := f.Tag.Get("flag"); flag != "" {
+			result[i].flag = flag
+		}
+	}
+	return result
+}
+
+// set parses value into the field of config, as given by an environment variable or flag
+func (f field) set(config *Config, value string) error {
+	target := reflect.ValueOf(config).Elem().Field(f.index)
+	switch target := target.Addr().Interface().(type) {
+	case *string:
+		*target = value
+	case *bool:
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", value)
+		}
+		*target = parsed
+	case *int:
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", value)
+		}
+		*target = parsed
+	case *float64:
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", value)
+		}
+		*target = parsed
+	case *Bytes:
+		return target.UnmarshalText([]byte(value))
+	case *Duration:
+		return target.UnmarshalText([]byte(value))
+	default:
+		panic(fmt.Sprintf("no parser for setting %s", f.name))
+	}
+	return nil
+}
+
+// Options are what was given on the command line: the config file, the profile, and the settings flagged
+type Options struct {
+	File    string
+	Profile string
+	set     []flagged
+}
+
+type flagged struct {
+	field field
+	value string
+}
+
+// Flags registers -config, -profile and a flag for every setting, bar those only for the daemon unless daemon is
+// true. The returned options are filled in as the flags are parsed
+func Flags(flags *flag.FlagSet, daemon bool) *Options {
+	options := &Options{}
+	flags.StringVar(&options.File, "config", "", fmt.Sprintf("json file to read settings from (default %s if it exists, or $%s)", DefaultFile(), FileEnv))
+	flags.StringVar(&options.Profile, "profile", "", fmt.Sprintf("named set of settings to apply over the config file: %s, or one of its own", strings.Join(Profiles(nil), ", ")))
+	defaults := Default()
+	for _, f := range fields() {
+		if f.daemon && !daemon {
+			continue
+		}
+		usage := f.help
+		if f.arg != "" {
+			usage = strings.Replace(usage, f.arg, "`"+f.arg+"`", 1) // shown as the argument's name
+		}
+		flags.Var(&setting_flag{f, &defaults, options}, f.flag, usage)
+	}
+	return options
+}
+
+// setting_flag is a flag.Value for a field, which shows the field's default and records what it is set to
+type setting_flag struct {
+	field    field
+	defaults *Config
+	options  *Options
+}
+
+func (s *setting_flag) String() string {
+	if s == nil || s.defaults == nil {
+		return ""
+	}
+	value := reflect.ValueOf(s.defaults).Elem().Field(s.field.index)
+	if value.IsZero() {
+		return ""
+	}
+	return fmt.Sprint(value.Interface())
+}
+
+func (s *setting_flag) Set(value string) error {
+	scratch := Config{}
+	if err := s.field.set(&scratch, value); err != nil {
+		return err
+	}
+	s.options.set = append(s.options.set, flagged{s.field, value})
+	return nil
+}
+
+func (s *setting_flag) IsBoolFlag() bool {
+	return reflect.TypeFor[Config]().Field(s.field.index).Type.Kind() == reflect.Bool
+}
@@ -2,93 +2,324 @@ package downloading
 
 import (
 	"context"
+	"crypto/sha1"
 	"fmt"
+	"log/slog"
 	"math/rand/v2"
+	"slices"
 	"sync"
 	"time"
 
+	"github.com/chrispritchard/gorrent/internal/bitfields"
+	"github.com/chrispritchard/gorrent/internal/logging"
+	"github.com/chrispritchard/gorrent/internal/messaging"
 	outfiles "github.com/chrispritchard/gorrent/internal/out_files"
 	"github.com/chrispritchard/gorrent/internal/peer"
+	"github.com/chrispritchard/gorrent/internal/stats"
 	"github.com/chrispritchard/gorrent/internal/torrent_files"
+	"github.com/chrispritchard/gorrent/internal/webseed"
 )
 
-var PAUSE_BETWEEN_REQUESTS = 1 * time.Millisecond
-var REQUEST_MAX_AGE = 3 * time.Second
+// DefaultBlockSize is what every client requests, and the most many will serve
+const DefaultBlockSize = 1 << 14
+
+type Config struct {
+	BlockSize       int           // the size of the blocks requested from peers and web seeds
+	RequestInterval time.Duration // between block requests
+	RequestMaxAge   time.Duration // after which an unanswered request is made again, of another peer
+}
+
+func DefaultConfig() Config {
+	return Config{
+		BlockSize:       DefaultBlockSize,
+		RequestInterval: 1 * time.Millisecond,
+		RequestMaxAge:   3 * time.Second,
+	}
+}
 
 type DownloadState struct {
-	requests  RequestMap
-	partials  []*PartialPiece
-	complete  int
-	peers     []*peer.PeerHandler
-	out_files *outfiles.OutFileManager
-	log       func(format string, a ...any)
-	mutex     sync.Mutex
+	config     Config
+	requests   RequestMap
+	partials   []*PartialPiece
+	complete   int
+	bitfield   bitfields.BitField
+	peers      []*peer.PeerHandler
+	web_seeds  []*webseed.WebSeed
+	web_claims map[int]struct{}
+	out_files  *outfiles.OutFileManager
+	log        *slog.Logger
+	mutex      sync.Mutex
+	downloaded *stats.Meter      // block data received, from peers and web seeds
+	uploaded   *stats.Meter      // charged by peers as they serve blocks
+	wasted     int64             // bytes received but thrown away: duplicates, and pieces that failed verification
+	failures   int64             // pieces that failed verification
+	writes     *stats.Timer      // of verified pieces to disk
+	priorities []Priority        // per piece, with pieces of the highest priority available requested first
+	suspects   map[int][]suspect // by piece, the blocks of a failed attempt, to compare once it verifies
+}
+
+// suspect is a block of a piece that failed verification, kept until the piece is downloaded again so that the peer
+// that sent it is banned if it differs from the good block
+type suspect struct {
+	block int
+	from  string
+	hash  [sha1.Size]byte
 }
 
-func NewDownloadState(metadata torrent_files.TorrentMetadata, peers []*peer.PeerHandler, out_file_manager *outfiles.OutFileManager, log func(format string, a ...any)) *DownloadState {
+type Priority int
+
+const (
+	Low Priority = iota - 1
+	Normal
+	High
+)
+
+func (p Priority) String() string {
+	switch p {
+	case Low:
+		return "low"
+	case Normal:
+		return "normal"
+	case High:
+		return "high"
+	}
+	return "unknown"
+}
+
+// Stats are totals in bytes and rolling rates in bytes per second, for this download only
+type Stats struct {
+	Downloaded, Uploaded, Wasted int64
+	DownloadRate, UploadRate     float64
+	Remaining                    int64 // bytes still needed
+	HashFailures                 int64
+	DiskWrites                   stats.Histogram
+}
+
+// NewDownloadState starts from the pieces already on disk, as given by local. Peers are added as they connect. logger
+// may be nil
+func NewDownloadState(metadata torrent_files.TorrentMetadata, local bitfields.BitField, web_seeds []*webseed.WebSeed, out_file_manager *outfiles.OutFileManager, config Config, logger *slog.Logger) *DownloadState {
+	partials := CreatePartialPieces(metadata, config.BlockSize)
+	bitfield := bitfields.CreateBlankBitfield(len(partials))
+	complete := 0
+	for i, p := range partials {
+		if local.Get(i) {
+			p.Done = true
+			p.Data = nil
+			bitfield.Set(uint(i))
+			complete++
+		}
+	}
+
 	return &DownloadState{
-		requests:  CreateEmptyRequestMap(REQUEST_MAX_AGE),
-		partials:  CreatePartialPieces(metadata),
-		complete:  0,
-		peers:     peers,
-		out_files: out_file_manager,
-		log:       log,
-		mutex:     sync.Mutex{},
+		config:     config,
+		requests:   CreateEmptyRequestMap(config.RequestMaxAge),
+		partials:   partials,
+		complete:   complete,
+		bitfield:   bitfield,
+		peers:      []*peer.PeerHandler{},
+		web_seeds:  web_seeds,
+		web_claims: map[int]struct{}{},
+		out_files:  out_file_manager,
+		log:        logging.For(logger, logging.Download),
+		mutex:      sync.Mutex{},
+		downloaded: stats.NewMeter(nil),
+		uploaded:   stats.NewMeter(nil),
+		writes:     stats.NewTimer(stats.LatencyBounds),
+		priorities: make([]Priority, len(partials)),
+		suspects:   map[int][]suspect{},
 	}
 }
 
+func (ds *DownloadState) AddPeer(p *peer.PeerHandler) {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+	ds.peers = append(ds.peers, p)
+}
+
+func (ds *DownloadState) RemovePeer(p *peer.PeerHandler) {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+	ds.peers = slices.DeleteFunc(ds.peers, func(o *peer.PeerHandler) bool {
+		return o == p
+	})
+}
+
+// Bitfield returns a copy of the pieces we have, for sending to newly connected peers
+func (ds *DownloadState) Bitfield() bitfields.BitField {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+	return bitfields.NewBitfield(slices.Clone(ds.bitfield.Data), ds.bitfield.Length)
+}
+
+func (ds *DownloadState) HasPiece(index int) bool {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+	return ds.bitfield.Get(index)
+}
+
+func (ds *DownloadState) Finished() bool {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+	return ds.complete == len(ds.partials)
+}
+
 func (ds *DownloadState) run_in_lock(action func() error) error {
 	ds.mutex.Lock()
 	defer ds.mutex.Unlock()
 	return action()
 }
 
+// SetPriorities replaces the priority of every piece, e.g. as derived from the priorities of the files they hold
+func (ds *DownloadState) SetPriorities(priorities []Priority) {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+	if len(priorities) == len(ds.partials) {
+		ds.priorities = slices.Clone(priorities)
+	}
+}
+
+// UploadMeter is given to peers, so blocks they serve count towards the torrent's uploads
+func (ds *DownloadState) UploadMeter() *stats.Meter {
+	return ds.uploaded
+}
+
+func (ds *DownloadState) Stats() Stats {
+	ds.mutex.Lock()
+	wasted, failures := ds.wasted, ds.failures
+	remaining := int64(0)
+	for _, p := range ds.partials {
+		remaining += int64(p.Remaining())
+	}
+	ds.mutex.Unlock()
+
+	return Stats{
+		Downloaded:   ds.downloaded.Total(),
+		Uploaded:     ds.uploaded.Total(),
+		Wasted:       wasted,
+		DownloadRate: ds.downloaded.Rate(),
+		UploadRate:   ds.uploaded.Rate(),
+		Remaining:    remaining,
+		HashFailures: failures,
+		DiskWrites:   ds.writes.Snapshot(),
+	}
+}
+
 func (ds *DownloadState) CompletedPieces() int {
 	ds.mutex.Lock()
 	defer ds.mutex.Unlock()
 	return ds.complete
 }
 
-func (ds *DownloadState) ReceiveBlock(index, begin int, piece []byte) (finished bool, err error) {
+// ReceiveBlock stores a block from the peer at the given address, or from a web seed if from is empty. banned is the
+// peers found to have sent corrupt data, once a piece is verified: the only peer to send blocks of a piece that failed,
+// or any whose blocks of it differ from those that made it verify. Their other blocks are discarded
+func (ds *DownloadState) ReceiveBlock(index, begin int, piece []byte, from string) (verified, finished bool, banned []string, err error) {
 	ds.mutex.Lock()
 	defer ds.mutex.Unlock()
 
+	if index < 0 || index >= len(ds.partials) {
+		return false, false, nil, nil
+	}
+
 	ds.requests.Delete(index, begin)
 	for _, p := range ds.peers {
-		err := p.CancelRequest(index, begin, len(piece))
-		if err != nil {
-			return false, err
-		}
+		p.CancelRequest(index, begin, len(piece)) // a failure closes the peer, which is then dropped
 	}
 
+	ds.downloaded.Add(len(piece))
 	partial := ds.partials[index]
+	if partial.Done || partial.Has(begin) {
+		ds.wasted += int64(len(piece)) // a late duplicate, e.g. a peer's block for a piece a web seed already delivered
+		return false, false, nil, nil
+	}
 
-	partial.Set(int(begin), piece)
-	ds.log("piece %d block offset %d received", index, begin)
+	partial.Set(int(begin), piece, from)
+	ds.log.Debug("block received", "piece", index, "block", begin)
 
+	if !partial.Complete() {
+		return false, false, nil, nil
+	}
 	if !partial.Valid() {
-		return false, nil
+		ds.wasted += int64(len(partial.Data))
+		ds.failures++
+		banned = ds.suspect(index, partial)
+		partial.Reset()
+		ds.log.Warn("piece failed verification, requesting it again", "piece", index)
+		ds.discard(banned)
+		return false, false, banned, nil
 	}
+	banned = ds.convict(index, partial)
+	ds.discard(banned)
 
+	start := time.Now()
 	err = partial.Conclude(index, ds.out_files)
+	ds.writes.Since(start)
 	if err != nil {
-		return false, err
+		return false, false, banned, err
 	}
-	ds.log("piece %d finished", index)
+	ds.log.Debug("piece finished", "piece", index)
+	ds.bitfield.Set(uint(index))
 
 	for _, p := range ds.peers {
-		err := p.SendHave(index)
-		if err != nil {
-			return false, err
-		}
+		p.SendHave(index)
 	}
 
 	ds.complete++
-	if ds.complete == len(ds.partials) {
-		return true, nil
+	return true, ds.complete == len(ds.partials), banned, nil
+}
+
+// suspect notes the blocks of a piece that failed verification, returning its sender if only one peer sent them, as
+// web seeds verify what they send. The blocks of earlier failures are kept until the piece verifies, bar a banned
+// sender's, so that peers suspected then can still be convicted
+func (ds *DownloadState) suspect(index int, partial *PartialPiece) []string {
+	senders := map[string]struct{}{}
+	for i := range partial.Length() {
+		data, from := partial.Block(i)
+		if from == "" {
+			continue
+		}
+		senders[from] = struct{}{}
+		ds.suspects[index] = append(ds.suspects[index], suspect{block: i, from: from, hash: sha1.Sum(data)})
+	}
+	if len(senders) != 1 {
+		return nil
 	}
+	for from := range senders {
+		ds.suspects[index] = slices.DeleteFunc(ds.suspects[index], func(s suspect) bool { return s.from == from })
+		if len(ds.suspects[index]) == 0 {
+			delete(ds.suspects, index)
+		}
+		return []string{from}
+	}
+	return nil
+}
 
-	return false, nil
+// convict compares the suspect blocks of a piece, now verified, with the good ones, returning those that sent others
+func (ds *DownloadState) convict(index int, partial *PartialPiece) []string {
+	banned := []string{}
+	for _, s := range ds.suspects[index] {
+		data, _ := partial.Block(s.block)
+		if sha1.Sum(data) != s.hash && !slices.Contains(banned, s.from) {
+			banned = append(banned, s.from)
+		}
+	}
+	delete(ds.suspects, index)
+	if len(banned) == 0 {
+		return nil
+	}
+	return banned
+}
+
+// discard drops the blocks banned peers sent of pieces not yet verified, so they are requested of others
+func (ds *DownloadState) discard(banned []string) {
+	for _, from := range banned {
+		ds.log.Warn("banning peer for sending corrupt data", "peer", from)
+		for _, p := range ds.partials {
+			if !p.Done {
+				ds.wasted += int64(p.Discard(from))
+			}
+		}
+	}
 }
 
 func (ds *DownloadState) StartRequestingPieces(ctx context.Context, error_channel chan<- error) {
@@ -97,51 +328,135 @@ func (ds *DownloadState) StartRequestingPieces(ctx context.Context, error_channe
 			select {
 			case <-ctx.Done():
 				return
-			case <-time.After(PAUSE_BETWEEN_REQUESTS):
+			case <-time.After(ds.config.RequestInterval):
 				err := ds.run_in_lock(func() error {
+					usable_peers := []*peer.PeerHandler{}
+					for _, p := range ds.peers {
+						if !p.Choking() && !p.Closed() {
+							usable_peers = append(usable_peers, p)
+						}
+					}
+
 					possible_indices := []int{}
+					top := Low
 					for i, p := range ds.partials {
-						if !p.Done {
-							possible_indices = append(possible_indices, i)
+						if _, claimed := ds.web_claims[i]; p.Done || claimed || ds.priorities[i] < top || !any_has(usable_peers, i) {
+							continue
+						}
+						if ds.priorities[i] > top {
+							top = ds.priorities[i]
+							possible_indices = possible_indices[:0]
 						}
+						possible_indices = append(possible_indices, i)
 					}
 					if len(possible_indices) == 0 {
-						return nil
+						return nil // left for the web seeds, or for peers yet to connect or unchoke us
 					}
 
 					piece_index := possible_indices[rand.IntN(len(possible_indices))]
 					partial := ds.partials[piece_index]
 
 					valid_peers := []*peer.PeerHandler{}
-					for _, p := range ds.peers {
+					for _, p := range usable_peers {
 						if p.HasPiece(piece_index) {
 							valid_peers = append(valid_peers, p)
 						}
 					}
 
-					if len(valid_peers) == 0 {
-						return fmt.Errorf("no peer has piece %d", piece_index)
+					block_index := -1
+					for _, b := range partial.Missing() {
+						if !ds.requests.Has(piece_index, partial.BlockOffset(b)) {
+							block_index = b
+							break
+						}
+					}
+					if block_index == -1 {
+						return nil // everything missing is already on its way
 					}
 
 					peer_index := rand.IntN(len(valid_peers))
 					valid_peer := valid_peers[peer_index]
-					block_index := partial.Missing()[0]
-					block_offset := block_index * BLOCK_SIZE
+					block_offset := partial.BlockOffset(block_index)
 					block_size := partial.BlockSize(block_index)
 
 					err := valid_peer.RequestPieceBlock(piece_index, block_offset, block_size)
 					if err != nil {
-						return err
+						return fmt.Errorf("unable to request from peer %s: %v", valid_peer.Id, err)
 					}
 
 					ds.requests.Set(piece_index, block_offset)
-					ds.log("requested block %d/%d (offset %d) of piece %d from peer %s", block_index+1, partial.Length(), block_offset, piece_index, valid_peer.Id)
+					ds.log.Debug("requested block", "piece", piece_index, "block", block_offset, "peer", valid_peer.Id)
 					return nil
 				})
 				if err != nil {
-					error_channel <- err
+					select {
+					case error_channel <- err:
+					case <-ctx.Done():
+						return
+					}
 				}
 			}
 		}
 	}()
 }
+
+// StartWebSeeds starts each web seed fetching pieces, which arrive on received_channel like any other peer's blocks
+func (ds *DownloadState) StartWebSeeds(ctx context.Context, received_channel chan<- messaging.Received) {
+	for _, ws := range ds.web_seeds {
+		ws.StartReceiving(ctx, ds, ds.config.BlockSize, received_channel)
+	}
+}
+
+// ClaimWebSeedPiece picks a missing piece for a web seed, of the highest priority left, preferring pieces no peer has
+// and that are not yet started
+func (ds *DownloadState) ClaimWebSeedPiece() (int, bool) {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+
+	var untouched, unavailable []int
+	top := Low
+	for i, p := range ds.partials {
+		if _, claimed := ds.web_claims[i]; p.Done || claimed || len(p.Missing()) != p.Length() || ds.priorities[i] < top {
+			continue
+		}
+		if ds.priorities[i] > top {
+			top = ds.priorities[i]
+			untouched, unavailable = untouched[:0], unavailable[:0]
+		}
+		untouched = append(untouched, i)
+		if !ds.any_peer_has(i) {
+			unavailable = append(unavailable, i)
+		}
+	}
+
+	candidates := unavailable
+	if len(candidates) == 0 {
+		candidates = untouched
+	}
+	if len(candidates) == 0 {
+		return 0, false
+	}
+
+	index := candidates[rand.IntN(len(candidates))]
+	ds.web_claims[index] = struct{}{}
+	return index, true
+}
+
+func (ds *DownloadState) ReleaseWebSeedPiece(index int) {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+	delete(ds.web_claims, index)
+}
+
+func (ds *DownloadState) any_peer_has(index int) bool {
+	return any_has(ds.peers, index)
+}
+
+func any_has(peers []*peer.PeerHandler, index int) bool {
+	for _, p := range peers {
+		if p.HasPiece(index) {
+			return true
+		}
+	}
+	return false
+}
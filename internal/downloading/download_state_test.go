@@ -0,0 +1,182 @@
+package downloading
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/chrispritchard/gorrent/internal/bitfields"
+	outfiles "github.com/chrispritchard/gorrent/internal/out_files"
+	"github.com/chrispritchard/gorrent/internal/torrent_files"
+)
+
+func newTestDownload(t *testing.T, data []byte) *DownloadState {
+	t.Helper()
+	source := filepath.Join(t.TempDir(), "data.bin")
+	if err := os.WriteFile(source, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, metadata, err := torrent_files.CreateTorrent(source, torrent_files.CreateOptions{PieceLength: 2 * DefaultBlockSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ofm, err := outfiles.CreateOutFileManager(metadata, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(ofm.Close)
+	blank := bitfields.CreateBlankBitfield(metadata.PieceCount())
+	return NewDownloadState(metadata, blank, nil, ofm, DefaultConfig(), nil)
+}
+
+func TestDownloadState_CountsWastedBytes(t *testing.T) {
+	data := make([]byte, 3*DefaultBlockSize)
+	for i := range data {
+		data[i] = byte(i * 31)
+	}
+	ds := newTestDownload(t, data)
+	first, second := data[:DefaultBlockSize], data[DefaultBlockSize:2*DefaultBlockSize]
+
+	// a duplicate block is thrown away
+	ds.ReceiveBlock(0, 0, first, "")
+	ds.ReceiveBlock(0, 0, first, "")
+	if s := ds.Stats(); s.Wasted != int64(DefaultBlockSize) || s.Downloaded != int64(2*DefaultBlockSize) {
+		t.Errorf("after a duplicate, got %+v", s)
+	}
+
+	// a corrupt block fails the piece, which is discarded to be fetched again
+	corrupt := append([]byte{}, second...)
+	corrupt[0]++
+	verified, _, _, err := ds.ReceiveBlock(0, DefaultBlockSize, corrupt, "")
+	if err != nil || verified {
+		t.Fatalf("expected the corrupt piece to fail verification, got verified=%v err=%v", verified, err)
+	}
+	if s := ds.Stats(); s.Wasted != int64(3*DefaultBlockSize) || s.Remaining != int64(len(data)) || s.HashFailures != 1 {
+		t.Errorf("after a hash failure, got %+v", s)
+	}
+
+	ds.ReceiveBlock(0, 0, first, "")
+	verified, finished, _, err := ds.ReceiveBlock(0, DefaultBlockSize, second, "")
+	if err != nil || !verified || finished {
+		t.Fatalf("expected piece 0 to verify without finishing, got verified=%v finished=%v err=%v", verified, finished, err)
+	}
+	_, finished, _, _ = ds.ReceiveBlock(1, 0, data[2*DefaultBlockSize:], "")
+	if s := ds.Stats(); !finished || s.Remaining != 0 || s.DiskWrites.Count != 2 {
+		t.Errorf("expected the download to finish, writing both pieces, got %+v", s)
+	}
+}
+
+func TestDownloadState_BansPeersThatSendCorruptBlocks(t *testing.T) {
+	data := make([]byte, 4*DefaultBlockSize)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	block := func(i int) []byte { return data[i*DefaultBlockSize : (i+1)*DefaultBlockSize] }
+	corrupt := func(i int) []byte {
+		result := append([]byte{}, block(i)...)
+		result[0]++
+		return result
+	}
+
+	type receipt struct {
+		piece, block int
+		data         []byte
+		from         string
+		verified     bool
+		banned       []string
+	}
+	tests := []struct {
+		name     string
+		receipts []receipt
+	}{
+		{
+			"a sole sender is banned at once",
+			[]receipt{
+				{0, 0, block(0), "bad:1", false, nil},
+				{0, 1, corrupt(1), "bad:1", false, []string{"bad:1"}},
+			},
+		},
+		{
+			"a sender whose block differs from the good one is banned once the piece verifies",
+			[]receipt{
+				{0, 0, block(0), "good:1", false, nil},
+				{0, 1, corrupt(1), "bad:1", false, nil},
+				{0, 0, block(0), "good:1", false, nil},
+				{0, 1, block(1), "other:1", true, []string{"bad:1"}},
+			},
+		},
+		{
+			"a sender suspected before a piece fails again with a sole sender is still banned once it verifies",
+			[]receipt{
+				{0, 0, block(0), "good:1", false, nil},
+				{0, 1, corrupt(1), "bad:1", false, nil},
+				{0, 0, corrupt(0), "worse:1", false, nil},
+				{0, 1, block(1), "worse:1", false, []string{"worse:1"}},
+				{0, 0, block(0), "good:1", false, nil},
+				{0, 1, block(1), "other:1", true, []string{"bad:1"}},
+			},
+		},
+		{
+			"two senders of a piece that fails twice are judged once it verifies",
+			[]receipt{
+				{0, 0, block(0), "good:1", false, nil},
+				{0, 1, corrupt(1), "bad:1", false, nil},
+				{0, 0, block(0), "good:1", false, nil},
+				{0, 1, corrupt(1), "bad:1", false, nil},
+				{0, 1, block(1), "other:1", false, nil},
+				{0, 0, block(0), "good:1", true, []string{"bad:1"}},
+			},
+		},
+		{
+			"nobody is banned for blocks of web seeds",
+			[]receipt{
+				{0, 0, block(0), "", false, nil},
+				{0, 1, corrupt(1), "", false, nil},
+			},
+		},
+		{
+			"the blocks a banned peer sent of other pieces are discarded",
+			[]receipt{
+				{1, 0, block(2), "bad:1", false, nil},
+				{0, 0, corrupt(0), "bad:1", false, nil},
+				{0, 1, block(1), "bad:1", false, []string{"bad:1"}},
+				{1, 1, block(3), "good:1", false, nil},
+				{1, 0, block(2), "good:1", true, nil},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ds := newTestDownload(t, data)
+			for i, r := range tt.receipts {
+				verified, _, banned, err := ds.ReceiveBlock(r.piece, r.block*DefaultBlockSize, r.data, r.from)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if verified != r.verified || !slices.Equal(banned, r.banned) {
+					t.Errorf("receipt %d: got verified=%v banned=%v, expected verified=%v banned=%v", i, verified, banned, r.verified, r.banned)
+				}
+			}
+		})
+	}
+}
+
+func TestDownloadState_WebSeedsClaimHighPriorityFirst(t *testing.T) {
+	ds := newTestDownload(t, make([]byte, 8*DefaultBlockSize))
+	ds.SetPriorities([]Priority{Low, Normal, High, Normal})
+
+	want := []int{2, -1, -1, 0}
+	for _, w := range want {
+		index, ok := ds.ClaimWebSeedPiece()
+		if !ok {
+			t.Fatal("expected a piece to claim")
+		}
+		if w != -1 && index != w {
+			t.Errorf("expected piece %d, claimed %d", w, index)
+		}
+		if w == -1 && index != 1 && index != 3 {
+			t.Errorf("expected a normal priority piece, claimed %d", index)
+		}
+	}
+}
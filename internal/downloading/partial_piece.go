@@ -1,7 +1,6 @@
 package downloading
 
 import (
-	"crypto/sha1"
 	"fmt"
 	"math"
 
@@ -9,46 +8,46 @@ import (
 	"github.com/chrispritchard/gorrent/internal/torrent_files"
 )
 
-var BLOCK_SIZE = 1 << 14
-
 type PartialPiece struct {
-	hash        string
+	verify      func(data []byte) bool
 	offset      int
+	block_size  int
 	blocks      []bool
 	block_sizes []int
+	senders     []string // by block, the address of the peer it came from
 	Data        []byte
 	Done        bool
 }
 
-func CreatePartialPieces(metadata torrent_files.TorrentMetadata) []*PartialPiece {
-	result := make([]*PartialPiece, len(metadata.Pieces))
-	last_size := metadata.Length % metadata.PieceLength
-	for i := range len(metadata.Pieces) {
-		length := metadata.PieceLength
-		if i == len(metadata.Pieces)-1 && last_size != 0 {
-			length = last_size
+func CreatePartialPieces(metadata torrent_files.TorrentMetadata, block_size int) []*PartialPiece {
+	result := make([]*PartialPiece, metadata.PieceCount())
+	for i := range result {
+		verify := func(data []byte) bool {
+			return metadata.VerifyPiece(i, data)
 		}
-		result[i] = new_partial_piece(metadata.Pieces[i], i*metadata.PieceLength, length)
+		result[i] = new_partial_piece(verify, i*metadata.PieceLength, metadata.PieceSize(i), block_size)
 	}
 	return result
 }
 
-func new_partial_piece(hash string, offset, full_length int) *PartialPiece {
-	block_count := int(math.Ceil(float64(full_length) / float64(BLOCK_SIZE)))
-	last_size := full_length % BLOCK_SIZE
+func new_partial_piece(verify func(data []byte) bool, offset, full_length, block_size int) *PartialPiece {
+	block_count := int(math.Ceil(float64(full_length) / float64(block_size)))
+	last_size := full_length % block_size
 	sizes := make([]int, block_count)
 	for i := range sizes {
 		if i == len(sizes)-1 && last_size != 0 {
 			sizes[i] = last_size
 		} else {
-			sizes[i] = BLOCK_SIZE
+			sizes[i] = block_size
 		}
 	}
 	return &PartialPiece{
-		hash:        hash,
+		verify:      verify,
 		offset:      offset,
+		block_size:  block_size,
 		blocks:      make([]bool, block_count),
 		block_sizes: sizes,
+		senders:     make([]string, block_count),
 		Data:        make([]byte, full_length),
 		Done:        false,
 	}
@@ -63,31 +62,87 @@ func (pp *PartialPiece) BlockSize(index int) int {
 	return pp.block_sizes[index]
 }
 
-func (pp *PartialPiece) Set(offset int, data []byte) error {
-	block_index := offset / BLOCK_SIZE
+// BlockOffset is where the block at index starts within the piece
+func (pp *PartialPiece) BlockOffset(index int) int {
+	return index * pp.block_size
+}
+
+// Set fills the block at offset with data, from the peer at the given address, or empty if it came from a web seed
+func (pp *PartialPiece) Set(offset int, data []byte, from string) error {
+	block_index := offset / pp.block_size
 	if block_index < 0 || block_index >= len(pp.blocks) {
 		return fmt.Errorf("invalid block index, out of range")
 	}
-	if len(data) > BLOCK_SIZE {
+	if len(data) > pp.block_size {
 		return fmt.Errorf("data is too large for a single block")
 	}
 	pp.blocks[block_index] = true
-	target := pp.Data[block_index*BLOCK_SIZE:]
+	pp.senders[block_index] = from
+	target := pp.Data[block_index*pp.block_size:]
 	if len(target) < len(data) {
 		return fmt.Errorf("data is too large for the target location") // should only be possible for the last block if truncated
 	}
-	copy(pp.Data[block_index*BLOCK_SIZE:], data)
+	copy(pp.Data[block_index*pp.block_size:], data)
 	return nil
 }
 
-func (pp *PartialPiece) Valid() bool {
+// Has is whether the block at offset has already been received
+func (pp *PartialPiece) Has(offset int) bool {
+	block_index := offset / pp.block_size
+	return block_index >= 0 && block_index < len(pp.blocks) && pp.blocks[block_index]
+}
+
+// Complete is whether every block has been received, though not necessarily valid
+func (pp *PartialPiece) Complete() bool {
 	for _, b := range pp.blocks {
 		if !b {
 			return false
 		}
 	}
-	hash := sha1.Sum(pp.Data)
-	return string(hash[:]) == pp.hash
+	return true
+}
+
+func (pp *PartialPiece) Valid() bool {
+	return pp.Complete() && pp.verify(pp.Data)
+}
+
+// Reset discards every block, after the piece failed verification, so it is requested again
+func (pp *PartialPiece) Reset() {
+	clear(pp.blocks)
+	clear(pp.senders)
+	clear(pp.Data)
+}
+
+// Block returns the data of the block at index, and who it came from
+func (pp *PartialPiece) Block(index int) ([]byte, string) {
+	start := index * pp.block_size
+	return pp.Data[start : start+pp.block_sizes[index]], pp.senders[index]
+}
+
+// Discard drops every block received from a peer, returning how many bytes were dropped
+func (pp *PartialPiece) Discard(from string) int {
+	dropped := 0
+	for i, sender := range pp.senders {
+		if pp.blocks[i] && sender == from {
+			pp.blocks[i], pp.senders[i] = false, ""
+			dropped += pp.block_sizes[i]
+		}
+	}
+	return dropped
+}
+
+// Remaining is the number of bytes still to be received
+func (pp *PartialPiece) Remaining() int {
+	if pp.Done {
+		return 0
+	}
+	remaining := 0
+	for i, b := range pp.blocks {
+		if !b {
+			remaining += pp.block_sizes[i]
+		}
+	}
+	return remaining
 }
 
 // Missing returns the index of missing blocks
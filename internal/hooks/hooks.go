@@ -0,0 +1,232 @@
+// Package hooks tells other programs about torrents as they are added, complete, fail or are removed: by running a
+// command with the torrent described in environment variables, and by POSTing it as json to a webhook.
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chrispritchard/gorrent/internal/logging"
+	"github.com/chrispritchard/gorrent/pkg/client"
+)
+
+const (
+	Added     = "added"
+	Completed = "completed"
+	Error     = "error"
+	Removed   = "removed"
+)
+
+var Events = []string{Added, Completed, Error, Removed}
+
+const (
+	DefaultTimeout    = time.Minute
+	DefaultRetries    = 3
+	DefaultRetryDelay = time.Second
+)
+
+type Config struct {
+	Command    string            // run by the shell, with the torrent in GORRENT_ environment variables
+	Webhook    string            // a url to POST a Payload to
+	Events     []string          // those to act on, all of them if empty
+	Timeout    time.Duration     // for each run of the command, and each attempt at the webhook
+	Retries    int               // further attempts at the webhook after it fails
+	RetryDelay time.Duration     // before the first retry, doubling for each after
+	Transport  http.RoundTripper // optional, for the webhook, e.g. one that goes through a proxy
+	Logger     *slog.Logger
+}
+
+// Payload is what the webhook is sent
+type Payload struct {
+	Event    string    `json:"event"`
+	Time     time.Time `json:"time"`
+	Name     string    `json:"name"`
+	InfoHash string    `json:"info_hash"`
+	SavePath string    `json:"save_path"`
+	Files    []File    `json:"files"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// File is a file of the torrent, with a path relative to the save path
+type File struct {
+	Path   string `json:"path"`
+	Length int64  `json:"length"`
+}
+
+type Hooks struct {
+	client *client.Client
+	config Config
+	log    *slog.Logger
+	http   *http.Client
+}
+
+func New(c *client.Client, config Config) *Hooks {
+	if len(config.Events) == 0 {
+		config.Events = Events
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultTimeout
+	}
+	if config.RetryDelay <= 0 {
+		config.RetryDelay = DefaultRetryDelay
+	}
+	return &Hooks{
+		client: c,
+		config: config,
+		log:    logging.For(config.Logger, logging.Hooks),
+		http:   &http.Client{Transport: config.Transport, Timeout: config.Timeout},
+	}
+}
+
+// Validate checks the event names, and that the webhook is an http url
+func (c Config) Validate() error {
+	for _, event := range c.Events {
+		if !slices.Contains(Events, event) {
+			return fmt.Errorf("unknown hook event %q, expected one of %s", event, strings.Join(Events, ", "))
+		}
+	}
+	if c.Webhook != "" && !strings.HasPrefix(c.Webhook, "http://") && !strings.HasPrefix(c.Webhook, "https://") {
+		return fmt.Errorf("webhook %q is not an http or https url", c.Webhook)
+	}
+	return nil
+}
+
+// Start acts on the client's events from now until ctx ends or the client is closed. The returned channel is closed
+// once the hooks still running have finished after that
+func (h *Hooks) Start(ctx context.Context) <-chan struct{} {
+	events := h.client.Subscribe(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var wg sync.WaitGroup
+		defer wg.Wait()
+		for event := range events {
+			name := event_name(event)
+			if name == "" || !slices.Contains(h.config.Events, name) {
+				continue
+			}
+			payload := describe(event, name)
+			if h.config.Command != "" {
+				wg.Go(func() { h.run_command(payload) })
+			}
+			if h.config.Webhook != "" {
+				wg.Go(func() { h.post(payload) })
+			}
+		}
+	}()
+	return done
+}
+
+func event_name(event client.Event) string {
+	switch {
+	case event.Kind == client.TorrentAdded:
+		return Added
+	case event.Kind == client.TorrentCompleted:
+		return Completed
+	case event.Kind == client.StateChanged && event.State == client.Failed:
+		return Error
+	case event.Kind == client.TorrentRemoved:
+		return Removed
+	}
+	return ""
+}
+
+func describe(event client.Event, name string) Payload {
+	t := event.Torrent
+	payload := Payload{
+		Event:    name,
+		Time:     event.Time,
+		Name:     t.Name(),
+		InfoHash: t.InfoHash().String(),
+		SavePath: t.DownloadDir(),
+		Files:    []File{},
+	}
+	if info, ok := t.Info(); ok {
+		for _, f := range info.Files {
+			payload.Files = append(payload.Files, File{Path: f.Path, Length: f.Length})
+		}
+	}
+	if event.Err != nil {
+		payload.Error = event.Err.Error()
+	}
+	return payload
+}
+
+// Environment describes the torrent as variables for the command. Files are one path per line
+func (p Payload) Environment() []string {
+	files := []string{}
+	for _, f := range p.Files {
+		files = append(files, filepath.FromSlash(f.Path))
+	}
+	return []string{
+		"GORRENT_EVENT=" + p.Event,
+		"GORRENT_NAME=" + p.Name,
+		"GORRENT_INFO_HASH=" + p.InfoHash,
+		"GORRENT_SAVE_PATH=" + p.SavePath,
+		"GORRENT_FILES=" + strings.Join(files, "\n"),
+		"GORRENT_ERROR=" + p.Error,
+	}
+}
+
+func (h *Hooks) run_command(payload Payload) {
+	ctx, cancel := context.WithTimeout(context.Background(), h.config.Timeout)
+	defer cancel()
+	cmd := shell(ctx, h.config.Command)
+	cmd.Env = append(os.Environ(), payload.Environment()...)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		h.log.Warn("hook command failed", "event", payload.Event, "torrent", payload.Name, "err", err, "output", strings.TrimSpace(string(output)))
+		return
+	}
+	h.log.Debug("ran hook command", "event", payload.Event, "torrent", payload.Name)
+}
+
+func shell(ctx context.Context, command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.CommandContext(ctx, "cmd", "/C", command)
+	}
+	return exec.CommandContext(ctx, "/bin/sh", "-c", command)
+}
+
+// post sends the payload to the webhook, retrying with backoff until it answers with a 2xx status
+func (h *Hooks) post(payload Payload) {
+	body, _ := json.Marshal(payload)
+	backoff := h.config.RetryDelay
+	var err error
+	for attempt := 0; attempt <= h.config.Retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		if err = h.try_post(body); err == nil {
+			h.log.Debug("called webhook", "event", payload.Event, "torrent", payload.Name)
+			return
+		}
+		h.log.Debug("webhook attempt failed", "event", payload.Event, "attempt", attempt+1, "err", err)
+	}
+	h.log.Warn("webhook failed", "event", payload.Event, "torrent", payload.Name, "attempts", h.config.Retries+1, "err", err)
+}
+
+func (h *Hooks) try_post(body []byte) error {
+	resp, err := h.http.Post(h.config.Webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
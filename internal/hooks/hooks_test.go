@@ -0,0 +1,158 @@
+package hooks
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/chrispritchard/gorrent/pkg/client"
+)
+
+// seed adds a torrent of data already in a temporary dir to a new client, with hooks started before it is added,
+// then removes it and closes the client, returning once the hooks have finished
+func seed(t *testing.T, config Config) (dir string, info_hash string) {
+	t.Helper()
+	dir = t.TempDir()
+	source := filepath.Join(dir, "data.bin")
+	if err := os.WriteFile(source, make([]byte, 40_000), 0644); err != nil {
+		t.Fatal(err)
+	}
+	torrent, _, err := client.CreateTorrent(source, client.CreateOptions{PieceLength: 1 << 14})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client_config := client.DefaultConfig()
+	client_config.ListenPort = 0
+	client_config.DownloadDir = dir
+	c, err := client.New(client_config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := New(c, config).Start(t.Context())
+
+	info, _ := client.ParseTorrent(torrent)
+	added, err := c.AddTorrent(info, client.AddOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for added.Status().State != client.Seeding && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := c.Remove(added); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("hooks did not finish once the client closed")
+	}
+	return dir, added.InfoHash().String()
+}
+
+func TestCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the command is written for sh")
+	}
+	out := filepath.Join(t.TempDir(), "events")
+	dir, info_hash := seed(t, Config{
+		Command: `printf '%s %s %s %s %s\n' "$GORRENT_EVENT" "$GORRENT_NAME" "$GORRENT_INFO_HASH" "$GORRENT_SAVE_PATH" "$GORRENT_FILES" >> ` + out,
+		Events:  []string{Added, Removed},
+	})
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected a line for each of added and removed, got %q", lines)
+	}
+	for _, event := range []string{Added, Removed} {
+		want := strings.Join([]string{event, "data.bin", info_hash, dir, "data.bin"}, " ")
+		found := false
+		for _, line := range lines {
+			found = found || line == want
+		}
+		if !found {
+			t.Errorf("expected %q in %q", want, lines)
+		}
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	var mutex sync.Mutex
+	attempts := 0
+	received := []Payload{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		attempts++
+		if attempts == 1 {
+			http.Error(w, "not yet", http.StatusServiceUnavailable)
+			return
+		}
+		var payload Payload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Errorf("unable to decode the payload: %v", err)
+		}
+		received = append(received, payload)
+	}))
+	defer server.Close()
+
+	_, info_hash := seed(t, Config{Webhook: server.URL, Events: []string{Removed}, Retries: 1, RetryDelay: time.Millisecond})
+	mutex.Lock()
+	defer mutex.Unlock()
+	if attempts != 2 || len(received) != 1 {
+		t.Fatalf("expected the webhook to be retried once then receive the payload, got %d attempts and %v", attempts, received)
+	}
+	payload := received[0]
+	if payload.Event != Removed || payload.InfoHash != info_hash || len(payload.Files) != 1 || payload.Files[0].Length != 40_000 {
+		t.Errorf("unexpected payload %+v", payload)
+	}
+}
+
+// countingTransport counts the requests it passes on, standing in for a proxy's
+type countingTransport struct {
+	requests atomic.Int32
+}
+
+func (c *countingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	c.requests.Add(1)
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestWebhook_Transport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	transport := &countingTransport{}
+	seed(t, Config{Webhook: server.URL, Events: []string{Added, Removed}, Transport: transport})
+	if transport.requests.Load() != 2 {
+		t.Errorf("expected both calls to the webhook to go through the transport, got %d", transport.requests.Load())
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, test := range []struct {
+		config Config
+		valid  bool
+	}{
+		{Config{Events: []string{Added, Error}}, true},
+		{Config{Webhook: "https://example.com/hook"}, true},
+		{Config{Events: []string{"finished"}}, false},
+		{Config{Webhook: "example.com/hook"}, false},
+	} {
+		if err := test.config.Validate(); (err == nil) != test.valid {
+			t.Errorf("Validate(%+v) = %v, expected valid %v", test.config, err, test.valid)
+		}
+	}
+}
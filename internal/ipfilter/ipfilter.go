@@ -0,0 +1,230 @@
+// Package ipfilter blocks peers by address, from lists of ranges in the PeerGuardian P2P, eMule DAT and CIDR formats,
+// which may be gzipped. Lists are merged into sorted, disjoint ranges, so a lookup is a binary search however long they
+// are.
+package ipfilter
+
+import (
+	"bufio"
+	"cmp"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"math"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// dat_allowed is the level from which eMule DAT entries allow rather than block their range
+const dat_allowed = 128
+
+// Filter is a loaded blocklist. It is never changed once built, so may be shared
+type Filter struct {
+	v4      []span[uint32] // as uint32s, to keep lists of millions of ranges small
+	v6      []span[netip.Addr]
+	invalid int
+}
+
+type span[T any] struct {
+	from, to T
+}
+
+// Load reads a blocklist from a file, see Parse
+func Load(path string) (*Filter, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open the blocklist: %v", err)
+	}
+	defer file.Close()
+	filter, err := Parse(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the blocklist %s: %v", path, err)
+	}
+	return filter, nil
+}
+
+// Parse reads a blocklist, gzipped or not, with each line in any of the formats:
+//
+//	label:1.2.3.0-1.2.3.255                        PeerGuardian P2P
+//	001.002.003.000 - 001.002.003.255 , 000 , label eMule DAT, allowing rather than blocking from level 128
+//	1.2.3.0/24                                     CIDR, or a single address
+//
+// Blank lines and those starting # or // are skipped, as are lines that cannot be read, which are counted by Invalid.
+// A list with lines but no valid ones is an error, as it is most likely not a blocklist
+func Parse(r io.Reader) (*Filter, error) {
+	buffered := bufio.NewReader(r)
+	if magic, _ := buffered.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		unzipped, err := gzip.NewReader(buffered)
+		if err != nil {
+			return nil, err
+		}
+		defer unzipped.Close()
+		buffered = bufio.NewReader(unzipped)
+	}
+
+	filter := &Filter{}
+	lines := 0
+	scanner := bufio.NewScanner(buffered)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") {
+			continue
+		}
+		lines++
+		from, to, block, ok := parse_line(line)
+		switch {
+		case !ok:
+			filter.invalid++
+		case !block:
+		case from.Is4():
+			filter.v4 = append(filter.v4, span[uint32]{to_uint32(from), to_uint32(to)})
+		default:
+			filter.v6 = append(filter.v6, span[netip.Addr]{from, to})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if lines > 0 && filter.invalid == lines {
+		return nil, fmt.Errorf("none of its %d lines is a range of addresses", lines)
+	}
+
+	filter.v4 = merge(filter.v4, cmp.Compare[uint32], func(to, from uint32) bool { return to != math.MaxUint32 && to+1 == from })
+	filter.v6 = merge(filter.v6, netip.Addr.Compare, func(to, from netip.Addr) bool { return to.Next() == from })
+	return filter, nil
+}
+
+// parse_line returns the range of a line, and whether it blocks it
+func parse_line(line string) (from, to netip.Addr, block, ok bool) {
+	if fields := strings.Split(line, ","); len(fields) >= 2 {
+		if level, err := strconv.Atoi(strings.TrimSpace(fields[1])); err == nil {
+			from, to, ok = parse_range(fields[0])
+			return from, to, level < dat_allowed, ok
+		}
+	}
+	if prefix, err := netip.ParsePrefix(strings.Fields(line)[0]); err == nil {
+		prefix = prefix.Masked()
+		return prefix.Addr().Unmap(), last(prefix).Unmap(), true, true
+	}
+	if from, to, ok = parse_range(line); ok {
+		return from, to, true, true
+	}
+	for rest := line; ; { // after the label, which may hold commas, slashes and colons of its own
+		i := strings.Index(rest, ":")
+		if i < 0 {
+			return from, to, false, false
+		}
+		rest = rest[i+1:]
+		if from, to, ok = parse_range(rest); ok {
+			return from, to, true, true
+		}
+	}
+}
+
+func parse_range(s string) (from, to netip.Addr, ok bool) {
+	first, second, found := strings.Cut(s, "-")
+	from, ok = parse_addr(first)
+	if !ok {
+		return from, to, false
+	}
+	if !found {
+		return from, from, true
+	}
+	to, ok = parse_addr(second)
+	if !ok || from.BitLen() != to.BitLen() || from.Compare(to) > 0 {
+		return from, to, false
+	}
+	return from, to, true
+}
+
+// parse_addr allows the leading zeros of DAT lists' IPv4 addresses, which netip takes for octal and rejects
+func parse_addr(s string) (netip.Addr, bool) {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, ":") {
+		addr, err := netip.ParseAddr(s)
+		return addr.WithZone("").Unmap(), err == nil
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) != 4 {
+		return netip.Addr{}, false
+	}
+	var octets [4]byte
+	for i, part := range parts {
+		n, err := strconv.ParseUint(part, 10, 8)
+		if err != nil {
+			return netip.Addr{}, false
+		}
+		octets[i] = byte(n)
+	}
+	return netip.AddrFrom4(octets), true
+}
+
+// last is the highest address of a prefix
+func last(prefix netip.Prefix) netip.Addr {
+	bytes := prefix.Addr().AsSlice()
+	for i := prefix.Bits(); i < len(bytes)*8; i++ {
+		bytes[i/8] |= 0x80 >> (i % 8)
+	}
+	addr, _ := netip.AddrFromSlice(bytes)
+	return addr
+}
+
+func to_uint32(addr netip.Addr) uint32 {
+	b := addr.As4()
+	return uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+}
+
+// merge sorts spans and joins those that overlap or touch, so each address is in at most one
+func merge[T any](spans []span[T], compare func(a, b T) int, adjacent func(to, from T) bool) []span[T] {
+	slices.SortFunc(spans, func(a, b span[T]) int { return compare(a.from, b.from) })
+	merged := spans[:0]
+	for _, s := range spans {
+		if n := len(merged); n > 0 && (compare(s.from, merged[n-1].to) <= 0 || adjacent(merged[n-1].to, s.from)) {
+			if compare(s.to, merged[n-1].to) > 0 {
+				merged[n-1].to = s.to
+			}
+			continue
+		}
+		merged = append(merged, s)
+	}
+	return slices.Clip(merged)
+}
+
+// contains finds the last span starting at or before addr, and checks whether it reaches it
+func contains[T any](spans []span[T], addr T, compare func(a, b T) int) bool {
+	i, found := slices.BinarySearchFunc(spans, addr, func(s span[T], addr T) int { return compare(s.from, addr) })
+	if found {
+		return true
+	}
+	return i > 0 && compare(spans[i-1].to, addr) >= 0
+}
+
+// Blocked is whether an address falls in any blocked range. A nil filter blocks nothing
+func (f *Filter) Blocked(addr netip.Addr) bool {
+	if f == nil || !addr.IsValid() {
+		return false
+	}
+	addr = addr.Unmap()
+	if addr.Is4() {
+		return contains(f.v4, to_uint32(addr), cmp.Compare[uint32])
+	}
+	return contains(f.v6, addr.WithZone(""), netip.Addr.Compare)
+}
+
+// Len is the number of ranges blocked, once those that overlap or touch are merged
+func (f *Filter) Len() int {
+	if f == nil {
+		return 0
+	}
+	return len(f.v4) + len(f.v6)
+}
+
+// Invalid is the number of lines skipped as they could not be read
+func (f *Filter) Invalid() int {
+	if f == nil {
+		return 0
+	}
+	return f.invalid
+}
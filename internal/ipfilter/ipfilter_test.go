@@ -0,0 +1,120 @@
+package ipfilter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func mustParse(t *testing.T, list string) *Filter {
+	t.Helper()
+	filter, err := Parse(strings.NewReader(list))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filter
+}
+
+func TestFilter_Blocked(t *testing.T) {
+	filter := mustParse(t, `# comment
+// another
+
+Some, Inc/Ltd:1.2.3.0-1.2.3.255
+a:b:10.0.0.1-10.0.0.9
+v6:2001:db8::-2001:db8::ff
+001.002.005.000 - 001.002.005.255 , 000 , eMule
+001.002.006.000 - 001.002.006.255 , 200 , allowed
+192.168.0.0/16
+172.16.0.7
+2001:db8:1::/48
+not a range
+`)
+
+	tests := []struct {
+		addr    string
+		blocked bool
+	}{
+		{"1.2.3.0", true},
+		{"1.2.3.255", true},
+		{"1.2.4.0", false},
+		{"10.0.0.5", true},
+		{"10.0.0.10", false},
+		{"2001:db8::80", true},
+		{"2001:db8::100", false},
+		{"1.2.5.9", true},
+		{"1.2.6.9", false},
+		{"192.168.200.1", true},
+		{"192.169.0.0", false},
+		{"172.16.0.7", true},
+		{"172.16.0.8", false},
+		{"2001:db8:1:ffff::1", true},
+		{"2001:db8:2::1", false},
+		{"::ffff:1.2.3.4", true},
+		{"0.0.0.0", false},
+	}
+	for _, tt := range tests {
+		if got := filter.Blocked(netip.MustParseAddr(tt.addr)); got != tt.blocked {
+			t.Errorf("Blocked(%s) = %v, want %v", tt.addr, got, tt.blocked)
+		}
+	}
+	if filter.Invalid() != 1 {
+		t.Errorf("expected one invalid line, got %d", filter.Invalid())
+	}
+}
+
+func TestFilter_MergesRanges(t *testing.T) {
+	filter := mustParse(t, "1.0.0.10-1.0.0.20\n1.0.0.0-1.0.0.15\n1.0.0.21-1.0.0.30\n1.0.0.100/32\n255.255.255.0/24\n")
+	if filter.Len() != 3 {
+		t.Errorf("expected 3 ranges once merged, got %d", filter.Len())
+	}
+	for addr, blocked := range map[string]bool{"1.0.0.0": true, "1.0.0.30": true, "1.0.0.31": false, "1.0.0.100": true, "255.255.255.255": true} {
+		if filter.Blocked(netip.MustParseAddr(addr)) != blocked {
+			t.Errorf("expected Blocked(%s) to be %v", addr, blocked)
+		}
+	}
+}
+
+func TestParse_Gzipped(t *testing.T) {
+	var buffer bytes.Buffer
+	zipped := gzip.NewWriter(&buffer)
+	fmt.Fprintln(zipped, "label:5.6.7.0-5.6.7.255")
+	zipped.Close()
+
+	filter, err := Parse(&buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !filter.Blocked(netip.MustParseAddr("5.6.7.8")) {
+		t.Error("expected the gzipped range to be blocked")
+	}
+}
+
+func TestParse_RejectsWhatIsNotABlocklist(t *testing.T) {
+	if _, err := Parse(strings.NewReader("<html>\n<body>not found</body>\n")); err == nil {
+		t.Error("expected an error")
+	}
+	if filter := mustParse(t, ""); filter.Len() != 0 || filter.Blocked(netip.MustParseAddr("1.2.3.4")) {
+		t.Error("expected an empty list to block nothing")
+	}
+}
+
+func TestFilter_MillionRanges(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds a large list")
+	}
+	var list strings.Builder
+	for i := range 1_000_000 {
+		a, b, c := byte(i>>16), byte(i>>8), byte(i)
+		fmt.Fprintf(&list, "r%d:%d.%d.%d.0-%d.%d.%d.127\n", i, a, b, c, a, b, c)
+	}
+	filter := mustParse(t, list.String())
+	if filter.Len() != 1_000_000 {
+		t.Fatalf("expected a million ranges, got %d", filter.Len())
+	}
+	if !filter.Blocked(netip.MustParseAddr("9.8.7.100")) || filter.Blocked(netip.MustParseAddr("9.8.7.200")) {
+		t.Error("expected only the lower half of each /24 to be blocked")
+	}
+}
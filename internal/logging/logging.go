@@ -0,0 +1,142 @@
+// Package logging builds the slog loggers used throughout: each subsystem logs through its own child logger, so its
+// level can be set separately, e.g. "info,peer=debug,tracker=warn"
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// Subsystems, recorded under the "subsystem" attribute
+const (
+	Session  = "session"
+	Torrent  = "torrent"
+	Peer     = "peer"
+	Download = "download"
+	WebSeed  = "webseed"
+	Tracker  = "tracker"
+	RPC      = "rpc"
+	Watch    = "watch"
+	Hooks    = "hooks"
+)
+
+const SubsystemKey = "subsystem"
+
+// For returns the logger for a subsystem, which is discarded if logger is nil
+func For(logger *slog.Logger, subsystem string) *slog.Logger {
+	if logger == nil {
+		return Discard()
+	}
+	return logger.With(SubsystemKey, subsystem)
+}
+
+// OrDiscard is logger, or a logger that writes nothing if it is nil
+func OrDiscard(logger *slog.Logger) *slog.Logger {
+	if logger == nil {
+		return Discard()
+	}
+	return logger
+}
+
+func Discard() *slog.Logger {
+	return slog.New(slog.DiscardHandler)
+}
+
+// Levels is a default level and overrides for particular subsystems
+type Levels struct {
+	Default    slog.Level
+	Subsystems map[string]slog.Level
+}
+
+// ParseLevels reads a comma separated list of levels (debug, info, warn or error), each optionally prefixed with a
+// subsystem and '='. A level without a subsystem is the default, which is info if not given
+func ParseLevels(spec string) (Levels, error) {
+	levels := Levels{Default: slog.LevelInfo, Subsystems: map[string]slog.Level{}}
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		subsystem, name, found := strings.Cut(part, "=")
+		if !found {
+			subsystem, name = "", part
+		}
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(strings.TrimSpace(name))); err != nil {
+			return Levels{}, fmt.Errorf("invalid log level %q: %v", part, err)
+		}
+		if subsystem == "" {
+			levels.Default = level
+		} else {
+			levels.Subsystems[strings.TrimSpace(subsystem)] = level
+		}
+	}
+	return levels, nil
+}
+
+// Minimum is the lowest level any subsystem logs at, for the handler underneath the filter
+func (l Levels) Minimum() slog.Level {
+	minimum := l.Default
+	for _, level := range l.Subsystems {
+		minimum = min(minimum, level)
+	}
+	return minimum
+}
+
+// New creates a logger writing text or json to out, filtered by levels
+func New(out io.Writer, format string, levels Levels) (*slog.Logger, error) {
+	options := &slog.HandlerOptions{Level: levels.Minimum()}
+	var handler slog.Handler
+	switch format {
+	case "text", "":
+		handler = slog.NewTextHandler(out, options)
+	case "json":
+		handler = slog.NewJSONHandler(out, options)
+	default:
+		return nil, fmt.Errorf("unknown log format %q, expected text or json", format)
+	}
+	return slog.New(NewFilter(handler, levels)), nil
+}
+
+// Filter is a handler that drops records below the level of the subsystem they were logged through
+type Filter struct {
+	next      slog.Handler
+	levels    Levels
+	subsystem string
+}
+
+func NewFilter(next slog.Handler, levels Levels) *Filter {
+	return &Filter{next: next, levels: levels}
+}
+
+func (f *Filter) level() slog.Level {
+	if level, ok := f.levels.Subsystems[f.subsystem]; ok {
+		return level
+	}
+	return f.levels.Default
+}
+
+func (f *Filter) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= f.level() && f.next.Enabled(ctx, level)
+}
+
+func (f *Filter) Handle(ctx context.Context, record slog.Record) error {
+	return f.next.Handle(ctx, record)
+}
+
+func (f *Filter) WithAttrs(attrs []slog.Attr) slog.Handler {
+	child := &Filter{next: f.next.WithAttrs(attrs), levels: f.levels, subsystem: f.subsystem}
+	for _, a := range attrs {
+		if a.Key == SubsystemKey {
+			child.subsystem = a.Value.String()
+		}
+	}
+	return child
+}
+
+func (f *Filter) WithGroup(name string) slog.Handler {
+	return &Filter{next: f.next.WithGroup(name), levels: f.levels, subsystem: f.subsystem}
+}
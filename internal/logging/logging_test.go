@@ -0,0 +1,78 @@
+package logging
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestParseLevels(t *testing.T) {
+	tests := []struct {
+		name     string
+		spec     string
+		want     Levels
+		want_err bool
+	}{
+		{name: "empty", spec: "", want: Levels{Default: slog.LevelInfo, Subsystems: map[string]slog.Level{}}},
+		{name: "default only", spec: "warn", want: Levels{Default: slog.LevelWarn, Subsystems: map[string]slog.Level{}}},
+		{
+			name: "subsystems",
+			spec: "error, peer=debug,tracker=WARN",
+			want: Levels{Default: slog.LevelError, Subsystems: map[string]slog.Level{"peer": slog.LevelDebug, "tracker": slog.LevelWarn}},
+		},
+		{name: "invalid level", spec: "peer=loud", want_err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseLevels(tt.spec)
+			if (err != nil) != tt.want_err {
+				t.Fatalf("ParseLevels() error = %v, want_err %v", err, tt.want_err)
+			}
+			if tt.want_err {
+				return
+			}
+			if got.Default != tt.want.Default || len(got.Subsystems) != len(tt.want.Subsystems) {
+				t.Fatalf("ParseLevels() = %+v, want %+v", got, tt.want)
+			}
+			for k, v := range tt.want.Subsystems {
+				if got.Subsystems[k] != v {
+					t.Errorf("level of %s = %v, want %v", k, got.Subsystems[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestFilter_PerSubsystemLevels(t *testing.T) {
+	levels, _ := ParseLevels("warn,peer=debug")
+	var out bytes.Buffer
+	logger, err := New(&out, "json", levels)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	For(logger, Peer).Debug("peer detail", "piece", 1)
+	For(logger, Torrent).Info("torrent detail")
+	For(logger, Torrent).Warn("torrent warning")
+	For(logger, Peer).With("peer", "1.2.3.4:5").Info("peer info")
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 records, got %d:\n%s", len(lines), out.String())
+	}
+	for _, want := range []string{`"msg":"peer detail"`, `"msg":"torrent warning"`, `"peer":"1.2.3.4:5"`} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("expected output to contain %s, got:\n%s", want, out.String())
+		}
+	}
+	if !strings.Contains(lines[0], `"subsystem":"peer"`) || !strings.Contains(lines[0], `"piece":1`) {
+		t.Errorf("expected structured attributes, got %s", lines[0])
+	}
+
+	if _, err := New(&out, "xml", levels); err == nil {
+		t.Error("expected an unknown format to fail")
+	}
+	For(nil, Peer).Error("discarded") // a nil logger is allowed
+}
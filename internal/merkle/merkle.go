@@ -0,0 +1,120 @@
+package merkle
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"math/bits"
+)
+
+// Merkle tree helpers for BitTorrent v2 (BEP 52). Each file is hashed as a binary tree of SHA-256 hashes over 16 KiB
+// blocks. Trees are always padded out to a power of two width - leaves past the end of the data are all-zero hashes,
+// and the padding nodes of higher layers are hashes of that zero padding.
+
+const BlockSize = 1 << 14
+
+type Hash = [32]byte
+
+// HashBlocks returns the leaf hashes for data, one per 16 KiB block (the last block may be shorter)
+func HashBlocks(data []byte) []Hash {
+	result := make([]Hash, 0, (len(data)+BlockSize-1)/BlockSize)
+	for start := 0; start < len(data); start += BlockSize {
+		result = append(result, sha256.Sum256(data[start:min(start+BlockSize, len(data))]))
+	}
+	return result
+}
+
+// PadHash returns the root of an all-zero subtree, the given number of layers above the leaves
+func PadHash(layer int) Hash {
+	var h Hash
+	for range layer {
+		h = hash_pair(h, h)
+	}
+	return h
+}
+
+// NextPowerOfTwo returns the smallest power of two >= n (and 1 for n <= 1)
+func NextPowerOfTwo(n int) int {
+	if n <= 1 {
+		return 1
+	}
+	return 1 << bits.Len(uint(n-1))
+}
+
+// Log2 returns the base two logarithm of n, which must be a power of two
+func Log2(n int) int {
+	return bits.TrailingZeros(uint(n))
+}
+
+// Tree builds every layer of the tree over nodes, padded to width with pad. Layer 0 is the (padded) nodes and the
+// final layer holds only the root
+func Tree(nodes []Hash, width int, pad Hash) [][]Hash {
+	layer := make([]Hash, width)
+	copy(layer, nodes)
+	for i := len(nodes); i < width; i++ {
+		layer[i] = pad
+	}
+
+	tree := [][]Hash{layer}
+	for len(layer) > 1 {
+		next := make([]Hash, len(layer)/2)
+		for i := range next {
+			next[i] = hash_pair(layer[i*2], layer[i*2+1])
+		}
+		tree = append(tree, next)
+		layer = next
+	}
+	return tree
+}
+
+// Root computes the root of the tree over nodes, padded to width with pad
+func Root(nodes []Hash, width int, pad Hash) Hash {
+	tree := Tree(nodes, width, pad)
+	return tree[len(tree)-1][0]
+}
+
+// Proof returns the uncle hashes needed to verify the run of length nodes at index in layer 0, from the lowest uncle
+// upwards, limited to proof_layers hashes
+func Proof(tree [][]Hash, index, length, proof_layers int) ([]Hash, error) {
+	if length <= 0 || length&(length-1) != 0 {
+		return nil, fmt.Errorf("length %d is not a power of two", length)
+	}
+	if index < 0 || index%length != 0 || index+length > len(tree[0]) {
+		return nil, fmt.Errorf("range %d+%d is not aligned within a tree of width %d", index, length, len(tree[0]))
+	}
+
+	uncles := []Hash{}
+	pos := index / length
+	for layer := Log2(length); layer < len(tree)-1 && len(uncles) < proof_layers; layer++ {
+		uncles = append(uncles, tree[layer][pos^1])
+		pos /= 2
+	}
+	return uncles, nil
+}
+
+// VerifyProof checks that hashes, a power of two run of nodes starting at index, combine with the uncles to root
+func VerifyProof(hashes, uncles []Hash, index int, root Hash) bool {
+	length := len(hashes)
+	if length == 0 || length&(length-1) != 0 || index%length != 0 {
+		return false
+	}
+
+	subtree := Tree(hashes, length, Hash{})
+	h := subtree[len(subtree)-1][0]
+	pos := index / length
+	for _, uncle := range uncles {
+		if pos%2 == 0 {
+			h = hash_pair(h, uncle)
+		} else {
+			h = hash_pair(uncle, h)
+		}
+		pos /= 2
+	}
+	return pos == 0 && h == root
+}
+
+func hash_pair(left, right Hash) Hash {
+	var buf [64]byte
+	copy(buf[:32], left[:])
+	copy(buf[32:], right[:])
+	return sha256.Sum256(buf[:])
+}
@@ -0,0 +1,130 @@
+package merkle
+
+import (
+	"crypto/sha256"
+	"testing"
+)
+
+func testData(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 31)
+	}
+	return data
+}
+
+func TestHashBlocks(t *testing.T) {
+	data := testData(BlockSize*2 + 100)
+	blocks := HashBlocks(data)
+	if len(blocks) != 3 {
+		t.Fatalf("expected 3 blocks, got %d", len(blocks))
+	}
+	if blocks[2] != sha256.Sum256(data[BlockSize*2:]) {
+		t.Errorf("last block should hash only the remaining data")
+	}
+	if len(HashBlocks(nil)) != 0 {
+		t.Errorf("expected no blocks for empty data")
+	}
+}
+
+func TestNextPowerOfTwo(t *testing.T) {
+	tests := map[int]int{0: 1, 1: 1, 2: 2, 3: 4, 4: 4, 5: 8, 1000: 1024}
+	for n, want := range tests {
+		if got := NextPowerOfTwo(n); got != want {
+			t.Errorf("NextPowerOfTwo(%d) = %d, want %d", n, got, want)
+		}
+	}
+}
+
+func TestPadHash(t *testing.T) {
+	zero := Hash{}
+	if PadHash(0) != zero {
+		t.Errorf("layer 0 pad should be the zero hash")
+	}
+	if PadHash(1) != hash_pair(zero, zero) {
+		t.Errorf("layer 1 pad should be the hash of two zero hashes")
+	}
+	if PadHash(3) != Root(nil, 8, zero) {
+		t.Errorf("pad hash should match the root of an all zero tree")
+	}
+}
+
+func TestRoot_PieceLayerMatchesFullTree(t *testing.T) {
+	// a file of 5 pieces, each of 4 blocks: building from the piece layer must give the same root as the leaves
+	blocks_per_piece := 4
+	data := testData(BlockSize*blocks_per_piece*4 + BlockSize + 10)
+	leaves := HashBlocks(data)
+
+	full_root := Root(leaves, NextPowerOfTwo(len(leaves)), Hash{})
+
+	layer := []Hash{}
+	for start := 0; start < len(leaves); start += blocks_per_piece {
+		end := min(start+blocks_per_piece, len(leaves))
+		layer = append(layer, Root(leaves[start:end], blocks_per_piece, Hash{}))
+	}
+	layer_root := Root(layer, NextPowerOfTwo(len(layer)), PadHash(Log2(blocks_per_piece)))
+
+	if full_root != layer_root {
+		t.Errorf("root from the piece layer does not match the root from the leaves")
+	}
+}
+
+func TestProofAndVerify(t *testing.T) {
+	nodes := HashBlocks(testData(BlockSize * 6))
+	tree := Tree(nodes, 8, Hash{})
+	root := tree[len(tree)-1][0]
+
+	tests := []struct {
+		name   string
+		index  int
+		length int
+	}{
+		{"single node", 5, 1},
+		{"pair", 2, 2},
+		{"half", 4, 4},
+		{"whole tree", 0, 8},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			uncles, err := Proof(tree, tt.index, tt.length, 32)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(uncles) != 3-Log2(tt.length) {
+				t.Errorf("expected %d uncles, got %d", 3-Log2(tt.length), len(uncles))
+			}
+			hashes := tree[0][tt.index : tt.index+tt.length]
+			if !VerifyProof(hashes, uncles, tt.index, root) {
+				t.Errorf("valid proof failed to verify")
+			}
+
+			tampered := append([]Hash{}, hashes...)
+			tampered[0][0] ^= 1
+			if VerifyProof(tampered, uncles, tt.index, root) {
+				t.Errorf("tampered hashes should not verify")
+			}
+		})
+	}
+}
+
+func TestProof_LimitsLayersAndRejectsBadRanges(t *testing.T) {
+	tree := Tree(HashBlocks(testData(BlockSize*8)), 8, Hash{})
+
+	uncles, err := Proof(tree, 0, 1, 1)
+	if err != nil || len(uncles) != 1 {
+		t.Errorf("expected 1 uncle when limited, got %d (%v)", len(uncles), err)
+	}
+	if VerifyProof(tree[0][:1], uncles, 0, tree[len(tree)-1][0]) {
+		t.Errorf("a proof that does not reach the root should not verify")
+	}
+
+	if _, err := Proof(tree, 1, 2, 8); err == nil {
+		t.Errorf("expected an error for an unaligned index")
+	}
+	if _, err := Proof(tree, 0, 3, 8); err == nil {
+		t.Errorf("expected an error for a length that is not a power of two")
+	}
+	if _, err := Proof(tree, 8, 1, 8); err == nil {
+		t.Errorf("expected an error for an index past the end of the tree")
+	}
+}
@@ -8,8 +8,6 @@ import (
 	"time"
 )
 
-var TIMEOUT = 500 * time.Millisecond
-
 func SendMessage(conn net.Conn, kind PeerMessageType, data []byte) error {
 	length := len(data) + 1           // 1 for the message type
 	to_send := make([]byte, 4+length) // first four bytes are where we put the length
@@ -18,10 +16,6 @@ func SendMessage(conn net.Conn, kind PeerMessageType, data []byte) error {
 	to_send[4] = byte(kind)
 	copy(to_send[5:], data)
 
-	// deadline := time.Now().Add(TIMEOUT)
-	// conn.SetWriteDeadline(deadline)
-	// defer conn.SetWriteDeadline(time.Time{})
-
 	n, err := conn.Write(to_send)
 	if err != nil {
 		// if net_err, ok := err.(net.Error); ok && net_err.Timeout() && retry_on_timeout {
@@ -35,27 +29,28 @@ func SendMessage(conn net.Conn, kind PeerMessageType, data []byte) error {
 	return err
 }
 
-func ReceiveMessage(conn net.Conn) (Received, error) {
-
-	defer conn.SetReadDeadline(time.Time{})
+// ReceiveMessage reads the next message, skipping keep-alives. If idle is not zero, it fails once that long passes
+// without anything from the peer, keep-alives included
+func ReceiveMessage(conn net.Conn, idle time.Duration) (Received, error) {
+	if idle > 0 {
+		defer conn.SetReadDeadline(time.Time{})
+	}
 
 	length_buffer := make([]byte, 4)
 	var length uint32
 	for {
-		conn.SetReadDeadline(time.Now().Add(TIMEOUT))
+		if idle > 0 {
+			conn.SetReadDeadline(time.Now().Add(idle))
+		}
 		_, err := io.ReadFull(conn, length_buffer)
 		if err != nil {
-			if net_err, ok := err.(net.Error); ok && net_err.Timeout() {
-				continue
-			}
 			return nil_received, err
 		}
 		length = binary.BigEndian.Uint32(length_buffer)
-		if length == 0 {
-			continue // keep-alive, keep listening
-		} else {
+		if length != 0 {
 			break
 		}
+		// keep-alive, keep listening
 	}
 
 	received := make([]byte, length)
@@ -65,10 +60,10 @@ func ReceiveMessage(conn net.Conn) (Received, error) {
 	}
 
 	kind := PeerMessageType(received[0])
-	if kind > MSG_CANCEL || kind < MSG_CHOKE {
+	if !kind.Valid() {
 		return nil_received, fmt.Errorf("invalid message type received: %d", kind)
 	}
 
 	data := received[1:]
-	return Received{kind, data}, nil
+	return Received{Kind: kind, Data: data}, nil
 }
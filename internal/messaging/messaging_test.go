@@ -109,7 +109,7 @@ func TestReceiveMessage(t *testing.T) {
 			server.Write(buf)
 		}()
 
-		received, err := ReceiveMessage(client)
+		received, err := ReceiveMessage(client, 0)
 		if err != nil {
 			t.Fatalf("ReceiveMessage() unexpected error: %v", err)
 		}
@@ -121,3 +121,54 @@ func TestReceiveMessage(t *testing.T) {
 		}
 	})
 }
+
+func TestHashRequestRoundTrip(t *testing.T) {
+	request := HashRequest{
+		PiecesRoot:  [32]byte{1, 2, 3},
+		BaseLayer:   1,
+		Index:       4,
+		Length:      2,
+		ProofLayers: 3,
+	}
+
+	received := Received{Kind: MSG_HASH_REQUEST, Data: request.Encode()}
+	got, err := received.AsHashRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != request {
+		t.Errorf("AsHashRequest() = %+v, want %+v", got, request)
+	}
+
+	hashes := [][32]byte{{9}, {8}, {7}}
+	received = Received{Kind: MSG_HASHES, Data: request.EncodeHashes(hashes)}
+	got, got_hashes, err := received.AsHashes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != request || len(got_hashes) != 3 || got_hashes[2] != hashes[2] {
+		t.Errorf("AsHashes() = %+v %v", got, got_hashes)
+	}
+
+	short := Received{Kind: MSG_HASH_REJECT, Data: make([]byte, 10)}
+	if _, err := short.AsHashRequest(); err == nil {
+		t.Errorf("expected an error for a truncated message")
+	}
+	partial := Received{Kind: MSG_HASHES, Data: append(request.Encode(), 1, 2, 3)}
+	if _, _, err := partial.AsHashes(); err == nil {
+		t.Errorf("expected an error for a partial hash")
+	}
+}
+
+func TestPeerMessageTypeValid(t *testing.T) {
+	for _, kind := range []PeerMessageType{MSG_CHOKE, MSG_CANCEL, MSG_EXTENDED, MSG_HASH_REQUEST, MSG_HASHES, MSG_HASH_REJECT} {
+		if !kind.Valid() {
+			t.Errorf("expected %d to be valid", kind)
+		}
+	}
+	for _, kind := range []PeerMessageType{9, 19, 24} {
+		if kind.Valid() {
+			t.Errorf("expected %d to be invalid", kind)
+		}
+	}
+}
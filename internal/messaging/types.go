@@ -1,6 +1,9 @@
 package messaging
 
-import "encoding/binary"
+import (
+	"encoding/binary"
+	"fmt"
+)
 
 type PeerMessageType int
 
@@ -16,9 +19,24 @@ const (
 	MSG_CANCEL
 )
 
+// BEP 52 messages, used to exchange merkle hashes for v2 torrents
+const (
+	MSG_HASH_REQUEST PeerMessageType = iota + 21
+	MSG_HASHES
+	MSG_HASH_REJECT
+)
+
+// BEP 10 extension protocol messages, which carry BEP 9 metadata exchange for magnet links
+const MSG_EXTENDED PeerMessageType = 20
+
+func (k PeerMessageType) Valid() bool {
+	return (k >= MSG_CHOKE && k <= MSG_CANCEL) || k == MSG_EXTENDED || (k >= MSG_HASH_REQUEST && k <= MSG_HASH_REJECT)
+}
+
 type Received struct {
 	Kind PeerMessageType
 	Data []byte
+	From string // the address of the peer that sent it, empty from web seeds
 }
 
 func (r *Received) AsPiece() (int, int, []byte) {
@@ -28,4 +46,74 @@ func (r *Received) AsPiece() (int, int, []byte) {
 	return int(index), int(begin), piece
 }
 
+// EncodePiece builds the payload of a piece message, the inverse of AsPiece
+func EncodePiece(index, begin int, block []byte) []byte {
+	data := make([]byte, 8+len(block))
+	binary.BigEndian.PutUint32(data[0:4], uint32(index))
+	binary.BigEndian.PutUint32(data[4:8], uint32(begin))
+	copy(data[8:], block)
+	return data
+}
+
+// HashRequest is the shared header of the hash request, hashes and hash reject messages
+type HashRequest struct {
+	PiecesRoot  [32]byte
+	BaseLayer   int
+	Index       int
+	Length      int
+	ProofLayers int
+}
+
+const hash_request_length = 48
+
+func (hr HashRequest) Encode() []byte {
+	data := make([]byte, hash_request_length)
+	copy(data[:32], hr.PiecesRoot[:])
+	binary.BigEndian.PutUint32(data[32:36], uint32(hr.BaseLayer))
+	binary.BigEndian.PutUint32(data[36:40], uint32(hr.Index))
+	binary.BigEndian.PutUint32(data[40:44], uint32(hr.Length))
+	binary.BigEndian.PutUint32(data[44:48], uint32(hr.ProofLayers))
+	return data
+}
+
+// EncodeHashes builds the payload of a hashes message: the request header followed by each hash
+func (hr HashRequest) EncodeHashes(hashes [][32]byte) []byte {
+	data := hr.Encode()
+	for _, h := range hashes {
+		data = append(data, h[:]...)
+	}
+	return data
+}
+
+// AsHashRequest parses the header of a hash request, hashes or hash reject message
+func (r *Received) AsHashRequest() (HashRequest, error) {
+	if len(r.Data) < hash_request_length {
+		return HashRequest{}, fmt.Errorf("hash message is too short: %d bytes", len(r.Data))
+	}
+	var hr HashRequest
+	copy(hr.PiecesRoot[:], r.Data[:32])
+	hr.BaseLayer = int(binary.BigEndian.Uint32(r.Data[32:36]))
+	hr.Index = int(binary.BigEndian.Uint32(r.Data[36:40]))
+	hr.Length = int(binary.BigEndian.Uint32(r.Data[40:44]))
+	hr.ProofLayers = int(binary.BigEndian.Uint32(r.Data[44:48]))
+	return hr, nil
+}
+
+// AsHashes parses a hashes message into its request header and the hashes that follow
+func (r *Received) AsHashes() (HashRequest, [][32]byte, error) {
+	hr, err := r.AsHashRequest()
+	if err != nil {
+		return hr, nil, err
+	}
+	rest := r.Data[hash_request_length:]
+	if len(rest)%32 != 0 {
+		return hr, nil, fmt.Errorf("hashes message has a partial hash")
+	}
+	hashes := make([][32]byte, len(rest)/32)
+	for i := range hashes {
+		copy(hashes[i][:], rest[i*32:])
+	}
+	return hr, hashes, nil
+}
+
 var nil_received Received
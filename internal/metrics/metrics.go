@@ -0,0 +1,188 @@
+// Package metrics serves a client's statistics in the Prometheus text format, for scraping at /metrics. Torrents are
+// labelled by info hash and name, and every series is computed from their status and peers as each scrape is made.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/chrispritchard/gorrent/internal/stats"
+	"github.com/chrispritchard/gorrent/pkg/client"
+)
+
+const (
+	Path         = "/metrics"
+	content_type = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+var states = []client.State{client.Paused, client.FetchingMetadata, client.Checking, client.Downloading, client.Seeding, client.Failed}
+
+// Handler serves the metrics of c at Path
+func Handler(c *client.Client) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != Path {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", content_type)
+		out := bufio.NewWriter(w)
+		write_all(out, snapshot(c))
+		out.Flush()
+	})
+}
+
+// torrent is what is known of a torrent at the time of a scrape
+type torrent struct {
+	labels string
+	status client.Status
+	peers  []client.PeerStatus
+}
+
+func snapshot(c *client.Client) []torrent {
+	result := []torrent{}
+	for _, t := range c.Torrents() {
+		result = append(result, torrent{
+			labels: labels("info_hash", t.InfoHash().String(), "name", t.Name()),
+			status: t.Status(),
+			peers:  t.Peers(),
+		})
+	}
+	return result
+}
+
+type family struct {
+	name, kind, help string
+	samples          func(t torrent, write sample)
+}
+
+// sample writes a value of the family, for the torrent, with a suffix to its name and labels of its own
+type sample func(suffix, labels string, value float64)
+
+// families are written in order, each with a sample, or several, for every torrent
+var families = []family{
+	{"gorrent_torrent_state", "gauge", "1 for the torrent's state, 0 for the others", func(t torrent, write sample) {
+		for _, state := range states {
+			write("", labels("state", state.String()), boolean(t.status.State == state))
+		}
+	}},
+	{"gorrent_torrent_downloaded_bytes_total", "counter", "Block data downloaded from peers and web seeds", func(t torrent, write sample) {
+		write("", "", float64(t.status.Downloaded))
+	}},
+	{"gorrent_torrent_uploaded_bytes_total", "counter", "Block data uploaded to peers", func(t torrent, write sample) {
+		write("", "", float64(t.status.Uploaded))
+	}},
+	{"gorrent_torrent_wasted_bytes_total", "counter", "Block data downloaded then discarded, as duplicates or failing verification", func(t torrent, write sample) {
+		write("", "", float64(t.status.Wasted))
+	}},
+	{"gorrent_torrent_download_rate_bytes", "gauge", "Bytes downloaded per second, over the last few seconds", func(t torrent, write sample) {
+		write("", "", t.status.DownloadRate)
+	}},
+	{"gorrent_torrent_upload_rate_bytes", "gauge", "Bytes uploaded per second, over the last few seconds", func(t torrent, write sample) {
+		write("", "", t.status.UploadRate)
+	}},
+	{"gorrent_torrent_peers", "gauge", "Connected peers", func(t torrent, write sample) {
+		write("", "", float64(len(t.peers)))
+	}},
+	{"gorrent_torrent_peers_choked", "gauge", "Connected peers by who is choking: the peer choking us, or us choking the peer", func(t torrent, write sample) {
+		var by_peer, by_us int
+		for _, p := range t.peers {
+			by_peer += int(boolean(p.Choked))
+			by_us += int(boolean(p.Choking))
+		}
+		write("", labels("by", "peer", "state", "choked"), float64(by_peer))
+		write("", labels("by", "peer", "state", "unchoked"), float64(len(t.peers)-by_peer))
+		write("", labels("by", "us", "state", "choked"), float64(by_us))
+		write("", labels("by", "us", "state", "unchoked"), float64(len(t.peers)-by_us))
+	}},
+	{"gorrent_torrent_outstanding_requests", "gauge", "Blocks requested from peers and not yet received", func(t torrent, write sample) {
+		requests := 0
+		for _, p := range t.peers {
+			requests += p.Requests
+		}
+		write("", "", float64(requests))
+	}},
+	{"gorrent_torrent_hash_failures_total", "counter", "Pieces that failed verification", func(t torrent, write sample) {
+		write("", "", float64(t.status.HashFailures))
+	}},
+	{"gorrent_torrent_banned_peers", "gauge", "Hosts refused for sending data that failed verification", func(t torrent, write sample) {
+		write("", "", float64(t.status.BannedPeers))
+	}},
+	{"gorrent_torrent_pieces", "gauge", "Pieces in the torrent, 0 until its metadata is known", func(t torrent, write sample) {
+		write("", "", float64(t.status.TotalPieces))
+	}},
+	{"gorrent_torrent_pieces_completed", "gauge", "Pieces downloaded and verified", func(t torrent, write sample) {
+		write("", "", float64(t.status.CompletedPieces))
+	}},
+	{"gorrent_torrent_completed_ratio", "gauge", "The fraction of the torrent's bytes downloaded and verified", func(t torrent, write sample) {
+		write("", "", t.status.Progress)
+	}},
+	{"gorrent_torrent_announces_total", "counter", "Announces to the torrent's trackers, by result", func(t torrent, write sample) {
+		write("", labels("result", "success"), float64(t.status.Announces.Count-t.status.AnnounceErrors))
+		write("", labels("result", "error"), float64(t.status.AnnounceErrors))
+	}},
+	{"gorrent_torrent_announce_duration_seconds", "histogram", "How long announces took, successful or not", func(t torrent, write sample) {
+		histogram(t.status.Announces, write)
+	}},
+	{"gorrent_torrent_disk_write_duration_seconds", "histogram", "How long verified pieces took to write to disk", func(t torrent, write sample) {
+		histogram(t.status.DiskWrites, write)
+	}},
+}
+
+// write_all writes every family, for the given torrents, in the text format
+func write_all(out *bufio.Writer, torrents []torrent) {
+	fmt.Fprintf(out, "# HELP gorrent_torrents Torrents in the client\n# TYPE gorrent_torrents gauge\ngorrent_torrents %d\n", len(torrents))
+	for _, f := range families {
+		fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+		for _, t := range torrents {
+			f.samples(t, func(suffix, extra string, value float64) {
+				fmt.Fprintf(out, "%s%s{%s} %s\n", f.name, suffix, join(t.labels, extra), format(value))
+			})
+		}
+	}
+}
+
+// histogram writes cumulative buckets, then the sum and count
+func histogram(h stats.Histogram, write sample) {
+	if h.Counts == nil {
+		h = stats.NewHistogram(stats.LatencyBounds)
+	}
+	cumulative := int64(0)
+	for i, bound := range h.Bounds {
+		cumulative += h.Counts[i]
+		write("_bucket", labels("le", format(bound.Seconds())), float64(cumulative))
+	}
+	write("_bucket", labels("le", "+Inf"), float64(h.Count))
+	write("_sum", "", h.Sum.Seconds())
+	write("_count", "", float64(h.Count))
+}
+
+// labels formats name and value pairs, escaping the values
+func labels(pairs ...string) string {
+	parts := []string{}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(pairs[i+1])
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, pairs[i], value))
+	}
+	return strings.Join(parts, ",")
+}
+
+func join(a, b string) string {
+	if a == "" || b == "" {
+		return a + b
+	}
+	return a + "," + b
+}
+
+func format(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func boolean(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,99 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chrispritchard/gorrent/pkg/client"
+)
+
+// sample_line is a sample in the text format: a name, labels, and a value
+var sample_line = regexp.MustCompile(`^[a-z_]+(\{([a-z_]+="([^"\\]|\\.)*",?)*\})? \S+$`)
+
+// scrape serves the metrics of a client seeding a torrent, once it has checked the data, returning the response body
+func scrape(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	source := filepath.Join(dir, `quote".bin`)
+	if err := os.WriteFile(source, make([]byte, 40_000), 0644); err != nil {
+		t.Fatal(err)
+	}
+	torrent, _, err := client.CreateTorrent(source, client.CreateOptions{PieceLength: 1 << 14})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := client.DefaultConfig()
+	config.ListenPort = 0
+	config.DownloadDir = dir
+	c, err := client.New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	info, _ := client.ParseTorrent(torrent)
+	added, err := c.AddTorrent(info, client.AddOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for added.Status().State != client.Seeding && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	server := httptest.NewServer(Handler(c))
+	t.Cleanup(server.Close)
+	resp, err := http.Get(server.URL + Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != content_type {
+		t.Fatalf("unexpected response %s %q", resp.Status, resp.Header.Get("Content-Type"))
+	}
+	body, _ := io.ReadAll(resp.Body)
+	return string(body)
+}
+
+func TestHandler(t *testing.T) {
+	body := scrape(t)
+	for line := range strings.Lines(body) {
+		line = strings.TrimSuffix(line, "\n")
+		if !strings.HasPrefix(line, "# ") && !sample_line.MatchString(line) {
+			t.Errorf("malformed line %q", line)
+		}
+	}
+
+	labels := `info_hash="` // the rest of the labels are checked by the line format
+	for _, want := range []string{
+		"gorrent_torrents 1\n",
+		"# TYPE gorrent_torrent_hash_failures_total counter\n",
+		"# TYPE gorrent_torrent_banned_peers gauge\n",
+		`gorrent_torrent_state{` + labels,
+		`,name="quote\".bin",state="seeding"} 1` + "\n",
+		`,name="quote\".bin"} 3` + "\n", // gorrent_torrent_pieces
+		`gorrent_torrent_completed_ratio{`,
+		`,by="peer",state="choked"} 0` + "\n",
+		`gorrent_torrent_announce_duration_seconds_bucket{` + labels,
+		`,le="+Inf"} 0` + "\n",
+		`gorrent_torrent_disk_write_duration_seconds_count{`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected %q in\n%s", want, body)
+		}
+	}
+}
+
+func TestHandler_NotFound(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	Handler(nil).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/other", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("expected only %s to be served, got %d", Path, recorder.Code)
+	}
+}
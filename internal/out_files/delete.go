@@ -0,0 +1,23 @@
+package out_files
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	. "github.com/chrispritchard/gorrent/internal/torrent_files"
+)
+
+// DeleteFiles removes a torrent's files from base_dir, as CreateOutFileManager would have laid them out, along with
+// any directories left empty. base_dir itself is kept. Files already gone are not an error
+func DeleteFiles(metadata TorrentMetadata, base_dir string) error {
+	paths, err := torrent_paths(metadata)
+	errs := []error{err}
+	for _, p := range paths {
+		if err := os.Remove(filepath.Join(base_dir, p)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+	remove_empty_dirs(base_dir, paths)
+	return errors.Join(errs...)
+}
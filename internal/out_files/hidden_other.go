@@ -0,0 +1,8 @@
+//go:build !windows
+
+package out_files
+
+// set_hidden does nothing outside of windows, where hidden files are those named with a leading dot
+func set_hidden(path string) error {
+	return nil
+}
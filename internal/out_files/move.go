@@ -0,0 +1,223 @@
+package out_files
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+
+	. "github.com/chrispritchard/gorrent/internal/torrent_files"
+)
+
+// Move moves the files into to, and reopens them there. Reads and writes wait until it is done. If any file cannot be
+// moved, those already moved are put back and the files are reopened where they were
+func (ofm *OutFileManager) Move(to string) error {
+	ofm.mutex.Lock()
+	defer ofm.mutex.Unlock()
+	if same_dir(ofm.base_dir, to) {
+		return nil
+	}
+	if ofm.closed {
+		return fmt.Errorf("the files are closed")
+	}
+	open := []int{}
+	for i, f := range ofm.files {
+		if f != nil {
+			open = append(open, i)
+		}
+	}
+	ofm.close()
+
+	err := move_paths(slices.DeleteFunc(slices.Clone(ofm.paths), func(p string) bool { return p == "" }), ofm.base_dir, to)
+	if err == nil {
+		for i := range ofm.attributes {
+			a := &ofm.attributes[i]
+			a.full_path = rebase(a.full_path, ofm.base_dir, to)
+			if a.symlink_target != "" {
+				a.symlink_target = rebase(a.symlink_target, ofm.base_dir, to)
+			}
+		}
+		ofm.base_dir = to
+	}
+
+	for _, i := range open {
+		f, open_err := os.OpenFile(filepath.Join(ofm.base_dir, ofm.paths[i]), os.O_RDWR, 0644)
+		if open_err != nil {
+			ofm.close()
+			return errors.Join(err, fmt.Errorf("unable to reopen %s: %v", ofm.paths[i], open_err))
+		}
+		ofm.files[i] = f
+	}
+	ofm.closed = false
+	return err
+}
+
+// MoveFiles moves a torrent's files from one base directory to another, as CreateOutFileManager would have laid them
+// out, for a torrent that is not running. Files not yet created are skipped
+func MoveFiles(metadata TorrentMetadata, from, to string) error {
+	if same_dir(from, to) {
+		return nil
+	}
+	paths, err := torrent_paths(metadata)
+	if err != nil {
+		return err
+	}
+	return move_paths(paths, from, to)
+}
+
+// FilesExist reports whether any of a torrent's files are in base_dir
+func FilesExist(metadata TorrentMetadata, base_dir string) bool {
+	paths, _ := torrent_paths(metadata)
+	for _, p := range paths {
+		if _, err := os.Lstat(filepath.Join(base_dir, p)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// torrent_paths lists the paths of a torrent's files relative to its base directory, bar padding. Files with invalid
+// paths are left out, and reported together
+func torrent_paths(metadata TorrentMetadata) ([]string, error) {
+	used_paths := map[string]struct{}{}
+	paths := []string{}
+	errs := []error{}
+	for _, span := range metadata.FileSpans() {
+		if span.File.IsPadding() {
+			continue
+		}
+		path, err := SanitisePath(span.File.Path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		paths = append(paths, filepath.Join(dedupe_path(path, used_paths)...))
+	}
+	return paths, errors.Join(errs...)
+}
+
+// move_paths moves each path from one base directory to the other, leaving no directory it emptied behind. On
+// failure, those already moved are moved back
+func move_paths(paths []string, from, to string) error {
+	moved := []string{}
+	for _, p := range paths {
+		source, target := filepath.Join(from, p), filepath.Join(to, p)
+		if _, err := os.Lstat(source); errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		err := within_dir(to, target)
+		if err == nil {
+			err = move_file(source, target)
+		}
+		if err != nil {
+			for _, m := range moved {
+				move_file(filepath.Join(to, m), filepath.Join(from, m))
+			}
+			remove_empty_dirs(to, moved)
+			return fmt.Errorf("unable to move %s to %s: %v", p, to, err)
+		}
+		moved = append(moved, p)
+	}
+	remove_empty_dirs(from, moved)
+	return nil
+}
+
+// move_file renames a file, or where that fails, as it does across filesystems, copies it and removes the original
+func move_file(source, target string) error {
+	if _, err := os.Lstat(target); err == nil {
+		return fmt.Errorf("%s already exists", target)
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(source, target); err == nil {
+		return nil
+	}
+	if err := copy_file(source, target); err != nil {
+		os.Remove(target)
+		return err
+	}
+	return os.Remove(source)
+}
+
+// copy_file copies a file or symlink, keeping its permissions, and reads the copy back to check it matches
+func copy_file(source, target string) error {
+	info, err := os.Lstat(source)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		link, err := os.Readlink(source)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(link, target)
+	}
+
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(target, os.O_RDWR|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	expected := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(out, expected), in); err != nil {
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		return err
+	}
+	if _, err := out.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	actual := sha256.New()
+	if _, err := io.Copy(actual, out); err != nil {
+		return err
+	}
+	if !bytes.Equal(expected.Sum(nil), actual.Sum(nil)) {
+		return fmt.Errorf("the copy of %s does not match the original", source)
+	}
+	return nil
+}
+
+// remove_empty_dirs removes the directories that held the given paths, deepest first so parents are empty by the time
+// they are reached. base_dir itself, and directories holding anything else, are kept
+func remove_empty_dirs(base_dir string, paths []string) {
+	dirs := map[string]struct{}{}
+	for _, p := range paths {
+		for dir := filepath.Dir(filepath.Join(base_dir, p)); len(dir) > len(filepath.Clean(base_dir)); dir = filepath.Dir(dir) {
+			dirs[dir] = struct{}{}
+		}
+	}
+	sorted := []string{}
+	for dir := range dirs {
+		sorted = append(sorted, dir)
+	}
+	slices.SortFunc(sorted, func(a, b string) int { return len(b) - len(a) })
+	for _, dir := range sorted {
+		os.Remove(dir)
+	}
+}
+
+func rebase(path, from, to string) string {
+	rel, err := filepath.Rel(from, path)
+	if err != nil {
+		return path
+	}
+	return filepath.Join(to, rel)
+}
+
+func same_dir(a, b string) bool {
+	a, err_a := filepath.Abs(a)
+	b, err_b := filepath.Abs(b)
+	return err_a == nil && err_b == nil && a == b
+}
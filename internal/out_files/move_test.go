@@ -0,0 +1,99 @@
+package out_files
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestMove(t *testing.T) {
+	from, to := t.TempDir(), filepath.Join(t.TempDir(), "completed")
+	ofm, err := CreateOutFileManager(attributesMetadata(), from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ofm.Close()
+	piece := bytes.Repeat([]byte{7}, 100)
+	if err := ofm.WritePiece(1, piece); err != nil { // data/file.bin, after run.sh and the padding
+		t.Fatal(err)
+	}
+	if runtime.GOOS != "windows" {
+		if err := ofm.ApplyFileAttributes(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := ofm.Move(to); err != nil {
+		t.Fatal(err)
+	}
+	entries, _ := os.ReadDir(from)
+	if len(entries) != 0 {
+		t.Errorf("expected nothing left where the files were, got %d entries", len(entries))
+	}
+	block, err := ofm.ReadBlock(1, 0, 100)
+	if err != nil || !bytes.Equal(block, piece) {
+		t.Errorf("expected the moved file to be read back, got %v", err)
+	}
+	if err := ofm.WritePiece(1, bytes.Repeat([]byte{8}, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(to, "data", "file.bin")); data[0] != 8 {
+		t.Errorf("expected writes to reach the moved file")
+	}
+	if runtime.GOOS != "windows" {
+		if target, err := os.Readlink(filepath.Join(to, "link")); err != nil || target != filepath.Join("data", "file.bin") {
+			t.Errorf("expected the symlink to move with its relative target, got %q, %v", target, err)
+		}
+	}
+}
+
+func TestMoveFiles_PutsBackOnFailure(t *testing.T) {
+	from, to := t.TempDir(), t.TempDir()
+	ofm, err := CreateOutFileManager(attributesMetadata(), from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ofm.Close()
+	if err := os.MkdirAll(filepath.Join(to, "data"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(to, "data", "file.bin"), []byte("in the way"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := MoveFiles(attributesMetadata(), from, to); err == nil {
+		t.Fatal("expected a file in the way to stop the move")
+	}
+	for _, path := range []string{"run.sh", filepath.Join("data", "file.bin")} {
+		if _, err := os.Stat(filepath.Join(from, path)); err != nil {
+			t.Errorf("expected %s to be where it was, got %v", path, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(to, "run.sh")); !os.IsNotExist(err) {
+		t.Errorf("expected run.sh to be moved back, got %v", err)
+	}
+}
+
+func TestCopyFile(t *testing.T) {
+	dir := t.TempDir()
+	source, target := filepath.Join(dir, "source"), filepath.Join(dir, "target")
+	data := bytes.Repeat([]byte("gorrent"), 10_000)
+	if err := os.WriteFile(source, data, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := copy_file(source, target); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(target)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("expected an exact copy, got %d bytes, %v", len(got), err)
+	}
+	if info, _ := os.Stat(target); runtime.GOOS != "windows" && info.Mode().Perm() != 0755 {
+		t.Errorf("expected the permissions to be kept, got %v", info.Mode().Perm())
+	}
+	if err := copy_file(source, target); err == nil {
+		t.Error("expected copying over an existing file to fail")
+	}
+}
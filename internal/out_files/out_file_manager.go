@@ -2,64 +2,202 @@ package out_files
 
 import (
 	"crypto/sha1"
-	"io"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"sync"
 
 	"github.com/chrispritchard/gorrent/internal/bitfields"
 	. "github.com/chrispritchard/gorrent/internal/torrent_files"
 )
 
+// OutFileManager reads and writes a torrent's pieces across its files. Reads and writes may be made concurrently,
+// with Move and Close waiting for them
 type OutFileManager struct {
-	files                      []*os.File
+	mutex                      sync.RWMutex
+	files                      []*os.File // nil for virtual files (padding and symlinks), which are never written
+	paths                      []string   // relative to base_dir, empty for padding
 	indices                    []file_indices
 	hashes                     []string
+	hashes_v2                  []PieceHashV2
 	piece_length, total_length int
 	bitfield                   *bitfields.BitField
+	base_dir                   string
+	attributes                 []file_attributes
+	closed                     bool
 }
 
 type file_indices struct {
 	start_offset, end_offset, file_length int
 }
 
-func CreateOutFileManager(metadata TorrentMetadata, base_dir string) (*OutFileManager, error) {
-	var files []TorrentFile
-	if len(metadata.Files) > 0 {
-		files = metadata.Files
-	} else {
-		files = []TorrentFile{{
-			Path:   []string{metadata.Name},
-			Length: metadata.Length,
-		}}
-	}
+// file_attributes holds what is applied to a file once the download completes (BEP 47)
+type file_attributes struct {
+	full_path          string
+	executable, hidden bool
+	symlink_target     string // full path the link should point to, empty if not a symlink
+}
 
+func CreateOutFileManager(metadata TorrentMetadata, base_dir string) (*OutFileManager, error) {
 	out_files := []*os.File{}
+	paths := []string{}
 	indices := []file_indices{}
+	attributes := []file_attributes{}
+	used_paths := map[string]struct{}{}
 	total_length := 0
 
-	offset := 0
-	for _, fm := range files {
-		f, err := create_file(base_dir, fm.Path, int64(fm.Length))
+	for _, span := range metadata.FileSpans() {
+		length := span.End - span.Start
+		indices = append(indices, file_indices{span.Start, span.End, length})
+		total_length = span.End
+
+		if span.File.IsPadding() {
+			out_files = append(out_files, nil)
+			paths = append(paths, "")
+			continue
+		}
+
+		path, err := SanitisePath(span.File.Path)
+		if err != nil {
+			close_all(out_files)
+			return nil, fmt.Errorf("invalid torrent file path: %v", err)
+		}
+		path = dedupe_path(path, used_paths)
+		full_path := filepath.Join(append([]string{base_dir}, path...)...)
+		paths = append(paths, filepath.Join(path...))
+
+		attr := file_attributes{
+			full_path:  full_path,
+			executable: span.File.IsExecutable(),
+			hidden:     span.File.IsHidden(),
+		}
+
+		if span.File.IsSymlink() {
+			target, err := SanitisePath(span.File.SymlinkPath)
+			if err != nil {
+				close_all(out_files)
+				return nil, fmt.Errorf("invalid symlink target for %s: %v", full_path, err)
+			}
+			attr.symlink_target = filepath.Join(append([]string{base_dir}, target...)...)
+			if err := within_dir(base_dir, attr.symlink_target); err != nil {
+				close_all(out_files)
+				return nil, err
+			}
+			out_files = append(out_files, nil)
+			attributes = append(attributes, attr)
+			continue
+		}
+
+		f, err := create_file(base_dir, path, int64(length))
 		if err != nil {
+			close_all(out_files)
 			return nil, err
 		}
 		out_files = append(out_files, f)
+		if attr.executable || attr.hidden {
+			attributes = append(attributes, attr)
+		}
+	}
+
+	return &OutFileManager{
+		files:        out_files,
+		paths:        paths,
+		indices:      indices,
+		hashes:       metadata.Pieces,
+		hashes_v2:    metadata.PiecesV2,
+		piece_length: metadata.PieceLength,
+		total_length: total_length,
+		base_dir:     base_dir,
+		attributes:   attributes,
+	}, nil
+}
 
-		indices = append(indices, file_indices{offset, offset + fm.Length, fm.Length})
-		offset += fm.Length
-		total_length += fm.Length
+// ApplyFileAttributes should be called once all pieces are written: it marks executables, hides hidden files where
+// the platform has such a flag, and creates symlinks. Link targets were confined to the download directory on creation
+func (ofm *OutFileManager) ApplyFileAttributes() error {
+	ofm.mutex.RLock()
+	defer ofm.mutex.RUnlock()
+	errs := []error{}
+	for _, a := range ofm.attributes {
+		if a.symlink_target != "" {
+			errs = append(errs, create_symlink(a.full_path, a.symlink_target))
+			continue
+		}
+		if a.executable {
+			errs = append(errs, make_executable(a.full_path))
+		}
+		if a.hidden {
+			errs = append(errs, set_hidden(a.full_path))
+		}
 	}
+	return errors.Join(errs...)
+}
 
-	return &OutFileManager{out_files, indices, metadata.Pieces, metadata.PieceLength, total_length, nil}, nil
+func make_executable(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	mode := info.Mode().Perm()
+	return os.Chmod(path, mode|(mode&0444)>>2) // execute wherever there is read
 }
 
+func create_symlink(link_path, target_path string) error {
+	if err := os.MkdirAll(filepath.Dir(link_path), 0755); err != nil {
+		return err
+	}
+
+	relative, err := filepath.Rel(filepath.Dir(link_path), target_path)
+	if err != nil {
+		return err
+	}
+
+	if info, err := os.Lstat(link_path); err == nil {
+		if info.Mode()&os.ModeSymlink == 0 {
+			return fmt.Errorf("refusing to replace %s with a symlink, as it is not a link", link_path)
+		}
+		if existing, err := os.Readlink(link_path); err == nil && existing == relative {
+			return nil
+		}
+		if err := os.Remove(link_path); err != nil {
+			return err
+		}
+	}
+
+	return os.Symlink(relative, link_path)
+}
+
+// Close flushes every file to disk and closes it, so no verified piece is lost to a crash afterwards. Closing again does
+// nothing
 func (ofm *OutFileManager) Close() {
-	for _, f := range ofm.files {
-		f.Close()
+	ofm.mutex.Lock()
+	defer ofm.mutex.Unlock()
+	ofm.close()
+}
+
+func (ofm *OutFileManager) close() {
+	for i, f := range ofm.files {
+		if f != nil {
+			f.Sync()
+			f.Close()
+			ofm.files[i] = nil
+		}
+	}
+	ofm.closed = true
+}
+
+func close_all(files []*os.File) {
+	for _, f := range files {
+		if f != nil {
+			f.Close()
+		}
 	}
 }
 
 func (ofm *OutFileManager) WritePiece(piece int, data []byte) error {
+	ofm.mutex.RLock()
+	defer ofm.mutex.RUnlock()
 	ofm.bitfield = nil
 
 	data_start := piece * ofm.piece_length
@@ -76,18 +214,14 @@ func (ofm *OutFileManager) WritePiece(piece int, data []byte) error {
 		overlap_end := min(data_end, fi.end_offset)
 		overlap_len := overlap_end - overlap_start
 
-		if overlap_len <= 0 {
+		if overlap_len <= 0 || file == nil {
 			continue
 		}
 
 		read_start := overlap_start - data_start
 		write_start := overlap_start - fi.start_offset
 
-		_, err := file.Seek(int64(write_start), io.SeekStart)
-		if err != nil {
-			return err
-		}
-		_, err = file.Write(data[read_start : read_start+overlap_len])
+		_, err := file.WriteAt(data[read_start:read_start+overlap_len], int64(write_start))
 		if err != nil {
 			return err
 		}
@@ -96,14 +230,32 @@ func (ofm *OutFileManager) WritePiece(piece int, data []byte) error {
 	return nil
 }
 
+// ReadBlock reads part of a piece back from disk, for serving to peers
+func (ofm *OutFileManager) ReadBlock(index, begin, length int) ([]byte, error) {
+	start := index*ofm.piece_length + begin
+	if index < 0 || begin < 0 || length <= 0 || begin+length > ofm.piece_length || start+length > ofm.total_length {
+		return nil, fmt.Errorf("block at piece %d offset %d length %d is out of range", index, begin, length)
+	}
+	ofm.mutex.RLock()
+	defer ofm.mutex.RUnlock()
+	return ofm.get_data_range(start, start+length)
+}
+
 func (ofm *OutFileManager) Bitfield() (*bitfields.BitField, error) {
+	ofm.mutex.RLock()
+	defer ofm.mutex.RUnlock()
 	if ofm.bitfield != nil {
 		return ofm.bitfield, nil
 	}
+	return ofm.check(nil), nil
+}
 
-	bitfield := bitfields.CreateBlankBitfield(len(ofm.hashes))
+// check verifies every piece on disk, bar those that known says whether we have. known may be nil
+func (ofm *OutFileManager) check(known func(index, start, end int) (have, ok bool)) *bitfields.BitField {
+	piece_count := max(len(ofm.hashes), len(ofm.hashes_v2))
+	bitfield := bitfields.CreateBlankBitfield(piece_count)
 
-	for i, h := range ofm.hashes {
+	for i := range piece_count {
 
 		piece_start := i * ofm.piece_length
 		piece_end := min(piece_start+ofm.piece_length, ofm.total_length)
@@ -112,19 +264,40 @@ func (ofm *OutFileManager) Bitfield() (*bitfields.BitField, error) {
 			continue
 		}
 
+		if known != nil {
+			if have, ok := known(i, piece_start, piece_end); ok {
+				if have {
+					bitfield.Set(uint(i))
+				}
+				continue
+			}
+		}
+
 		piece_data, err := ofm.get_data_range(piece_start, piece_end)
 		if err != nil {
 			continue
 		}
 
-		hash := sha1.Sum(piece_data)
-		if string(hash[:]) == h {
+		if ofm.verify_piece(i, piece_data) {
 			bitfield.Set(uint(i))
 		}
 	}
 
 	ofm.bitfield = &bitfield
-	return ofm.bitfield, nil
+	return ofm.bitfield
+}
+
+func (ofm *OutFileManager) verify_piece(index int, data []byte) bool {
+	if index < len(ofm.hashes) {
+		hash := sha1.Sum(data)
+		if string(hash[:]) != ofm.hashes[index] {
+			return false
+		}
+	}
+	if index < len(ofm.hashes_v2) && !ofm.hashes_v2[index].Verify(data) {
+		return false
+	}
+	return true
 }
 
 func (ofm *OutFileManager) get_data_range(data_start, data_end int) ([]byte, error) {
@@ -141,23 +314,18 @@ func (ofm *OutFileManager) get_data_range(data_start, data_end int) ([]byte, err
 		overlap_end := min(data_end, fi.end_offset)
 		overlap_len := overlap_end - overlap_start
 
-		if overlap_len <= 0 {
-			continue
+		if overlap_len <= 0 || file == nil {
+			continue // virtual files read as zeroes
 		}
 
 		read_start := overlap_start - data_start
 		write_start := overlap_start - fi.start_offset
 
-		_, err := file.Seek(int64(write_start), io.SeekStart)
-		if err != nil {
-			return nil, err
-		}
-		segment := make([]byte, overlap_len)
-		_, err = io.ReadFull(file, segment)
+		// positioned reads and writes, rather than seeking, so blocks can be served to peers while pieces are written
+		_, err := file.ReadAt(data[read_start:read_start+overlap_len], int64(write_start))
 		if err != nil {
 			return nil, err
 		}
-		copy(data[read_start:read_start+overlap_len], segment)
 	}
 
 	return data, nil
@@ -166,6 +334,9 @@ func (ofm *OutFileManager) get_data_range(data_start, data_end int) ([]byte, err
 func create_file(base_dir string, path []string, length int64) (*os.File, error) {
 	path = append([]string{base_dir}, path...)
 	full_path := filepath.Join(path...)
+	if err := within_dir(base_dir, full_path); err != nil {
+		return nil, err
+	}
 	dir := filepath.Dir(full_path)
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		return nil, err
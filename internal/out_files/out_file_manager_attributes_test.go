@@ -0,0 +1,132 @@
+package out_files
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	. "github.com/chrispritchard/gorrent/internal/torrent_files"
+)
+
+func attributesMetadata() TorrentMetadata {
+	return TorrentMetadata{
+		Name:        "attrs",
+		PieceLength: 16384,
+		Length:      16384 + 100,
+		Files: []TorrentFile{
+			{Path: []string{"run.sh"}, Length: 100, Attr: "x"},
+			{Path: []string{".pad", "16284"}, Length: 16284, Attr: "p"},
+			{Path: []string{"data", "file.bin"}, Length: 100},
+			{Path: []string{"link"}, Length: 0, Attr: "l", SymlinkPath: []string{"data", "file.bin"}},
+		},
+	}
+}
+
+func TestCreateOutFileManager_PaddingIsVirtual(t *testing.T) {
+	base := t.TempDir()
+	ofm, err := CreateOutFileManager(attributesMetadata(), base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ofm.Close()
+
+	if _, err := os.Stat(filepath.Join(base, ".pad")); !os.IsNotExist(err) {
+		t.Errorf("padding files should not be created on disk")
+	}
+	if _, err := os.Lstat(filepath.Join(base, "link")); !os.IsNotExist(err) {
+		t.Errorf("symlinks should not be created until completion")
+	}
+
+	// a piece covering run.sh and the padding: only the first 100 bytes land anywhere
+	piece := make([]byte, 16384)
+	for i := range 100 {
+		piece[i] = byte(i + 1)
+	}
+	piece[200] = 0xff // inside the padding, so it must be dropped
+	if err := ofm.WritePiece(0, piece); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ofm.get_data_range(0, 16384)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data[99] != 100 || data[200] != 0 {
+		t.Errorf("padding should read back as zeroes, got %d at offset 200", data[200])
+	}
+}
+
+func TestApplyFileAttributes(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("executable bits and symlinks need a unix filesystem")
+	}
+	base := t.TempDir()
+	ofm, err := CreateOutFileManager(attributesMetadata(), base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ofm.Close()
+
+	if err := ofm.ApplyFileAttributes(); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(filepath.Join(base, "run.sh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm()&0100 == 0 {
+		t.Errorf("expected run.sh to be executable, mode %v", info.Mode())
+	}
+
+	target, err := os.Readlink(filepath.Join(base, "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != filepath.Join("data", "file.bin") {
+		t.Errorf("expected a relative link to data/file.bin, got %s", target)
+	}
+
+	// applying twice is harmless
+	if err := ofm.ApplyFileAttributes(); err != nil {
+		t.Errorf("reapplying attributes failed: %v", err)
+	}
+}
+
+func TestCreateOutFileManager_RejectsEscapingSymlink(t *testing.T) {
+	metadata := TorrentMetadata{
+		Name:        "evil",
+		PieceLength: 16384,
+		Length:      0,
+		Files: []TorrentFile{
+			{Path: []string{"link"}, Attr: "l", SymlinkPath: []string{"..", "..", "etc", "passwd"}},
+		},
+	}
+	if _, err := CreateOutFileManager(metadata, t.TempDir()); err == nil {
+		t.Errorf("expected a symlink pointing outside the download directory to be rejected")
+	}
+}
+
+func TestApplyFileAttributes_WontReplaceRealFile(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks need a unix filesystem")
+	}
+	base := t.TempDir()
+	if err := os.WriteFile(filepath.Join(base, "link"), []byte("precious"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ofm, err := CreateOutFileManager(attributesMetadata(), base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ofm.Close()
+
+	if err := ofm.ApplyFileAttributes(); err == nil {
+		t.Errorf("expected an error rather than replacing a regular file with a link")
+	}
+	content, _ := os.ReadFile(filepath.Join(base, "link"))
+	if string(content) != "precious" {
+		t.Errorf("existing file was modified")
+	}
+}
@@ -0,0 +1,62 @@
+package out_files
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/chrispritchard/gorrent/internal/bitfields"
+)
+
+func TestResume(t *testing.T) {
+	tests := []struct {
+		name    string
+		saved   string // the bitfield saved, as a bit string
+		touch   bool   // whether the second file is changed since
+		partial bool   // whether the states saved are of fewer files
+		want    string
+	}{
+		{name: "unchanged files are trusted", saved: "1111", want: "1111"},
+		{name: "including pieces they lacked", saved: "1110", want: "1110"},
+		{name: "pieces in changed files are verified", saved: "1111", touch: true, want: "1011"},
+		{name: "states of other files are ignored", saved: "1110", partial: true, want: "1011"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ofm, cleanup := setupBitfieldTest(t, []int{50, 50}, 32, 100)
+			defer cleanup()
+			ofm.base_dir = filepath.Dir(ofm.files[0].Name())
+			for _, f := range ofm.files {
+				ofm.paths = append(ofm.paths, filepath.Base(f.Name()))
+			}
+			states := ofm.FileStates()
+
+			// corrupt piece 1, which spans both files, without the first file appearing to change
+			if _, err := ofm.files[0].WriteAt([]byte{0xff}, 40); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(states[0].Path, time.Time{}, states[0].ModTime); err != nil {
+				t.Fatal(err)
+			}
+			if tt.touch {
+				if err := os.Chtimes(states[1].Path, time.Time{}, states[1].ModTime.Add(time.Second)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.partial {
+				states = states[:1]
+			}
+
+			saved := bitfields.CreateBlankBitfield(len(tt.saved))
+			for i, c := range tt.saved {
+				if c == '1' {
+					saved.Set(uint(i))
+				}
+			}
+			if got := ofm.Resume(saved, states); got.BitString() != tt.want {
+				t.Errorf("expected %s, got %s", tt.want, got.BitString())
+			}
+		})
+	}
+}
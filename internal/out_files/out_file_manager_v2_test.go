@@ -0,0 +1,77 @@
+package out_files
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/chrispritchard/gorrent/internal/merkle"
+	. "github.com/chrispritchard/gorrent/internal/torrent_files"
+)
+
+func v2PieceHash(data []byte, leaf_count int) PieceHashV2 {
+	return PieceHashV2{
+		Root:       merkle.Root(merkle.HashBlocks(data), leaf_count, merkle.Hash{}),
+		DataLength: len(data),
+		LeafCount:  leaf_count,
+	}
+}
+
+func TestCreateOutFileManager_V2AlignsFilesToPieces(t *testing.T) {
+	base := t.TempDir()
+	first := make([]byte, 100)
+	second := make([]byte, 20000)
+	for i := range second {
+		second[i] = byte(i % 251)
+	}
+
+	metadata := TorrentMetadata{
+		Name:        "v2",
+		PieceLength: 16384,
+		Length:      20100,
+		MetaVersion: 2,
+		Files: []TorrentFile{
+			{Path: []string{"first.bin"}, Length: 100},
+			{Path: []string{"second.bin"}, Length: 20000},
+		},
+		PiecesV2: []PieceHashV2{
+			v2PieceHash(first, 1),
+			v2PieceHash(second[:16384], 1),
+			v2PieceHash(second[16384:], 1),
+		},
+	}
+
+	ofm, err := CreateOutFileManager(metadata, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ofm.Close()
+
+	if ofm.indices[1].start_offset != 16384 {
+		t.Fatalf("second file should start on a piece boundary, got offset %d", ofm.indices[1].start_offset)
+	}
+
+	if err := ofm.WritePiece(1, second[:16384]); err != nil {
+		t.Fatal(err)
+	}
+	if err := ofm.WritePiece(2, second[16384:]); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(filepath.Join(base, "second.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != string(second) {
+		t.Errorf("second file content mismatch")
+	}
+
+	bitfield, err := ofm.Bitfield()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first file is all zeroes on disk, which happens to be its content
+	if bitfield.BitString() != "111" {
+		t.Errorf("expected all pieces verified, got %s", bitfield.BitString())
+	}
+}
@@ -0,0 +1,148 @@
+package out_files
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// Torrent paths come straight from untrusted metadata, so every component is checked before it touches the disk.
+// Traversal (.., absolute paths, drive letters) is rejected outright, while merely awkward names are rewritten.
+
+const max_component_length = 255 // bytes, the common limit across ext4, ntfs, apfs etc
+
+const illegal_chars = `<>:"/\|?*`
+
+var reserved_names = map[string]struct{}{
+	"CON": {}, "PRN": {}, "AUX": {}, "NUL": {},
+	"COM1": {}, "COM2": {}, "COM3": {}, "COM4": {}, "COM5": {}, "COM6": {}, "COM7": {}, "COM8": {}, "COM9": {},
+	"LPT1": {}, "LPT2": {}, "LPT3": {}, "LPT4": {}, "LPT5": {}, "LPT6": {}, "LPT7": {}, "LPT8": {}, "LPT9": {},
+}
+
+// SanitisePath validates a torrent file path and returns a copy that is safe to join onto a download directory
+func SanitisePath(path []string) ([]string, error) {
+	if len(path) == 0 {
+		return nil, fmt.Errorf("empty file path")
+	}
+
+	result := []string{}
+	for _, component := range path {
+		if component == ".." {
+			return nil, fmt.Errorf("path %q contains a parent directory reference", strings.Join(path, "/"))
+		}
+		if is_absolute(component) {
+			return nil, fmt.Errorf("path %q contains an absolute component", strings.Join(path, "/"))
+		}
+		if component == "" || component == "." {
+			continue
+		}
+		result = append(result, sanitise_component(component))
+	}
+
+	if len(result) == 0 {
+		return nil, fmt.Errorf("path %q has no usable components", strings.Join(path, "/"))
+	}
+	return result, nil
+}
+
+func is_absolute(component string) bool {
+	if strings.HasPrefix(component, "/") || strings.HasPrefix(component, `\`) {
+		return true
+	}
+	// windows drive letters, e.g. C: or C:\
+	return len(component) >= 2 && component[1] == ':' &&
+		((component[0] >= 'a' && component[0] <= 'z') || (component[0] >= 'A' && component[0] <= 'Z'))
+}
+
+func sanitise_component(component string) string {
+	var s strings.Builder
+	for _, r := range component {
+		if r < 0x20 || r == 0x7f || r == utf8.RuneError || strings.ContainsRune(illegal_chars, r) {
+			s.WriteRune('_')
+		} else {
+			s.WriteRune(r)
+		}
+	}
+	result := s.String()
+
+	// windows silently strips trailing dots and spaces, which could make two distinct names collide
+	result = strings.TrimRight(result, ". ")
+	if result == "" {
+		result = "_"
+	}
+
+	base := strings.ToUpper(strings.SplitN(result, ".", 2)[0])
+	if _, reserved := reserved_names[base]; reserved {
+		result = "_" + result
+	}
+
+	return truncate_component(result, max_component_length)
+}
+
+// truncate_component shortens a name to the byte limit, keeping the extension where there is room for it
+func truncate_component(component string, limit int) string {
+	if len(component) <= limit {
+		return component
+	}
+	ext := filepath.Ext(component)
+	if len(ext) >= limit/2 {
+		ext = ""
+	}
+	stem := component[:len(component)-len(ext)]
+	return truncate_utf8(stem, limit-len(ext)) + ext
+}
+
+func truncate_utf8(s string, limit int) string {
+	if len(s) <= limit {
+		return s
+	}
+	for limit > 0 && !utf8.RuneStart(s[limit]) {
+		limit--
+	}
+	return s[:limit]
+}
+
+// dedupe_path appends a counter to the final component if the path (compared case-insensitively, for the sake of
+// windows and macos) has already been used by an earlier file in the torrent
+func dedupe_path(path []string, used map[string]struct{}) []string {
+	key := func(p []string) string {
+		return strings.ToLower(strings.Join(p, "/"))
+	}
+	if _, exists := used[key(path)]; !exists {
+		used[key(path)] = struct{}{}
+		return path
+	}
+
+	last := path[len(path)-1]
+	ext := filepath.Ext(last)
+	stem := last[:len(last)-len(ext)]
+	for i := 1; ; i++ {
+		suffix := fmt.Sprintf(" (%d)", i)
+		candidate := append(append([]string{}, path[:len(path)-1]...), truncate_utf8(stem, max_component_length-len(suffix)-len(ext))+suffix+ext)
+		if _, exists := used[key(candidate)]; !exists {
+			used[key(candidate)] = struct{}{}
+			return candidate
+		}
+	}
+}
+
+// within_dir confirms the joined path cannot escape the base directory, as a final guard after sanitisation
+func within_dir(base_dir, full_path string) error {
+	base, err := filepath.Abs(base_dir)
+	if err != nil {
+		return err
+	}
+	full, err := filepath.Abs(full_path)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(base, full)
+	if err != nil {
+		return err
+	}
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) || filepath.IsAbs(rel) {
+		return fmt.Errorf("path %s is outside of the download directory %s", full_path, base_dir)
+	}
+	return nil
+}
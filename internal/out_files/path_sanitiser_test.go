@@ -0,0 +1,186 @@
+package out_files
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	. "github.com/chrispritchard/gorrent/internal/torrent_files"
+)
+
+func TestSanitisePath(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    []string
+		want     []string
+		want_err bool
+	}{
+		{
+			name:  "simple path unchanged",
+			input: []string{"dir", "file.txt"},
+			want:  []string{"dir", "file.txt"},
+		},
+		{
+			name:     "parent directory rejected",
+			input:    []string{"dir", "..", "..", "etc", "passwd"},
+			want_err: true,
+		},
+		{
+			name:     "absolute unix path rejected",
+			input:    []string{"/etc", "passwd"},
+			want_err: true,
+		},
+		{
+			name:     "windows drive letter rejected",
+			input:    []string{`C:\Windows`, "system.ini"},
+			want_err: true,
+		},
+		{
+			name:     "empty path rejected",
+			input:    []string{},
+			want_err: true,
+		},
+		{
+			name:     "only dot components rejected",
+			input:    []string{".", ""},
+			want_err: true,
+		},
+		{
+			name:  "dot and empty components dropped",
+			input: []string{".", "dir", "", "file.txt"},
+			want:  []string{"dir", "file.txt"},
+		},
+		{
+			name:  "embedded separators replaced",
+			input: []string{"a/../b", `c\d`},
+			want:  []string{"a_.._b", "c_d"},
+		},
+		{
+			name:  "illegal characters replaced",
+			input: []string{`what?<is>:this*"|`},
+			want:  []string{"what__is__this___"},
+		},
+		{
+			name:  "control characters replaced",
+			input: []string{"bad\x00name\x1f.txt"},
+			want:  []string{"bad_name_.txt"},
+		},
+		{
+			name:  "reserved names prefixed",
+			input: []string{"con", "LPT1.txt"},
+			want:  []string{"_con", "_LPT1.txt"},
+		},
+		{
+			name:  "trailing dots and spaces trimmed",
+			input: []string{"dir. ", "file.txt.."},
+			want:  []string{"dir", "file.txt"},
+		},
+		{
+			name:  "name of only dots becomes placeholder",
+			input: []string{"..."},
+			want:  []string{"_"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := SanitisePath(tt.input)
+			if (err != nil) != tt.want_err {
+				t.Fatalf("SanitisePath() error = %v, want_err %v", err, tt.want_err)
+			}
+			if !tt.want_err && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("SanitisePath() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSanitisePath_TruncatesKeepingExtension(t *testing.T) {
+	long := strings.Repeat("a", 300) + ".mkv"
+	got, err := SanitisePath([]string{long})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got[0]) != max_component_length {
+		t.Errorf("expected length %d, got %d", max_component_length, len(got[0]))
+	}
+	if !strings.HasSuffix(got[0], ".mkv") {
+		t.Errorf("expected extension to be kept, got %q", got[0])
+	}
+}
+
+func TestSanitisePath_TruncatesOnRuneBoundary(t *testing.T) {
+	long := strings.Repeat("é", 200) // 400 bytes
+	got, err := SanitisePath([]string{long})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got[0]) > max_component_length {
+		t.Errorf("expected at most %d bytes, got %d", max_component_length, len(got[0]))
+	}
+	if !strings.HasPrefix(long, got[0]) {
+		t.Errorf("truncation split a multi-byte character")
+	}
+}
+
+func TestDedupePath(t *testing.T) {
+	used := map[string]struct{}{}
+	first := dedupe_path([]string{"dir", "file.txt"}, used)
+	second := dedupe_path([]string{"dir", "FILE.txt"}, used)
+	third := dedupe_path([]string{"dir", "file.txt"}, used)
+
+	if !reflect.DeepEqual(first, []string{"dir", "file.txt"}) {
+		t.Errorf("first path should be unchanged, got %q", first)
+	}
+	if !reflect.DeepEqual(second, []string{"dir", "FILE (1).txt"}) {
+		t.Errorf("case-insensitive duplicate should be renamed, got %q", second)
+	}
+	if !reflect.DeepEqual(third, []string{"dir", "file (2).txt"}) {
+		t.Errorf("second duplicate should get the next counter, got %q", third)
+	}
+}
+
+func TestCreateOutFileManager_RejectsTraversal(t *testing.T) {
+	base := t.TempDir()
+	metadata := TorrentMetadata{
+		Name:        "evil",
+		PieceLength: 16384,
+		Length:      10,
+		Files:       []TorrentFile{{Path: []string{"..", "escaped.txt"}, Length: 10}},
+	}
+
+	_, err := CreateOutFileManager(metadata, base)
+	if err == nil {
+		t.Fatal("expected an error for a path containing '..'")
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(base), "escaped.txt")); !os.IsNotExist(err) {
+		t.Errorf("file should not have been created outside the base directory")
+	}
+}
+
+func TestCreateOutFileManager_SanitisesAndDedupes(t *testing.T) {
+	base := t.TempDir()
+	metadata := TorrentMetadata{
+		Name:        "set",
+		PieceLength: 16384,
+		Length:      20,
+		Files: []TorrentFile{
+			{Path: []string{"a<b.txt"}, Length: 10},
+			{Path: []string{"a?b.txt"}, Length: 10},
+		},
+	}
+
+	ofm, err := CreateOutFileManager(metadata, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ofm.Close()
+
+	for _, name := range []string{"a_b.txt", "a_b (1).txt"} {
+		if _, err := os.Stat(filepath.Join(base, name)); err != nil {
+			t.Errorf("expected %s to exist: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package out_files
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/chrispritchard/gorrent/internal/bitfields"
+)
+
+// FileState is what a file on disk was like when last seen, to tell whether it has changed since
+type FileState struct {
+	Path    string    `json:"path"` // empty for padding
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+func (s FileState) same(other FileState) bool {
+	return s.Path == other.Path && s.Size == other.Size && s.ModTime.Equal(other.ModTime)
+}
+
+// FileStates describes each of the torrent's files as they are on disk, in the order of its file spans. It is meant
+// to be taken once the files are closed, so that nothing changes them afterwards
+func (ofm *OutFileManager) FileStates() []FileState {
+	ofm.mutex.RLock()
+	defer ofm.mutex.RUnlock()
+	return ofm.file_states()
+}
+
+func (ofm *OutFileManager) file_states() []FileState {
+	states := make([]FileState, len(ofm.paths))
+	for i, path := range ofm.paths {
+		if path == "" {
+			continue
+		}
+		states[i].Path = filepath.Join(ofm.base_dir, path)
+		if info, err := os.Lstat(states[i].Path); err == nil {
+			states[i].Size, states[i].ModTime = info.Size(), info.ModTime()
+		}
+	}
+	return states
+}
+
+// Resume is Bitfield given what was had when the files were last described by saved_states: pieces wholly within
+// files that are unchanged since are taken from saved, and only the rest are read and verified
+func (ofm *OutFileManager) Resume(saved bitfields.BitField, saved_states []FileState) *bitfields.BitField {
+	ofm.mutex.RLock()
+	defer ofm.mutex.RUnlock()
+
+	current := ofm.file_states()
+	if len(saved_states) != len(current) || saved.Length != max(len(ofm.hashes), len(ofm.hashes_v2)) {
+		return ofm.check(nil)
+	}
+	changed := make([]bool, len(current))
+	for i := range current {
+		changed[i] = !current[i].same(saved_states[i])
+	}
+
+	first := 0 // the first file that may overlap the piece, as pieces are checked in order
+	return ofm.check(func(index, start, end int) (bool, bool) {
+		for first < len(ofm.indices) && ofm.indices[first].end_offset <= start {
+			first++
+		}
+		for i := first; i < len(ofm.indices) && ofm.indices[i].start_offset < end; i++ {
+			if changed[i] {
+				return false, false
+			}
+		}
+		return saved.Get(index), true
+	})
+}
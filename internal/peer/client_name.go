@@ -0,0 +1,49 @@
+package peer
+
+import (
+	"fmt"
+	"strings"
+)
+
+// clients maps the two letter codes of Azureus style peer ids, e.g. -qB4250-, to the client's name
+var clients = map[string]string{
+	"AZ": "Vuze",
+	"BC": "BitComet",
+	"BT": "BitTorrent",
+	"DE": "Deluge",
+	"GR": "gorrent",
+	"lt": "libtorrent",
+	"LT": "libtorrent",
+	"qB": "qBittorrent",
+	"TR": "Transmission",
+	"UT": "µTorrent",
+	"UM": "µTorrent Mac",
+	"WW": "WebTorrent",
+}
+
+// ClientName describes the software behind a peer id, falling back to the printable part of the id
+func ClientName(id [20]byte) string {
+	s := string(id[:])
+	if s[0] == '-' && s[7] == '-' {
+		version := strings.TrimRight(s[3:7], "-")
+		if name, ok := clients[s[1:3]]; ok {
+			if strings.Trim(version, "0123456789") == "" && len(version) >= 2 {
+				return fmt.Sprintf("%s %s", name, strings.Join(strings.Split(version, ""), "."))
+			}
+			return name + " " + version
+		}
+		return s[1:7]
+	}
+
+	var printable strings.Builder
+	for _, c := range s {
+		if c < ' ' || c > '~' {
+			break
+		}
+		printable.WriteRune(c)
+	}
+	if printable.Len() == 0 {
+		return "unknown"
+	}
+	return printable.String()
+}
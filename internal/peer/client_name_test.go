@@ -0,0 +1,28 @@
+package peer
+
+import "testing"
+
+func TestClientName(t *testing.T) {
+	tests := []struct {
+		name string
+		id   string
+		want string
+	}{
+		{"known azureus style", "-qB4250-abcdefghijkl", "qBittorrent 4.2.5.0"},
+		{"ours", "-GR0001-abcdefghijkl", "gorrent 0.0.0.1"},
+		{"letters in the version", "-TR30Z0-abcdefghijkl", "Transmission 30Z0"},
+		{"unknown azureus style", "-XX1234-abcdefghijkl", "XX1234"},
+		{"printable prefix", "M7-2-2--\x00\x01abcdefghij", "M7-2-2--"},
+		{"nothing printable", "\x00\x01\x02\x03\x04\x05\x06\x07\x08\x09\x0a\x0b\x0c\x0d\x0e\x0f\x10\x11\x12\x13", "unknown"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var id [20]byte
+			copy(id[:], tt.id)
+			if got := ClientName(id); got != tt.want {
+				t.Errorf("ClientName() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,235 @@
+package peer
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"net"
+
+	"github.com/chrispritchard/gorrent/internal/bencode"
+	"github.com/chrispritchard/gorrent/internal/messaging"
+	"github.com/chrispritchard/gorrent/internal/tracker"
+)
+
+// The extension protocol (BEP 10) is used here only for metadata exchange (BEP 9): a peer that started from a magnet
+// link has no info dict, so asks for it from peers in 16KiB pieces, checking the result against the info hash.
+
+const (
+	reserved_extensions = 0x10 // in reserved byte 5
+	ut_metadata_id      = 1    // the id we give ut_metadata in our extended handshake
+	metadata_piece_size = 1 << 14
+	max_metadata_size   = 1 << 24
+)
+
+const (
+	metadata_request = iota
+	metadata_data
+	metadata_reject
+)
+
+func supports_extensions(h Handshake) bool {
+	return h.Reserved[5]&reserved_extensions != 0
+}
+
+func extended_handshake(metadata_size int) []byte {
+	dict := map[string]any{
+		"m": map[string]any{"ut_metadata": ut_metadata_id},
+		"v": "gorrent",
+	}
+	if metadata_size > 0 {
+		dict["metadata_size"] = metadata_size
+	}
+	data, _ := bencode.Encode(dict) // cannot fail for these types
+	return append([]byte{0}, data...)
+}
+
+// parse_extended_handshake returns the peer's id for ut_metadata, zero if they do not support it, and the size of
+// the metadata they have, zero if they have none
+func parse_extended_handshake(payload []byte) (int, int, error) {
+	decoded, _, err := bencode.Decode(payload)
+	if err != nil {
+		return 0, 0, err
+	}
+	dict, ok := decoded.(map[string]any)
+	if !ok {
+		return 0, 0, fmt.Errorf("extended handshake is not a dict")
+	}
+	m, _ := bencode.Get[map[string]any](dict, "m")
+	id, _ := bencode.Get[int](m, "ut_metadata")
+	size, _ := bencode.Get[int](dict, "metadata_size")
+	return id, size, nil
+}
+
+func metadata_message(remote_id, msg_type, piece, total_size int, data []byte) []byte {
+	dict := map[string]any{"msg_type": msg_type, "piece": piece}
+	if msg_type == metadata_data {
+		dict["total_size"] = total_size
+	}
+	encoded, _ := bencode.Encode(dict)
+	return append(append([]byte{byte(remote_id)}, encoded...), data...)
+}
+
+// parse_metadata_message splits a ut_metadata message into its header and, for data messages, the piece that follows
+func parse_metadata_message(payload []byte) (int, int, []byte, error) {
+	decoded, rest, err := bencode.Decode(payload)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	dict, ok := decoded.(map[string]any)
+	if !ok {
+		return 0, 0, nil, fmt.Errorf("metadata message is not a dict")
+	}
+	msg_type, err := bencode.Get[int](dict, "msg_type")
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	piece, err := bencode.Get[int](dict, "piece")
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	return msg_type, piece, rest, nil
+}
+
+// ServeMetadata sets the info dict given to peers who ask for it, and tells the peer we have it
+func (p *PeerHandler) ServeMetadata(info []byte) error {
+	p.mutex.Lock()
+	p.metadata = info
+	extensions := p.remote_extensions
+	p.mutex.Unlock()
+
+	if !extensions {
+		return nil
+	}
+	return p.send(messaging.MSG_EXTENDED, extended_handshake(len(info)))
+}
+
+func (p *PeerHandler) handle_extended(received messaging.Received) error {
+	if len(received.Data) == 0 {
+		return fmt.Errorf("peer %s sent an empty extended message", p.Id)
+	}
+	id, payload := received.Data[0], received.Data[1:]
+
+	if id == 0 {
+		remote_id, _, err := parse_extended_handshake(payload)
+		if err != nil {
+			return fmt.Errorf("peer %s sent an invalid extended handshake: %v", p.Id, err)
+		}
+		p.mutex.Lock()
+		p.remote_metadata_id = remote_id
+		p.mutex.Unlock()
+		return nil
+	}
+	if id != ut_metadata_id {
+		return nil // an extension we never advertised
+	}
+
+	msg_type, piece, _, err := parse_metadata_message(payload)
+	if err != nil || msg_type != metadata_request {
+		return err
+	}
+
+	p.mutex.Lock()
+	metadata, remote_id := p.metadata, p.remote_metadata_id
+	p.mutex.Unlock()
+
+	if remote_id == 0 {
+		return nil
+	}
+	start := piece * metadata_piece_size
+	if metadata == nil || piece < 0 || start >= len(metadata) {
+		return p.send(messaging.MSG_EXTENDED, metadata_message(remote_id, metadata_reject, piece, 0, nil))
+	}
+	end := min(start+metadata_piece_size, len(metadata))
+	return p.send(messaging.MSG_EXTENDED, metadata_message(remote_id, metadata_data, piece, len(metadata), metadata[start:end]))
+}
+
+// FetchMetadata connects to a peer only to download the info dict, for a torrent added by magnet link. The result
+// matches local.InfoHash
+func FetchMetadata(ctx context.Context, peer tracker.PeerInfo, local Local) ([]byte, error) {
+	address := net.JoinHostPort(peer.IP, fmt.Sprintf("%d", peer.Port))
+
+	conn, err := local.dial(address)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to peer %s: %v", address, err)
+	}
+	defer conn.Close()
+
+	if local.Timeouts.Metadata > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, local.Timeouts.Metadata)
+		defer cancel()
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() }) // unblocks any read in progress
+	defer stop()
+
+	remote, err := handshake(conn, local.InfoHash, local.ID, peer.Id, local.Timeouts.Connect)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to peer %s: %v", address, err)
+	}
+	if !supports_extensions(remote) {
+		return nil, fmt.Errorf("peer %s does not support the extension protocol", address)
+	}
+	err = messaging.SendMessage(conn, messaging.MSG_EXTENDED, extended_handshake(0))
+	if err != nil {
+		return nil, err
+	}
+
+	remote_id, size := 0, 0
+	for remote_id == 0 {
+		received, err := messaging.ReceiveMessage(conn, local.Timeouts.Idle)
+		if err != nil {
+			return nil, fmt.Errorf("peer %s: %v", address, err)
+		}
+		if received.Kind != messaging.MSG_EXTENDED || len(received.Data) == 0 || received.Data[0] != 0 {
+			continue // bitfields, haves and the like are of no use without the metadata
+		}
+		remote_id, size, err = parse_extended_handshake(received.Data[1:])
+		if err != nil {
+			return nil, fmt.Errorf("peer %s sent an invalid extended handshake: %v", address, err)
+		}
+		if remote_id == 0 {
+			return nil, fmt.Errorf("peer %s does not support metadata exchange", address)
+		}
+	}
+	if size <= 0 || size > max_metadata_size {
+		return nil, fmt.Errorf("peer %s offered metadata of an invalid size: %d", address, size)
+	}
+
+	piece_count := (size + metadata_piece_size - 1) / metadata_piece_size
+	for i := range piece_count {
+		err = messaging.SendMessage(conn, messaging.MSG_EXTENDED, metadata_message(remote_id, metadata_request, i, 0, nil))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	info := make([]byte, size)
+	received_pieces := map[int]struct{}{}
+	for len(received_pieces) < piece_count {
+		received, err := messaging.ReceiveMessage(conn, local.Timeouts.Idle)
+		if err != nil {
+			return nil, fmt.Errorf("peer %s: %v", address, err)
+		}
+		if received.Kind != messaging.MSG_EXTENDED || len(received.Data) == 0 || received.Data[0] != ut_metadata_id {
+			continue
+		}
+		msg_type, piece, data, err := parse_metadata_message(received.Data[1:])
+		if err != nil {
+			return nil, fmt.Errorf("peer %s sent an invalid metadata message: %v", address, err)
+		}
+		if msg_type == metadata_reject {
+			return nil, fmt.Errorf("peer %s rejected a metadata request", address)
+		}
+		start := piece * metadata_piece_size
+		if msg_type != metadata_data || piece < 0 || piece >= piece_count || len(data) != min(metadata_piece_size, size-start) {
+			return nil, fmt.Errorf("peer %s sent an invalid metadata piece", address)
+		}
+		copy(info[start:], data)
+		received_pieces[piece] = struct{}{}
+	}
+
+	if hash := sha1.Sum(info); string(hash[:]) != string(local.InfoHash) {
+		return nil, fmt.Errorf("peer %s sent metadata that does not match the info hash", address)
+	}
+	return info, nil
+}
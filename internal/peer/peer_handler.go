@@ -4,54 +4,261 @@ import (
 	"context"
 	"encoding/binary"
 	"fmt"
+	"log/slog"
 	"net"
+	"slices"
 	"sync"
+	"time"
 
 	. "github.com/chrispritchard/gorrent/internal/bitfields"
+	"github.com/chrispritchard/gorrent/internal/logging"
+	"github.com/chrispritchard/gorrent/internal/merkle"
 	"github.com/chrispritchard/gorrent/internal/messaging"
+	"github.com/chrispritchard/gorrent/internal/stats"
 	"github.com/chrispritchard/gorrent/internal/tracker"
 )
 
+// the largest block we will serve, as recommended by the spec. Anything bigger is ignored
+const max_request_length = 1 << 17
+
 type PeerHandler struct {
-	Id       string
-	bitfield *BitField
-	conn     net.Conn
-	mutex    sync.Mutex
-	requests map[int]map[int]struct{}
+	Id           string
+	Address      string
+	RemoteID     [20]byte
+	bitfield     *BitField
+	conn         net.Conn
+	writer       net.Conn          // conn, or what it wraps if writes are paced, see paced
+	pace         func(n int) error // waits for the budget to upload n bytes, nil if unlimited
+	mutex        sync.Mutex
+	write_mutex  sync.Mutex
+	write_limit  time.Duration
+	queued       []func() error // sends made in the background, see queue
+	wake         chan struct{}
+	stopped      chan struct{} // closed along with the connection
+	close_once   sync.Once
+	requests     map[int]map[int]struct{}
+	hash_source  HashSource
+	block_source BlockSource
+	on_have      func(index int)
+	pending      *messaging.Received
+	idle         time.Duration
+	state        peer_state
+	downloaded   *stats.Meter // block data received, not counting protocol overhead
+	uploaded     *stats.Meter
+
+	remote_extensions  bool   // whether the peer speaks the extension protocol
+	remote_metadata_id int    // the peer's id for ut_metadata, zero until their extended handshake
+	metadata           []byte // the info dict, served to peers who ask
+}
+
+// peer_state is the four flags of the wire protocol, plus whether the connection has gone
+type peer_state struct {
+	am_choking, am_interested     bool
+	peer_choking, peer_interested bool
+	closed                        bool
+}
+
+// paced is a connection whose writes are charged against upload limits, as ratelimit.Conn's are. Block data waits for
+// its budget before taking the write lock and is then written directly, so other messages never queue behind the wait
+type paced interface {
+	WaitWrite(n int) error
+	Direct() net.Conn
+}
+
+// HashSource answers BEP 52 hash requests with the requested hashes followed by their proof
+type HashSource func(pieces_root string, base_layer, index, length, proof_layers int) ([]merkle.Hash, error)
+
+// BlockSource answers block requests from a peer we have unchoked, erroring if we do not have the piece
+type BlockSource func(index, begin, length int) ([]byte, error)
+
+// Local is our side of a connection: the swarm, who we are and what we have
+type Local struct {
+	InfoHash   []byte
+	ID         []byte
+	Bitfield   BitField
+	Advertised *BitField                              // optional, what to tell the peer we have if not Bitfield, as when super-seeding
+	Dial       func(address string) (net.Conn, error) // defaults to a plain tcp dial
+	Logger     *slog.Logger                           // optional
+	Uploaded   *stats.Meter                           // optional, also charged with every block we serve, e.g. the torrent's total
+	Timeouts   Timeouts
+}
+
+// Timeouts bound how long we wait on a peer. Zero waits indefinitely
+type Timeouts struct {
+	Connect  time.Duration // to dial, and then for each step of the handshake
+	Idle     time.Duration // without any message, keep-alives included, before dropping the peer
+	Metadata time.Duration // to fetch the info dict of a magnet link from one peer
+	Write    time.Duration // for each message written, before dropping a peer that has stopped reading
+}
+
+func DefaultTimeouts() Timeouts {
+	return Timeouts{
+		Connect:  5 * time.Second,
+		Idle:     3 * time.Minute, // peers send keep-alives every two minutes
+		Metadata: 30 * time.Second,
+		Write:    30 * time.Second,
+	}
+}
+
+func (local Local) log(peer_id string) *slog.Logger {
+	return logging.For(local.Logger, logging.Peer).With("peer", peer_id)
+}
+
+// Stats are the block data exchanged with a peer, as totals and rolling rates in bytes per second
+type Stats struct {
+	Downloaded, Uploaded     int64
+	DownloadRate, UploadRate float64
+}
+
+func (l Local) dial(address string) (net.Conn, error) {
+	if l.Dial != nil {
+		return l.Dial(address)
+	}
+	return net.DialTimeout("tcp", address, l.Timeouts.Connect)
 }
 
-func ConnectToPeer(peer tracker.PeerInfo, info_hash, local_id []byte, local_bitfield *BitField, log func(format string, a ...any)) (*PeerHandler, error) {
+func ConnectToPeer(peer tracker.PeerInfo, local Local) (*PeerHandler, error) {
+	address := net.JoinHostPort(peer.IP, fmt.Sprintf("%d", peer.Port))
 	peer_id := peer.Id
 	if peer_id == "" {
-		peer_id = fmt.Sprintf("%s:%d", peer.IP, peer.Port)
+		peer_id = address
 	}
 
-	conn, err := handshake(info_hash, local_id, peer)
+	conn, err := local.dial(address)
 	if err != nil {
 		return nil, fmt.Errorf("error connecting to peer %s: %s", peer_id, err.Error())
 	}
-	log("completed handshake with peer %s", peer_id)
 
-	field, err := exchange_bitfields(conn, local_bitfield)
+	remote, err := handshake(conn, local.InfoHash, local.ID, peer.Id, local.Timeouts.Connect)
 	if err != nil {
+		conn.Close()
 		return nil, fmt.Errorf("error connecting to peer %s: %s", peer_id, err.Error())
 	}
-	log("exchanged bitfields with peer %s, received:\n\t%s", peer_id, field.BitString())
+	local.log(peer_id).Debug("completed handshake")
+
+	return establish(conn, peer_id, address, remote, local)
+}
+
+// AcceptPeer completes an inbound connection whose handshake has already been read, replying with our own
+func AcceptPeer(conn net.Conn, remote Handshake, local Local) (*PeerHandler, error) {
+	address := conn.RemoteAddr().String()
+	if string(remote.InfoHash[:]) != string(local.InfoHash) {
+		conn.Close()
+		return nil, fmt.Errorf("peer %s sent the wrong info hash", address)
+	}
+	if string(remote.PeerID[:]) == string(local.ID) {
+		conn.Close()
+		return nil, fmt.Errorf("peer %s is ourselves", address)
+	}
 
-	err = send_interested(conn)
+	err := write_handshake(conn, local.InfoHash, local.ID)
 	if err != nil {
-		return nil, fmt.Errorf("error connecting to peer %s: %s", peer_id, err.Error())
+		conn.Close()
+		return nil, fmt.Errorf("error accepting peer %s: %s", address, err.Error())
 	}
-	log("sent 'interested' to peer %s", peer_id)
+	local.log(address).Debug("accepted handshake")
+
+	return establish(conn, address, address, remote, local)
+}
 
-	err = receive_unchoked(conn)
+func establish(conn net.Conn, peer_id, address string, remote Handshake, local Local) (*PeerHandler, error) {
+	advertised := local.Bitfield
+	if local.Advertised != nil {
+		advertised = *local.Advertised
+	}
+	field, pending, err := exchange_bitfields(conn, advertised, local.Timeouts.Connect)
 	if err != nil {
+		conn.Close()
 		return nil, fmt.Errorf("error connecting to peer %s: %s", peer_id, err.Error())
 	}
-	log("received 'unchoke' from peer %s", peer_id)
+	local.log(peer_id).Debug("exchanged bitfields", "bitfield", field.BitString())
+
+	handler := &PeerHandler{
+		Id:          peer_id,
+		Address:     address,
+		RemoteID:    remote.PeerID,
+		bitfield:    field,
+		conn:        conn,
+		writer:      conn,
+		write_limit: local.Timeouts.Write,
+		wake:        make(chan struct{}, 1),
+		stopped:     make(chan struct{}),
+		requests:    map[int]map[int]struct{}{},
+		pending:     pending,
+		idle:        local.Timeouts.Idle,
+		state:       peer_state{am_choking: true, peer_choking: true},
+		downloaded:  stats.NewMeter(nil),
+		uploaded:    stats.NewMeter(local.Uploaded),
+
+		remote_extensions: supports_extensions(remote),
+	}
+	if c, ok := conn.(paced); ok {
+		handler.writer, handler.pace = c.Direct(), c.WaitWrite
+	}
+	go handler.send_queued()
+
+	if local.Bitfield.Incomplete() {
+		err = handler.SetInterested(true)
+		if err != nil {
+			return nil, fmt.Errorf("error connecting to peer %s: %s", peer_id, err.Error())
+		}
+		local.log(peer_id).Debug("sent interested")
+	}
+
+	return handler, nil
+}
+
+// send serialises writes, as requests, haves and served blocks come from different goroutines. A failed write, or
+// one the peer does not take within the write timeout, means the connection is unusable, so it is closed, which in
+// turn ends the receiving goroutine
+func (p *PeerHandler) send(kind messaging.PeerMessageType, data []byte) error {
+	if kind == messaging.MSG_PIECE && p.pace != nil {
+		if err := p.pace(len(data)); err != nil {
+			p.Close()
+			return err
+		}
+	}
+	p.write_mutex.Lock()
+	defer p.write_mutex.Unlock()
+	if p.write_limit > 0 {
+		p.writer.SetWriteDeadline(time.Now().Add(p.write_limit))
+	}
+	err := messaging.SendMessage(p.writer, kind, data)
+	if err != nil {
+		p.Close()
+	}
+	return err
+}
+
+// queue sends in the background, in order, for callers that hold locks of their own and so must not wait on the
+// connection. A failure closes the peer as send does
+func (p *PeerHandler) queue(send func() error) {
+	p.mutex.Lock()
+	p.queued = append(p.queued, send)
+	p.mutex.Unlock()
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
 
-	handler := PeerHandler{peer_id, field, conn, sync.Mutex{}, map[int]map[int]struct{}{}}
-	return &handler, nil
+func (p *PeerHandler) send_queued() {
+	for {
+		select {
+		case <-p.stopped:
+			return
+		case <-p.wake:
+		}
+		p.mutex.Lock()
+		queued := p.queued
+		p.queued = nil
+		p.mutex.Unlock()
+		for _, send := range queued {
+			if send() != nil {
+				return
+			}
+		}
+	}
 }
 
 func (p *PeerHandler) delete_request(index, begin int) bool {
@@ -82,20 +289,114 @@ func (p *PeerHandler) set_request(index, begin int) {
 }
 
 func (p *PeerHandler) HasPiece(index int) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
 	return p.bitfield.Get(index)
 }
 
-func (p *PeerHandler) CancelRequest(index, begin, length int) error {
+// Bitfield returns a copy of the pieces the peer has
+func (p *PeerHandler) Bitfield() BitField {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return NewBitfield(slices.Clone(p.bitfield.Data), p.bitfield.Length)
+}
+
+// Choking is whether the peer is refusing our requests
+func (p *PeerHandler) Choking() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.state.peer_choking
+}
+
+// Interested is whether the peer wants pieces from us
+func (p *PeerHandler) Interested() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.state.peer_interested
+}
+
+// AmChoking is whether we are refusing the peer's requests
+func (p *PeerHandler) AmChoking() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.state.am_choking
+}
+
+// AmInterested is whether we want pieces from the peer
+func (p *PeerHandler) AmInterested() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.state.am_interested
+}
+
+// OutstandingRequests is the number of blocks requested from the peer and not yet received
+func (p *PeerHandler) OutstandingRequests() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	count := 0
+	for _, blocks := range p.requests {
+		count += len(blocks)
+	}
+	return count
+}
+
+func (p *PeerHandler) Stats() Stats {
+	return Stats{
+		Downloaded:   p.downloaded.Total(),
+		Uploaded:     p.uploaded.Total(),
+		DownloadRate: p.downloaded.Rate(),
+		UploadRate:   p.uploaded.Rate(),
+	}
+}
+
+func (p *PeerHandler) Closed() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.state.closed
+}
+
+func (p *PeerHandler) SetInterested(interested bool) error {
+	p.mutex.Lock()
+	changed := p.state.am_interested != interested
+	p.state.am_interested = interested
+	p.mutex.Unlock()
+
+	if !changed {
+		return nil
+	}
+	if interested {
+		return p.send(messaging.MSG_INTERESTED, []byte{})
+	}
+	return p.send(messaging.MSG_NOTINTERESTED, []byte{})
+}
+
+func (p *PeerHandler) SetChoking(choking bool) error {
+	p.mutex.Lock()
+	changed := p.state.am_choking != choking
+	p.state.am_choking = choking
+	p.mutex.Unlock()
+
+	if !changed {
+		return nil
+	}
+	if choking {
+		return p.send(messaging.MSG_CHOKE, []byte{})
+	}
+	return p.send(messaging.MSG_UNCHOKE, []byte{})
+}
+
+// CancelRequest cancels a block requested of the peer, if it still is. It is sent in the background
+func (p *PeerHandler) CancelRequest(index, begin, length int) {
 	if p.delete_request(index, begin) {
 		to_send := make([]byte, 12)
 		binary.BigEndian.PutUint32(to_send[:4], uint32(index))
 		binary.BigEndian.PutUint32(to_send[4:8], uint32(begin))
 		binary.BigEndian.PutUint32(to_send[8:], uint32(length))
-		return messaging.SendMessage(p.conn, messaging.MSG_CANCEL, to_send)
+		p.queue(func() error { return p.send(messaging.MSG_CANCEL, to_send) })
 	}
-	return nil
 }
 
+// RequestPieceBlock requests a block of a piece the peer has. It is sent in the background
 func (p *PeerHandler) RequestPieceBlock(index, begin, length int) error {
 	if !p.HasPiece(index) {
 		return fmt.Errorf("peer %s does not have the requested piece with index %d", p.Id, index)
@@ -106,44 +407,210 @@ func (p *PeerHandler) RequestPieceBlock(index, begin, length int) error {
 	binary.BigEndian.PutUint32(to_send[:4], uint32(index))
 	binary.BigEndian.PutUint32(to_send[4:8], uint32(begin))
 	binary.BigEndian.PutUint32(to_send[8:], uint32(length))
-	return messaging.SendMessage(p.conn, messaging.MSG_REQUEST, to_send)
+	p.queue(func() error { return p.send(messaging.MSG_REQUEST, to_send) })
+	return nil
 }
 
+// StartReceiving reads messages until the connection fails or ctx ends. Protocol state (choking, interest, haves) and
+// requests for blocks or hashes are handled here; everything else, plus interest changes, goes to received_channel.
+// A read failure closes the peer and is reported once on error_channel
 func (p *PeerHandler) StartReceiving(ctx context.Context, received_channel chan<- messaging.Received, error_channel chan<- error) {
 	go func() {
+		if p.pending != nil {
+			if !p.handle(ctx, *p.pending, received_channel, error_channel) {
+				return
+			}
+			p.pending = nil
+		}
 		for {
 			select {
 			case <-ctx.Done():
 				return
 			default:
-				received, err := messaging.ReceiveMessage(p.conn)
+				received, err := messaging.ReceiveMessage(p.conn, p.idle)
 				if err != nil {
-					error_channel <- err
-					continue
+					p.Close()
+					select {
+					case error_channel <- fmt.Errorf("peer %s disconnected: %v", p.Id, err):
+					case <-ctx.Done():
+					}
+					return
 				}
-
-				if received.Kind == messaging.MSG_PIECE {
-					index, begin, _ := received.AsPiece()
-					p.delete_request(index, begin)
+				if !p.handle(ctx, received, received_channel, error_channel) {
+					return
 				}
-
-				received_channel <- received
 			}
 		}
 	}()
 }
 
-func (p *PeerHandler) SendHave(piece_index int) error {
+// handle processes a single message, returning false if receiving should stop
+func (p *PeerHandler) handle(ctx context.Context, received messaging.Received, received_channel chan<- messaging.Received, error_channel chan<- error) bool {
+	forward := false
+	var err error
+
+	switch received.Kind {
+	case messaging.MSG_CHOKE:
+		p.mutex.Lock()
+		p.state.peer_choking = true
+		clear(p.requests) // a choke discards everything outstanding
+		p.mutex.Unlock()
+	case messaging.MSG_UNCHOKE:
+		p.mutex.Lock()
+		p.state.peer_choking = false
+		p.mutex.Unlock()
+	case messaging.MSG_INTERESTED, messaging.MSG_NOTINTERESTED:
+		p.mutex.Lock()
+		p.state.peer_interested = received.Kind == messaging.MSG_INTERESTED
+		p.mutex.Unlock()
+		forward = true
+	case messaging.MSG_HAVE:
+		if len(received.Data) == 4 {
+			index := int(binary.BigEndian.Uint32(received.Data))
+			p.mutex.Lock()
+			valid := p.bitfield.Set(uint(index)) == nil
+			on_have := p.on_have
+			p.mutex.Unlock()
+			if valid && on_have != nil {
+				on_have(index)
+			}
+		}
+	case messaging.MSG_BITFIELD:
+		p.mutex.Lock()
+		if len(received.Data) == len(p.bitfield.Data) {
+			p.bitfield.Data = received.Data
+		}
+		p.mutex.Unlock()
+	case messaging.MSG_REQUEST:
+		err = p.answer_block_request(received)
+	case messaging.MSG_CANCEL:
+		// blocks are served as soon as they are requested, so there is never anything queued to cancel
+	case messaging.MSG_HASH_REQUEST:
+		err = p.answer_hash_request(received)
+	case messaging.MSG_EXTENDED:
+		err = p.handle_extended(received)
+	case messaging.MSG_PIECE:
+		index, begin, piece := received.AsPiece()
+		p.delete_request(index, begin)
+		p.downloaded.Add(len(piece))
+		forward = true
+	default:
+		forward = true
+	}
+
+	if err != nil {
+		select {
+		case error_channel <- err:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	if forward {
+		received.From = p.Address
+		select {
+		case received_channel <- received:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
+}
+
+// ServeHashes sets the source used to answer hash requests from this peer. Without one, all requests are rejected
+func (p *PeerHandler) ServeHashes(source HashSource) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.hash_source = source
+}
+
+// ServeBlocks sets the source used to answer block requests. Without one, requests are ignored
+func (p *PeerHandler) ServeBlocks(source BlockSource) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.block_source = source
+}
+
+// WatchHaves sets a function called with each piece the peer announces it has, once its bitfield includes it
+func (p *PeerHandler) WatchHaves(on_have func(index int)) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.on_have = on_have
+}
+
+func (p *PeerHandler) answer_block_request(received messaging.Received) error {
+	if len(received.Data) != 12 {
+		return fmt.Errorf("peer %s sent a malformed request", p.Id)
+	}
+	index := int(binary.BigEndian.Uint32(received.Data[:4]))
+	begin := int(binary.BigEndian.Uint32(received.Data[4:8]))
+	length := int(binary.BigEndian.Uint32(received.Data[8:]))
+
+	p.mutex.Lock()
+	source := p.block_source
+	choking := p.state.am_choking
+	p.mutex.Unlock()
+
+	if source == nil || choking || length > max_request_length {
+		return nil // requests while choked are allowed to race with the choke, and are simply dropped
+	}
+
+	block, err := source(index, begin, length)
+	if err != nil {
+		return fmt.Errorf("unable to serve piece %d to peer %s: %v", index, p.Id, err)
+	}
+	err = p.send(messaging.MSG_PIECE, messaging.EncodePiece(index, begin, block))
+	if err == nil {
+		p.uploaded.Add(len(block))
+	}
+	return err
+}
+
+func (p *PeerHandler) answer_hash_request(received messaging.Received) error {
+	request, err := received.AsHashRequest()
+	if err != nil {
+		return err
+	}
+
+	p.mutex.Lock()
+	source := p.hash_source
+	p.mutex.Unlock()
+
+	if source != nil {
+		hashes, err := source(string(request.PiecesRoot[:]), request.BaseLayer, request.Index, request.Length, request.ProofLayers)
+		if err == nil {
+			return p.send(messaging.MSG_HASHES, request.EncodeHashes(hashes))
+		}
+	}
+	return p.send(messaging.MSG_HASH_REJECT, request.Encode())
+}
+
+// SendHave tells the peer we have a piece. It is sent in the background
+func (p *PeerHandler) SendHave(piece_index int) {
 	to_send := make([]byte, 4)
 	binary.BigEndian.PutUint32(to_send, uint32(piece_index))
-	return messaging.SendMessage(p.conn, messaging.MSG_HAVE, to_send)
+	p.queue(func() error { return p.send(messaging.MSG_HAVE, to_send) })
 }
 
-func (p *PeerHandler) SendKeepAlive() error {
-	_, err := p.conn.Write([]byte{0, 0, 0, 0})
-	return err
+// SendKeepAlive is sent in the background
+func (p *PeerHandler) SendKeepAlive() {
+	p.queue(func() error {
+		p.write_mutex.Lock()
+		defer p.write_mutex.Unlock()
+		if p.write_limit > 0 {
+			p.writer.SetWriteDeadline(time.Now().Add(p.write_limit))
+		}
+		_, err := p.writer.Write([]byte{0, 0, 0, 0})
+		if err != nil {
+			p.Close()
+		}
+		return err
+	})
 }
 
 func (p *PeerHandler) Close() error {
+	p.mutex.Lock()
+	p.state.closed = true
+	p.mutex.Unlock()
+	p.close_once.Do(func() { close(p.stopped) })
 	return p.conn.Close()
 }
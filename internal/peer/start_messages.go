@@ -9,25 +9,57 @@ import (
 
 	. "github.com/chrispritchard/gorrent/internal/bitfields"
 	. "github.com/chrispritchard/gorrent/internal/messaging"
-	"github.com/chrispritchard/gorrent/internal/tracker"
 )
 
-var conn_timeout = 5 * time.Second
+const reserved_v2 = 0x10
 
-func handshake(info_hash, local_id []byte, peer tracker.PeerInfo) (net.Conn, error) {
-	conn, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", peer.IP, peer.Port), conn_timeout)
+const protocol_name = "BitTorrent protocol"
+
+const handshake_length = 68 // fixed header, reserved bytes, info hash, peer id
+
+// Handshake is the opening message of every connection. Inbound connections are read before we know which torrent
+// they are for, so the session can route them by info hash
+type Handshake struct {
+	Reserved [8]byte
+	InfoHash [20]byte
+	PeerID   [20]byte
+}
+
+// ReadHandshake reads a peer's handshake, giving up after timeout unless that is zero
+func ReadHandshake(conn net.Conn, timeout time.Duration) (Handshake, error) {
+	var result Handshake
+
+	if timeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		defer conn.SetReadDeadline(time.Time{})
+	}
+
+	received := make([]byte, handshake_length)
+	_, err := io.ReadFull(conn, received)
 	if err != nil {
-		return nil, err
+		return result, err
+	}
+
+	// fixed header
+	if received[0] != 19 || string(received[1:20]) != protocol_name {
+		return result, fmt.Errorf("invalid fixed header in handshake")
 	}
 
-	to_send := make([]byte, 68) // fixed header, fixed bytes, info hash, peer id
+	copy(result.Reserved[:], received[20:28])
+	copy(result.InfoHash[:], received[28:48])
+	copy(result.PeerID[:], received[48:68])
+	return result, nil
+}
+
+func write_handshake(conn net.Conn, info_hash, local_id []byte) error {
+	to_send := make([]byte, handshake_length)
 
 	// fixed header
 	to_send[0] = 19 // length of following string
-	copy(to_send[1:20], []byte("BitTorrent protocol"))
+	copy(to_send[1:20], []byte(protocol_name))
 
-	// fixed bytes
-	copy(to_send[20:28], []byte{0, 0, 0, 0, 0, 0, 0, 0})
+	// reserved bytes, flagging the extension protocol (BEP 10) and bittorrent v2 support (BEP 52)
+	copy(to_send[20:28], []byte{0, 0, 0, 0, 0, reserved_extensions, 0, reserved_v2})
 
 	// info hash
 	copy(to_send[28:48], info_hash)
@@ -38,50 +70,56 @@ func handshake(info_hash, local_id []byte, peer tracker.PeerInfo) (net.Conn, err
 	// send to peer
 	n, err := conn.Write(to_send)
 	if err != nil {
-		return nil, err
-	} else if n != 68 {
-		return nil, fmt.Errorf("was not able to send all 68 bytes of handshake")
+		return err
+	} else if n != handshake_length {
+		return fmt.Errorf("was not able to send all 68 bytes of handshake")
 	}
+	return nil
+}
 
-	// recieve their response
-	received := make([]byte, 68)
-	_, err = io.ReadFull(conn, received)
+// handshake sends ours then validates theirs is the mirror of it
+func handshake(conn net.Conn, info_hash, local_id []byte, expected_id string, timeout time.Duration) (Handshake, error) {
+	err := write_handshake(conn, info_hash, local_id)
 	if err != nil {
-		return nil, err
+		return Handshake{}, err
 	}
 
-	// validate response is the mirror of our own
-	// fixed header
-	if received[0] != 19 || string(received[1:20]) != "BitTorrent protocol" {
-		return nil, fmt.Errorf("invalid fixed header in response")
+	received, err := ReadHandshake(conn, timeout)
+	if err != nil {
+		return received, err
 	}
 
 	// info hash
-	if !bytes.Equal(received[28:48], info_hash) {
-		return nil, fmt.Errorf("invalid info hash in response")
+	if !bytes.Equal(received.InfoHash[:], info_hash) {
+		return received, fmt.Errorf("invalid info hash in response")
 	}
 
 	// their peer id (should match what we have for them, if we have it - we dont in the compact version of the tracker response)
-	if peer.Id != "" && string(received[48:68]) != peer.Id {
-		return nil, fmt.Errorf("invalid peer ID in response")
+	if expected_id != "" && string(received.PeerID[:]) != expected_id {
+		return received, fmt.Errorf("invalid peer ID in response")
+	}
+	if bytes.Equal(received.PeerID[:], local_id) {
+		return received, fmt.Errorf("connected to ourselves")
 	}
 
-	return conn, nil
+	return received, nil
 }
 
-func exchange_bitfields(conn net.Conn, local *BitField) (remote *BitField, err error) {
+// exchange_bitfields sends ours and reads theirs. A peer with no pieces may skip its bitfield, in which case the first
+// message is something else, returned as pending to be handled once receiving starts
+func exchange_bitfields(conn net.Conn, local BitField, timeout time.Duration) (remote *BitField, pending *Received, err error) {
 	err = SendMessage(conn, MSG_BITFIELD, local.Data)
 	if err != nil {
 		return
 	}
 
-	received, err := ReceiveMessage(conn)
+	received, err := ReceiveMessage(conn, timeout)
 	if err != nil {
 		return
 	}
 	if received.Kind != MSG_BITFIELD {
-		err = fmt.Errorf("expected a bitfield response message from peer, got %d", received.Kind)
-		return
+		blank := CreateBlankBitfield(local.Length)
+		return &blank, &received, nil
 	}
 
 	remote = &BitField{Data: received.Data}
@@ -92,21 +130,3 @@ func exchange_bitfields(conn net.Conn, local *BitField) (remote *BitField, err e
 
 	return
 }
-
-func send_interested(conn net.Conn) error {
-	return SendMessage(conn, MSG_INTERESTED, []byte{})
-}
-
-func receive_unchoked(conn net.Conn) error {
-	received, err := ReceiveMessage(conn)
-	if err != nil {
-		return err
-	}
-
-	if received.Kind != MSG_UNCHOKE {
-		err = fmt.Errorf("expected a unchoke response message from peer, got %d", received.Kind)
-		return err
-	}
-
-	return nil
-}
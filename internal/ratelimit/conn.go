@@ -0,0 +1,98 @@
+package ratelimit
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// Conn charges every byte read or written against a set of limiters, so peers of many torrents can share one budget.
+// Closing the connection ends any wait in progress
+type Conn struct {
+	net.Conn
+	read, write []*Limiter
+	ctx         context.Context
+	cancel      context.CancelFunc
+	close_once  sync.Once
+	on_close    []func()
+}
+
+func WrapConn(conn net.Conn, read, write []*Limiter) *Conn {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Conn{Conn: conn, read: read, write: write, ctx: ctx, cancel: cancel}
+}
+
+// OnClose registers a function run once the connection is closed, e.g. to release its per connection limiters
+func (c *Conn) OnClose(f func()) *Conn {
+	c.on_close = append(c.on_close, f)
+	return c
+}
+
+func (c *Conn) Close() error {
+	err := c.Conn.Close()
+	c.close_once.Do(func() {
+		c.cancel()
+		for _, f := range c.on_close {
+			f()
+		}
+	})
+	return err
+}
+
+// Read charges after the fact, as we cannot know how much will arrive; the wait then holds back the next read
+func (c *Conn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		for _, l := range c.read {
+			if wait_err := l.WaitN(c.ctx, n); wait_err != nil {
+				return n, net.ErrClosed
+			}
+		}
+	}
+	return n, err
+}
+
+// WaitWrite charges n bytes as Write would without writing them, for a writer to wait for its budget before taking a
+// lock, then write through Direct
+func (c *Conn) WaitWrite(n int) error {
+	for n > 0 {
+		chunk := n
+		for _, l := range c.write {
+			chunk = min(chunk, l.burst())
+		}
+		for _, l := range c.write {
+			if err := l.WaitN(c.ctx, chunk); err != nil {
+				return net.ErrClosed
+			}
+		}
+		n -= chunk
+	}
+	return nil
+}
+
+// Direct is the connection underneath, whose writes are not charged
+func (c *Conn) Direct() net.Conn {
+	return c.Conn
+}
+
+// Write waits for each chunk before sending it, so a large piece message is spread out rather than sent in a burst
+func (c *Conn) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		chunk := len(b) - written
+		for _, l := range c.write {
+			chunk = min(chunk, l.burst())
+		}
+		for _, l := range c.write {
+			if err := l.WaitN(c.ctx, chunk); err != nil {
+				return written, net.ErrClosed
+			}
+		}
+		n, err := c.Conn.Write(b[written : written+chunk])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,149 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// A token bucket: bytes accrue as tokens at the configured rate, up to one second's worth, and a transfer waits until
+// the bucket holds enough tokens to cover it. A rate of zero means unlimited.
+
+// Clock is the source of time for limiters, replaced in tests
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type real_clock struct{}
+
+func (real_clock) Now() time.Time                         { return time.Now() }
+func (real_clock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+type Limiter struct {
+	mutex  sync.Mutex
+	clock  Clock
+	rate   float64 // bytes per second
+	tokens float64
+	last   time.Time
+}
+
+func NewLimiter(rate int) *Limiter {
+	return NewLimiterWithClock(rate, real_clock{})
+}
+
+func NewLimiterWithClock(rate int, clock Clock) *Limiter {
+	return &Limiter{clock: clock, rate: float64(rate), tokens: float64(rate), last: clock.Now()}
+}
+
+func (l *Limiter) Rate() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return int(l.rate)
+}
+
+func (l *Limiter) SetRate(rate int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.refill(l.clock.Now())
+	l.rate = float64(rate)
+	l.tokens = min(l.tokens, l.rate)
+}
+
+// burst is the most that can be taken at once, so larger transfers are split into chunks of this size
+func (l *Limiter) burst() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.rate <= 0 {
+		return math.MaxInt
+	}
+	return max(int(l.rate), 1)
+}
+
+func (l *Limiter) refill(now time.Time) {
+	l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*l.rate, l.rate)
+	l.last = now
+}
+
+// WaitN blocks until n bytes may be transferred, or the context ends
+func (l *Limiter) WaitN(ctx context.Context, n int) error {
+	for n > 0 {
+		chunk := min(n, l.burst())
+		if err := l.wait_chunk(ctx, chunk); err != nil {
+			return err
+		}
+		n -= chunk
+	}
+	return nil
+}
+
+func (l *Limiter) wait_chunk(ctx context.Context, n int) error {
+	for {
+		l.mutex.Lock()
+		if l.rate <= 0 {
+			l.mutex.Unlock()
+			return nil
+		}
+		l.refill(l.clock.Now())
+		if l.tokens >= float64(n) {
+			l.tokens -= float64(n)
+			l.mutex.Unlock()
+			return nil
+		}
+		wait := time.Duration(math.Ceil((float64(n) - l.tokens) / l.rate * float64(time.Second))) // rounding down would spin
+		l.mutex.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-l.clock.After(wait):
+		}
+	}
+}
+
+// Set hands out a limiter per connection, all sharing one rate that can be changed at any time, e.g. a per peer limit
+type Set struct {
+	mutex    sync.Mutex
+	clock    Clock
+	rate     int
+	limiters map[*Limiter]struct{}
+}
+
+func NewSet(rate int) *Set {
+	return NewSetWithClock(rate, real_clock{})
+}
+
+func NewSetWithClock(rate int, clock Clock) *Set {
+	return &Set{clock: clock, rate: rate, limiters: map[*Limiter]struct{}{}}
+}
+
+func (s *Set) Rate() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.rate
+}
+
+func (s *Set) SetRate(rate int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.rate = rate
+	for l := range s.limiters {
+		l.SetRate(rate)
+	}
+}
+
+// New returns a limiter at the set's rate, which follows any changes until released
+func (s *Set) New() *Limiter {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	l := NewLimiterWithClock(s.rate, s.clock)
+	s.limiters[l] = struct{}{}
+	return l
+}
+
+func (s *Set) Release(l *Limiter) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.limiters, l)
+}
@@ -0,0 +1,212 @@
+package ratelimit
+
+import (
+	"context"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock moves time forward only when something waits on it, so tests can measure simulated rates instantly
+type fakeClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(0, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+	result := make(chan time.Time, 1)
+	result <- c.now
+	return result
+}
+
+func (c *fakeClock) elapsed() time.Duration {
+	return c.Now().Sub(time.Unix(0, 0))
+}
+
+// withinPercent checks a measured rate is close to the target
+func withinPercent(t *testing.T, bytes int, elapsed time.Duration, target int, percent float64) {
+	t.Helper()
+	actual := float64(bytes) / elapsed.Seconds()
+	if diff := math.Abs(actual-float64(target)) / float64(target) * 100; diff > percent {
+		t.Errorf("rate was %.0f bytes/s, more than %.1f%% from %d", actual, percent, target)
+	}
+}
+
+func TestLimiter_RateWithinTarget(t *testing.T) {
+	tests := []struct {
+		name  string
+		rate  int
+		chunk int
+	}{
+		{"slow with large chunks", 1000, 1500},
+		{"one block per second", 16384, 16384},
+		{"fast with small chunks", 1 << 20, 1400},
+		{"chunks larger than the burst", 5000, 40000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := newFakeClock()
+			l := NewLimiterWithClock(tt.rate, clock)
+
+			total := 0
+			for total < tt.rate*20 {
+				if err := l.WaitN(context.Background(), tt.chunk); err != nil {
+					t.Fatal(err)
+				}
+				total += tt.chunk
+			}
+			// the bucket starts full, so the first second's worth is free
+			withinPercent(t, total-tt.rate, clock.elapsed(), tt.rate, 3)
+		})
+	}
+}
+
+func TestLimiter_SetRateAtRuntime(t *testing.T) {
+	clock := newFakeClock()
+	l := NewLimiterWithClock(10_000, clock)
+	l.WaitN(context.Background(), 10_000) // empty the bucket
+
+	l.SetRate(2000)
+	start := clock.elapsed()
+	for range 50 {
+		l.WaitN(context.Background(), 1000)
+	}
+	withinPercent(t, 50_000, clock.elapsed()-start, 2000, 3)
+
+	l.SetRate(0)
+	start = clock.elapsed()
+	l.WaitN(context.Background(), 1<<30)
+	if clock.elapsed() != start {
+		t.Error("an unlimited limiter should never wait")
+	}
+}
+
+func TestSet_RateAppliesToEveryLimiter(t *testing.T) {
+	clock := newFakeClock()
+	s := NewSetWithClock(1000, clock)
+	first, second := s.New(), s.New()
+
+	s.SetRate(4000)
+	if first.Rate() != 4000 || second.Rate() != 4000 {
+		t.Errorf("expected both limiters at 4000, got %d and %d", first.Rate(), second.Rate())
+	}
+
+	s.Release(first)
+	s.SetRate(8000)
+	if first.Rate() != 4000 || second.Rate() != 8000 {
+		t.Errorf("expected only the unreleased limiter to change, got %d and %d", first.Rate(), second.Rate())
+	}
+	if third := s.New(); third.Rate() != 8000 {
+		t.Errorf("expected a new limiter at the set's rate, got %d", third.Rate())
+	}
+}
+
+func TestConn_WritesAtTheLowestRate(t *testing.T) {
+	tests := []struct {
+		name   string
+		global int
+		peer   int
+		want   int
+	}{
+		{"peer limited", 50_000, 10_000, 10_000},
+		{"globally limited", 8000, 0, 8000},
+		{"both equal", 12_000, 12_000, 12_000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := newFakeClock()
+			global, peer := NewLimiterWithClock(tt.global, clock), NewLimiterWithClock(tt.peer, clock)
+			// drain the initial bursts so only the steady rate is measured
+			global.WaitN(context.Background(), tt.global)
+			peer.WaitN(context.Background(), tt.peer)
+			start := clock.elapsed()
+
+			local, remote := net.Pipe()
+			defer remote.Close()
+			conn := WrapConn(local, nil, []*Limiter{global, peer})
+			defer conn.Close()
+			go io.Copy(io.Discard, remote)
+
+			data := make([]byte, tt.want*10)
+			n, err := conn.Write(data)
+			if err != nil || n != len(data) {
+				t.Fatalf("wrote %d of %d bytes: %v", n, len(data), err)
+			}
+			withinPercent(t, len(data), clock.elapsed()-start, tt.want, 5)
+		})
+	}
+}
+
+func TestConn_WaitWriteThenDirect(t *testing.T) {
+	clock := newFakeClock()
+	limiter := NewLimiterWithClock(10_000, clock)
+	limiter.WaitN(context.Background(), 10_000) // drain the initial burst
+	local, remote := net.Pipe()
+	defer remote.Close()
+	conn := WrapConn(local, nil, []*Limiter{limiter})
+	defer conn.Close()
+	go io.Copy(io.Discard, remote)
+
+	start := clock.elapsed()
+	if err := conn.WaitWrite(50_000); err != nil {
+		t.Fatal(err)
+	}
+	withinPercent(t, 50_000, clock.elapsed()-start, 10_000, 5)
+
+	start = clock.elapsed()
+	if _, err := conn.Direct().Write(make([]byte, 50_000)); err != nil {
+		t.Fatal(err)
+	}
+	if clock.elapsed() != start {
+		t.Error("expected writing directly not to wait on the limit")
+	}
+}
+
+func TestConn_CloseEndsWaits(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	go io.Copy(io.Discard, remote)
+
+	released := make(chan struct{})
+	conn := WrapConn(local, nil, []*Limiter{NewLimiter(10)}).OnClose(func() { close(released) })
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(make([]byte, 1000)) // would take over a minute
+		result <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	conn.Close()
+	select {
+	case err := <-result:
+		if err == nil {
+			t.Error("expected the write to fail once closed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("write was still waiting after the connection closed")
+	}
+	select {
+	case <-released:
+	default:
+		t.Error("expected OnClose to have run")
+	}
+}
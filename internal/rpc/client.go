@@ -0,0 +1,117 @@
+package rpc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// Client calls a daemon's control API
+type Client struct {
+	base  string
+	token string
+	http  *http.Client
+	id    atomic.Int64
+}
+
+// NewClient creates a client for the daemon listening at address, as given to Listen
+func NewClient(address, token string) *Client {
+	network, target := split_address(address)
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, target)
+		},
+	}
+	base := "http://" + target
+	if network == "unix" {
+		base = "http://daemon" // the host is unused, as every connection goes to the socket
+	}
+	return &Client{base: base, token: token, http: &http.Client{Transport: transport}}
+}
+
+// Call invokes method with params, decoding its result into result unless that is nil
+func (c *Client) Call(ctx context.Context, method string, params, result any) error {
+	request := Request{JSONRPC: "2.0", ID: json.RawMessage(fmt.Sprint(c.id.Add(1))), Method: method}
+	if params != nil {
+		encoded, err := json.Marshal(params)
+		if err != nil {
+			return err
+		}
+		request.Params = encoded
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.do(ctx, http.MethodPost, RPCPath, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var response Response
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return fmt.Errorf("invalid response from daemon: %v", err)
+	}
+	if response.Error != nil {
+		return response.Error
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(response.Result, result)
+}
+
+// Events calls handle with each event from the daemon until ctx ends, the connection drops or handle returns an error
+func (c *Client) Events(ctx context.Context, handle func(Event) error) error {
+	resp, err := c.do(ctx, http.MethodGet, EventsPath, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return fmt.Errorf("invalid event from daemon: %v", err)
+		}
+		if err := handle(e); err != nil {
+			return err
+		}
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return scanner.Err()
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to reach the daemon: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("daemon returned %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	return resp, nil
+}
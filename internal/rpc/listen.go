@@ -0,0 +1,82 @@
+package rpc
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultAddress only accepts connections from this host
+const DefaultAddress = "127.0.0.1:9800"
+
+// Listen listens on a tcp address such as "127.0.0.1:9800", or a unix socket given as "unix:/path/to/socket"
+func Listen(address string) (net.Listener, error) {
+	network, target := split_address(address)
+	if network == "unix" {
+		os.Remove(target) // left behind if a previous daemon was killed
+	}
+	listener, err := net.Listen(network, target)
+	if err != nil {
+		return nil, err
+	}
+	if network == "unix" {
+		os.Chmod(target, 0600)
+	}
+	return listener, nil
+}
+
+func split_address(address string) (network, target string) {
+	if path, found := strings.CutPrefix(address, "unix:"); found {
+		return "unix", path
+	}
+	return "tcp", address
+}
+
+// DefaultTokenFile is where the daemon keeps its token unless told otherwise, in the user's config directory
+func DefaultTokenFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = "."
+	}
+	return filepath.Join(dir, "gorrent", "rpc-token")
+}
+
+// LoadOrCreateToken reads the token from path, first writing a new random one readable only by this user if there
+// is none
+func LoadOrCreateToken(path string) (string, error) {
+	token, err := ReadToken(path)
+	if err == nil || !errors.Is(err, os.ErrNotExist) {
+		return token, err
+	}
+
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	token = hex.EncodeToString(random)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, []byte(token+"\n"), 0600); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// ReadToken reads the token from path, ignoring surrounding whitespace
+func ReadToken(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("token file %s is empty", path)
+	}
+	return token, nil
+}
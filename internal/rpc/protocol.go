@@ -0,0 +1,216 @@
+// Package rpc is the control API of the daemon: JSON-RPC 2.0 over http, POSTed to /rpc, with events streamed as
+// newline delimited json from /events. Every request must carry the daemon's token as "Authorization: Bearer <token>".
+package rpc
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const (
+	RPCPath    = "/rpc"
+	EventsPath = "/events"
+)
+
+// Methods, with their params and results
+const (
+	MethodSessionStats         = "session.stats"            // no params, returns SessionInfo
+	MethodSessionSetLimits     = "session.set_limits"       // SessionLimits, returns SessionInfo
+	MethodSessionSetSeedLimits = "session.set_seed_limits"  // SeedLimits, returns SessionInfo
+	MethodSessionBlocklist     = "session.reload_blocklist" // no params, returns SessionInfo
+	MethodTorrentAdd           = "torrent.add"              // AddParams, returns TorrentInfo
+	MethodTorrentList          = "torrent.list"             // no params, returns []TorrentInfo
+	MethodTorrentGet           = "torrent.get"              // TorrentRef, returns TorrentDetail
+	MethodTorrentPause         = "torrent.pause"            // TorrentRef, returns TorrentInfo
+	MethodTorrentResume        = "torrent.resume"           // TorrentRef, returns TorrentInfo
+	MethodTorrentRemove        = "torrent.remove"           // RemoveParams, returns nothing
+	MethodTorrentMove          = "torrent.move"             // MoveParams, returns TorrentInfo
+	MethodTorrentPriority      = "torrent.set_priority"
+	MethodTorrentSetLimits     = "torrent.set_limits"
+	MethodTorrentSetSeedLimits = "torrent.set_seed_limits"   // TorrentSeedLimits, returns TorrentInfo
+	MethodTorrentSuperSeed     = "torrent.set_super_seeding" // SuperSeedParams, returns TorrentInfo
+)
+
+// error codes from the JSON-RPC spec, and one of our own for failed operations
+const (
+	CodeParseError     = -32700
+	CodeInvalidRequest = -32600
+	CodeMethodNotFound = -32601
+	CodeInvalidParams  = -32602
+	CodeFailed         = -32000
+)
+
+type Request struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type Response struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *Error          `json:"error,omitempty"`
+}
+
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s (code %d)", e.Message, e.Code)
+}
+
+// AddParams adds a torrent from exactly one of: the contents of a .torrent file, a path to one on the daemon's host,
+// or a magnet link
+type AddParams struct {
+	Torrent      []byte `json:"torrent,omitempty"` // base64 in json
+	Path         string `json:"path,omitempty"`
+	Magnet       string `json:"magnet,omitempty"`
+	DownloadDir  string `json:"download_dir,omitempty"`
+	Paused       bool   `json:"paused,omitempty"`
+	DownloadRate int    `json:"download_rate,omitempty"`
+	UploadRate   int    `json:"upload_rate,omitempty"`
+	SuperSeed    bool   `json:"super_seed,omitempty"`
+}
+
+// TorrentRef names a torrent by its info hash, or any prefix of it that matches only one torrent
+type TorrentRef struct {
+	InfoHash string `json:"info_hash"`
+}
+
+type RemoveParams struct {
+	InfoHash   string `json:"info_hash"`
+	DeleteData bool   `json:"delete_data,omitempty"`
+}
+
+// MoveParams moves a torrent's files into a directory on the daemon's host, which becomes its download directory
+type MoveParams struct {
+	InfoHash string `json:"info_hash"`
+	Dir      string `json:"dir"`
+}
+
+// SuperSeedParams turns super-seeding on or off, see client.Torrent.SetSuperSeeding
+type SuperSeedParams struct {
+	InfoHash     string `json:"info_hash"`
+	SuperSeeding bool   `json:"super_seeding"`
+}
+
+type PriorityParams struct {
+	InfoHash string `json:"info_hash"`
+	File     int    `json:"file"`     // index into TorrentDetail.Files
+	Priority string `json:"priority"` // low, normal or high
+}
+
+// TorrentLimits are in bytes per second, 0 for unlimited
+type TorrentLimits struct {
+	InfoHash     string `json:"info_hash"`
+	DownloadRate int    `json:"download_rate"`
+	UploadRate   int    `json:"upload_rate"`
+}
+
+// SessionLimits are in bytes per second, 0 for unlimited. Nil leaves a limit as it is
+type SessionLimits struct {
+	DownloadRate     *int `json:"download_rate,omitempty"`
+	UploadRate       *int `json:"upload_rate,omitempty"`
+	PeerDownloadRate *int `json:"peer_download_rate,omitempty"`
+	PeerUploadRate   *int `json:"peer_upload_rate,omitempty"`
+}
+
+// SeedLimits stop a complete torrent seeding once any is reached, 0 for no limit. Action is stop, remove or delete,
+// taken as stop if empty
+type SeedLimits struct {
+	Ratio       float64 `json:"ratio"`
+	TimeSeconds float64 `json:"time_seconds"`
+	IdleSeconds float64 `json:"idle_seconds"` // with no peer interested
+	Action      string  `json:"action"`
+}
+
+// TorrentSeedLimits gives a torrent limits of its own, or with nil limits, has it follow the session's
+type TorrentSeedLimits struct {
+	InfoHash string      `json:"info_hash"`
+	Limits   *SeedLimits `json:"limits"`
+}
+
+type SessionInfo struct {
+	Port              int        `json:"port"`
+	Torrents          int        `json:"torrents"`
+	DownloadRate      float64    `json:"download_rate"` // current, in bytes per second
+	UploadRate        float64    `json:"upload_rate"`
+	DownloadLimit     int        `json:"download_limit"` // 0 for unlimited
+	UploadLimit       int        `json:"upload_limit"`
+	PeerDownloadLimit int        `json:"peer_download_limit"`
+	PeerUploadLimit   int        `json:"peer_upload_limit"`
+	SeedLimits        SeedLimits `json:"seed_limits"`
+	BlocklistSize     int        `json:"blocklist_size"` // ranges of addresses refused, 0 without a blocklist
+}
+
+type TorrentInfo struct {
+	InfoHash       string     `json:"info_hash"`
+	Name           string     `json:"name"`
+	State          string     `json:"state"`
+	Error          string     `json:"error,omitempty"`
+	TrackerError   string     `json:"tracker_error,omitempty"`
+	DownloadDir    string     `json:"download_dir"`
+	Progress       float64    `json:"progress"`
+	BytesCompleted int64      `json:"bytes_completed"`
+	BytesTotal     int64      `json:"bytes_total"`
+	Peers          int        `json:"peers"`
+	BannedPeers    int        `json:"banned_peers"` // refused for sending data that failed verification
+	Downloaded     int64      `json:"downloaded"`
+	Uploaded       int64      `json:"uploaded"`
+	DownloadRate   float64    `json:"download_rate"`
+	UploadRate     float64    `json:"upload_rate"`
+	DownloadLimit  int        `json:"download_limit"`
+	UploadLimit    int        `json:"upload_limit"`
+	Ratio          float64    `json:"ratio"`
+	SeedingSeconds float64    `json:"seeding_seconds"`
+	SeedLimits     SeedLimits `json:"seed_limits"`
+	OwnSeedLimits  bool       `json:"own_seed_limits"` // rather than the session's
+	SuperSeeding   bool       `json:"super_seeding"`
+	ETASeconds     float64    `json:"eta_seconds"` // -1 if unknown
+	MagnetLink     string     `json:"magnet_link"`
+}
+
+type TorrentDetail struct {
+	TorrentInfo
+	Files    []FileInfo `json:"files"`
+	PeerList []PeerInfo `json:"peer_list"`
+}
+
+type FileInfo struct {
+	Path           string `json:"path"`
+	Length         int64  `json:"length"`
+	BytesCompleted int64  `json:"bytes_completed"`
+	Priority       string `json:"priority"`
+}
+
+type PeerInfo struct {
+	Address      string  `json:"address"`
+	Client       string  `json:"client"`
+	DownloadRate float64 `json:"download_rate"`
+	UploadRate   float64 `json:"upload_rate"`
+	Downloaded   int64   `json:"downloaded"`
+	Uploaded     int64   `json:"uploaded"`
+	Choked       bool    `json:"choked"`
+	Choking      bool    `json:"choking"`
+	Interested   bool    `json:"interested"`
+	AmInterested bool    `json:"am_interested"`
+	Requests     int     `json:"requests"`
+}
+
+// Event is one line of the events stream. Event is one of torrent_added, metadata_received, state_changed,
+// piece_verified, peer_connected, peer_disconnected, torrent_completed or torrent_removed
+type Event struct {
+	Event    string    `json:"event"`
+	Time     time.Time `json:"time"`
+	InfoHash string    `json:"info_hash"`
+	Torrent  string    `json:"torrent"`
+	State    string    `json:"state,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Piece    *int      `json:"piece,omitempty"`
+	Peer     string    `json:"peer,omitempty"`
+}
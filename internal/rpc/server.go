@@ -0,0 +1,535 @@
+package rpc
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/chrispritchard/gorrent/internal/logging"
+	"github.com/chrispritchard/gorrent/pkg/client"
+)
+
+const max_request_size = 16 << 20 // room for a large .torrent file, base64 encoded
+
+// Server answers the control API for a client. It is an http.Handler
+type Server struct {
+	client  *client.Client
+	token   string
+	log     *slog.Logger
+	methods map[string]func(params json.RawMessage) (any, error)
+	mux     *http.ServeMux
+}
+
+// NewServer creates a server for c, requiring token on every request. logger may be nil
+func NewServer(c *client.Client, token string, logger *slog.Logger) *Server {
+	s := &Server{client: c, token: token, log: logging.For(logger, logging.RPC), mux: http.NewServeMux()}
+	s.methods = map[string]func(json.RawMessage) (any, error){
+		MethodSessionStats:         s.session_stats,
+		MethodSessionSetLimits:     s.session_set_limits,
+		MethodSessionSetSeedLimits: s.session_set_seed_limits,
+		MethodSessionBlocklist:     s.session_reload_blocklist,
+		MethodTorrentAdd:           s.torrent_add,
+		MethodTorrentList:          s.torrent_list,
+		MethodTorrentGet:           s.torrent_get,
+		MethodTorrentPause:         s.torrent_pause,
+		MethodTorrentResume:        s.torrent_resume,
+		MethodTorrentRemove:        s.torrent_remove,
+		MethodTorrentMove:          s.torrent_move,
+		MethodTorrentPriority:      s.torrent_set_priority,
+		MethodTorrentSetLimits:     s.torrent_set_limits,
+		MethodTorrentSetSeedLimits: s.torrent_set_seed_limits,
+		MethodTorrentSuperSeed:     s.torrent_set_super_seeding,
+	}
+	s.mux.HandleFunc("POST "+RPCPath, s.serve_rpc)
+	s.mux.HandleFunc("GET "+EventsPath, s.serve_events)
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	given, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found || subtle.ConstantTimeCompare([]byte(given), []byte(s.token)) != 1 {
+		s.log.Warn("rejected a request without a valid token", "remote", r.RemoteAddr, "path", r.URL.Path)
+		http.Error(w, "missing or invalid token", http.StatusUnauthorized)
+		return
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) serve_rpc(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	response := Response{JSONRPC: "2.0", ID: json.RawMessage("null")}
+
+	var request Request
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, max_request_size)).Decode(&request); err != nil {
+		response.Error = &Error{Code: CodeParseError, Message: err.Error()}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	if request.ID != nil {
+		response.ID = request.ID
+	}
+
+	method, ok := s.methods[request.Method]
+	switch {
+	case request.JSONRPC != "2.0":
+		response.Error = &Error{Code: CodeInvalidRequest, Message: `jsonrpc must be "2.0"`}
+	case !ok:
+		response.Error = &Error{Code: CodeMethodNotFound, Message: fmt.Sprintf("unknown method %q", request.Method)}
+	default:
+		result, err := method(request.Params)
+		if err != nil {
+			response.Error = as_error(err)
+			s.log.Debug("call failed", "method", request.Method, "err", err)
+			break
+		}
+		encoded, err := json.Marshal(result)
+		if err != nil {
+			response.Error = &Error{Code: CodeFailed, Message: err.Error()}
+			break
+		}
+		response.Result = encoded
+		s.log.Debug("call", "method", request.Method)
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// serve_events streams every event until the caller disconnects or the client closes
+func (s *Server) serve_events(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+	}
+
+	encoder := json.NewEncoder(w)
+	for e := range s.client.Subscribe(r.Context()) {
+		if err := encoder.Encode(new_event(e)); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+// invalid_params marks an error as the caller's fault, rather than a failure to carry out a valid request
+type invalid_params struct{ error }
+
+func as_error(err error) *Error {
+	if _, ok := err.(invalid_params); ok {
+		return &Error{Code: CodeInvalidParams, Message: err.Error()}
+	}
+	return &Error{Code: CodeFailed, Message: err.Error()}
+}
+
+func decode[T any](params json.RawMessage) (T, error) {
+	var result T
+	if len(params) == 0 {
+		return result, nil
+	}
+	if err := json.Unmarshal(params, &result); err != nil {
+		return result, invalid_params{fmt.Errorf("invalid params: %v", err)}
+	}
+	return result, nil
+}
+
+// find looks a torrent up by its info hash, or a prefix of it that only one torrent has
+func (s *Server) find(info_hash string) (*client.Torrent, error) {
+	info_hash = strings.ToLower(info_hash)
+	if info_hash == "" {
+		return nil, invalid_params{fmt.Errorf("info_hash is required")}
+	}
+	var found *client.Torrent
+	for _, t := range s.client.Torrents() {
+		if !strings.HasPrefix(t.InfoHash().String(), info_hash) {
+			continue
+		}
+		if found != nil {
+			return nil, invalid_params{fmt.Errorf("info hash %s matches more than one torrent", info_hash)}
+		}
+		found = t
+	}
+	if found == nil {
+		return nil, invalid_params{fmt.Errorf("no torrent with info hash %s", info_hash)}
+	}
+	return found, nil
+}
+
+func (s *Server) session_stats(json.RawMessage) (any, error) {
+	info := SessionInfo{Port: s.client.Port()}
+	info.DownloadLimit, info.UploadLimit = s.client.Rates()
+	info.PeerDownloadLimit, info.PeerUploadLimit = s.client.PeerRates()
+	info.SeedLimits = new_seed_limits(s.client.SeedLimits())
+	info.BlocklistSize = s.client.BlocklistSize()
+	for _, t := range s.client.Torrents() {
+		status := t.Status()
+		info.Torrents++
+		info.DownloadRate += status.DownloadRate
+		info.UploadRate += status.UploadRate
+	}
+	return info, nil
+}
+
+func (s *Server) session_reload_blocklist(json.RawMessage) (any, error) {
+	if _, err := s.client.ReloadBlocklist(); err != nil {
+		return nil, err
+	}
+	return s.session_stats(nil)
+}
+
+func (s *Server) session_set_limits(params json.RawMessage) (any, error) {
+	limits, err := decode[SessionLimits](params)
+	if err != nil {
+		return nil, err
+	}
+	for _, rate := range []*int{limits.DownloadRate, limits.UploadRate, limits.PeerDownloadRate, limits.PeerUploadRate} {
+		if rate != nil && *rate < 0 {
+			return nil, invalid_params{fmt.Errorf("rates cannot be negative")}
+		}
+	}
+
+	download, upload := s.client.Rates()
+	s.client.SetRates(or(limits.DownloadRate, download), or(limits.UploadRate, upload))
+	peer_download, peer_upload := s.client.PeerRates()
+	s.client.SetPeerRates(or(limits.PeerDownloadRate, peer_download), or(limits.PeerUploadRate, peer_upload))
+	return s.session_stats(nil)
+}
+
+func (s *Server) session_set_seed_limits(params json.RawMessage) (any, error) {
+	given, err := decode[SeedLimits](params)
+	if err != nil {
+		return nil, err
+	}
+	limits, err := given.limits()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.client.SetSeedLimits(limits); err != nil {
+		return nil, invalid_params{err}
+	}
+	return s.session_stats(nil)
+}
+
+func or(value *int, fallback int) int {
+	if value == nil {
+		return fallback
+	}
+	return *value
+}
+
+func (s *Server) torrent_add(params json.RawMessage) (any, error) {
+	add, err := decode[AddParams](params)
+	if err != nil {
+		return nil, err
+	}
+	given := 0
+	for _, set := range []bool{len(add.Torrent) > 0, add.Path != "", add.Magnet != ""} {
+		if set {
+			given++
+		}
+	}
+	if given != 1 {
+		return nil, invalid_params{fmt.Errorf("exactly one of torrent, path or magnet is required")}
+	}
+	if add.DownloadRate < 0 || add.UploadRate < 0 {
+		return nil, invalid_params{fmt.Errorf("rates cannot be negative")}
+	}
+
+	options := client.AddOptions{
+		DownloadDir:  add.DownloadDir,
+		Paused:       add.Paused,
+		DownloadRate: add.DownloadRate,
+		UploadRate:   add.UploadRate,
+		SuperSeed:    add.SuperSeed,
+	}
+	var t *client.Torrent
+	switch {
+	case add.Magnet != "":
+		t, err = s.client.AddMagnet(add.Magnet, options)
+	default:
+		var info client.Metainfo
+		if add.Path != "" {
+			info, err = client.LoadTorrentFile(add.Path)
+		} else {
+			info, err = client.ParseTorrent(add.Torrent)
+		}
+		if err != nil {
+			return nil, invalid_params{err}
+		}
+		t, err = s.client.AddTorrent(info, options)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.log.Info("added torrent", "torrent", t.Name(), "info_hash", t.InfoHash().String())
+	return new_torrent_info(t), nil
+}
+
+func (s *Server) torrent_list(json.RawMessage) (any, error) {
+	result := []TorrentInfo{}
+	for _, t := range s.client.Torrents() {
+		result = append(result, new_torrent_info(t))
+	}
+	return result, nil
+}
+
+func (s *Server) torrent_get(params json.RawMessage) (any, error) {
+	t, err := s.find_ref(params)
+	if err != nil {
+		return nil, err
+	}
+	detail := TorrentDetail{TorrentInfo: new_torrent_info(t), Files: []FileInfo{}, PeerList: []PeerInfo{}}
+	for _, f := range t.Files() {
+		detail.Files = append(detail.Files, FileInfo{
+			Path:           f.Path,
+			Length:         f.Length,
+			BytesCompleted: f.BytesCompleted,
+			Priority:       f.Priority.String(),
+		})
+	}
+	for _, p := range t.Peers() {
+		detail.PeerList = append(detail.PeerList, PeerInfo{
+			Address:      p.Address,
+			Client:       p.Client,
+			DownloadRate: p.DownloadRate,
+			UploadRate:   p.UploadRate,
+			Downloaded:   p.Downloaded,
+			Uploaded:     p.Uploaded,
+			Choked:       p.Choked,
+			Choking:      p.Choking,
+			Interested:   p.Interested,
+			AmInterested: p.AmInterested,
+			Requests:     p.Requests,
+		})
+	}
+	return detail, nil
+}
+
+func (s *Server) torrent_pause(params json.RawMessage) (any, error) {
+	t, err := s.find_ref(params)
+	if err != nil {
+		return nil, err
+	}
+	t.Pause()
+	return new_torrent_info(t), nil
+}
+
+func (s *Server) torrent_resume(params json.RawMessage) (any, error) {
+	t, err := s.find_ref(params)
+	if err != nil {
+		return nil, err
+	}
+	t.Resume()
+	return new_torrent_info(t), nil
+}
+
+func (s *Server) torrent_remove(params json.RawMessage) (any, error) {
+	remove, err := decode[RemoveParams](params)
+	if err != nil {
+		return nil, err
+	}
+	t, err := s.find(remove.InfoHash)
+	if err != nil {
+		return nil, err
+	}
+	if remove.DeleteData {
+		err = s.client.Delete(t)
+	} else {
+		err = s.client.Remove(t)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.log.Info("removed torrent", "torrent", t.Name(), "info_hash", t.InfoHash().String(), "deleted_data", remove.DeleteData)
+	return nil, nil
+}
+
+func (s *Server) torrent_move(params json.RawMessage) (any, error) {
+	move, err := decode[MoveParams](params)
+	if err != nil {
+		return nil, err
+	}
+	if move.Dir == "" {
+		return nil, invalid_params{fmt.Errorf("no directory to move to")}
+	}
+	t, err := s.find(move.InfoHash)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.Move(move.Dir); err != nil {
+		return nil, err
+	}
+	s.log.Info("moved torrent", "torrent", t.Name(), "info_hash", t.InfoHash().String(), "dir", move.Dir)
+	return new_torrent_info(t), nil
+}
+
+func (s *Server) torrent_set_priority(params json.RawMessage) (any, error) {
+	set, err := decode[PriorityParams](params)
+	if err != nil {
+		return nil, err
+	}
+	t, err := s.find(set.InfoHash)
+	if err != nil {
+		return nil, err
+	}
+	priority, err := ParsePriority(set.Priority)
+	if err != nil {
+		return nil, invalid_params{err}
+	}
+	if err := t.SetFilePriority(set.File, priority); err != nil {
+		return nil, invalid_params{err}
+	}
+	return s.torrent_get(params)
+}
+
+func (s *Server) torrent_set_limits(params json.RawMessage) (any, error) {
+	limits, err := decode[TorrentLimits](params)
+	if err != nil {
+		return nil, err
+	}
+	if limits.DownloadRate < 0 || limits.UploadRate < 0 {
+		return nil, invalid_params{fmt.Errorf("rates cannot be negative")}
+	}
+	t, err := s.find(limits.InfoHash)
+	if err != nil {
+		return nil, err
+	}
+	t.SetRates(limits.DownloadRate, limits.UploadRate)
+	return new_torrent_info(t), nil
+}
+
+func (s *Server) torrent_set_seed_limits(params json.RawMessage) (any, error) {
+	set, err := decode[TorrentSeedLimits](params)
+	if err != nil {
+		return nil, err
+	}
+	t, err := s.find(set.InfoHash)
+	if err != nil {
+		return nil, err
+	}
+	var limits *client.SeedLimits
+	if set.Limits != nil {
+		own, err := set.Limits.limits()
+		if err != nil {
+			return nil, err
+		}
+		limits = &own
+	}
+	if err := t.SetSeedLimits(limits); err != nil {
+		return nil, invalid_params{err}
+	}
+	return new_torrent_info(t), nil
+}
+
+func (s *Server) torrent_set_super_seeding(params json.RawMessage) (any, error) {
+	set, err := decode[SuperSeedParams](params)
+	if err != nil {
+		return nil, err
+	}
+	t, err := s.find(set.InfoHash)
+	if err != nil {
+		return nil, err
+	}
+	t.SetSuperSeeding(set.SuperSeeding)
+	return new_torrent_info(t), nil
+}
+
+func (s *Server) find_ref(params json.RawMessage) (*client.Torrent, error) {
+	ref, err := decode[TorrentRef](params)
+	if err != nil {
+		return nil, err
+	}
+	return s.find(ref.InfoHash)
+}
+
+// ParsePriority reads low, normal or high
+func ParsePriority(s string) (client.Priority, error) {
+	for _, p := range []client.Priority{client.Low, client.Normal, client.High} {
+		if strings.EqualFold(s, p.String()) {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid priority %q, expected low, normal or high", s)
+}
+
+func (l SeedLimits) limits() (client.SeedLimits, error) {
+	limits := client.SeedLimits{
+		Ratio: l.Ratio,
+		Time:  time.Duration(l.TimeSeconds * float64(time.Second)),
+		Idle:  time.Duration(l.IdleSeconds * float64(time.Second)),
+	}
+	if l.Action != "" {
+		action, err := client.ParseSeedAction(l.Action)
+		if err != nil {
+			return limits, invalid_params{err}
+		}
+		limits.Action = action
+	}
+	return limits, nil
+}
+
+func new_seed_limits(l client.SeedLimits) SeedLimits {
+	return SeedLimits{Ratio: l.Ratio, TimeSeconds: l.Time.Seconds(), IdleSeconds: l.Idle.Seconds(), Action: l.Action.String()}
+}
+
+func new_torrent_info(t *client.Torrent) TorrentInfo {
+	status := t.Status()
+	info := TorrentInfo{
+		InfoHash:       t.InfoHash().String(),
+		Name:           t.Name(),
+		State:          status.State.String(),
+		DownloadDir:    t.DownloadDir(),
+		Progress:       status.Progress,
+		BytesCompleted: status.BytesCompleted,
+		BytesTotal:     status.BytesTotal,
+		Peers:          status.Peers,
+		BannedPeers:    status.BannedPeers,
+		Downloaded:     status.Downloaded,
+		Uploaded:       status.Uploaded,
+		DownloadRate:   status.DownloadRate,
+		UploadRate:     status.UploadRate,
+		Ratio:          status.Ratio,
+		SeedingSeconds: status.SeedingTime.Seconds(),
+		ETASeconds:     status.ETA.Seconds(),
+		MagnetLink:     t.MagnetLink(),
+	}
+	if status.ETA < 0 {
+		info.ETASeconds = -1
+	}
+	if status.Err != nil {
+		info.Error = status.Err.Error()
+	}
+	if status.TrackerErr != nil {
+		info.TrackerError = status.TrackerErr.Error()
+	}
+	info.DownloadLimit, info.UploadLimit = t.Rates()
+	limits, own := t.SeedLimits()
+	info.SeedLimits, info.OwnSeedLimits = new_seed_limits(limits), own
+	info.SuperSeeding = t.SuperSeeding()
+	return info
+}
+
+func new_event(e client.Event) Event {
+	event := Event{
+		Event:    strings.ReplaceAll(e.Kind.String(), " ", "_"),
+		Time:     e.Time,
+		InfoHash: e.Torrent.InfoHash().String(),
+		Torrent:  e.Torrent.Name(),
+		Peer:     e.Peer,
+	}
+	switch e.Kind {
+	case client.StateChanged:
+		event.State = e.State.String()
+		if e.Err != nil {
+			event.Error = e.Err.Error()
+		}
+	case client.PieceVerified:
+		event.Piece = &e.Piece
+	}
+	return event
+}
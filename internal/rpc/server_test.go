@@ -0,0 +1,209 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chrispritchard/gorrent/pkg/client"
+)
+
+// startDaemon serves the control API for a client with one complete torrent added, returning a connected rpc client
+func startDaemon(t *testing.T) (*Client, string, []byte) {
+	t.Helper()
+	dir := t.TempDir()
+	source := filepath.Join(dir, "data.bin")
+	if err := os.WriteFile(source, make([]byte, 40_000), 0644); err != nil {
+		t.Fatal(err)
+	}
+	torrent, _, err := client.CreateTorrent(source, client.CreateOptions{PieceLength: 1 << 14})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := client.DefaultConfig()
+	config.ListenPort = 0
+	config.DownloadDir = dir
+	c, err := client.New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	server := httptest.NewServer(NewServer(c, "secret", nil))
+	t.Cleanup(server.Close)
+	return NewClient(strings.TrimPrefix(server.URL, "http://"), "secret"), source, torrent
+}
+
+func TestServer_ManagesTorrents(t *testing.T) {
+	rpc, source, torrent := startDaemon(t)
+	ctx := context.Background()
+
+	var added TorrentInfo
+	if err := rpc.Call(ctx, MethodTorrentAdd, AddParams{Torrent: torrent}, &added); err != nil {
+		t.Fatal(err)
+	}
+	if added.Name != "data.bin" || len(added.InfoHash) != 40 {
+		t.Fatalf("unexpected torrent %+v", added)
+	}
+
+	var list []TorrentInfo
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if err := rpc.Call(ctx, MethodTorrentList, nil, &list); err != nil {
+			t.Fatal(err)
+		}
+		if len(list) == 1 && list[0].State == "seeding" {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if len(list) != 1 || list[0].State != "seeding" || list[0].Progress != 1 {
+		t.Fatalf("expected the torrent to be seeding, got %+v", list)
+	}
+
+	short := added.InfoHash[:8]
+	var detail TorrentDetail
+	if err := rpc.Call(ctx, MethodTorrentPriority, PriorityParams{InfoHash: short, File: 0, Priority: "high"}, &detail); err != nil {
+		t.Fatal(err)
+	}
+	if len(detail.Files) != 1 || detail.Files[0].Priority != "high" {
+		t.Errorf("expected the file to be high priority, got %+v", detail.Files)
+	}
+
+	var limited TorrentInfo
+	if err := rpc.Call(ctx, MethodTorrentSetLimits, TorrentLimits{InfoHash: short, DownloadRate: 1000, UploadRate: 2000}, &limited); err != nil {
+		t.Fatal(err)
+	}
+	if limited.DownloadLimit != 1000 || limited.UploadLimit != 2000 {
+		t.Errorf("expected limits to be set, got %+v", limited)
+	}
+
+	var session SessionInfo
+	if err := rpc.Call(ctx, MethodSessionSetSeedLimits, SeedLimits{Ratio: 2, TimeSeconds: 3600}, &session); err != nil {
+		t.Fatal(err)
+	}
+	if session.SeedLimits != (SeedLimits{Ratio: 2, TimeSeconds: 3600, Action: "stop"}) {
+		t.Errorf("expected the session's seed limits to be set, got %+v", session.SeedLimits)
+	}
+	if err := rpc.Call(ctx, MethodTorrentSetSeedLimits, TorrentSeedLimits{InfoHash: short, Limits: &SeedLimits{IdleSeconds: 600, Action: "remove"}}, &limited); err != nil {
+		t.Fatal(err)
+	}
+	if !limited.OwnSeedLimits || limited.SeedLimits != (SeedLimits{IdleSeconds: 600, Action: "remove"}) {
+		t.Errorf("expected the torrent's own seed limits, got %+v, %v", limited.SeedLimits, limited.OwnSeedLimits)
+	}
+	if err := rpc.Call(ctx, MethodTorrentSuperSeed, SuperSeedParams{InfoHash: short, SuperSeeding: true}, &limited); err != nil || !limited.SuperSeeding {
+		t.Errorf("expected the torrent to be super-seeding, got %v, %v", limited.SuperSeeding, err)
+	}
+
+	moved := filepath.Join(t.TempDir(), "moved")
+	if err := rpc.Call(ctx, MethodTorrentMove, MoveParams{InfoHash: short, Dir: moved}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(source); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the data to have moved, got %v", err)
+	}
+	source = filepath.Join(moved, "data.bin")
+	if _, err := os.Stat(source); err != nil {
+		t.Errorf("expected the data in %s, got %v", moved, err)
+	}
+
+	var paused TorrentInfo
+	if err := rpc.Call(ctx, MethodTorrentPause, TorrentRef{InfoHash: short}, &paused); err != nil {
+		t.Fatal(err)
+	}
+	if paused.State != "paused" {
+		t.Errorf("expected paused, got %s", paused.State)
+	}
+
+	if err := rpc.Call(ctx, MethodTorrentRemove, RemoveParams{InfoHash: short, DeleteData: true}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(source); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the data to be deleted, got %v", err)
+	}
+	if err := rpc.Call(ctx, MethodTorrentList, nil, &list); err != nil || len(list) != 0 {
+		t.Errorf("expected no torrents, got %+v, %v", list, err)
+	}
+}
+
+func TestServer_Errors(t *testing.T) {
+	rpc, _, _ := startDaemon(t)
+	ctx := context.Background()
+
+	tests := []struct {
+		name   string
+		method string
+		params any
+		code   int
+	}{
+		{name: "unknown method", method: "torrent.explode", code: CodeMethodNotFound},
+		{name: "unknown torrent", method: MethodTorrentPause, params: TorrentRef{InfoHash: "abcdef"}, code: CodeInvalidParams},
+		{name: "nothing to add", method: MethodTorrentAdd, params: AddParams{}, code: CodeInvalidParams},
+		{name: "invalid torrent", method: MethodTorrentAdd, params: AddParams{Torrent: []byte("nonsense")}, code: CodeInvalidParams},
+		{name: "negative limit", method: MethodSessionSetLimits, params: map[string]int{"upload_rate": -1}, code: CodeInvalidParams},
+		{name: "unknown seed action", method: MethodSessionSetSeedLimits, params: SeedLimits{Action: "explode"}, code: CodeInvalidParams},
+		{name: "no blocklist", method: MethodSessionBlocklist, code: CodeFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := rpc.Call(ctx, tt.method, tt.params, nil)
+			var rpc_err *Error
+			if !errors.As(err, &rpc_err) || rpc_err.Code != tt.code {
+				t.Errorf("expected error code %d, got %v", tt.code, err)
+			}
+		})
+	}
+
+	wrong := NewClient(strings.TrimPrefix(rpc.base, "http://"), "guess")
+	if err := wrong.Call(ctx, MethodTorrentList, nil, nil); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("expected a wrong token to be refused, got %v", err)
+	}
+}
+
+func TestServer_StreamsEvents(t *testing.T) {
+	rpc, _, torrent := startDaemon(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	events := make(chan Event, 16)
+	go rpc.Events(ctx, func(e Event) error {
+		events <- e
+		return nil
+	})
+	time.Sleep(100 * time.Millisecond) // for the stream to be subscribed
+
+	if err := rpc.Call(ctx, MethodTorrentAdd, AddParams{Torrent: torrent}, nil); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		select {
+		case e := <-events:
+			if e.Event == "state_changed" && e.State == "seeding" && e.Torrent == "data.bin" {
+				return
+			}
+		case <-ctx.Done():
+			t.Fatal("expected the torrent to be reported seeding")
+		}
+	}
+}
+
+func TestLoadOrCreateToken(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gorrent", "token")
+	first, err := LoadOrCreateToken(path)
+	if err != nil || len(first) != 64 {
+		t.Fatalf("expected a new token, got %q, %v", first, err)
+	}
+	second, err := LoadOrCreateToken(path)
+	if err != nil || second != first {
+		t.Errorf("expected the same token again, got %q, %v", second, err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("expected the token file to be private, got %v, %v", info.Mode(), err)
+	}
+}
@@ -0,0 +1,39 @@
+package session
+
+import (
+	"net"
+)
+
+// ban refuses peers at the hosts of addresses for the rest of the torrent's life, closing any connected, after they
+// sent blocks that failed verification. The peers are pruned as their receive loops notice
+func (t *Torrent) ban(addresses []string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.banned == nil {
+		t.banned = map[string]struct{}{}
+	}
+	for _, address := range addresses {
+		t.banned[host(address)] = struct{}{}
+	}
+	for _, p := range t.peers {
+		if _, banned := t.banned[host(p.Address)]; banned {
+			p.Close()
+		}
+	}
+}
+
+func (t *Torrent) is_banned(address string) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	_, banned := t.banned[host(address)]
+	return banned
+}
+
+// host is the IP of an address, as peers connecting to us come from ports other than those they listen on
+func host(address string) string {
+	h, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	return h
+}
@@ -0,0 +1,42 @@
+package session
+
+import (
+	"fmt"
+	"net/netip"
+
+	"github.com/chrispritchard/gorrent/internal/ipfilter"
+)
+
+// ReloadBlocklist reads the blocklist file again, returning how many ranges it blocks, and disconnects any peer it now
+// blocks. The list in use is kept if the file cannot be read
+func (s *Session) ReloadBlocklist() (int, error) {
+	if s.config.Blocklist == "" {
+		return 0, fmt.Errorf("no blocklist is configured")
+	}
+	filter, err := ipfilter.Load(s.config.Blocklist)
+	if err != nil {
+		return s.blocklist.Load().Len(), err
+	}
+	s.blocklist.Store(filter)
+	s.log.Info("loaded blocklist", "path", s.config.Blocklist, "ranges", filter.Len(), "invalid_lines", filter.Invalid())
+
+	for _, t := range s.Torrents() {
+		for _, p := range t.peer_list() {
+			if s.blocked(p.Address) {
+				p.Close() // pruned as its receive loop notices
+			}
+		}
+	}
+	return filter.Len(), nil
+}
+
+// BlocklistSize is the number of ranges blocked, 0 without a blocklist
+func (s *Session) BlocklistSize() int {
+	return s.blocklist.Load().Len()
+}
+
+// blocked is whether the blocklist covers the host of an address
+func (s *Session) blocked(address string) bool {
+	addr, err := netip.ParseAddr(host(address))
+	return err == nil && s.blocklist.Load().Blocked(addr)
+}
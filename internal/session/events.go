@@ -0,0 +1,59 @@
+package session
+
+import "time"
+
+type EventKind int
+
+const (
+	TorrentAdded EventKind = iota
+	MetadataReceived
+	StateChanged
+	PieceVerified
+	PeerConnected
+	PeerDisconnected
+	TorrentCompleted
+	TorrentRemoved
+)
+
+// Event reports something that happened to a torrent. Only the fields relevant to the kind are set
+type Event struct {
+	Kind    EventKind
+	Time    time.Time
+	Torrent *Torrent
+	State   State  // for StateChanged
+	Err     error  // for StateChanged to Failed
+	Piece   int    // for PieceVerified
+	Peer    string // for PeerConnected and PeerDisconnected
+}
+
+// emit passes an event to the configured handler. It is called from the torrents' goroutines, never holding a lock,
+// so the handler can query the session but must not block
+func (s *Session) emit(event Event) {
+	if s.config.OnEvent == nil {
+		return
+	}
+	event.Time = time.Now()
+	s.config.OnEvent(event)
+}
+
+func (k EventKind) String() string {
+	switch k {
+	case TorrentAdded:
+		return "torrent added"
+	case MetadataReceived:
+		return "metadata received"
+	case StateChanged:
+		return "state changed"
+	case PieceVerified:
+		return "piece verified"
+	case PeerConnected:
+		return "peer connected"
+	case PeerDisconnected:
+		return "peer disconnected"
+	case TorrentCompleted:
+		return "torrent completed"
+	case TorrentRemoved:
+		return "torrent removed"
+	}
+	return "unknown"
+}
@@ -0,0 +1,133 @@
+package session
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/chrispritchard/gorrent/internal/bitfields"
+	"github.com/chrispritchard/gorrent/internal/downloading"
+	outfiles "github.com/chrispritchard/gorrent/internal/out_files"
+	. "github.com/chrispritchard/gorrent/internal/torrent_files"
+)
+
+// Resume state is saved for each torrent as its run ends, in Config.ResumeDir. The next run, even of another process,
+// trusts it for files unchanged since, so only changed files are checked, and carries on the totals and time seeded
+// that the seed limits go by
+
+type resume_state struct {
+	Pieces     []byte               `json:"pieces"` // the bitfield
+	PieceCount int                  `json:"piece_count"`
+	Files      []outfiles.FileState `json:"files"`
+	Downloaded int64                `json:"downloaded"`
+	Uploaded   int64                `json:"uploaded"`
+	Wasted     int64                `json:"wasted"`
+	Failures   int64                `json:"hash_failures"`
+	Seeded     time.Duration        `json:"seeded"`
+}
+
+// resume_path is empty if resume state is not kept
+func (t *Torrent) resume_path(metadata TorrentMetadata) string {
+	if t.session.config.ResumeDir == "" {
+		return ""
+	}
+	return filepath.Join(t.session.config.ResumeDir, hex.EncodeToString(metadata.InfoHash[:])+".resume")
+}
+
+// check_files finds the pieces already on disk, using the resume state if there is any. Totals and time seeded are
+// only taken from it by the first run, as later ones carry on from the one before
+func (t *Torrent) check_files(metadata TorrentMetadata, out_files *outfiles.OutFileManager) (*bitfields.BitField, error) {
+	state, err := t.load_resume(metadata)
+	if err != nil {
+		t.log.Warn("ignoring resume state", "err", err)
+	}
+	if state == nil {
+		return out_files.Bitfield()
+	}
+
+	t.mutex.Lock()
+	if t.download == nil {
+		t.past = downloading.Stats{Downloaded: state.Downloaded, Uploaded: state.Uploaded, Wasted: state.Wasted, HashFailures: state.Failures}
+		t.seeded = state.Seeded
+	}
+	t.mutex.Unlock()
+	return out_files.Resume(bitfields.NewBitfield(state.Pieces, state.PieceCount), state.Files), nil
+}
+
+// load_resume returns nil without an error if there is no resume state
+func (t *Torrent) load_resume(metadata TorrentMetadata) (*resume_state, error) {
+	path := t.resume_path(metadata)
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state resume_state
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("invalid resume state %s: %v", path, err)
+	}
+	if len(state.Pieces) != (state.PieceCount+7)/8 {
+		return nil, fmt.Errorf("invalid resume state %s: %d pieces in %d bytes", path, state.PieceCount, len(state.Pieces))
+	}
+	return &state, nil
+}
+
+// save_resume records what the run ends with. out_files must be closed, so the files are as they will be next time
+func (t *Torrent) save_resume(metadata TorrentMetadata, ds *downloading.DownloadState, out_files *outfiles.OutFileManager) {
+	path := t.resume_path(metadata)
+	if path == "" {
+		return
+	}
+	status := t.Status()
+	pieces := ds.Bitfield()
+	state := resume_state{
+		Pieces:     pieces.Data,
+		PieceCount: pieces.Length,
+		Files:      out_files.FileStates(),
+		Downloaded: status.Downloaded,
+		Uploaded:   status.Uploaded,
+		Wasted:     status.Wasted,
+		Failures:   status.HashFailures,
+		Seeded:     status.SeedingTime,
+	}
+	if err := write_resume(path, state); err != nil {
+		t.log.Warn("failed to save resume state", "err", err)
+	}
+}
+
+// write_resume replaces the file whole, so a crash part way leaves the old state rather than a broken one
+func write_resume(path string, state resume_state) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	temp := path + ".tmp"
+	if err := os.WriteFile(temp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(temp, path)
+}
+
+// forget_resume deletes the resume state of a removed torrent
+func (t *Torrent) forget_resume() {
+	if !t.HasMetadata() {
+		return
+	}
+	if path := t.resume_path(t.Metadata()); path != "" {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			t.log.Warn("failed to delete resume state", "err", err)
+		}
+	}
+}
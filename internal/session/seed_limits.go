@@ -0,0 +1,165 @@
+package session
+
+import (
+	"fmt"
+	"time"
+)
+
+// SeedLimits say when a complete torrent should stop seeding. Zero values are no limit
+type SeedLimits struct {
+	Ratio  float64       // uploaded over downloaded, see Status.Ratio
+	Time   time.Duration // spent seeding, across runs
+	Idle   time.Duration // seeding with no peer interested in what we have
+	Action SeedAction    // taken once any limit is reached
+}
+
+type SeedAction int
+
+const (
+	SeedStop   SeedAction = iota // pause the torrent
+	SeedRemove                   // remove it, leaving the files
+	SeedDelete                   // remove it and delete the files
+)
+
+func (a SeedAction) String() string {
+	switch a {
+	case SeedStop:
+		return "stop"
+	case SeedRemove:
+		return "remove"
+	case SeedDelete:
+		return "delete"
+	}
+	return "unknown"
+}
+
+// ParseSeedAction reads stop, remove or delete
+func ParseSeedAction(s string) (SeedAction, error) {
+	for _, a := range []SeedAction{SeedStop, SeedRemove, SeedDelete} {
+		if s == a.String() {
+			return a, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown seed action %q, expected stop, remove or delete", s)
+}
+
+func (l SeedLimits) Validate() error {
+	if l.Ratio < 0 || l.Time < 0 || l.Idle < 0 {
+		return fmt.Errorf("seed limits cannot be negative")
+	}
+	if l.Action < SeedStop || l.Action > SeedDelete {
+		return fmt.Errorf("invalid seed action %d", l.Action)
+	}
+	return nil
+}
+
+// reached names the first limit reached, or returns empty if none are
+func (l SeedLimits) reached(ratio float64, seeding, idle time.Duration) string {
+	switch {
+	case l.Ratio > 0 && ratio >= l.Ratio:
+		return fmt.Sprintf("ratio %.2f reached", ratio)
+	case l.Time > 0 && seeding >= l.Time:
+		return fmt.Sprintf("seeded for %s", seeding.Round(time.Second))
+	case l.Idle > 0 && idle >= l.Idle:
+		return fmt.Sprintf("no peer interested for %s", idle.Round(time.Second))
+	}
+	return ""
+}
+
+// SetSeedLimits changes the limits of every torrent without limits of its own
+func (s *Session) SetSeedLimits(limits SeedLimits) error {
+	if err := limits.Validate(); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.seed_limits = limits
+	return nil
+}
+
+func (s *Session) SeedLimits() SeedLimits {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.seed_limits
+}
+
+// SetSeedLimits gives the torrent limits of its own, or with nil, has it follow the session's
+func (t *Torrent) SetSeedLimits(limits *SeedLimits) error {
+	if limits != nil {
+		if err := limits.Validate(); err != nil {
+			return err
+		}
+		copied := *limits
+		limits = &copied
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.seed_limits = limits
+	return nil
+}
+
+// SeedLimits returns the limits that apply to the torrent, and whether they are its own rather than the session's
+func (t *Torrent) SeedLimits() (SeedLimits, bool) {
+	t.mutex.Lock()
+	own := t.seed_limits
+	t.mutex.Unlock()
+	if own != nil {
+		return *own, true
+	}
+	return t.session.SeedLimits(), false
+}
+
+// seeding notes the torrent starting or stopping seeding, for the time spent seeding and idle
+func (t *Torrent) seeding(started bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	now := time.Now()
+	if !t.seeding_since.IsZero() {
+		t.seeded += now.Sub(t.seeding_since)
+	}
+	t.seeding_since, t.idle_since = time.Time{}, time.Time{}
+	if started {
+		t.seeding_since, t.idle_since = now, now
+	}
+}
+
+// check_seed_limits acts on the first seed limit reached, returning true if it did. The action is taken on another
+// goroutine, as it stops the run this is called from
+func (t *Torrent) check_seed_limits() bool {
+	status := t.Status()
+	if status.State != Seeding {
+		return false
+	}
+	interested := false
+	for _, p := range t.peer_list() {
+		interested = interested || p.Interested()
+	}
+	t.mutex.Lock()
+	if interested || t.idle_since.IsZero() {
+		t.idle_since = time.Now()
+	}
+	idle := time.Since(t.idle_since)
+	t.mutex.Unlock()
+
+	limits, _ := t.SeedLimits()
+	reason := limits.reached(status.Ratio, status.SeedingTime, idle)
+	if reason == "" {
+		return false
+	}
+	t.log.Info("seed limit reached", "reason", reason, "action", limits.Action.String())
+	go func() {
+		var err error
+		switch limits.Action {
+		case SeedStop:
+			t.Pause()
+		case SeedRemove:
+			err = t.session.Remove(t)
+		case SeedDelete:
+			err = t.session.Delete(t)
+		}
+		if err != nil {
+			t.log.Warn("unable to act on the seed limit", "action", limits.Action.String(), "err", err)
+		}
+	}()
+	return true
+}
@@ -0,0 +1,420 @@
+package session
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/chrispritchard/gorrent/internal/downloading"
+	"github.com/chrispritchard/gorrent/internal/ipfilter"
+	"github.com/chrispritchard/gorrent/internal/logging"
+	outfiles "github.com/chrispritchard/gorrent/internal/out_files"
+	"github.com/chrispritchard/gorrent/internal/peer"
+	"github.com/chrispritchard/gorrent/internal/proxy"
+	"github.com/chrispritchard/gorrent/internal/ratelimit"
+	. "github.com/chrispritchard/gorrent/internal/torrent_files"
+	"github.com/chrispritchard/gorrent/internal/tracker"
+	"github.com/chrispritchard/gorrent/internal/webseed"
+)
+
+// A session runs any number of torrents side by side. They share one listening port, with inbound connections routed
+// to their torrent by the info hash in the handshake, along with a cap on peer connections and the bandwidth limits.
+
+const port_attempts = 9   // the traditional range, 6881 to 6889
+const metadata_peers = 10 // asked at once for the info dict of a magnet link
+const min_block_size = 1 << 10
+
+type Config struct {
+	Port             int // 0 picks any free port, otherwise the next free one in the following few is used
+	MaxPeers         int // across all torrents
+	MaxTorrentPeers  int
+	UploadSlots      int // peers unchoked at once, per torrent
+	DownloadRate     int // bytes per second across all torrents, 0 for unlimited
+	UploadRate       int
+	PeerDownloadRate int // bytes per second for each peer connection, 0 for unlimited
+	PeerUploadRate   int
+	Timeouts         peer.Timeouts
+	WebSeedTimeout   time.Duration // for each request to a web seed
+	Download         downloading.Config
+	Intervals        Intervals
+	IncompleteDir    string       // optional, where torrents download to before moving to their output directory
+	ResumeDir        string       // optional, where each torrent's resume state is kept between runs, see resume.go
+	SeedLimits       SeedLimits   // for torrents without limits of their own
+	SuperSeed        bool         // whether torrents start super-seeding, see Torrent.SetSuperSeeding
+	Blocklist        string       // optional, the path of a list of addresses never to connect to, see ipfilter.Parse
+	Proxy            string       // optional, a socks5:// or http:// url to connect to peers, trackers and web seeds through
+	ProxyOnly        bool         // refuse inbound peer connections, which cannot come through the proxy. Needs Proxy
+	Logger           *slog.Logger // optional, with torrents, peers and the rest logging through child loggers
+	OnEvent          func(Event)  // optional, see emit
+}
+
+// Intervals pace the session's periodic work
+type Intervals struct {
+	MinAnnounce   time.Duration // the least time between announces, whatever the tracker asks for
+	RetryAnnounce time.Duration // after a failed announce
+	Rechoke       time.Duration // between choosing which peers to upload to
+	KeepAlive     time.Duration // between keep-alives sent to each peer
+	StopAnnounce  time.Duration // how long to wait on trackers when stopping
+	Announce      time.Duration // the most each announce may take
+}
+
+func DefaultIntervals() Intervals {
+	return Intervals{
+		MinAnnounce:   30 * time.Second,
+		RetryAnnounce: 1 * time.Minute,
+		Rechoke:       10 * time.Second,
+		KeepAlive:     2 * time.Minute,
+		StopAnnounce:  5 * time.Second,
+		Announce:      tracker.DefaultTimeout,
+	}
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Port:            6881,
+		MaxPeers:        200,
+		MaxTorrentPeers: 50,
+		UploadSlots:     4,
+		Timeouts:        peer.DefaultTimeouts(),
+		WebSeedTimeout:  webseed.DefaultTimeout,
+		Download:        downloading.DefaultConfig(),
+		Intervals:       DefaultIntervals(),
+	}
+}
+
+type Session struct {
+	config        Config
+	logger        *slog.Logger // the root, for torrents to derive theirs from
+	log           *slog.Logger
+	peer_id       []byte
+	listener      net.Listener
+	ctx           context.Context
+	cancel        context.CancelFunc
+	mutex         sync.Mutex
+	torrents      map[[20]byte]*Torrent // keyed by every swarm hash, so hybrid torrents appear twice
+	order         []*Torrent
+	peer_slots    chan struct{}
+	download      *ratelimit.Limiter
+	upload        *ratelimit.Limiter
+	peer_download *ratelimit.Set
+	peer_upload   *ratelimit.Set
+	seed_limits   SeedLimits
+	blocklist     atomic.Pointer[ipfilter.Filter] // nil until one is loaded
+	proxy         *proxy.Proxy                    // nil to connect directly
+	transport     http.RoundTripper               // for trackers and web seeds, nil for the default
+	trackers      *http.Client
+}
+
+// NewSession starts listening for peers. Timeouts, intervals and download settings take their defaults where zero
+func NewSession(config Config) (*Session, error) {
+	if config.MaxPeers <= 0 || config.MaxTorrentPeers <= 0 || config.UploadSlots <= 0 {
+		return nil, fmt.Errorf("peer limits and upload slots must be positive")
+	}
+	timeouts, intervals, download := peer.DefaultTimeouts(), DefaultIntervals(), downloading.DefaultConfig()
+	config.Timeouts = peer.Timeouts{
+		Connect:  or_default(config.Timeouts.Connect, timeouts.Connect),
+		Idle:     or_default(config.Timeouts.Idle, timeouts.Idle),
+		Metadata: or_default(config.Timeouts.Metadata, timeouts.Metadata),
+		Write:    or_default(config.Timeouts.Write, timeouts.Write),
+	}
+	config.Intervals = Intervals{
+		MinAnnounce:   or_default(config.Intervals.MinAnnounce, intervals.MinAnnounce),
+		RetryAnnounce: or_default(config.Intervals.RetryAnnounce, intervals.RetryAnnounce),
+		Rechoke:       or_default(config.Intervals.Rechoke, intervals.Rechoke),
+		KeepAlive:     or_default(config.Intervals.KeepAlive, intervals.KeepAlive),
+		StopAnnounce:  or_default(config.Intervals.StopAnnounce, intervals.StopAnnounce),
+		Announce:      or_default(config.Intervals.Announce, intervals.Announce),
+	}
+	config.Download = downloading.Config{
+		BlockSize:       or_default(config.Download.BlockSize, download.BlockSize),
+		RequestInterval: or_default(config.Download.RequestInterval, download.RequestInterval),
+		RequestMaxAge:   or_default(config.Download.RequestMaxAge, download.RequestMaxAge),
+	}
+	config.WebSeedTimeout = or_default(config.WebSeedTimeout, webseed.DefaultTimeout)
+	if b := config.Download.BlockSize; b < min_block_size || b > downloading.DefaultBlockSize || b&(b-1) != 0 {
+		return nil, fmt.Errorf("block size must be a power of two from %d to %d bytes", min_block_size, downloading.DefaultBlockSize)
+	}
+	if err := config.SeedLimits.Validate(); err != nil {
+		return nil, err
+	}
+	var through *proxy.Proxy
+	if config.Proxy != "" {
+		parsed, err := proxy.Parse(config.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		through = parsed
+	} else if config.ProxyOnly {
+		return nil, fmt.Errorf("refusing direct connections needs a proxy")
+	}
+
+	peer_id, err := tracker.GeneratePeerID()
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := listen(config.Port)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Session{
+		config:        config,
+		logger:        logging.OrDiscard(config.Logger),
+		log:           logging.For(config.Logger, logging.Session),
+		peer_id:       peer_id,
+		listener:      listener,
+		ctx:           ctx,
+		cancel:        cancel,
+		torrents:      map[[20]byte]*Torrent{},
+		peer_slots:    make(chan struct{}, config.MaxPeers),
+		download:      ratelimit.NewLimiter(config.DownloadRate),
+		upload:        ratelimit.NewLimiter(config.UploadRate),
+		peer_download: ratelimit.NewSet(config.PeerDownloadRate),
+		peer_upload:   ratelimit.NewSet(config.PeerUploadRate),
+		seed_limits:   config.SeedLimits,
+		proxy:         through,
+	}
+	if through != nil {
+		s.transport = through.Transport()
+		s.log.Info("connecting through a proxy", "proxy", through.String(), "proxy_only", config.ProxyOnly)
+	}
+	s.trackers = &http.Client{Transport: s.transport, Timeout: config.Intervals.Announce}
+	if config.Blocklist != "" {
+		if _, err := s.ReloadBlocklist(); err != nil {
+			listener.Close()
+			cancel()
+			return nil, err
+		}
+	}
+	go s.accept_loop()
+	return s, nil
+}
+
+func or_default[T comparable](value, fallback T) T {
+	var zero T
+	if value == zero {
+		return fallback
+	}
+	return value
+}
+
+func listen(port int) (net.Listener, error) {
+	if port == 0 {
+		return net.Listen("tcp", ":0")
+	}
+	var last_err error
+	for p := port; p < port+port_attempts; p++ {
+		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", p))
+		if err == nil {
+			return listener, nil
+		}
+		last_err = err
+	}
+	return nil, fmt.Errorf("unable to listen on ports %d to %d: %v", port, port+port_attempts-1, last_err)
+}
+
+func (s *Session) Port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (s *Session) PeerID() []byte {
+	return s.peer_id
+}
+
+// SetRates changes the session-wide bandwidth limits, in bytes per second with 0 for unlimited
+func (s *Session) SetRates(download, upload int) {
+	s.download.SetRate(download)
+	s.upload.SetRate(upload)
+}
+
+// Rates returns the session-wide bandwidth limits
+func (s *Session) Rates() (download, upload int) {
+	return s.download.Rate(), s.upload.Rate()
+}
+
+// SetPeerRates changes the bandwidth limits of every peer connection, existing and future
+func (s *Session) SetPeerRates(download, upload int) {
+	s.peer_download.SetRate(download)
+	s.peer_upload.SetRate(upload)
+}
+
+func (s *Session) PeerRates() (download, upload int) {
+	return s.peer_download.Rate(), s.peer_upload.Rate()
+}
+
+// Add registers a torrent, saving its files into output_dir, and starts it unless paused
+func (s *Session) Add(metadata TorrentMetadata, output_dir string, paused bool) (*Torrent, error) {
+	return s.add(new_torrent(s, metadata, nil, output_dir), paused)
+}
+
+// AddMagnet registers a torrent whose metadata will be fetched from peers, once started
+func (s *Session) AddMagnet(magnet Magnet, output_dir string, paused bool) (*Torrent, error) {
+	return s.add(new_torrent(s, magnet.Metadata(), &magnet, output_dir), paused)
+}
+
+func (s *Session) add(t *Torrent, paused bool) (*Torrent, error) {
+	metadata := t.Metadata()
+	s.mutex.Lock()
+	if s.ctx.Err() != nil {
+		s.mutex.Unlock()
+		return nil, fmt.Errorf("session is closed")
+	}
+	for _, h := range metadata.SwarmHashes() {
+		if _, exists := s.torrents[h]; exists {
+			s.mutex.Unlock()
+			return nil, fmt.Errorf("torrent %s has already been added", metadata.Name)
+		}
+	}
+	for _, h := range metadata.SwarmHashes() {
+		s.torrents[h] = t
+	}
+	s.order = append(s.order, t)
+	s.mutex.Unlock()
+
+	s.emit(Event{Kind: TorrentAdded, Torrent: t})
+	if !paused {
+		t.Resume()
+	}
+	return t, nil
+}
+
+// register adds any swarms the torrent joined once its metadata arrived, e.g. the v2 swarm of a hybrid torrent
+func (s *Session) register(t *Torrent, metadata TorrentMetadata) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, h := range metadata.SwarmHashes() {
+		if _, exists := s.torrents[h]; !exists {
+			s.torrents[h] = t
+		}
+	}
+}
+
+// Remove stops the torrent and forgets it. Downloaded files are left in place
+func (s *Session) Remove(t *Torrent) error {
+	s.mutex.Lock()
+	found := false
+	for i, o := range s.order {
+		if o == t {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			found = true
+			break
+		}
+	}
+	if found {
+		for h, o := range s.torrents {
+			if o == t {
+				delete(s.torrents, h)
+			}
+		}
+	}
+	s.mutex.Unlock()
+
+	if !found {
+		return fmt.Errorf("torrent %s is not in this session", t.Metadata().Name)
+	}
+	t.Pause()
+	t.forget_resume()
+	s.emit(Event{Kind: TorrentRemoved, Torrent: t})
+	return nil
+}
+
+// Delete removes the torrent, as Remove, then deletes its downloaded files
+func (s *Session) Delete(t *Torrent) error {
+	if err := s.Remove(t); err != nil {
+		return err
+	}
+	if !t.HasMetadata() {
+		return nil // nothing can have been written
+	}
+	if err := outfiles.DeleteFiles(t.Metadata(), t.DataDir()); err != nil {
+		return fmt.Errorf("failed to delete the files of %s: %v", t.Metadata().Name, err)
+	}
+	return nil
+}
+
+// Torrents returns every torrent in the order they were added
+func (s *Session) Torrents() []*Torrent {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]*Torrent{}, s.order...)
+}
+
+// Find looks a torrent up by any of its swarm info hashes
+func (s *Session) Find(info_hash [20]byte) (*Torrent, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	t, ok := s.torrents[info_hash]
+	return t, ok
+}
+
+// Close stops every torrent and the listener. Torrents stop side by side, each closing its peers and files then telling
+// its trackers, so this takes at most about the stop announce interval however many there are
+func (s *Session) Close() error {
+	s.cancel()
+	err := s.listener.Close()
+	var wg sync.WaitGroup
+	for _, t := range s.Torrents() {
+		wg.Go(t.Pause)
+	}
+	wg.Wait()
+	return err
+}
+
+func (s *Session) accept_loop() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if s.ctx.Err() != nil {
+				return
+			}
+			s.log.Warn("failed to accept a connection", "err", err)
+			continue
+		}
+		if s.config.ProxyOnly || s.blocked(conn.RemoteAddr().String()) {
+			s.log.Debug("refused an inbound peer", "peer", conn.RemoteAddr().String(), "proxy_only", s.config.ProxyOnly)
+			conn.Close()
+			continue
+		}
+		go s.dispatch(conn)
+	}
+}
+
+// dispatch reads an inbound handshake and hands the connection to the torrent it names, if we have it
+func (s *Session) dispatch(conn net.Conn) {
+	handshake, err := peer.ReadHandshake(conn, s.config.Timeouts.Connect)
+	if err != nil {
+		s.log.Debug("invalid handshake", "peer", conn.RemoteAddr().String(), "err", err)
+		conn.Close()
+		return
+	}
+
+	t, ok := s.Find(handshake.InfoHash)
+	if !ok {
+		conn.Close()
+		return
+	}
+	wrapped := t.wrap(conn)
+	if !t.offer(inbound_conn{wrapped, handshake}) {
+		wrapped.Close()
+	}
+}
+
+func (s *Session) try_acquire_slot() bool {
+	select {
+	case s.peer_slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Session) release_slot() {
+	<-s.peer_slots
+}
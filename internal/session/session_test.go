@@ -0,0 +1,749 @@
+package session
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chrispritchard/gorrent/internal/bencode"
+	. "github.com/chrispritchard/gorrent/internal/torrent_files"
+)
+
+// testConfig is the default, but announcing and rechoking fast enough for tests
+func testConfig() Config {
+	config := DefaultConfig()
+	config.Intervals.MinAnnounce = 100 * time.Millisecond
+	config.Intervals.RetryAnnounce = 100 * time.Millisecond
+	config.Intervals.Rechoke = 200 * time.Millisecond
+	return config
+}
+
+// startTracker serves compact peer lists of everyone who has announced for each info hash, bar the one asking
+func startTracker(t *testing.T) string {
+	var mutex sync.Mutex
+	swarms := map[string]map[int]struct{}{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info_hash := r.URL.Query().Get("info_hash")
+		port, _ := strconv.Atoi(r.URL.Query().Get("port"))
+
+		mutex.Lock()
+		if swarms[info_hash] == nil {
+			swarms[info_hash] = map[int]struct{}{}
+		}
+		swarms[info_hash][port] = struct{}{}
+		peers := []byte{}
+		for p := range swarms[info_hash] {
+			if p != port {
+				peers = append(peers, 127, 0, 0, 1)
+				peers = binary.BigEndian.AppendUint16(peers, uint16(p))
+			}
+		}
+		mutex.Unlock()
+
+		data, _ := bencode.Encode(map[string]any{"interval": 1, "peers": peers})
+		w.Write(data)
+	}))
+	t.Cleanup(server.Close)
+	return server.URL + "/announce"
+}
+
+func makeTorrent(t *testing.T, dir, name string, size int, announce string) (TorrentMetadata, []byte) {
+	data := make([]byte, size)
+	rand.Read(data)
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, metadata, err := CreateTorrent(path, CreateOptions{PieceLength: 1 << 14, Announce: [][]string{{announce}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return metadata, data
+}
+
+func newTestSession(t *testing.T) *Session {
+	config := testConfig()
+	config.Port = 0
+	s, err := NewSession(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func waitForState(t *testing.T, torrent *Torrent, state State) {
+	deadline := time.Now().Add(20 * time.Second)
+	for time.Now().Before(deadline) {
+		status := torrent.Status()
+		if status.State == state {
+			return
+		}
+		if status.State == Failed {
+			t.Fatalf("%s failed: %v", torrent.Metadata().Name, status.Err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	status := torrent.Status()
+	t.Fatalf("%s did not reach %s, is %s with %d/%d pieces", torrent.Metadata().Name, state, status.State, status.CompletedPieces, status.TotalPieces)
+}
+
+func TestSession_DownloadsSeveralTorrentsThroughOnePort(t *testing.T) {
+	announce := startTracker(t)
+	seed_dir, leech_dir := t.TempDir(), t.TempDir()
+
+	first, first_data := makeTorrent(t, seed_dir, "first.bin", 200_000, announce)
+	second, second_data := makeTorrent(t, seed_dir, "second.bin", 70_000, announce)
+
+	seeder := newTestSession(t)
+	leecher := newTestSession(t)
+
+	for _, m := range []TorrentMetadata{first, second} {
+		torrent, err := seeder.Add(m, seed_dir, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitForState(t, torrent, Seeding)
+	}
+
+	for _, m := range []TorrentMetadata{first, second} {
+		torrent, err := leecher.Add(m, leech_dir, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitForState(t, torrent, Seeding)
+
+		status := torrent.Status()
+		if status.Downloaded < int64(m.Length) || status.ETA != 0 {
+			t.Errorf("%s: expected at least %d bytes downloaded and no ETA, got %+v", m.Name, m.Length, status)
+		}
+	}
+
+	uploaded := int64(0)
+	for _, torrent := range seeder.Torrents() {
+		status := torrent.Status()
+		uploaded += status.Uploaded
+		if status.Downloaded != 0 || status.Uploaded > 0 && status.Ratio <= 0 {
+			t.Errorf("%s: seeder stats are inconsistent: %+v", torrent.Metadata().Name, status)
+		}
+	}
+	if uploaded == 0 {
+		t.Error("expected the seeder to count its uploads")
+	}
+
+	for name, want := range map[string][]byte{"first.bin": first_data, "second.bin": second_data} {
+		got, err := os.ReadFile(filepath.Join(leech_dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s does not match the seeded data", name)
+		}
+	}
+}
+
+func TestSession_PauseResumeRemove(t *testing.T) {
+	dir := t.TempDir()
+	metadata, _ := makeTorrent(t, dir, "data.bin", 50_000, "http://127.0.0.1:1/announce")
+	s := newTestSession(t)
+
+	torrent, err := s.Add(metadata, dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, torrent, Seeding)
+
+	if _, err := s.Add(metadata, dir, false); err == nil {
+		t.Error("expected adding the same torrent twice to fail")
+	}
+
+	torrent.Pause()
+	if state := torrent.Status().State; state != Paused {
+		t.Errorf("expected paused, got %s", state)
+	}
+
+	torrent.Resume()
+	waitForState(t, torrent, Seeding)
+
+	if err := s.Remove(torrent); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := s.Find(metadata.InfoHash); found {
+		t.Error("removed torrent should no longer be found")
+	}
+	if len(s.Torrents()) != 0 {
+		t.Errorf("expected no torrents, got %d", len(s.Torrents()))
+	}
+	if err := s.Remove(torrent); err == nil {
+		t.Error("expected removing twice to fail")
+	}
+}
+
+func TestSession_ClosesUnknownInfoHash(t *testing.T) {
+	s := newTestSession(t)
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", s.Port()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	handshake := make([]byte, 68)
+	handshake[0] = 19
+	copy(handshake[1:20], "BitTorrent protocol")
+	rand.Read(handshake[28:68])
+	if _, err := conn.Write(handshake); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := conn.Read(make([]byte, 68)); err == nil {
+		t.Errorf("expected the connection to be closed, read %d bytes", n)
+	}
+}
+
+func TestSession_DownloadsFromMagnetLink(t *testing.T) {
+	announce := startTracker(t)
+	seed_dir, leech_dir := t.TempDir(), t.TempDir()
+	metadata, data := makeTorrent(t, seed_dir, "magnet.bin", 100_000, announce)
+
+	seeder := newTestSession(t)
+	torrent, err := seeder.Add(metadata, seed_dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, torrent, Seeding)
+
+	magnet, err := ParseMagnet(MagnetLink(metadata))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mutex sync.Mutex
+	kinds := map[EventKind]int{}
+	config := testConfig()
+	config.Port = 0
+	config.OnEvent = func(e Event) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		kinds[e.Kind]++
+	}
+	leecher, err := NewSession(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leecher.Close()
+
+	torrent, err = leecher.AddMagnet(magnet, leech_dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, torrent, Seeding)
+
+	if !torrent.HasMetadata() || torrent.Metadata().Length != len(data) {
+		t.Errorf("expected the full metadata, got %+v", torrent.Metadata())
+	}
+	got, err := os.ReadFile(filepath.Join(leech_dir, "magnet.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("downloaded data does not match the seeded data")
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	for _, kind := range []EventKind{TorrentAdded, MetadataReceived, PieceVerified, PeerConnected, TorrentCompleted} {
+		if kinds[kind] == 0 {
+			t.Errorf("expected an event of kind %d", kind)
+		}
+	}
+}
+
+func TestPiecePriorities(t *testing.T) {
+	// three files over pieces of 10 bytes: a is 0-14, padding 15-19, b 20-34, c 35-39
+	metadata := TorrentMetadata{
+		PieceLength: 10,
+		Pieces:      make([]string, 4),
+		Length:      40,
+		Files: []TorrentFile{
+			{Path: []string{"a"}, Length: 15},
+			{Path: []string{".pad", "5"}, Length: 5, Attr: "p"},
+			{Path: []string{"b"}, Length: 15},
+			{Path: []string{"c"}, Length: 5},
+		},
+	}
+
+	tests := []struct {
+		name  string
+		files map[int]Priority
+		want  []Priority
+	}{
+		{"all normal", map[int]Priority{}, []Priority{Normal, Normal, Normal, Normal}},
+		{"one high", map[int]Priority{2: High}, []Priority{Normal, Normal, High, High}},
+		{"shared piece takes the highest", map[int]Priority{2: Low, 3: High}, []Priority{Normal, Normal, Low, High}},
+		{"padding does not count", map[int]Priority{0: Low}, []Priority{Low, Low, Normal, Normal}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := piece_priorities(metadata, tt.files)
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("piece_priorities() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSession_CloseAnnouncesStopped(t *testing.T) {
+	var mutex sync.Mutex
+	events := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		events = append(events, r.URL.Query().Get("event"))
+		mutex.Unlock()
+		data, _ := bencode.Encode(map[string]any{"interval": 60, "peers": ""})
+		w.Write(data)
+	}))
+	defer server.Close()
+	seen := func(event string) bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return slices.Contains(events, event)
+	}
+
+	dir := t.TempDir()
+	metadata, _ := makeTorrent(t, dir, "data.bin", 50_000, server.URL+"/announce")
+	s := newTestSession(t)
+	torrent, err := s.Add(metadata, dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, torrent, Seeding)
+	for deadline := time.Now().Add(5 * time.Second); !seen("started") && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond) // for the response to reach the torrent
+
+	s.Close()
+	if !seen("stopped") {
+		t.Errorf("expected the tracker to be told we stopped, got events %q", events)
+	}
+	if state := torrent.Status().State; state != Paused {
+		t.Errorf("expected paused after closing, got %s", state)
+	}
+}
+
+func TestSession_ResumeState(t *testing.T) {
+	announce := startTracker(t)
+	dir, resume_dir := t.TempDir(), t.TempDir()
+	metadata, _ := makeTorrent(t, dir, "data.bin", 100_000, announce)
+	seeder := func() *Session {
+		config := testConfig()
+		config.Port = 0
+		config.ResumeDir = resume_dir
+		s, err := NewSession(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close() })
+		return s
+	}
+
+	first := seeder()
+	torrent, err := first.Add(metadata, dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, torrent, Seeding)
+	leeching, err := newTestSession(t).Add(metadata, t.TempDir(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, leeching, Seeding)
+	first.Close()
+	before := torrent.Status()
+	if before.Uploaded == 0 {
+		t.Fatal("expected the leecher to have been uploaded to")
+	}
+
+	// corrupt the data without it appearing to change, which only a check that trusts the resume state misses
+	path := filepath.Join(dir, "data.bin")
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteAt(make([]byte, 10), 0)
+	file.Close()
+	if err := os.Chtimes(path, time.Time{}, info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+
+	second := seeder()
+	torrent, err = second.Add(metadata, dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, torrent, Seeding)
+	after := torrent.Status()
+	if after.Uploaded != before.Uploaded || after.SeedingTime < before.SeedingTime {
+		t.Errorf("expected the totals and time seeded to carry on, had %d and %s, now %d and %s",
+			before.Uploaded, before.SeedingTime, after.Uploaded, after.SeedingTime)
+	}
+
+	resume_file := filepath.Join(resume_dir, hex.EncodeToString(metadata.InfoHash[:])+".resume")
+	if _, err := os.Stat(resume_file); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.Remove(torrent); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(resume_file); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected removing the torrent to delete its resume state, got %v", err)
+	}
+}
+
+func TestSession_IncompleteDirAndMove(t *testing.T) {
+	announce := startTracker(t)
+	seed_dir, leech_dir, incomplete_dir := t.TempDir(), t.TempDir(), t.TempDir()
+	metadata, data := makeTorrent(t, seed_dir, "data.bin", 100_000, announce)
+
+	config := testConfig()
+	config.Port = 0
+	config.IncompleteDir = incomplete_dir
+	seeder, err := NewSession(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { seeder.Close() })
+	seeding, err := seeder.Add(metadata, seed_dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, seeding, Seeding)
+	if dir := seeding.DataDir(); dir != seed_dir {
+		t.Errorf("expected data found in the output directory to be seeded in place, got %s", dir)
+	}
+
+	leecher, err := NewSession(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { leecher.Close() })
+	torrent, err := leecher.Add(metadata, leech_dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, torrent, Seeding)
+	expectData := func(dir string) {
+		t.Helper()
+		got, err := os.ReadFile(filepath.Join(dir, "data.bin"))
+		if err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("expected the data in %s, got %v", dir, err)
+		}
+		if torrent.DataDir() != dir || torrent.OutputDir() != dir {
+			t.Fatalf("expected the torrent to be in %s, got %s and %s", dir, torrent.DataDir(), torrent.OutputDir())
+		}
+	}
+	expectData(leech_dir)
+	if _, err := os.Stat(filepath.Join(incomplete_dir, "data.bin")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected nothing left in the incomplete directory, got %v", err)
+	}
+
+	running := filepath.Join(t.TempDir(), "running")
+	if err := torrent.Move(running); err != nil {
+		t.Fatal(err)
+	}
+	expectData(running)
+	if state := torrent.Status().State; state != Seeding {
+		t.Errorf("expected the torrent to keep seeding, got %s", state)
+	}
+
+	torrent.Pause()
+	if err := torrent.Move(leech_dir); err != nil {
+		t.Fatal(err)
+	}
+	expectData(leech_dir)
+	torrent.Resume()
+	waitForState(t, torrent, Seeding)
+	if status := torrent.Status(); status.CompletedPieces != status.TotalPieces {
+		t.Errorf("expected the moved data to check as complete, got %d/%d pieces", status.CompletedPieces, status.TotalPieces)
+	}
+}
+
+func TestSession_SeedLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		session SeedLimits
+		own     *SeedLimits
+		leecher bool // to upload to, so the ratio rises
+		done    func(s *Session, torrent *Torrent, dir string) bool
+	}{
+		{name: "seeding time stops", session: SeedLimits{Time: 300 * time.Millisecond}, done: func(s *Session, torrent *Torrent, dir string) bool {
+			status := torrent.Status()
+			return status.State == Paused && status.SeedingTime >= 300*time.Millisecond
+		}},
+		{name: "idle removes", own: &SeedLimits{Idle: 300 * time.Millisecond, Action: SeedRemove}, done: func(s *Session, torrent *Torrent, dir string) bool {
+			return len(s.Torrents()) == 0
+		}},
+		{name: "ratio deletes", session: SeedLimits{Ratio: 0.5, Action: SeedDelete}, leecher: true, done: func(s *Session, torrent *Torrent, dir string) bool {
+			_, err := os.Stat(filepath.Join(dir, "data.bin"))
+			return len(s.Torrents()) == 0 && errors.Is(err, os.ErrNotExist)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			announce := "http://127.0.0.1:1/announce"
+			if tt.leecher {
+				announce = startTracker(t)
+			}
+			metadata, _ := makeTorrent(t, dir, "data.bin", 100_000, announce)
+			s := newTestSession(t)
+			if err := s.SetSeedLimits(tt.session); err != nil {
+				t.Fatal(err)
+			}
+			torrent, err := s.Add(metadata, dir, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := torrent.SetSeedLimits(tt.own); err != nil {
+				t.Fatal(err)
+			}
+			torrent.Resume()
+			waitForState(t, torrent, Seeding)
+			if tt.leecher {
+				if _, err := newTestSession(t).Add(metadata, t.TempDir(), false); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			deadline := time.Now().Add(10 * time.Second)
+			for !tt.done(s, torrent, dir) {
+				if time.Now().After(deadline) {
+					t.Fatalf("expected the seed limit to be acted on, got %+v", torrent.Status())
+				}
+				time.Sleep(20 * time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestSession_OwnSeedLimitsOverride(t *testing.T) {
+	dir := t.TempDir()
+	metadata, _ := makeTorrent(t, dir, "data.bin", 50_000, "http://127.0.0.1:1/announce")
+	s := newTestSession(t)
+	if err := s.SetSeedLimits(SeedLimits{Time: 100 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	torrent, err := s.Add(metadata, dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := torrent.SetSeedLimits(&SeedLimits{}); err != nil {
+		t.Fatal(err)
+	}
+	torrent.Resume()
+	waitForState(t, torrent, Seeding)
+	time.Sleep(time.Second) // several rechokes
+	if state := torrent.Status().State; state != Seeding {
+		t.Errorf("expected the torrent's own limits, of none, to keep it seeding, got %s", state)
+	}
+	if limits, own := torrent.SeedLimits(); !own || limits != (SeedLimits{}) {
+		t.Errorf("expected its own limits, got %+v, %v", limits, own)
+	}
+	if err := torrent.SetSeedLimits(&SeedLimits{Ratio: -1}); err == nil {
+		t.Error("expected a negative ratio to be refused")
+	}
+}
+
+func TestSession_SuperSeeding(t *testing.T) {
+	announce := startTracker(t)
+	seed_dir := t.TempDir()
+	metadata, data := makeTorrent(t, seed_dir, "data.bin", 300_000, announce)
+
+	seeder := newTestSession(t)
+	seeding, err := seeder.Add(metadata, seed_dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seeding.SetSuperSeeding(true)
+	seeding.Resume()
+	waitForState(t, seeding, Seeding)
+
+	leech_dirs := []string{t.TempDir(), t.TempDir()}
+	leeching := []*Torrent{}
+	for _, dir := range leech_dirs {
+		torrent, err := newTestSession(t).Add(metadata, dir, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leeching = append(leeching, torrent)
+	}
+	for i, torrent := range leeching {
+		waitForState(t, torrent, Seeding)
+		got, err := os.ReadFile(filepath.Join(leech_dirs[i], "data.bin"))
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("expected leecher %d to have the seeded data, got %v", i, err)
+		}
+	}
+
+	// each piece leaves the seeder once, with the leechers trading the rest between them
+	if uploaded := seeding.Status().Uploaded; uploaded != int64(metadata.Length) {
+		t.Errorf("expected the seeder to upload each piece once, %d bytes, got %d", metadata.Length, uploaded)
+	}
+}
+
+func TestSession_Blocklist(t *testing.T) {
+	list := filepath.Join(t.TempDir(), "blocklist.p2p")
+	if err := os.WriteFile(list, []byte("loopback:127.0.0.0-127.255.255.255\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config := testConfig()
+	config.Port = 0
+	config.Blocklist = list
+	s, err := NewSession(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	dir := t.TempDir()
+	metadata, _ := makeTorrent(t, dir, "data.bin", 50_000, startTracker(t))
+	seeder, err := newTestSession(t).Add(metadata, dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, seeder, Seeding)
+	leecher, err := s.Add(metadata, t.TempDir(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Second) // several announces, each way
+	if status := leecher.Status(); status.Peers != 0 || status.CompletedPieces != 0 {
+		t.Fatalf("expected no blocked peer to connect, got %+v", status)
+	}
+
+	if err := os.WriteFile(list, []byte("not a blocklist\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ReloadBlocklist(); err == nil || s.BlocklistSize() != 1 {
+		t.Fatalf("expected the reload to fail and keep the list in use, got %v with %d ranges", err, s.BlocklistSize())
+	}
+
+	if err := os.WriteFile(list, []byte("10.0.0.0/8\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if size, err := s.ReloadBlocklist(); err != nil || size != 1 {
+		t.Fatalf("expected the new list to load, got %d ranges: %v", size, err)
+	}
+	waitForState(t, leecher, Seeding)
+}
+
+// startSocks serves SOCKS5 CONNECT without authentication, recording the address of each tunnel made
+func startSocks(t *testing.T) (string, func() []string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	var mutex sync.Mutex
+	tunnels := []string{}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				greeting := make([]byte, 3)
+				request := make([]byte, 10) // CONNECT to an IPv4 address
+				if _, err := io.ReadFull(conn, greeting); err != nil {
+					return
+				}
+				conn.Write([]byte{5, 0})
+				if _, err := io.ReadFull(conn, request); err != nil || request[3] != 1 {
+					return
+				}
+				address := net.JoinHostPort(net.IP(request[4:8]).String(), strconv.Itoa(int(binary.BigEndian.Uint16(request[8:]))))
+				target, err := net.Dial("tcp", address)
+				if err != nil {
+					conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+					return
+				}
+				defer target.Close()
+				mutex.Lock()
+				tunnels = append(tunnels, address)
+				mutex.Unlock()
+				conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+				go io.Copy(target, conn)
+				io.Copy(conn, target)
+			}()
+		}
+	}()
+	return listener.Addr().String(), func() []string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return slices.Clone(tunnels)
+	}
+}
+
+func TestSession_Proxy(t *testing.T) {
+	socks, tunnels := startSocks(t)
+	config := testConfig()
+	config.Port = 0
+	config.Proxy = "socks5://" + socks
+	config.ProxyOnly = true
+	s, err := NewSession(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	dir := t.TempDir()
+	announce := startTracker(t)
+	metadata, _ := makeTorrent(t, dir, "data.bin", 50_000, announce)
+	seeder_session := newTestSession(t)
+	seeder, err := seeder_session.Add(metadata, dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, seeder, Seeding)
+	leecher, err := s.Add(metadata, t.TempDir(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, leecher, Seeding)
+
+	tracker_host := strings.TrimPrefix(strings.TrimSuffix(announce, "/announce"), "http://")
+	seeder_address := net.JoinHostPort("127.0.0.1", strconv.Itoa(seeder_session.Port()))
+	made := tunnels()
+	if !slices.Contains(made, tracker_host) || !slices.Contains(made, seeder_address) {
+		t.Errorf("expected tunnels to the tracker %s and the seeder %s, got %v", tracker_host, seeder_address, made)
+	}
+
+	if _, err := NewSession(Config{ProxyOnly: true, MaxPeers: 1, MaxTorrentPeers: 1, UploadSlots: 1}); err == nil {
+		t.Error("expected refusing direct connections without a proxy to be an error")
+	}
+}
@@ -0,0 +1,195 @@
+package session
+
+import (
+	"math/rand/v2"
+	"slices"
+	"sync"
+
+	"github.com/chrispritchard/gorrent/internal/bitfields"
+	"github.com/chrispritchard/gorrent/internal/peer"
+)
+
+// super_seeding hides what a complete torrent has from the peers it is used with, offering each one a piece at a time
+// with a have, so that no piece is uploaded twice before the swarm has it (BEP 16). A peer is offered its next piece
+// once another peer is seen to have the last, or once it has the last itself and no other peer lacks it. Only pieces
+// no peer has, and that no other peer has been offered, are offered, so a peer may wait for the others to catch up
+type super_seeding struct {
+	mutex  sync.Mutex
+	pieces int
+	peers  func() []*peer.PeerHandler // taken without holding the mutex, as the torrent calls in holding its own
+	offers map[*peer.PeerHandler]*offer
+}
+
+type offer struct {
+	current int              // the piece last offered, -1 if none
+	given   map[int]struct{} // every piece offered, which the peer may request
+}
+
+// pending_have is a have decided on under the mutex, sent once it is released as sends may block on slow peers
+type pending_have struct {
+	peer  *peer.PeerHandler
+	index int
+}
+
+func send_haves(haves []pending_have) {
+	for _, h := range haves {
+		h.peer.SendHave(h.index)
+	}
+}
+
+func new_super_seeding(pieces int, peers func() []*peer.PeerHandler) *super_seeding {
+	return &super_seeding{pieces: pieces, peers: peers, offers: map[*peer.PeerHandler]*offer{}}
+}
+
+// add starts super-seeding to p, which must have been told we have nothing
+func (s *super_seeding) add(p *peer.PeerHandler) {
+	peers := s.peers()
+	s.mutex.Lock()
+	s.offers[p] = &offer{current: -1, given: map[int]struct{}{}}
+	next, ok := s.offer_next(p, peers)
+	s.mutex.Unlock()
+	if ok {
+		send_haves([]pending_have{next})
+	}
+}
+
+// remove forgets p. Call reoffer once it is no longer among the torrent's peers
+func (s *super_seeding) remove(p *peer.PeerHandler) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.offers, p)
+}
+
+// reoffer offers a piece to each peer waiting without one, as a peer leaving may take the only copy of pieces with it
+func (s *super_seeding) reoffer() {
+	if s.idle() {
+		return
+	}
+	peers := s.peers()
+	s.mutex.Lock()
+	haves := []pending_have{}
+	for p, o := range s.offers {
+		if o.current < 0 {
+			if next, ok := s.offer_next(p, peers); ok {
+				haves = append(haves, next)
+			}
+		}
+	}
+	s.mutex.Unlock()
+	send_haves(haves)
+}
+
+func (s *super_seeding) idle() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.offers) == 0
+}
+
+// allowed is whether p may be sent blocks of a piece: one offered to it, or any if it is not super-seeded
+func (s *super_seeding) allowed(p *peer.PeerHandler, index int) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	o, ok := s.offers[p]
+	if !ok {
+		return true
+	}
+	_, given := o.given[index]
+	return given
+}
+
+// have notes that from announced it has a piece, which moves on any peer whose offer has now spread
+func (s *super_seeding) have(from *peer.PeerHandler, index int) {
+	if s.idle() {
+		return
+	}
+	peers := s.peers()
+	s.mutex.Lock()
+	haves := []pending_have{}
+	for p, o := range s.offers {
+		if o.current != index {
+			continue
+		}
+		if p != from || !lacking(index, p, peers) {
+			if next, ok := s.offer_next(p, peers); ok {
+				haves = append(haves, next)
+			}
+		}
+	}
+	s.mutex.Unlock()
+	send_haves(haves)
+}
+
+// stop tells every super-seeded peer about the pieces it was not offered, so that they are seeded to as usual
+func (s *super_seeding) stop() {
+	s.mutex.Lock()
+	haves := []pending_have{}
+	for p, o := range s.offers {
+		for i := range s.pieces {
+			if _, given := o.given[i]; !given {
+				haves = append(haves, pending_have{p, i})
+			}
+		}
+	}
+	clear(s.offers)
+	s.mutex.Unlock()
+	send_haves(haves)
+}
+
+// offer_next chooses a piece to offer p that no peer has and no other peer is being offered, if there is one,
+// returning the have for the caller to send once the mutex is released
+func (s *super_seeding) offer_next(p *peer.PeerHandler, peers []*peer.PeerHandler) (pending_have, bool) {
+	o := s.offers[p]
+	o.current = -1
+	unavailable := map[int]bool{}
+	for other, o := range s.offers {
+		if other != p && o.current >= 0 {
+			unavailable[o.current] = true
+		}
+	}
+	fields := []bitfields.BitField{}
+	for _, other := range peers {
+		if !other.Closed() {
+			fields = append(fields, other.Bitfield())
+		}
+	}
+
+	start := rand.IntN(max(1, s.pieces)) // so that peers are not offered pieces in the same order
+	for n := range s.pieces {
+		i := (start + n) % s.pieces
+		if _, given := o.given[i]; given || unavailable[i] || slices.ContainsFunc(fields, func(f bitfields.BitField) bool { return f.Get(i) }) {
+			continue
+		}
+		o.current = i
+		o.given[i] = struct{}{}
+		return pending_have{p, i}, true
+	}
+	return pending_have{}, false
+}
+
+// lacking is whether any peer other than p is without a piece
+func lacking(index int, p *peer.PeerHandler, peers []*peer.PeerHandler) bool {
+	for _, other := range peers {
+		if other != p && !other.Closed() && !other.HasPiece(index) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetSuperSeeding turns super-seeding on or off. It applies to peers that connect while the torrent is seeding, and
+// turning it off tells those it applied to about every piece
+func (t *Torrent) SetSuperSeeding(on bool) {
+	t.mutex.Lock()
+	t.super_seed = on
+	super := t.super
+	t.mutex.Unlock()
+	if !on && super != nil {
+		super.stop()
+	}
+}
+
+func (t *Torrent) SuperSeeding() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.super_seed
+}
@@ -0,0 +1,1149 @@
+package session
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/chrispritchard/gorrent/internal/bitfields"
+	"github.com/chrispritchard/gorrent/internal/downloading"
+	"github.com/chrispritchard/gorrent/internal/logging"
+	"github.com/chrispritchard/gorrent/internal/messaging"
+	outfiles "github.com/chrispritchard/gorrent/internal/out_files"
+	"github.com/chrispritchard/gorrent/internal/peer"
+	"github.com/chrispritchard/gorrent/internal/ratelimit"
+	"github.com/chrispritchard/gorrent/internal/stats"
+	. "github.com/chrispritchard/gorrent/internal/torrent_files"
+	"github.com/chrispritchard/gorrent/internal/tracker"
+	"github.com/chrispritchard/gorrent/internal/webseed"
+)
+
+type State int
+
+const (
+	Paused State = iota
+	FetchingMetadata
+	Checking
+	Downloading
+	Seeding
+	Failed
+)
+
+func (s State) String() string {
+	switch s {
+	case Paused:
+		return "paused"
+	case FetchingMetadata:
+		return "fetching metadata"
+	case Checking:
+		return "checking"
+	case Downloading:
+		return "downloading"
+	case Seeding:
+		return "seeding"
+	case Failed:
+		return "failed"
+	}
+	return "unknown"
+}
+
+type Status struct {
+	State           State
+	Err             error // why the torrent failed
+	TrackerErr      error // the last announce failure, cleared by a success
+	CompletedPieces int
+	TotalPieces     int
+	Peers           int
+	Downloaded      int64 // block data, since the torrent was added
+	Uploaded        int64
+	Wasted          int64   // downloaded but discarded, as duplicates or failing verification
+	DownloadRate    float64 // bytes per second, over the last few seconds
+	UploadRate      float64
+	Ratio           float64       // uploaded over downloaded less wasted, or over the data we have if we downloaded none
+	ETA             time.Duration // 0 once complete, -1 if unknown
+	SeedingTime     time.Duration // since the torrent was added
+	HashFailures    int64         // pieces that failed verification
+	DiskWrites      stats.Histogram
+	Announces       stats.Histogram // how long each announce took, successful or not
+	AnnounceErrors  int64
+	BannedPeers     int // hosts refused for sending corrupt data
+}
+
+// PeerStatus describes a connected peer. Choked means the peer is refusing our requests, Choking that we are
+// refusing theirs
+type PeerStatus struct {
+	Address      string
+	ID           [20]byte
+	Client       string
+	Requests     int // blocks requested from the peer and not yet received
+	Choked       bool
+	Interested   bool // the peer wants pieces from us
+	Choking      bool
+	AmInterested bool
+	peer.Stats
+}
+
+// Torrent is a single torrent within a session. Everything about a running torrent belongs to its run goroutine,
+// with the mutex guarding only what status and control calls need to see
+type Torrent struct {
+	output_dir     string // where the files belong once complete
+	dir            string // where they are now, which may be the session's incomplete directory
+	storage        sync.Mutex
+	metadata       TorrentMetadata
+	magnet         *Magnet // set until the metadata of a torrent added by magnet link arrives
+	session        *Session
+	mutex          sync.Mutex
+	state          State
+	err            error
+	tracker        error
+	cancel         context.CancelFunc
+	done           chan struct{}
+	inbound        chan inbound_conn
+	moves          chan move_request
+	download       *downloading.DownloadState
+	peers          map[[20]byte]*peer.PeerHandler
+	dialing        map[string]struct{}
+	logger         *slog.Logger // with the torrent's attributes, for its components to derive theirs from
+	log            *slog.Logger
+	downloaded     bool              // whether this run downloaded anything, so completion should be announced
+	past           downloading.Stats // totals from earlier runs
+	priorities     map[int]Priority  // by index into the metadata's file spans, normal if missing
+	download_limit *ratelimit.Limiter
+	upload_limit   *ratelimit.Limiter
+	announces      *stats.Timer
+	announce_errs  int64
+	seed_limits    *SeedLimits // nil to follow the session's
+	seeding_since  time.Time   // zero unless seeding
+	idle_since     time.Time   // when a peer was last interested, while seeding
+	seeded         time.Duration
+	super_seed     bool
+	super          *super_seeding      // the current run's
+	banned         map[string]struct{} // hosts that sent corrupt data, refused from then on
+}
+
+type inbound_conn struct {
+	conn      net.Conn
+	handshake peer.Handshake
+}
+
+// move_request asks the run goroutine to move the files it has open
+type move_request struct {
+	dir  string
+	done chan<- error
+}
+
+type dial_result struct {
+	address string
+	handler *peer.PeerHandler
+	err     error
+	super   bool // whether the peer was told we have nothing, to be super-seeded
+}
+
+type announce_result struct {
+	response tracker.TrackerResponse
+	err      error
+}
+
+func new_torrent(s *Session, metadata TorrentMetadata, magnet *Magnet, output_dir string) *Torrent {
+	logger := s.logger.With("torrent", metadata.Name, "info_hash", hex.EncodeToString(metadata.InfoHash[:]))
+	dir := output_dir
+	if s.config.IncompleteDir != "" {
+		dir = s.config.IncompleteDir
+	}
+	return &Torrent{
+		metadata:       metadata,
+		magnet:         magnet,
+		output_dir:     output_dir,
+		dir:            dir,
+		priorities:     map[int]Priority{},
+		download_limit: ratelimit.NewLimiter(0),
+		upload_limit:   ratelimit.NewLimiter(0),
+		announces:      stats.NewTimer(stats.LatencyBounds),
+		super_seed:     s.config.SuperSeed,
+		session:        s,
+		state:          Paused,
+		peers:          map[[20]byte]*peer.PeerHandler{},
+		logger:         logger,
+		log:            logging.For(logger, logging.Torrent),
+	}
+}
+
+// Metadata is the torrent's metadata. For a torrent added by magnet link, it holds only the name, trackers and info
+// hash until HasMetadata
+func (t *Torrent) Metadata() TorrentMetadata {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.metadata
+}
+
+// OutputDir is where the torrent's files are saved once complete
+func (t *Torrent) OutputDir() string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.output_dir
+}
+
+// DataDir is where the torrent's files are now: the session's incomplete directory while downloading, if it has one,
+// and the output directory after
+func (t *Torrent) DataDir() string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.dir
+}
+
+// Move moves the torrent's files into dir, which becomes its output directory. A running torrent carries on, with
+// its files reopened in their new place once they have moved
+func (t *Torrent) Move(dir string) error {
+	for {
+		t.mutex.Lock()
+		moves, done := t.moves, t.done
+		running := t.cancel != nil && !closed(done)
+		t.mutex.Unlock()
+
+		if running && t.HasMetadata() {
+			result := make(chan error, 1)
+			select {
+			case moves <- move_request{dir, result}:
+				return <-result
+			case <-done:
+				continue // the run failed or was paused first, so the files can be moved where they lie
+			}
+		}
+		if !running && done != nil {
+			<-done // a paused run may still be closing its files
+		}
+
+		t.storage.Lock()
+		t.mutex.Lock()
+		has_metadata, restarted := t.magnet == nil, t.done != done
+		t.mutex.Unlock()
+		if restarted || (running && has_metadata) {
+			t.storage.Unlock()
+			continue
+		}
+		var err error
+		if has_metadata {
+			err = outfiles.MoveFiles(t.Metadata(), t.DataDir(), dir)
+		}
+		if err == nil {
+			t.moved(dir)
+		}
+		t.storage.Unlock()
+		return err
+	}
+}
+
+func (t *Torrent) moved(dir string) {
+	t.mutex.Lock()
+	t.dir, t.output_dir = dir, dir
+	t.mutex.Unlock()
+	t.log.Info("moved files", "dir", dir)
+}
+
+func closed(done chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (t *Torrent) HasMetadata() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.magnet == nil
+}
+
+// Bitfield returns the pieces we have, or false if the torrent has not yet checked its files
+func (t *Torrent) Bitfield() (bitfields.BitField, bool) {
+	t.mutex.Lock()
+	ds := t.download
+	t.mutex.Unlock()
+	if ds == nil {
+		return bitfields.BitField{}, false
+	}
+	return ds.Bitfield(), true
+}
+
+func (t *Torrent) Status() Status {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	status := Status{
+		State:          t.state,
+		Err:            t.err,
+		TrackerErr:     t.tracker,
+		TotalPieces:    t.metadata.PieceCount(),
+		Peers:          len(t.peers),
+		Announces:      t.announces.Snapshot(),
+		AnnounceErrors: t.announce_errs,
+		BannedPeers:    len(t.banned),
+	}
+	totals := t.past
+	if t.download != nil {
+		status.CompletedPieces = t.download.CompletedPieces()
+		current := t.download.Stats()
+		totals.Downloaded += current.Downloaded
+		totals.Uploaded += current.Uploaded
+		totals.Wasted += current.Wasted
+		totals.HashFailures += current.HashFailures
+		totals.DiskWrites = totals.DiskWrites.Add(current.DiskWrites)
+		status.DownloadRate, status.UploadRate = current.DownloadRate, current.UploadRate
+		status.ETA = stats.ETA(current.Remaining, current.DownloadRate)
+		if have := int64(t.metadata.Length) - current.Remaining; totals.Downloaded == 0 && have > 0 {
+			status.Ratio = float64(totals.Uploaded) / float64(have)
+		}
+	} else {
+		status.ETA = -1
+	}
+	status.Downloaded, status.Uploaded, status.Wasted = totals.Downloaded, totals.Uploaded, totals.Wasted
+	status.HashFailures, status.DiskWrites = totals.HashFailures, totals.DiskWrites
+	if useful := totals.Downloaded - totals.Wasted; useful > 0 {
+		status.Ratio = float64(totals.Uploaded) / float64(useful)
+	}
+	status.SeedingTime = t.seeded
+	if !t.seeding_since.IsZero() {
+		status.SeedingTime += time.Since(t.seeding_since)
+	}
+	return status
+}
+
+// PieceState is whether we have a piece, and how many connected peers do
+type PieceState struct {
+	Have  bool
+	Peers int
+}
+
+// Pieces describes every piece, empty until the torrent has checked its files
+func (t *Torrent) Pieces() []PieceState {
+	t.mutex.Lock()
+	ds := t.download
+	count := t.metadata.PieceCount()
+	t.mutex.Unlock()
+	if ds == nil {
+		return nil
+	}
+
+	bitfield := ds.Bitfield()
+	result := make([]PieceState, count)
+	for i := range result {
+		result[i].Have = bitfield.Get(i)
+	}
+	for _, p := range t.peer_list() {
+		remote := p.Bitfield()
+		for i := range result {
+			if remote.Get(i) {
+				result[i].Peers++
+			}
+		}
+	}
+	return result
+}
+
+type Priority = downloading.Priority
+
+const (
+	Low    = downloading.Low
+	Normal = downloading.Normal
+	High   = downloading.High
+)
+
+// SetFilePriority changes the priority of a file, given by its index in the metadata's FileSpans. Pieces of higher
+// priority files are downloaded first; a piece shared between files takes the highest of their priorities
+func (t *Torrent) SetFilePriority(index int, priority Priority) error {
+	if priority < Low || priority > High {
+		return fmt.Errorf("invalid priority %d", priority)
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if index < 0 || index >= len(t.metadata.FileSpans()) {
+		return fmt.Errorf("no file with index %d", index)
+	}
+	if t.magnet != nil {
+		return fmt.Errorf("the metadata has not yet been received")
+	}
+	t.priorities[index] = priority
+	if t.download != nil {
+		t.download.SetPriorities(piece_priorities(t.metadata, t.priorities))
+	}
+	return nil
+}
+
+func (t *Torrent) FilePriority(index int) Priority {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.priorities[index]
+}
+
+func piece_priorities(metadata TorrentMetadata, files map[int]Priority) []Priority {
+	result := make([]Priority, metadata.PieceCount())
+	if len(files) == 0 || metadata.PieceLength == 0 {
+		return result
+	}
+	for i := range result {
+		result[i] = Low - 1 // raised by the files the piece holds
+	}
+	for i, span := range metadata.FileSpans() {
+		if span.File.IsPadding() || span.End == span.Start {
+			continue
+		}
+		for p := span.Start / metadata.PieceLength; p <= (span.End-1)/metadata.PieceLength && p < len(result); p++ {
+			result[p] = max(result[p], files[i])
+		}
+	}
+	for i := range result {
+		result[i] = max(result[i], Low) // pieces holding only padding
+	}
+	return result
+}
+
+// Peers describes each connected peer, with its transfer statistics
+func (t *Torrent) Peers() []PeerStatus {
+	result := []PeerStatus{}
+	for _, p := range t.peer_list() {
+		result = append(result, PeerStatus{
+			Address:      p.Address,
+			ID:           p.RemoteID,
+			Client:       peer.ClientName(p.RemoteID),
+			Requests:     p.OutstandingRequests(),
+			Choked:       p.Choking(),
+			Interested:   p.Interested(),
+			Choking:      p.AmChoking(),
+			AmInterested: p.AmInterested(),
+			Stats:        p.Stats(),
+		})
+	}
+	return result
+}
+
+// SetRates changes this torrent's bandwidth limits, in bytes per second with 0 for unlimited. The session's limits
+// still apply on top
+func (t *Torrent) SetRates(download, upload int) {
+	t.download_limit.SetRate(download)
+	t.upload_limit.SetRate(upload)
+}
+
+func (t *Torrent) Rates() (download, upload int) {
+	return t.download_limit.Rate(), t.upload_limit.Rate()
+}
+
+// Pause stops the torrent, disconnecting its peers and closing its files, and waits for that to finish
+func (t *Torrent) Pause() {
+	t.mutex.Lock()
+	cancel, done := t.cancel, t.done
+	t.cancel = nil
+	t.mutex.Unlock()
+
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-done
+
+	t.mutex.Lock()
+	failed := t.state == Failed
+	t.mutex.Unlock()
+	if !failed {
+		t.set_state(Paused, nil)
+	}
+}
+
+// Resume starts a paused or failed torrent, checking what is already on disk first
+func (t *Torrent) Resume() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.cancel != nil {
+		select {
+		case <-t.done: // the run ended by failing, so it can be restarted
+			t.cancel()
+		default:
+			return
+		}
+	}
+
+	ctx, cancel := context.WithCancel(t.session.ctx)
+	t.cancel = cancel
+	t.done = make(chan struct{})
+	t.inbound = make(chan inbound_conn, 16)
+	t.moves = make(chan move_request)
+	go t.run(ctx, t.inbound, t.moves, t.done)
+}
+
+// offer passes an inbound connection to the run goroutine, returning false if the torrent is not taking peers
+func (t *Torrent) offer(in inbound_conn) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.cancel == nil || (t.state != Downloading && t.state != Seeding) {
+		return false
+	}
+	select {
+	case t.inbound <- in:
+		return true
+	default:
+		return false
+	}
+}
+
+func (t *Torrent) set_state(state State, err error) {
+	t.mutex.Lock()
+	changed := t.state != state
+	t.state = state
+	t.err = err
+	t.mutex.Unlock()
+
+	if changed {
+		t.session.emit(Event{Kind: StateChanged, Torrent: t, State: state, Err: err})
+	}
+}
+
+func (t *Torrent) run(ctx context.Context, inbound <-chan inbound_conn, moves <-chan move_request, done chan struct{}) {
+	defer close(done)
+	defer drain(inbound)
+
+	ctx, cancel := context.WithCancel(ctx) // so that failing also stops everything started here
+	defer cancel()
+
+	if !t.HasMetadata() {
+		t.set_state(FetchingMetadata, nil)
+		if !t.fetch_metadata(ctx) {
+			return
+		}
+	}
+	metadata := t.Metadata()
+	t.set_state(Checking, nil)
+
+	t.storage.Lock()
+	out_files, err := outfiles.CreateOutFileManager(metadata, t.data_dir(metadata))
+	t.storage.Unlock()
+	if err != nil {
+		t.set_state(Failed, fmt.Errorf("failed to establish local files: %v", err))
+		return
+	}
+	defer out_files.Close()
+
+	local, err := t.check_files(metadata, out_files)
+	if err != nil {
+		t.set_state(Failed, fmt.Errorf("failed to check local files: %v", err))
+		return
+	}
+	t.log.Debug("checked local files", "bitfield", local.BitString())
+
+	ds := downloading.NewDownloadState(metadata, *local, t.create_web_seeds(metadata), out_files, t.session.config.Download, t.logger)
+	t.mutex.Lock()
+	ds.SetPriorities(piece_priorities(metadata, t.priorities))
+	if t.download != nil {
+		previous := t.download.Stats()
+		t.past.Downloaded += previous.Downloaded
+		t.past.Uploaded += previous.Uploaded
+		t.past.Wasted += previous.Wasted
+		t.past.HashFailures += previous.HashFailures
+		t.past.DiskWrites = t.past.DiskWrites.Add(previous.DiskWrites)
+	}
+	t.download = ds
+	t.super = new_super_seeding(metadata.PieceCount(), t.peer_list)
+	t.dialing = map[string]struct{}{}
+	t.downloaded = false
+	t.mutex.Unlock()
+
+	tracked := false // whether a tracker knows of us, so should be told when we stop
+	limited := false // whether a seed limit has been reached, and its action is underway
+	defer t.seeding(false)
+	defer func() {
+		out_files.Close() // flushed before the announce, which may take a while
+		t.save_resume(metadata, ds, out_files)
+		if tracked {
+			t.announce_stopped(metadata, ds)
+		}
+	}()
+	defer t.drop_all_peers(ds)
+
+	received_channel := make(chan messaging.Received)
+	error_channel := make(chan error)
+	dialed := make(chan dial_result)
+	announced := make(chan announce_result)
+
+	if ds.Finished() {
+		t.finish(ctx, ds, out_files, announced)
+	} else {
+		t.set_state(Downloading, nil)
+		ds.StartRequestingPieces(ctx, error_channel)
+		ds.StartWebSeeds(ctx, received_channel)
+	}
+
+	event := "started"
+	announce_timer := time.NewTimer(0)
+	defer announce_timer.Stop()
+	if len(metadata.Announcers) == 0 {
+		announce_timer.Stop()
+	}
+	keep_alive := time.NewTicker(t.session.config.Intervals.KeepAlive)
+	defer keep_alive.Stop()
+	rechoke := time.NewTicker(t.session.config.Intervals.Rechoke)
+	defer rechoke.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-announce_timer.C:
+			go t.announce(ctx, metadata, ds, event, announced)
+			event = ""
+		case result := <-announced:
+			interval := t.session.config.Intervals.RetryAnnounce
+			t.mutex.Lock()
+			t.tracker = result.err
+			t.mutex.Unlock()
+			if result.err != nil {
+				logging.For(t.logger, logging.Tracker).Warn("failed to announce", "err", result.err)
+			} else {
+				logging.For(t.logger, logging.Tracker).Debug("announced", "peers", len(result.response.Peers))
+				interval = max(time.Duration(result.response.Interval)*time.Second, t.session.config.Intervals.MinAnnounce)
+				tracked = true
+				t.connect_to_peers(ctx, ds, result.response.Peers, dialed)
+			}
+			announce_timer.Reset(interval)
+		case in := <-inbound:
+			t.accept_peer(ctx, ds, in, dialed)
+		case request := <-moves:
+			err := out_files.Move(request.dir)
+			if err == nil {
+				t.moved(request.dir)
+			}
+			request.done <- err
+		case result := <-dialed:
+			t.mutex.Lock()
+			delete(t.dialing, result.address)
+			t.mutex.Unlock()
+			if result.err != nil {
+				t.session.release_slot()
+				t.log.Debug("failed to connect to peer", "peer", result.address, "err", result.err)
+				continue
+			}
+			t.add_peer(ctx, metadata, ds, out_files, result, received_channel, error_channel)
+		case <-keep_alive.C:
+			for _, p := range t.peer_list() {
+				p.SendKeepAlive()
+			}
+			t.log.Debug("sent keep alives")
+		case <-rechoke.C:
+			t.rechoke(true)
+			limited = limited || t.check_seed_limits()
+		case received := <-received_channel:
+			switch received.Kind {
+			case messaging.MSG_PIECE:
+				index, begin, piece := received.AsPiece()
+				verified, finished, banned, err := ds.ReceiveBlock(index, begin, piece, received.From)
+				if len(banned) > 0 {
+					t.ban(banned)
+					t.prune_peers(ds)
+				}
+				if err != nil {
+					t.set_state(Failed, fmt.Errorf("failed to store piece %d: %v", index, err))
+					return
+				}
+				t.downloaded = true
+				if verified {
+					t.session.emit(Event{Kind: PieceVerified, Torrent: t, Piece: index})
+				}
+				if finished {
+					t.finish(ctx, ds, out_files, announced)
+				}
+			case messaging.MSG_INTERESTED, messaging.MSG_NOTINTERESTED:
+				t.rechoke(false)
+			case messaging.MSG_HASHES, messaging.MSG_HASH_REJECT:
+				// piece layers come with the torrent file, so hashes are never requested, and any sent are ignored
+				t.log.Debug("received unrequested hashes", "kind", received.Kind)
+			default:
+				t.log.Debug("received an unhandled kind", "kind", received.Kind)
+			}
+		case err := <-error_channel:
+			t.log.Debug("peer error", "err", err)
+			t.prune_peers(ds)
+		}
+	}
+}
+
+// drain closes inbound connections that arrived as the torrent stopped
+func drain(inbound <-chan inbound_conn) {
+	for {
+		select {
+		case in := <-inbound:
+			in.conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// fetch_metadata asks the trackers for peers and downloads the info dict from them, retrying until it arrives or the
+// torrent is paused. Returns false if it did not arrive
+func (t *Torrent) fetch_metadata(ctx context.Context) bool {
+	t.mutex.Lock()
+	magnet := *t.magnet
+	t.mutex.Unlock()
+
+	stand_in := magnet.Metadata()
+	if len(stand_in.Announcers) == 0 {
+		t.set_state(Failed, fmt.Errorf("magnet link has no trackers to find peers with"))
+		return false
+	}
+
+	for {
+		info, err := t.try_fetch_metadata(ctx, stand_in)
+		if err == nil {
+			metadata, err := MetadataFromInfo(magnet, info)
+			if err != nil {
+				t.set_state(Failed, fmt.Errorf("invalid metadata: %v", err))
+				return false
+			}
+			t.mutex.Lock()
+			t.metadata = metadata
+			t.magnet = nil
+			t.mutex.Unlock()
+
+			t.session.register(t, metadata)
+			t.log.Info("received metadata", "name", metadata.Name)
+			t.session.emit(Event{Kind: MetadataReceived, Torrent: t})
+			return true
+		}
+		t.log.Warn("failed to fetch metadata", "err", err)
+
+		retry := t.session.config.Intervals.RetryAnnounce
+		if errors.Is(err, err_no_peers) {
+			retry = t.session.config.Intervals.MinAnnounce // the tracker works, so peers may well be along soon
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(retry):
+		}
+	}
+}
+
+var err_no_peers = errors.New("tracker returned no peers")
+
+// try_fetch_metadata asks several peers at once, taking the first complete info dict
+func (t *Torrent) try_fetch_metadata(ctx context.Context, stand_in TorrentMetadata) ([]byte, error) {
+	response, err := t.call_tracker(ctx, stand_in, tracker.AnnounceRequest{
+		LocalID: t.session.peer_id,
+		Port:    t.session.Port(),
+		Left:    1, // unknown, but not zero so we are not taken for a seeder
+		Event:   "started",
+	})
+	t.mutex.Lock()
+	t.tracker = err
+	t.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if len(response.Peers) == 0 {
+		return nil, err_no_peers
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	local := peer.Local{
+		InfoHash: stand_in.InfoHash[:],
+		ID:       t.session.peer_id,
+		Dial:     t.dial,
+		Logger:   t.logger,
+		Timeouts: t.session.config.Timeouts,
+	}
+	peers := slices.DeleteFunc(slices.Clone(response.Peers), func(p tracker.PeerInfo) bool {
+		return t.session.blocked(net.JoinHostPort(p.IP, fmt.Sprintf("%d", p.Port)))
+	})
+	if len(peers) == 0 {
+		return nil, fmt.Errorf("tracker returned only blocked peers")
+	}
+	peers = peers[:min(len(peers), metadata_peers)]
+	results := make(chan []byte, len(peers))
+	failures := make(chan error, len(peers))
+	for _, p := range peers {
+		go func() {
+			info, err := peer.FetchMetadata(ctx, p, local)
+			if err != nil {
+				failures <- err
+				return
+			}
+			results <- info
+		}()
+	}
+
+	var last_err error
+	for range peers {
+		select {
+		case info := <-results:
+			return info, nil
+		case last_err = <-failures:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return nil, last_err
+}
+
+// data_dir is where to look for the torrent's files, and create them. That is the incomplete directory if the files
+// are there, or nothing of them is in the output directory either
+func (t *Torrent) data_dir(metadata TorrentMetadata) string {
+	t.mutex.Lock()
+	dir, output_dir := t.dir, t.output_dir
+	t.mutex.Unlock()
+	if dir != output_dir && !outfiles.FilesExist(metadata, dir) && outfiles.FilesExist(metadata, output_dir) {
+		t.mutex.Lock()
+		t.dir = output_dir // e.g. added to seed what was downloaded before
+		t.mutex.Unlock()
+		return output_dir
+	}
+	return dir
+}
+
+// finish moves the torrent to seeding: file attributes are applied, the files are moved out of the incomplete
+// directory, peers are told we need nothing more, and if the data was downloaded rather than found on disk, the
+// tracker hears of the completion
+func (t *Torrent) finish(ctx context.Context, ds *downloading.DownloadState, out_files *outfiles.OutFileManager, announced chan<- announce_result) {
+	err := out_files.ApplyFileAttributes()
+	if err != nil {
+		t.log.Warn("unable to apply all file attributes", "err", err) // the data is intact, so only warn
+	}
+	if output_dir := t.OutputDir(); t.DataDir() != output_dir {
+		t.storage.Lock()
+		if err := out_files.Move(output_dir); err != nil {
+			t.log.Warn("unable to move the completed files, so seeding them where they are", "err", err)
+		} else {
+			t.moved(output_dir)
+		}
+		t.storage.Unlock()
+	}
+	for _, p := range t.peer_list() {
+		p.SetInterested(false)
+	}
+	t.set_state(Seeding, nil)
+	t.seeding(true)
+	t.log.Info("download complete, now seeding")
+
+	if t.downloaded {
+		t.session.emit(Event{Kind: TorrentCompleted, Torrent: t})
+		if metadata := t.Metadata(); len(metadata.Announcers) > 0 {
+			go t.announce(ctx, metadata, ds, "completed", announced)
+		}
+	}
+}
+
+func (t *Torrent) announce(ctx context.Context, metadata TorrentMetadata, ds *downloading.DownloadState, event string, announced chan<- announce_result) {
+	response, err := t.call_tracker(ctx, metadata, t.announce_request(ds, event))
+	select {
+	case announced <- announce_result{response, err}:
+	case <-ctx.Done():
+	}
+}
+
+// announce_stopped tells the trackers we are leaving the swarm. The run's context has ended by now, so this has its
+// own, bounded by the stop announce interval
+func (t *Torrent) announce_stopped(metadata TorrentMetadata, ds *downloading.DownloadState) {
+	ctx, cancel := context.WithTimeout(context.Background(), t.session.config.Intervals.StopAnnounce)
+	defer cancel()
+	_, err := t.call_tracker(ctx, metadata, t.announce_request(ds, "stopped"))
+	if err != nil {
+		logging.For(t.logger, logging.Tracker).Debug("failed to announce stopping", "err", err)
+	}
+}
+
+// call_tracker announces, timing it and counting failures
+func (t *Torrent) call_tracker(ctx context.Context, metadata TorrentMetadata, request tracker.AnnounceRequest) (tracker.TrackerResponse, error) {
+	defer t.announces.Since(time.Now())
+	response, err := tracker.CallTracker(ctx, t.session.trackers, metadata, request)
+	if err != nil {
+		t.mutex.Lock()
+		t.announce_errs++
+		t.mutex.Unlock()
+	}
+	return response, err
+}
+
+// announce_request reports what this run has transferred, as trackers count from the started event. Wasted data is
+// not counted as downloaded
+func (t *Torrent) announce_request(ds *downloading.DownloadState, event string) tracker.AnnounceRequest {
+	totals := ds.Stats()
+	return tracker.AnnounceRequest{
+		LocalID:    t.session.peer_id,
+		Port:       t.session.Port(),
+		Uploaded:   totals.Uploaded,
+		Downloaded: totals.Downloaded - totals.Wasted,
+		Left:       totals.Remaining,
+		Event:      event,
+	}
+}
+
+// local is our side of a new connection. While super-seeding, the peer is told we have nothing
+func (t *Torrent) local(ds *downloading.DownloadState, info_hash [20]byte) peer.Local {
+	local := peer.Local{
+		InfoHash: info_hash[:],
+		ID:       t.session.peer_id,
+		Bitfield: ds.Bitfield(),
+		Dial:     t.dial,
+		Logger:   t.logger,
+		Uploaded: ds.UploadMeter(),
+		Timeouts: t.session.config.Timeouts,
+	}
+	if t.SuperSeeding() && ds.Finished() {
+		blank := bitfields.CreateBlankBitfield(local.Bitfield.Length)
+		local.Advertised = &blank
+	}
+	return local
+}
+
+// has_room reserves a connection slot, if both this torrent and the session are under their peer limits
+func (t *Torrent) has_room() bool {
+	t.mutex.Lock()
+	count := len(t.peers) + len(t.dialing)
+	t.mutex.Unlock()
+	return count < t.session.config.MaxTorrentPeers && t.session.try_acquire_slot()
+}
+
+func (t *Torrent) connect_to_peers(ctx context.Context, ds *downloading.DownloadState, peers []tracker.PeerInfo, dialed chan<- dial_result) {
+	connected := map[string]struct{}{}
+	for _, p := range t.peer_list() {
+		connected[p.Address] = struct{}{}
+	}
+
+	for _, info := range peers {
+		address := net.JoinHostPort(info.IP, fmt.Sprintf("%d", info.Port))
+		t.mutex.Lock()
+		_, dialing := t.dialing[address]
+		t.mutex.Unlock()
+		if _, exists := connected[address]; exists || dialing || t.is_banned(address) || t.session.blocked(address) {
+			continue
+		}
+		if !t.has_room() {
+			return
+		}
+
+		t.mutex.Lock()
+		t.dialing[address] = struct{}{}
+		t.mutex.Unlock()
+
+		local := t.local(ds, info.InfoHash)
+		go func() {
+			handler, err := peer.ConnectToPeer(info, local)
+			select {
+			case dialed <- dial_result{address, handler, err, local.Advertised != nil}:
+			case <-ctx.Done():
+				if handler != nil {
+					handler.Close()
+				}
+				t.session.release_slot()
+			}
+		}()
+	}
+}
+
+func (t *Torrent) accept_peer(ctx context.Context, ds *downloading.DownloadState, in inbound_conn, dialed chan<- dial_result) {
+	if t.is_banned(in.conn.RemoteAddr().String()) || !t.has_room() {
+		in.conn.Close()
+		return
+	}
+
+	address := in.conn.RemoteAddr().String()
+	t.mutex.Lock()
+	t.dialing[address] = struct{}{}
+	t.mutex.Unlock()
+
+	local := t.local(ds, in.handshake.InfoHash)
+	go func() {
+		handler, err := peer.AcceptPeer(in.conn, in.handshake, local)
+		select {
+		case dialed <- dial_result{address, handler, err, local.Advertised != nil}:
+		case <-ctx.Done():
+			if handler != nil {
+				handler.Close()
+			}
+			t.session.release_slot()
+		}
+	}()
+}
+
+func (t *Torrent) add_peer(ctx context.Context, metadata TorrentMetadata, ds *downloading.DownloadState, out_files *outfiles.OutFileManager, result dial_result, received_channel chan<- messaging.Received, error_channel chan<- error) {
+	p := result.handler
+	blocked := t.session.blocked(p.Address) // by a blocklist reloaded while it was being dialed
+	t.mutex.Lock()
+	super := t.super
+	_, duplicate := t.peers[p.RemoteID]
+	_, banned := t.banned[host(p.Address)]
+	banned = banned || blocked
+	if !duplicate && !banned {
+		t.peers[p.RemoteID] = p
+	}
+	t.mutex.Unlock()
+
+	if duplicate || banned {
+		if duplicate {
+			t.log.Debug("already connected to peer", "peer", p.Id) // e.g. we dialed them while they dialed us
+		} else {
+			t.log.Debug("refused banned or blocked peer", "peer", p.Address)
+		}
+		p.Close()
+		t.session.release_slot()
+		return
+	}
+
+	p.ServeBlocks(func(index, begin, length int) ([]byte, error) {
+		if !ds.HasPiece(index) || !super.allowed(p, index) {
+			return nil, fmt.Errorf("we do not have piece %d", index)
+		}
+		return out_files.ReadBlock(index, begin, length)
+	})
+	p.WatchHaves(func(index int) { super.have(p, index) })
+	if metadata.IsV2() {
+		p.ServeHashes(metadata.LayerHashes)
+	}
+	if len(metadata.Info) > 0 {
+		p.ServeMetadata(metadata.Info)
+	}
+	if ds.Finished() {
+		p.SetInterested(false)
+	}
+
+	ds.AddPeer(p)
+	if result.super {
+		super.add(p)
+	}
+	p.StartReceiving(ctx, received_channel, error_channel)
+	t.log.Debug("connected to peer", "peer", p.Id)
+	t.session.emit(Event{Kind: PeerConnected, Torrent: t, Peer: p.Address})
+}
+
+func (t *Torrent) peer_list() []*peer.PeerHandler {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	result := make([]*peer.PeerHandler, 0, len(t.peers))
+	for _, p := range t.peers {
+		result = append(result, p)
+	}
+	return result
+}
+
+func (t *Torrent) prune_peers(ds *downloading.DownloadState) {
+	t.mutex.Lock()
+	pruned := []*peer.PeerHandler{}
+	for id, p := range t.peers {
+		if p.Closed() {
+			delete(t.peers, id)
+			ds.RemovePeer(p)
+			t.super.remove(p)
+			t.session.release_slot()
+			pruned = append(pruned, p)
+		}
+	}
+	super := t.super
+	t.mutex.Unlock()
+
+	if len(pruned) > 0 {
+		super.reoffer()
+	}
+
+	for _, p := range pruned {
+		t.session.emit(Event{Kind: PeerDisconnected, Torrent: t, Peer: p.Address})
+	}
+}
+
+func (t *Torrent) drop_all_peers(ds *downloading.DownloadState) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for id, p := range t.peers {
+		p.Close()
+		delete(t.peers, id)
+		ds.RemovePeer(p)
+		t.super.remove(p)
+		t.session.release_slot()
+	}
+}
+
+// rechoke unchokes interested peers up to the upload slot limit. On the periodic pass, one unchoked peer may be
+// choked to give a waiting peer a turn, so newcomers get a chance to prove themselves
+func (t *Torrent) rechoke(rotate bool) {
+	slots := t.session.config.UploadSlots
+	unchoked := []*peer.PeerHandler{}
+	waiting := []*peer.PeerHandler{}
+	for _, p := range t.peer_list() {
+		if p.Closed() {
+			continue
+		}
+		if !p.Interested() {
+			p.SetChoking(true)
+		} else if p.AmChoking() {
+			waiting = append(waiting, p)
+		} else {
+			unchoked = append(unchoked, p)
+		}
+	}
+
+	if rotate && len(unchoked) >= slots && len(waiting) > 0 {
+		i := rand.IntN(len(unchoked))
+		unchoked[i].SetChoking(true)
+		unchoked = slices.Delete(unchoked, i, i+1)
+	}
+
+	rand.Shuffle(len(waiting), func(i, j int) {
+		waiting[i], waiting[j] = waiting[j], waiting[i]
+	})
+	for _, p := range waiting {
+		if len(unchoked) >= slots {
+			break
+		}
+		p.SetChoking(false)
+		unchoked = append(unchoked, p)
+	}
+}
+
+// wrap charges a peer connection's traffic against the session's, this torrent's and its own bandwidth limits
+func (t *Torrent) wrap(conn net.Conn) net.Conn {
+	s := t.session
+	peer_download, peer_upload := s.peer_download.New(), s.peer_upload.New()
+	wrapped := ratelimit.WrapConn(conn,
+		[]*ratelimit.Limiter{s.download, t.download_limit, peer_download},
+		[]*ratelimit.Limiter{s.upload, t.upload_limit, peer_upload})
+	return wrapped.OnClose(func() {
+		s.peer_download.Release(peer_download)
+		s.peer_upload.Release(peer_upload)
+	})
+}
+
+// dial connects to a peer, through the session's proxy if it has one
+func (t *Torrent) dial(address string) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if through := t.session.proxy; through != nil {
+		conn, err = through.Dial(address, t.session.config.Timeouts.Connect)
+	} else {
+		conn, err = net.DialTimeout("tcp", address, t.session.config.Timeouts.Connect)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return t.wrap(conn), nil
+}
+
+func (t *Torrent) create_web_seeds(metadata TorrentMetadata) []*webseed.WebSeed {
+	web_seeds := []*webseed.WebSeed{}
+	for _, url := range metadata.WebSeeds {
+		ws, err := webseed.NewWebSeed(url, metadata, t.session.config.WebSeedTimeout, t.logger)
+		if err != nil {
+			t.log.Warn("skipping web seed", "err", err)
+			continue
+		}
+		web_seeds = append(web_seeds, ws.WithTransport(t.session.transport))
+	}
+	if len(web_seeds) > 0 {
+		t.log.Debug("using web seeds", "count", len(web_seeds))
+	}
+	return web_seeds
+}
@@ -0,0 +1,95 @@
+package stats
+
+import (
+	"sync"
+	"time"
+)
+
+// A Meter counts bytes transferred, reporting the total and the rate over a rolling window of recent whole seconds.
+// Meters can have a parent, so a peer's traffic also counts towards its torrent's.
+
+const window_seconds = 10
+
+type bucket struct {
+	second int64
+	bytes  int64
+}
+
+type Meter struct {
+	mutex   sync.Mutex
+	now     func() time.Time
+	start   time.Time
+	total   int64
+	buckets [window_seconds]bucket
+	parent  *Meter
+}
+
+// NewMeter returns a meter that also adds to parent, which can be nil
+func NewMeter(parent *Meter) *Meter {
+	return new_meter(parent, time.Now)
+}
+
+func new_meter(parent *Meter, now func() time.Time) *Meter {
+	return &Meter{now: now, start: now(), parent: parent}
+}
+
+func (m *Meter) Add(n int) {
+	if m == nil || n <= 0 {
+		return
+	}
+	m.mutex.Lock()
+	second := m.now().Unix()
+	b := &m.buckets[second%window_seconds]
+	if b.second != second {
+		*b = bucket{second: second}
+	}
+	b.bytes += int64(n)
+	m.total += int64(n)
+	m.mutex.Unlock()
+
+	m.parent.Add(n)
+}
+
+func (m *Meter) Total() int64 {
+	if m == nil {
+		return 0
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.total
+}
+
+// Rate is in bytes per second, over the whole seconds of the window that have passed. The current second is left out
+// as it is only partly counted
+func (m *Meter) Rate() float64 {
+	if m == nil {
+		return 0
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := m.now()
+	current := now.Unix()
+	seconds := min(int64(window_seconds-1), current-m.start.Unix())
+	if seconds <= 0 {
+		return 0
+	}
+	sum := int64(0)
+	for _, b := range m.buckets {
+		if b.second < current && b.second >= current-seconds {
+			sum += b.bytes
+		}
+	}
+	return float64(sum) / float64(seconds)
+}
+
+// ETA estimates how long the remaining bytes will take at the given rate, or -1 if they never will
+func ETA(remaining int64, rate float64) time.Duration {
+	if remaining <= 0 {
+		return 0
+	}
+	if rate <= 0 {
+		return -1
+	}
+	return time.Duration(float64(remaining) / rate * float64(time.Second)).Round(time.Second)
+}
@@ -0,0 +1,118 @@
+package stats
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestMeter_Rate(t *testing.T) {
+	tests := []struct {
+		name      string
+		per_tick  int
+		ticks     int
+		tick      time.Duration
+		want_rate float64
+	}{
+		{"no traffic", 0, 20, time.Second, 0},
+		{"steady over the whole window", 1000, 30, time.Second, 1000},
+		{"steady, several adds a second", 250, 120, 250 * time.Millisecond, 1000},
+		{"younger than the window", 500, 4, time.Second, 500},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Unix(1000, 0)
+			m := new_meter(nil, func() time.Time { return now })
+			for range tt.ticks {
+				m.Add(tt.per_tick)
+				now = now.Add(tt.tick)
+			}
+			if got := m.Rate(); got != tt.want_rate {
+				t.Errorf("Rate() = %v, want %v", got, tt.want_rate)
+			}
+			if got, want := m.Total(), int64(tt.per_tick*tt.ticks); got != want {
+				t.Errorf("Total() = %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestMeter_RateDecaysWhenIdle(t *testing.T) {
+	now := time.Unix(1000, 0)
+	m := new_meter(nil, func() time.Time { return now })
+	for range 20 {
+		m.Add(1000)
+		now = now.Add(time.Second)
+	}
+
+	now = now.Add(window_seconds * time.Second)
+	if rate := m.Rate(); rate != 0 {
+		t.Errorf("expected no rate after a window of idleness, got %v", rate)
+	}
+	if m.Total() != 20_000 {
+		t.Errorf("expected the total to be kept, got %d", m.Total())
+	}
+}
+
+func TestMeter_AddsToParent(t *testing.T) {
+	parent := NewMeter(nil)
+	first, second := NewMeter(parent), NewMeter(parent)
+	first.Add(100)
+	second.Add(50)
+
+	if parent.Total() != 150 {
+		t.Errorf("expected the parent to total 150, got %d", parent.Total())
+	}
+	var none *Meter
+	none.Add(10) // a nil meter counts nothing, so parents are optional
+	if none.Total() != 0 || none.Rate() != 0 {
+		t.Error("expected a nil meter to report nothing")
+	}
+}
+
+func TestETA(t *testing.T) {
+	tests := []struct {
+		name      string
+		remaining int64
+		rate      float64
+		want      time.Duration
+	}{
+		{"complete", 0, 100, 0},
+		{"stalled", 1000, 0, -1},
+		{"a minute", 60_000, 1000, time.Minute},
+		{"rounded", 1500, 1000, 2 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ETA(tt.remaining, tt.rate); got != tt.want {
+				t.Errorf("ETA() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	bounds := []time.Duration{time.Millisecond, time.Second}
+	h := NewHistogram(bounds)
+	for _, d := range []time.Duration{time.Microsecond, time.Millisecond, 2 * time.Millisecond, time.Minute} {
+		h.Observe(d)
+	}
+	if want := []int64{2, 1, 1}; !slices.Equal(h.Counts, want) || h.Count != 4 {
+		t.Errorf("expected counts %v of 4, got %v of %d", want, h.Counts, h.Count)
+	}
+
+	other := NewHistogram(bounds)
+	other.Observe(time.Second)
+	sum := h.Add(other)
+	if want := []int64{2, 2, 1}; !slices.Equal(sum.Counts, want) || sum.Sum != h.Sum+time.Second {
+		t.Errorf("expected counts %v, got %v", want, sum.Counts)
+	}
+	if h.Counts[1] != 1 {
+		t.Errorf("expected adding to leave the original alone")
+	}
+	if empty := (Histogram{}).Add(h); !slices.Equal(empty.Counts, h.Counts) {
+		t.Errorf("expected adding to an empty histogram to copy the other, got %v", empty.Counts)
+	}
+}
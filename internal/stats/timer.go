@@ -0,0 +1,82 @@
+package stats
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// LatencyBounds suit timing disk writes and tracker announces, from a millisecond to tens of seconds
+var LatencyBounds = []time.Duration{
+	time.Millisecond, 5 * time.Millisecond, 10 * time.Millisecond, 25 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 2500 * time.Millisecond, 5 * time.Second, 10 * time.Second, 30 * time.Second,
+}
+
+// Histogram counts durations by the least bound each is within, with those beyond every bound counted last
+type Histogram struct {
+	Bounds []time.Duration
+	Counts []int64 // one per bound, plus one
+	Count  int64
+	Sum    time.Duration
+}
+
+func NewHistogram(bounds []time.Duration) Histogram {
+	return Histogram{Bounds: bounds, Counts: make([]int64, len(bounds)+1)}
+}
+
+func (h *Histogram) Observe(d time.Duration) {
+	i, _ := slices.BinarySearch(h.Bounds, d)
+	h.Counts[i]++
+	h.Count++
+	h.Sum += d
+}
+
+// Add returns the combination of two histograms with the same bounds, either of which may be empty
+func (h Histogram) Add(other Histogram) Histogram {
+	if other.Count == 0 {
+		return h.Clone()
+	}
+	if h.Count == 0 {
+		return other.Clone()
+	}
+	result := h.Clone()
+	for i, c := range other.Counts {
+		result.Counts[i] += c
+	}
+	result.Count += other.Count
+	result.Sum += other.Sum
+	return result
+}
+
+func (h Histogram) Clone() Histogram {
+	h.Counts = slices.Clone(h.Counts)
+	return h
+}
+
+// A Timer is a histogram safe for concurrent use
+type Timer struct {
+	mutex     sync.Mutex
+	histogram Histogram
+}
+
+func NewTimer(bounds []time.Duration) *Timer {
+	return &Timer{histogram: NewHistogram(bounds)}
+}
+
+func (t *Timer) Observe(d time.Duration) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.histogram.Observe(d)
+}
+
+// Since observes the time since start, as in defer timer.Since(time.Now())
+func (t *Timer) Since(start time.Time) {
+	t.Observe(time.Since(start))
+}
+
+func (t *Timer) Snapshot() Histogram {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.histogram.Clone()
+}
@@ -0,0 +1,32 @@
+package terminal
+
+import (
+	"fmt"
+	"time"
+)
+
+// FormatBytes gives a size in binary units, e.g. 1.5 MiB
+func FormatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	value, prefix := float64(n)/unit, 0
+	for value >= unit && prefix < len("KMGTPE")-1 {
+		value /= unit
+		prefix++
+	}
+	return fmt.Sprintf("%.1f %ciB", value, "KMGTPE"[prefix])
+}
+
+func FormatRate(bytes_per_second float64) string {
+	return FormatBytes(int64(bytes_per_second)) + "/s"
+}
+
+// FormatETA gives a duration to the second, or ∞ when unknown (negative)
+func FormatETA(eta time.Duration) string {
+	if eta < 0 {
+		return "∞"
+	}
+	return eta.Round(time.Second).String()
+}
@@ -0,0 +1,94 @@
+package terminal
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A piece map draws a torrent's pieces as a grid of cells, coloured by whether we have them and, if not, by how many
+// peers do. With more pieces than cells, each cell stands for a run of pieces.
+
+type MapPiece struct {
+	Have  bool
+	Peers int
+}
+
+const (
+	colour_have      = 34  // green
+	colour_partial   = 114 // pale green, some of the cell's pieces are had
+	colour_none      = 160 // red, no peer has the piece
+	colour_rare      = 208 // orange, one peer
+	colour_available = 220 // yellow, a few peers
+	colour_common    = 75  // blue, many peers
+)
+
+func PieceMap(pieces []MapPiece, width, height int) []string {
+	if len(pieces) == 0 || width <= 0 || height <= 0 {
+		return nil
+	}
+	cells := min(len(pieces), width*height)
+	lines := []string{}
+	var line strings.Builder
+	for c := range cells {
+		start, end := c*len(pieces)/cells, (c+1)*len(pieces)/cells
+		colour, symbol := map_cell(pieces[start:end])
+		fmt.Fprintf(&line, escape+"[38;5;%dm%s", colour, symbol)
+		if (c+1)%width == 0 || c == cells-1 {
+			line.WriteString(styleReset)
+			lines = append(lines, line.String())
+			line.Reset()
+		}
+	}
+	return lines
+}
+
+// map_cell colours a run of pieces: wholly had, partly had, or by the rarest missing piece's availability
+func map_cell(run []MapPiece) (int, string) {
+	have, rarest := 0, -1
+	for _, p := range run {
+		if p.Have {
+			have++
+		} else if rarest == -1 || p.Peers < rarest {
+			rarest = p.Peers
+		}
+	}
+	switch {
+	case have == len(run):
+		return colour_have, "█"
+	case have > 0:
+		return colour_partial, "▓"
+	case rarest == 0:
+		return colour_none, "░"
+	case rarest == 1:
+		return colour_rare, "░"
+	case rarest < 5:
+		return colour_available, "░"
+	}
+	return colour_common, "░"
+}
+
+// PieceMapLegend explains the colours, in the same style as the map
+func PieceMapLegend() string {
+	entries := []struct {
+		colour int
+		symbol string
+		label  string
+	}{
+		{colour_have, "█", "have"},
+		{colour_partial, "▓", "some"},
+		{colour_none, "░", "unavailable"},
+		{colour_rare, "░", "1 peer"},
+		{colour_available, "░", "2-4 peers"},
+		{colour_common, "░", "5+ peers"},
+	}
+	parts := []string{}
+	for _, e := range entries {
+		parts = append(parts, fmt.Sprintf(escape+"[38;5;%dm%s"+styleReset+" %s", e.colour, e.symbol, e.label))
+	}
+	return strings.Join(parts, "  ")
+}
+
+// PieceMapLegendWidth is how many cells the legend takes on screen
+func PieceMapLegendWidth() int {
+	return len([]rune("█ have  ▓ some  ░ unavailable  ░ 1 peer  ░ 2-4 peers  ░ 5+ peers"))
+}
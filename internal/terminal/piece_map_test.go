@@ -0,0 +1,92 @@
+package terminal
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var colour_code = regexp.MustCompile("\x1b\\[[0-9;]*m")
+
+func visible(line string) string {
+	return colour_code.ReplaceAllString(line, "")
+}
+
+func TestPieceMap(t *testing.T) {
+	tests := []struct {
+		name   string
+		pieces []MapPiece
+		width  int
+		height int
+		want   []string
+	}{
+		{
+			name:   "one cell per piece",
+			pieces: []MapPiece{{Have: true}, {Peers: 0}, {Peers: 1}, {Peers: 3}, {Peers: 9}},
+			width:  3, height: 2,
+			want: []string{"█░░", "░░"},
+		},
+		{
+			name:   "runs of pieces share a cell",
+			pieces: []MapPiece{{Have: true}, {Have: true}, {Have: true}, {Peers: 2}, {Peers: 2}, {Peers: 2}},
+			width:  3, height: 1,
+			want: []string{"█▓░"},
+		},
+		{name: "nothing to draw", width: 10, height: 2, want: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lines := PieceMap(tt.pieces, tt.width, tt.height)
+			got := []string{}
+			for _, l := range lines {
+				got = append(got, visible(l))
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("PieceMap() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPieceMap_ColoursByAvailability(t *testing.T) {
+	lines := PieceMap([]MapPiece{{Peers: 0}, {Peers: 1}, {Peers: 3}, {Peers: 9}}, 4, 1)
+	codes := colour_code.FindAllString(lines[0], -1)
+	want := []string{"\x1b[38;5;160m", "\x1b[38;5;208m", "\x1b[38;5;220m", "\x1b[38;5;75m", "\x1b[0m"}
+	if strings.Join(codes, "") != strings.Join(want, "") {
+		t.Errorf("expected colours %q, got %q", want, codes)
+	}
+	if got := len([]rune(visible(PieceMapLegend()))); got != PieceMapLegendWidth() {
+		t.Errorf("legend is %d wide, but reports %d", got, PieceMapLegendWidth())
+	}
+}
+
+func TestReadKeys(t *testing.T) {
+	keys := ReadKeys(strings.NewReader("q\x1b[A\x1b[B\t\r+\x03é"))
+	got := []string{}
+	for k := range keys {
+		got = append(got, k)
+	}
+	want := []string{"q", "up", "down", "tab", "enter", "+", "ctrl+c", "é"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("ReadKeys() = %v, want %v", got, want)
+	}
+}
+
+func TestFit(t *testing.T) {
+	tests := []struct {
+		s     string
+		width int
+		want  string
+	}{
+		{"abc", 5, "abc  "},
+		{"abcdef", 4, "abc…"},
+		{"µTorrent", 8, "µTorrent"},
+		{"abc", 0, ""},
+	}
+	for _, tt := range tests {
+		if got := Fit(tt.s, tt.width); got != tt.want {
+			t.Errorf("Fit(%q, %d) = %q, want %q", tt.s, tt.width, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package terminal
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/term"
+)
+
+const (
+	altScreenOn  = escape + "[?1049h"
+	altScreenOff = escape + "[?1049l"
+	cursorHome   = escape + "[H"
+	clearBelow   = escape + "[0J"
+	reverseOn    = escape + "[7m"
+	styleReset   = escape + "[0m"
+)
+
+// Screen is a full screen, raw mode view of the terminal, restored on Close
+type Screen struct {
+	in, out *os.File
+	state   *term.State
+}
+
+// IsOutputTerminal is whether stdout is a terminal, so escape codes can be used
+func IsOutputTerminal() bool {
+	return term.IsTerminal(int(os.Stdout.Fd()))
+}
+
+// IsInteractive is whether stdin and stdout are both terminals, so a full screen view can be used
+func IsInteractive() bool {
+	return term.IsTerminal(int(os.Stdin.Fd())) && term.IsTerminal(int(os.Stdout.Fd()))
+}
+
+func OpenScreen() (*Screen, error) {
+	if !IsInteractive() {
+		return nil, fmt.Errorf("not a terminal")
+	}
+	state, err := term.MakeRaw(int(os.Stdin.Fd()))
+	if err != nil {
+		return nil, err
+	}
+	fmt.Print(altScreenOn + cursorHide)
+	return &Screen{in: os.Stdin, out: os.Stdout, state: state}, nil
+}
+
+// Size is the terminal's width and height in cells, with a fallback if it cannot be read
+func (s *Screen) Size() (int, int) {
+	width, height, err := term.GetSize(int(s.out.Fd()))
+	if err != nil || width <= 0 || height <= 0 {
+		return 80, 24
+	}
+	return width, height
+}
+
+// Draw replaces the screen's contents. Lines should already fit the width
+func (s *Screen) Draw(lines []string) {
+	var b strings.Builder
+	b.WriteString(cursorHome)
+	for i, l := range lines {
+		if i > 0 {
+			b.WriteString("\r\n") // raw mode does not return the carriage
+		}
+		b.WriteString(l)
+		b.WriteString(clearToEnd)
+	}
+	b.WriteString(clearBelow)
+	io.WriteString(s.out, b.String())
+}
+
+func (s *Screen) Close() {
+	fmt.Print(cursorShow + altScreenOff)
+	term.Restore(int(s.in.Fd()), s.state)
+}
+
+// Keys reads key presses until the input ends. Printable keys are themselves, others are named: up, down, left,
+// right, tab, enter, esc and ctrl+c
+func (s *Screen) Keys() <-chan string {
+	return ReadKeys(s.in)
+}
+
+func ReadKeys(r io.Reader) <-chan string {
+	keys := make(chan string)
+	go func() {
+		defer close(keys)
+		reader := bufio.NewReader(r)
+		for {
+			key, err := read_key(reader)
+			if err != nil {
+				return
+			}
+			if key != "" {
+				keys <- key
+			}
+		}
+	}()
+	return keys
+}
+
+func read_key(r *bufio.Reader) (string, error) {
+	c, err := r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	switch c {
+	case 3:
+		return "ctrl+c", nil
+	case '\t':
+		return "tab", nil
+	case '\r', '\n':
+		return "enter", nil
+	case 0x1b:
+		if r.Buffered() == 0 {
+			return "esc", nil
+		}
+		next, _ := r.ReadByte()
+		if next != '[' && next != 'O' {
+			return "", nil
+		}
+		final, _ := r.ReadByte()
+		switch final {
+		case 'A':
+			return "up", nil
+		case 'B':
+			return "down", nil
+		case 'C':
+			return "right", nil
+		case 'D':
+			return "left", nil
+		}
+		return "", nil // an escape sequence we do not use
+	}
+	if c < utf8.RuneSelf {
+		if c < ' ' {
+			return "", nil
+		}
+		return string(c), nil
+	}
+	r.UnreadByte()
+	ch, _, err := r.ReadRune()
+	return string(ch), err
+}
+
+// Fit pads or truncates plain text to exactly width cells, marking truncation with an ellipsis
+func Fit(s string, width int) string {
+	if width <= 0 {
+		return ""
+	}
+	runes := []rune(s)
+	if len(runes) > width {
+		return string(runes[:width-1]) + "…"
+	}
+	return s + strings.Repeat(" ", width-len(runes))
+}
+
+// Reverse highlights text, e.g. a selected row or a title bar
+func Reverse(s string) string {
+	return reverseOn + s + styleReset
+}
@@ -0,0 +1,143 @@
+package torrent_files
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/chrispritchard/gorrent/internal/bencode"
+)
+
+// MagnetLink builds a BEP 9 magnet uri for the torrent, including its name, trackers and any web seeds
+func MagnetLink(metadata TorrentMetadata) string {
+	var s strings.Builder
+	s.WriteString("magnet:?xt=urn:btih:")
+	s.WriteString(hex.EncodeToString(metadata.InfoHash[:]))
+	if metadata.Name != "" {
+		s.WriteString("&dn=" + url.QueryEscape(metadata.Name))
+	}
+	seen := map[string]struct{}{} // 'announce' is usually repeated in 'announce-list'
+	for _, a := range metadata.Announcers {
+		if _, exists := seen[a]; exists {
+			continue
+		}
+		seen[a] = struct{}{}
+		s.WriteString("&tr=" + url.QueryEscape(a))
+	}
+	for _, w := range metadata.WebSeeds {
+		s.WriteString("&ws=" + url.QueryEscape(w))
+	}
+	return s.String()
+}
+
+// Magnet is what a magnet link tells us: enough to find peers, who can then send us the info dict
+type Magnet struct {
+	InfoHash [20]byte
+	Name     string
+	Trackers []string
+	WebSeeds []string
+}
+
+// ParseMagnet reads a BEP 9 magnet uri. Only v1 info hashes (btih) are supported, in hex or base32
+func ParseMagnet(uri string) (Magnet, error) {
+	var result Magnet
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return result, fmt.Errorf("invalid magnet link: %v", err)
+	}
+	if parsed.Scheme != "magnet" {
+		return result, fmt.Errorf("invalid magnet link: scheme is %q", parsed.Scheme)
+	}
+	query := parsed.Query()
+
+	found := false
+	for _, xt := range query["xt"] {
+		encoded, ok := strings.CutPrefix(xt, "urn:btih:")
+		if !ok {
+			continue
+		}
+		var hash []byte
+		switch len(encoded) {
+		case 40:
+			hash, err = hex.DecodeString(encoded)
+		case 32:
+			hash, err = base32.StdEncoding.DecodeString(strings.ToUpper(encoded))
+		default:
+			err = fmt.Errorf("info hash has length %d", len(encoded))
+		}
+		if err != nil {
+			return result, fmt.Errorf("invalid magnet link: %v", err)
+		}
+		copy(result.InfoHash[:], hash)
+		found = true
+		break
+	}
+	if !found {
+		return result, fmt.Errorf("invalid magnet link: no btih info hash")
+	}
+
+	result.Name = query.Get("dn")
+	result.Trackers = query["tr"]
+	result.WebSeeds = query["ws"]
+	return result, nil
+}
+
+// Metadata is the stand-in used until the info dict arrives, so the torrent can announce and be shown by name
+func (m Magnet) Metadata() TorrentMetadata {
+	name := m.Name
+	if name == "" {
+		name = hex.EncodeToString(m.InfoHash[:])
+	}
+	return TorrentMetadata{
+		Announcers: m.Trackers,
+		InfoHash:   m.InfoHash,
+		Name:       name,
+		WebSeeds:   m.WebSeeds,
+	}
+}
+
+// MetadataFromInfo completes a magnet link with an info dict received from peers, checking it matches the info hash
+func MetadataFromInfo(m Magnet, info []byte) (TorrentMetadata, error) {
+	var nil_torrent TorrentMetadata
+	if sha1.Sum(info) != m.InfoHash {
+		return nil_torrent, fmt.Errorf("info dict does not match the info hash")
+	}
+	decoded, _, err := bencode.Decode(info)
+	if dict, ok := decoded.(map[string]any); err != nil || !ok {
+		return nil_torrent, fmt.Errorf("info dict is not a valid dict")
+	} else if version, _ := bencode.Get[int](dict, "meta version"); version == 2 {
+		return nil_torrent, fmt.Errorf("v2 torrents cannot be completed from a magnet link, as their piece layers are not in the info dict")
+	}
+
+	// rebuild a torrent file around the info dict, keeping the keys in sorted order
+	var data bytes.Buffer
+	data.WriteString("d")
+	if len(m.Trackers) > 0 {
+		tiers := []any{}
+		for _, tr := range m.Trackers {
+			tiers = append(tiers, []string{tr})
+		}
+		announce_list, err := bencode.Encode(tiers)
+		if err != nil {
+			return nil_torrent, err
+		}
+		fmt.Fprintf(&data, "8:announce%d:%s13:announce-list%s", len(m.Trackers[0]), m.Trackers[0], announce_list)
+	}
+	data.WriteString("4:info")
+	data.Write(info)
+	if len(m.WebSeeds) > 0 {
+		web_seeds, err := bencode.Encode(m.WebSeeds)
+		if err != nil {
+			return nil_torrent, err
+		}
+		data.WriteString("8:url-list")
+		data.Write(web_seeds)
+	}
+	data.WriteString("e")
+
+	return ParseTorrentFile(data.Bytes())
+}
@@ -0,0 +1,83 @@
+package torrent_files
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseMagnet(t *testing.T) {
+	tests := []struct {
+		name     string
+		uri      string
+		want     Magnet
+		want_err bool
+	}{
+		{
+			name: "hex with name and trackers",
+			uri:  "magnet:?xt=urn:btih:0102030405060708090a0b0c0d0e0f1011121314&dn=some+file&tr=http%3A%2F%2Fa%2Fannounce&tr=http%3A%2F%2Fb%2Fannounce",
+			want: Magnet{
+				InfoHash: [20]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20},
+				Name:     "some file",
+				Trackers: []string{"http://a/announce", "http://b/announce"},
+			},
+		},
+		{
+			name: "base32",
+			uri:  "magnet:?xt=urn:btih:aebagbafaydqqcikbmga2dqpcaireeyu",
+			want: Magnet{InfoHash: [20]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}},
+		},
+		{name: "not a magnet", uri: "http://example.com", want_err: true},
+		{name: "no info hash", uri: "magnet:?dn=name", want_err: true},
+		{name: "bad hash length", uri: "magnet:?xt=urn:btih:0102", want_err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseMagnet(tt.uri)
+			if (err != nil) != tt.want_err {
+				t.Fatalf("ParseMagnet() error = %v, want_err %v", err, tt.want_err)
+			}
+			if !tt.want_err && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseMagnet() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMetadataFromInfo_RoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data.bin")
+	writeTestFile(t, path, 40000, 3)
+
+	_, original, err := CreateTorrent(path, CreateOptions{
+		PieceLength: 16384,
+		Announce:    [][]string{{"http://tracker.example/announce"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	magnet, err := ParseMagnet(MagnetLink(original))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if magnet.InfoHash != original.InfoHash || magnet.Name != original.Name {
+		t.Errorf("magnet does not match the torrent: %+v", magnet)
+	}
+
+	rebuilt, err := MetadataFromInfo(magnet, original.Info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rebuilt.InfoHash != original.InfoHash || rebuilt.Length != original.Length || !reflect.DeepEqual(rebuilt.Pieces, original.Pieces) {
+		t.Errorf("rebuilt metadata differs: %+v", rebuilt)
+	}
+	if len(rebuilt.Announcers) == 0 || rebuilt.Announcers[0] != "http://tracker.example/announce" {
+		t.Errorf("expected the magnet's tracker, got %v", rebuilt.Announcers)
+	}
+
+	if _, err := MetadataFromInfo(magnet, append([]byte{}, original.Info[:len(original.Info)-1]...)); err == nil {
+		t.Error("expected a truncated info dict to be rejected")
+	}
+}
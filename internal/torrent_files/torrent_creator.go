@@ -0,0 +1,276 @@
+package torrent_files
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chrispritchard/gorrent/internal/bencode"
+)
+
+// Builds new torrent files from local data. Pieces are hashed in parallel, each worker reading its own piece range
+// across however many files that piece spans.
+
+const (
+	min_piece_length    = 1 << 14 // 16 KiB
+	max_piece_length    = 1 << 24 // 16 MiB
+	target_piece_count  = 1500
+	default_created_by  = "gorrent"
+	hash_channel_buffer = 64
+)
+
+type CreateOptions struct {
+	PieceLength int        // 0 to choose automatically
+	Announce    [][]string // tiers of tracker urls, the first url of the first tier becomes 'announce'
+	WebSeeds    []string
+	Private     bool
+	Comment     string
+	CreatedBy   string
+	Workers     int // 0 to use one per cpu
+}
+
+type source_file struct {
+	full_path string
+	path      []string
+	length    int
+}
+
+// CreateTorrent hashes the file or directory at root, returning the bencoded torrent and its parsed metadata
+func CreateTorrent(root string, options CreateOptions) ([]byte, TorrentMetadata, error) {
+	var nil_torrent TorrentMetadata
+
+	root = filepath.Clean(root)
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, nil_torrent, err
+	}
+
+	files, err := collect_files(root, info)
+	if err != nil {
+		return nil, nil_torrent, err
+	}
+
+	total_length := 0
+	for _, f := range files {
+		total_length += f.length
+	}
+	if total_length == 0 {
+		return nil, nil_torrent, fmt.Errorf("no data to create a torrent from at %s", root)
+	}
+
+	piece_length := options.PieceLength
+	if piece_length == 0 {
+		piece_length = ChoosePieceLength(total_length)
+	} else if piece_length < min_piece_length || piece_length&(piece_length-1) != 0 {
+		return nil, nil_torrent, fmt.Errorf("piece length must be a power of two and at least %d bytes", min_piece_length)
+	}
+
+	workers := options.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	pieces, err := hash_pieces(files, total_length, piece_length, workers)
+	if err != nil {
+		return nil, nil_torrent, err
+	}
+
+	info_dict := map[string]any{
+		"name":         filepath.Base(root),
+		"piece length": piece_length,
+		"pieces":       pieces,
+	}
+	if info.IsDir() {
+		file_list := []any{}
+		for _, f := range files {
+			file_list = append(file_list, map[string]any{
+				"length": f.length,
+				"path":   f.path,
+			})
+		}
+		info_dict["files"] = file_list
+	} else {
+		info_dict["length"] = total_length
+	}
+	if options.Private {
+		info_dict["private"] = 1
+	}
+
+	created_by := options.CreatedBy
+	if created_by == "" {
+		created_by = default_created_by
+	}
+	torrent := map[string]any{
+		"info":          info_dict,
+		"created by":    created_by,
+		"creation date": time.Now().Unix(),
+	}
+	if len(options.Announce) > 0 && len(options.Announce[0]) > 0 {
+		torrent["announce"] = options.Announce[0][0]
+		if len(options.Announce) > 1 || len(options.Announce[0]) > 1 {
+			tiers := []any{}
+			for _, tier := range options.Announce {
+				if len(tier) > 0 {
+					tiers = append(tiers, tier)
+				}
+			}
+			torrent["announce-list"] = tiers
+		}
+	}
+	if len(options.WebSeeds) > 0 {
+		torrent["url-list"] = options.WebSeeds
+	}
+	if options.Comment != "" {
+		torrent["comment"] = options.Comment
+	}
+
+	data, err := bencode.Encode(torrent)
+	if err != nil {
+		return nil, nil_torrent, err
+	}
+
+	metadata, err := ParseTorrentFile(data)
+	if err != nil {
+		return nil, nil_torrent, fmt.Errorf("created torrent failed to parse: %v", err)
+	}
+	return data, metadata, nil
+}
+
+// ChoosePieceLength picks a power of two piece length giving roughly target_piece_count pieces, within sensible bounds
+func ChoosePieceLength(total_length int) int {
+	piece_length := min_piece_length
+	for piece_length < max_piece_length && total_length/piece_length > target_piece_count {
+		piece_length <<= 1
+	}
+	return piece_length
+}
+
+func collect_files(root string, info fs.FileInfo) ([]source_file, error) {
+	if !info.IsDir() {
+		if !info.Mode().IsRegular() {
+			return nil, fmt.Errorf("%s is not a regular file", root)
+		}
+		return []source_file{{root, []string{info.Name()}, int(info.Size())}}, nil
+	}
+
+	files := []source_file{}
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil // directories are implied by paths, and links or devices are not included
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, source_file{path, strings.Split(filepath.ToSlash(rel), "/"), int(info.Size())})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil // WalkDir visits in lexical order, so the file list is deterministic
+}
+
+type piece_hash struct {
+	index int
+	hash  [20]byte
+	err   error
+}
+
+func hash_pieces(files []source_file, total_length, piece_length, workers int) (string, error) {
+	handles := make([]*os.File, len(files))
+	for i, f := range files {
+		h, err := os.Open(f.full_path)
+		if err != nil {
+			close_files(handles)
+			return "", err
+		}
+		handles[i] = h
+	}
+	defer close_files(handles)
+
+	piece_count := (total_length + piece_length - 1) / piece_length
+	indices := make(chan int, hash_channel_buffer)
+	results := make(chan piece_hash, hash_channel_buffer)
+
+	var wg sync.WaitGroup
+	for range min(workers, piece_count) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buffer := make([]byte, piece_length)
+			for i := range indices {
+				start := i * piece_length
+				end := min(start+piece_length, total_length)
+				err := read_range(files, handles, start, buffer[:end-start])
+				results <- piece_hash{i, sha1.Sum(buffer[:end-start]), err}
+			}
+		}()
+	}
+
+	go func() {
+		for i := range piece_count {
+			indices <- i
+		}
+		close(indices)
+		wg.Wait()
+		close(results)
+	}()
+
+	pieces := make([]byte, piece_count*20)
+	var first_err error
+	for r := range results {
+		if r.err != nil && first_err == nil {
+			first_err = r.err
+		}
+		copy(pieces[r.index*20:], r.hash[:])
+	}
+	if first_err != nil {
+		return "", first_err
+	}
+	return string(pieces), nil
+}
+
+// read_range fills buffer with data starting at the torrent-wide offset start, spanning files as needed
+func read_range(files []source_file, handles []*os.File, start int, buffer []byte) error {
+	file_start := 0
+	end := start + len(buffer)
+	for i, f := range files {
+		file_end := file_start + f.length
+		if file_end > start && file_start < end {
+			overlap_start := max(start, file_start)
+			overlap_end := min(end, file_end)
+			n, err := handles[i].ReadAt(buffer[overlap_start-start:overlap_end-start], int64(overlap_start-file_start))
+			if n != overlap_end-overlap_start {
+				if err == nil || err == io.EOF {
+					err = fmt.Errorf("file changed size while hashing")
+				}
+				return fmt.Errorf("failed to read %s: %v", f.full_path, err)
+			}
+		}
+		file_start = file_end
+	}
+	return nil
+}
+
+func close_files(handles []*os.File) {
+	for _, h := range handles {
+		if h != nil {
+			h.Close()
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package torrent_files
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/chrispritchard/gorrent/internal/bencode"
+)
+
+func writeTestFile(t *testing.T, path string, size int, seed byte) []byte {
+	t.Helper()
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i*7) + seed
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestCreateTorrent_SingleFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data.bin")
+	content := writeTestFile(t, path, 40000, 1)
+
+	data, metadata, err := CreateTorrent(path, CreateOptions{
+		PieceLength: 16384,
+		Announce:    [][]string{{"http://tracker.example/announce"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if metadata.Name != "data.bin" || metadata.Length != 40000 || len(metadata.Files) != 0 {
+		t.Errorf("unexpected metadata: %+v", metadata)
+	}
+	if len(metadata.Pieces) != 3 {
+		t.Fatalf("expected 3 pieces, got %d", len(metadata.Pieces))
+	}
+	for i, p := range metadata.Pieces {
+		end := min((i+1)*16384, len(content))
+		want := sha1.Sum(content[i*16384 : end])
+		if p != string(want[:]) {
+			t.Errorf("piece %d hash mismatch", i)
+		}
+	}
+
+	reparsed, err := ParseTorrentFile(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reparsed.InfoHash != metadata.InfoHash {
+		t.Errorf("info hash changed on reparse")
+	}
+}
+
+func TestCreateTorrent_DirectoryPiecesSpanFiles(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "set")
+	a := writeTestFile(t, filepath.Join(dir, "a.bin"), 10000, 1)
+	b := writeTestFile(t, filepath.Join(dir, "sub", "b.bin"), 30000, 2)
+	c := writeTestFile(t, filepath.Join(dir, "z.bin"), 5, 3)
+	all := append(append(append([]byte{}, a...), b...), c...)
+
+	_, metadata, err := CreateTorrent(dir, CreateOptions{PieceLength: 16384, Workers: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want_files := []TorrentFile{
+		{Path: []string{"a.bin"}, Length: 10000},
+		{Path: []string{"sub", "b.bin"}, Length: 30000},
+		{Path: []string{"z.bin"}, Length: 5},
+	}
+	if !reflect.DeepEqual(metadata.Files, want_files) {
+		t.Errorf("files = %+v, want %+v", metadata.Files, want_files)
+	}
+	if metadata.Name != "set" || metadata.Length != len(all) {
+		t.Errorf("unexpected name or length: %s %d", metadata.Name, metadata.Length)
+	}
+	for i, p := range metadata.Pieces {
+		end := min((i+1)*16384, len(all))
+		want := sha1.Sum(all[i*16384 : end])
+		if p != string(want[:]) {
+			t.Errorf("piece %d hash mismatch", i)
+		}
+	}
+}
+
+func TestCreateTorrent_OptionalFields(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data.bin")
+	writeTestFile(t, path, 100, 1)
+
+	data, metadata, err := CreateTorrent(path, CreateOptions{
+		Announce:  [][]string{{"http://a/announce", "http://b/announce"}, {"http://c/announce"}},
+		WebSeeds:  []string{"http://mirror/data.bin"},
+		Private:   true,
+		Comment:   "nightly dataset",
+		CreatedBy: "tests",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, _, err := bencode.Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := decoded.(map[string]any)
+	info := root["info"].(map[string]any)
+
+	if root["announce"] != "http://a/announce" {
+		t.Errorf("unexpected announce: %v", root["announce"])
+	}
+	want_tiers := []any{[]any{"http://a/announce", "http://b/announce"}, []any{"http://c/announce"}}
+	if !reflect.DeepEqual(root["announce-list"], want_tiers) {
+		t.Errorf("unexpected announce-list: %v", root["announce-list"])
+	}
+	if root["comment"] != "nightly dataset" || root["created by"] != "tests" {
+		t.Errorf("unexpected comment or created by: %v %v", root["comment"], root["created by"])
+	}
+	if info["private"] != 1 {
+		t.Errorf("expected private flag in info dict")
+	}
+	if !reflect.DeepEqual(metadata.WebSeeds, []string{"http://mirror/data.bin"}) {
+		t.Errorf("unexpected web seeds: %v", metadata.WebSeeds)
+	}
+
+	// the info hash must be over the canonical encoding of the info dict
+	info_bytes, _ := bencode.Encode(info)
+	if sha1.Sum(info_bytes) != metadata.InfoHash {
+		t.Errorf("info hash does not match the encoded info dict")
+	}
+	if !bytes.Contains(data, info_bytes) {
+		t.Errorf("encoded info dict not found verbatim in torrent")
+	}
+}
+
+func TestCreateTorrent_Errors(t *testing.T) {
+	dir := t.TempDir()
+	if _, _, err := CreateTorrent(dir, CreateOptions{}); err == nil {
+		t.Errorf("expected an error for an empty directory")
+	}
+	if _, _, err := CreateTorrent(filepath.Join(dir, "missing"), CreateOptions{}); err == nil {
+		t.Errorf("expected an error for a missing path")
+	}
+	path := filepath.Join(dir, "data.bin")
+	writeTestFile(t, path, 100, 1)
+	if _, _, err := CreateTorrent(path, CreateOptions{PieceLength: 20000}); err == nil {
+		t.Errorf("expected an error for a piece length that is not a power of two")
+	}
+}
+
+func TestChoosePieceLength(t *testing.T) {
+	tests := []struct {
+		total int
+		want  int
+	}{
+		{1, 1 << 14},
+		{1 << 20, 1 << 14},
+		{1 << 30, 1 << 20},
+		{1 << 40, 1 << 24},
+	}
+	for _, tt := range tests {
+		if got := ChoosePieceLength(tt.total); got != tt.want {
+			t.Errorf("ChoosePieceLength(%d) = %d, want %d", tt.total, got, tt.want)
+		}
+	}
+}
+
+func TestMagnetLink(t *testing.T) {
+	metadata := TorrentMetadata{
+		InfoHash:   [20]byte{0xde, 0xad, 0xbe, 0xef},
+		Name:       "my data",
+		Announcers: []string{"http://a/announce", "http://a/announce", "udp://b:80"},
+		WebSeeds:   []string{"http://mirror/"},
+	}
+	got := MagnetLink(metadata)
+	want := "magnet:?xt=urn:btih:deadbeef00000000000000000000000000000000&dn=my+data" +
+		"&tr=http%3A%2F%2Fa%2Fannounce&tr=udp%3A%2F%2Fb%3A80&ws=http%3A%2F%2Fmirror%2F"
+	if got != want {
+		t.Errorf("MagnetLink() = %s, want %s", got, want)
+	}
+	if strings.Count(got, "&tr=") != 2 {
+		t.Errorf("duplicate trackers should be removed")
+	}
+}
@@ -1,16 +1,159 @@
 package torrent_files
 
+import (
+	"crypto/sha1"
+	"strings"
+
+	"github.com/chrispritchard/gorrent/internal/merkle"
+)
+
 type TorrentMetadata struct {
 	Announcers  []string
-	InfoHash    [20]byte
+	InfoHash    [20]byte // the hash used on the wire: sha1 for v1 and hybrid torrents, truncated sha256 for v2 only
 	Name        string
 	PieceLength int
 	Pieces      []string
 	Length      int
 	Files       []TorrentFile
+	WebSeeds    []string
+	MetaVersion int                      // 1, or 2 for v2 and hybrid torrents (BEP 52)
+	InfoHashV2  [32]byte                 // sha256 of the info dict, for v2 and hybrid torrents
+	PiecesV2    []PieceHashV2            // per piece merkle roots, for v2 and hybrid torrents
+	PieceLayers map[string][]merkle.Hash // piece layer hashes keyed by the file's pieces root
+	Info        []byte                   // the raw info dict, served to peers who only have a magnet link (BEP 9)
 }
 
 type TorrentFile struct {
-	Path   []string
-	Length int
+	Path        []string
+	Length      int
+	PiecesRoot  string   // merkle root of the file's data, for v2 and hybrid torrents
+	Attr        string   // BEP 47 attributes: p for padding, x executable, h hidden and l symlink
+	SymlinkPath []string // the link target relative to the torrent root, for symlinks
+}
+
+func (f TorrentFile) IsPadding() bool {
+	return strings.Contains(f.Attr, "p")
+}
+
+func (f TorrentFile) IsExecutable() bool {
+	return strings.Contains(f.Attr, "x")
+}
+
+func (f TorrentFile) IsHidden() bool {
+	return strings.Contains(f.Attr, "h")
+}
+
+func (f TorrentFile) IsSymlink() bool {
+	return strings.Contains(f.Attr, "l")
+}
+
+// IsVirtual reports whether the file has no data on disk: padding is zeros that are never written, and symlinks are
+// created once the download is complete
+func (f TorrentFile) IsVirtual() bool {
+	return f.IsPadding() || f.IsSymlink()
+}
+
+// PieceHashV2 is what a piece must hash to under BEP 52, where pieces never span files
+type PieceHashV2 struct {
+	Root       merkle.Hash // the piece layer hash, or the file's pieces root when the file fits in one piece
+	DataLength int         // bytes of file data in the piece, excluding any v1 padding
+	LeafCount  int         // blocks in the piece's subtree, including zero padding
+}
+
+// Verify checks the piece data against its merkle root. Only the first DataLength bytes are considered, so a hybrid
+// piece that includes v1 padding can be passed whole
+func (ph PieceHashV2) Verify(data []byte) bool {
+	if len(data) < ph.DataLength {
+		return false
+	}
+	leaves := merkle.HashBlocks(data[:ph.DataLength])
+	return merkle.Root(leaves, ph.LeafCount, merkle.Hash{}) == ph.Root
+}
+
+func (m TorrentMetadata) IsV1() bool {
+	return len(m.Pieces) > 0
+}
+
+func (m TorrentMetadata) IsV2() bool {
+	return m.MetaVersion == 2
+}
+
+func (m TorrentMetadata) IsHybrid() bool {
+	return m.IsV1() && m.IsV2()
+}
+
+// SwarmHashes returns the info hashes to announce and handshake with. Hybrid torrents join both the v1 and v2 swarms
+func (m TorrentMetadata) SwarmHashes() [][20]byte {
+	result := [][20]byte{m.InfoHash}
+	if m.IsHybrid() {
+		var truncated [20]byte
+		copy(truncated[:], m.InfoHashV2[:20])
+		result = append(result, truncated)
+	}
+	return result
+}
+
+func (m TorrentMetadata) PieceCount() int {
+	if m.IsV1() {
+		return len(m.Pieces)
+	}
+	return len(m.PiecesV2)
+}
+
+// PieceSize returns the number of bytes in the given piece, which for v2 only torrents is short at the end of each file
+func (m TorrentMetadata) PieceSize(index int) int {
+	if !m.IsV1() {
+		return m.PiecesV2[index].DataLength
+	}
+	if index == len(m.Pieces)-1 {
+		if last_size := m.Length % m.PieceLength; last_size != 0 {
+			return last_size
+		}
+	}
+	return m.PieceLength
+}
+
+// VerifyPiece checks piece data against every hash the torrent has for it
+func (m TorrentMetadata) VerifyPiece(index int, data []byte) bool {
+	if index < 0 || index >= m.PieceCount() {
+		return false
+	}
+	if m.IsV1() && !verify_sha1(m.Pieces[index], data) {
+		return false
+	}
+	if m.IsV2() && !m.PiecesV2[index].Verify(data) {
+		return false
+	}
+	return true
+}
+
+func verify_sha1(hash string, data []byte) bool {
+	actual := sha1.Sum(data)
+	return string(actual[:]) == hash
+}
+
+// FileSpan places a file within the torrent's contiguous piece space
+type FileSpan struct {
+	File       TorrentFile
+	Start, End int
+}
+
+// FileSpans lays the files out end to end as pieces see them. Single file torrents are one span named for the torrent,
+// and in v2 only torrents each file starts on a piece boundary, leaving gaps that no file backs
+func (m TorrentMetadata) FileSpans() []FileSpan {
+	if len(m.Files) == 0 {
+		return []FileSpan{{TorrentFile{Path: []string{m.Name}, Length: m.Length}, 0, m.Length}}
+	}
+
+	align_files := m.IsV2() && !m.IsV1()
+	spans := make([]FileSpan, len(m.Files))
+	offset := 0
+	for i, f := range m.Files {
+		if align_files && f.Length > 0 {
+			offset = (offset + m.PieceLength - 1) / m.PieceLength * m.PieceLength
+		}
+		spans[i] = FileSpan{f, offset, offset + f.Length}
+		offset += f.Length
+	}
+	return spans
 }
@@ -3,6 +3,7 @@ package torrent_files
 import (
 	"crypto/sha1"
 	"fmt"
+	"strings"
 
 	"github.com/chrispritchard/gorrent/internal/bencode"
 )
@@ -11,7 +12,7 @@ import (
 
 func ParseTorrentFile(file_data []byte) (TorrentMetadata, error) {
 	var nil_torrent TorrentMetadata
-	hash, err := get_info_hash(file_data)
+	info_bytes, err := get_info_bytes(file_data)
 	if err != nil {
 		return nil_torrent, err
 	}
@@ -25,11 +26,11 @@ func ParseTorrentFile(file_data []byte) (TorrentMetadata, error) {
 		return nil_torrent, fmt.Errorf("invalid torrent: root is not a dict")
 	}
 
+	announcers := []string{}
 	announce, err := bencode.Get[string](root, "announce")
-	if err != nil {
-		return nil_torrent, fmt.Errorf("invalid torrent: %v", err)
+	if err == nil {
+		announcers = append(announcers, announce)
 	}
-	announcers := []string{announce}
 
 	announce_list, err := bencode.Get[[]any](root, "announce-list")
 	if err == nil {
@@ -48,6 +49,14 @@ func ParseTorrentFile(file_data []byte) (TorrentMetadata, error) {
 		}
 	}
 
+	// url-list is either a single url or a list of them
+	web_seeds := []string{}
+	if web_seed, err := bencode.Get[string](root, "url-list"); err == nil && web_seed != "" {
+		web_seeds = append(web_seeds, web_seed)
+	} else if list, err := bencode.GetStrings(root, "url-list"); err == nil {
+		web_seeds = list
+	}
+
 	info, err := bencode.Get[map[string]any](root, "info")
 	if err != nil {
 		return nil_torrent, fmt.Errorf("invalid torrent: %v", err)
@@ -63,8 +72,11 @@ func ParseTorrentFile(file_data []byte) (TorrentMetadata, error) {
 		return nil_torrent, fmt.Errorf("invalid torrent: %v", err)
 	}
 
+	// v2 only torrents have no 'pieces', 'length' or 'files', instead using 'file tree' and 'piece layers'
+	meta_version, _ := bencode.Get[int](info, "meta version")
+
 	pieces, err := bencode.Get[string](info, "pieces")
-	if err != nil {
+	if err != nil && meta_version != 2 {
 		return nil_torrent, fmt.Errorf("invalid torrent: %v", err)
 	}
 	pieces_parsed := []string{}
@@ -74,7 +86,7 @@ func ParseTorrentFile(file_data []byte) (TorrentMetadata, error) {
 
 	length, err := bencode.Get[int](info, "length")
 	files, err2 := bencode.Get[[]any](info, "files")
-	if err != nil && err2 != nil {
+	if err != nil && err2 != nil && len(pieces_parsed) > 0 {
 		return nil_torrent, fmt.Errorf("invalid torrent: invalid files or missing length")
 	}
 	file_set := []TorrentFile{}
@@ -92,9 +104,15 @@ func ParseTorrentFile(file_data []byte) (TorrentMetadata, error) {
 			if err != nil {
 				return nil_torrent, fmt.Errorf("invalid torrent: %v", err)
 			}
+			attr, symlink_path, err := parse_attributes(info)
+			if err != nil {
+				return nil_torrent, fmt.Errorf("invalid torrent: %v", err)
+			}
 			file_set = append(file_set, TorrentFile{
-				Length: file_length,
-				Path:   path,
+				Length:      file_length,
+				Path:        path,
+				Attr:        attr,
+				SymlinkPath: symlink_path,
 			})
 		}
 	}
@@ -105,53 +123,79 @@ func ParseTorrentFile(file_data []byte) (TorrentMetadata, error) {
 		}
 	}
 
-	return TorrentMetadata{
+	metadata := TorrentMetadata{
 		Announcers:  announcers,
-		InfoHash:    hash,
+		InfoHash:    sha1.Sum(info_bytes),
 		Name:        name,
 		PieceLength: piece_length,
 		Pieces:      pieces_parsed,
 		Length:      length,
 		Files:       file_set,
-	}, nil
+		WebSeeds:    web_seeds,
+		MetaVersion: 1,
+		Info:        info_bytes,
+	}
+
+	if meta_version == 2 {
+		err = parse_v2(root, info, info_bytes, &metadata)
+		if err != nil {
+			return nil_torrent, fmt.Errorf("invalid v2 torrent: %v", err)
+		}
+	}
+
+	return metadata, nil
 }
 
-func get_info_hash(data []byte) ([20]byte, error) {
+// parse_attributes reads the optional BEP 47 keys of a file entry
+func parse_attributes(entry map[string]any) (string, []string, error) {
+	attr, _ := bencode.Get[string](entry, "attr")
+	if !strings.Contains(attr, "l") {
+		return attr, nil, nil
+	}
+	symlink_path, err := bencode.GetStrings(entry, "symlink path")
+	if err != nil || len(symlink_path) == 0 {
+		return "", nil, fmt.Errorf("symlink is missing its symlink path")
+	}
+	return attr, symlink_path, nil
+}
+
+// get_info_bytes finds the raw bencoded info dict, which the info hashes are calculated over
+func get_info_bytes(data []byte) ([]byte, error) {
+	if len(data) < 2 || data[0] != 'd' {
+		return nil, fmt.Errorf("invalid torrent: root is not a dict")
+	}
 	data = data[1:]
-	var nil_hash [20]byte
 	if data[0] == 'e' {
-		return nil_hash, fmt.Errorf("no info key found")
+		return nil, fmt.Errorf("no info key found")
 	}
 	is_key := true
 	key := ""
 	for {
 		n, r, e := bencode.Decode(data)
 		if e != nil {
-			return nil_hash, e
+			return nil, e
 		}
 		if is_key {
 			k, ok := n.(string)
 			if !ok {
-				return nil_hash, fmt.Errorf("invalid dictionary - keys should be strings")
+				return nil, fmt.Errorf("invalid dictionary - keys should be strings")
 			}
 			key = k
 			is_key = false
 		} else if key == "info" {
-			sub_set := data[:len(data)-len(r)]
-			hash := sha1.Sum([]byte(sub_set))
-			return hash, nil
+			return data[:len(data)-len(r)], nil
 		} else {
 			is_key = true
 		}
 		data = r
 		if len(data) == 0 {
-			return nil_hash, fmt.Errorf("invalid dictionary - should start with 'd' and end with 'e'")
+			return nil, fmt.Errorf("invalid dictionary - should start with 'd' and end with 'e'")
 		}
 		if data[0] == 'e' {
 			if !is_key {
-				return nil_hash, fmt.Errorf("invalid dictionary - an entry is missing a defined value")
+				return nil, fmt.Errorf("invalid dictionary - an entry is missing a defined value")
 			}
-			return nil_hash, fmt.Errorf("no info key found")
+			return nil, fmt.Errorf("no info key found")
 		}
 	}
 }
@@ -0,0 +1,62 @@
+package torrent_files
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/chrispritchard/gorrent/internal/bencode"
+)
+
+func encodeTorrent(t *testing.T, files []any) []byte {
+	t.Helper()
+	data, err := bencode.Encode(map[string]any{
+		"announce": "http://tracker/announce",
+		"info": map[string]any{
+			"name":         "attrs",
+			"piece length": 16384,
+			"pieces":       string(make([]byte, 20)),
+			"files":        files,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestParseTorrentFile_FileAttributes(t *testing.T) {
+	data := encodeTorrent(t, []any{
+		map[string]any{"length": 10, "path": []any{"bin", "tool"}, "attr": "xh"},
+		map[string]any{"length": 16374, "path": []any{".pad", "16374"}, "attr": "p"},
+		map[string]any{"length": 0, "path": []any{"latest"}, "attr": "l", "symlink path": []any{"bin", "tool"}},
+		map[string]any{"length": 5, "path": []any{"plain.txt"}},
+	})
+
+	metadata, err := ParseTorrentFile(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := metadata.Files
+	if !files[0].IsExecutable() || !files[0].IsHidden() || files[0].IsPadding() || files[0].IsVirtual() {
+		t.Errorf("unexpected attributes for tool: %q", files[0].Attr)
+	}
+	if !files[1].IsPadding() || !files[1].IsVirtual() {
+		t.Errorf("expected padding file, got %q", files[1].Attr)
+	}
+	if !files[2].IsSymlink() || !reflect.DeepEqual(files[2].SymlinkPath, []string{"bin", "tool"}) {
+		t.Errorf("expected symlink to bin/tool, got %q %v", files[2].Attr, files[2].SymlinkPath)
+	}
+	if files[3].Attr != "" || files[3].IsVirtual() {
+		t.Errorf("expected no attributes for a plain file, got %q", files[3].Attr)
+	}
+}
+
+func TestParseTorrentFile_SymlinkWithoutTarget(t *testing.T) {
+	data := encodeTorrent(t, []any{
+		map[string]any{"length": 0, "path": []any{"broken"}, "attr": "l"},
+	})
+	if _, err := ParseTorrentFile(data); err == nil {
+		t.Errorf("expected an error for a symlink without a symlink path")
+	}
+}
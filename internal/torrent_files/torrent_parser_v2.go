@@ -0,0 +1,206 @@
+package torrent_files
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/chrispritchard/gorrent/internal/bencode"
+	"github.com/chrispritchard/gorrent/internal/merkle"
+)
+
+// Decodes the BEP 52 parts of v2 and hybrid torrents: the 'file tree' in the info dict, and the 'piece layers' in the
+// root. Piece layers are checked against each file's pieces root as they are read, so they can be trusted afterwards.
+
+func parse_v2(root, info map[string]any, info_bytes []byte, metadata *TorrentMetadata) error {
+	piece_length := metadata.PieceLength
+	if piece_length < merkle.BlockSize || piece_length&(piece_length-1) != 0 {
+		return fmt.Errorf("piece length must be a power of two and at least %d", merkle.BlockSize)
+	}
+
+	tree, err := bencode.Get[map[string]any](info, "file tree")
+	if err != nil {
+		return err
+	}
+	v2_files := []TorrentFile{}
+	err = walk_file_tree(tree, []string{}, &v2_files)
+	if err != nil {
+		return err
+	}
+	if len(v2_files) == 0 {
+		return fmt.Errorf("file tree is empty")
+	}
+
+	layers_raw, err := bencode.Get[map[string]any](root, "piece layers")
+	if err != nil {
+		layers_raw = map[string]any{} // only required if a file is larger than a piece
+	}
+
+	piece_layer := merkle.Log2(piece_length / merkle.BlockSize)
+	layer_pad := merkle.PadHash(piece_layer)
+	layers := map[string][]merkle.Hash{}
+	pieces := []PieceHashV2{}
+
+	for _, f := range v2_files {
+		if f.Length == 0 {
+			continue // empty files have no pieces
+		}
+		var pieces_root merkle.Hash
+		copy(pieces_root[:], f.PiecesRoot)
+
+		if f.Length <= piece_length {
+			block_count := (f.Length + merkle.BlockSize - 1) / merkle.BlockSize
+			pieces = append(pieces, PieceHashV2{pieces_root, f.Length, merkle.NextPowerOfTwo(block_count)})
+			continue
+		}
+
+		raw, err := bencode.Get[string](layers_raw, f.PiecesRoot)
+		if err != nil {
+			return fmt.Errorf("missing piece layer for file %s", strings.Join(f.Path, "/"))
+		}
+		piece_count := (f.Length + piece_length - 1) / piece_length
+		if len(raw) != piece_count*32 {
+			return fmt.Errorf("piece layer for file %s has %d bytes, expected %d", strings.Join(f.Path, "/"), len(raw), piece_count*32)
+		}
+
+		hashes := make([]merkle.Hash, piece_count)
+		for i := range hashes {
+			copy(hashes[i][:], raw[i*32:(i+1)*32])
+		}
+		if merkle.Root(hashes, merkle.NextPowerOfTwo(piece_count), layer_pad) != pieces_root {
+			return fmt.Errorf("piece layer for file %s does not match its pieces root", strings.Join(f.Path, "/"))
+		}
+		layers[f.PiecesRoot] = hashes
+
+		for i, h := range hashes {
+			data_length := min(piece_length, f.Length-i*piece_length)
+			pieces = append(pieces, PieceHashV2{h, data_length, piece_length / merkle.BlockSize})
+		}
+	}
+
+	metadata.MetaVersion = 2
+	metadata.InfoHashV2 = sha256.Sum256(info_bytes)
+	metadata.PiecesV2 = pieces
+	metadata.PieceLayers = layers
+
+	if metadata.IsV1() {
+		return attach_hybrid_roots(metadata, v2_files)
+	}
+
+	// v2 only: the wire hash is the truncated v2 hash, and the file list comes from the tree
+	copy(metadata.InfoHash[:], metadata.InfoHashV2[:20])
+	metadata.Length = 0
+	for _, f := range v2_files {
+		metadata.Length += f.Length
+	}
+	if len(v2_files) == 1 && len(v2_files[0].Path) == 1 && v2_files[0].Path[0] == metadata.Name {
+		metadata.Files = []TorrentFile{} // single file torrent, matching the v1 layout
+	} else {
+		metadata.Files = v2_files
+	}
+	return nil
+}
+
+func walk_file_tree(node map[string]any, path []string, result *[]TorrentFile) error {
+	if leaf, exists := node[""]; exists {
+		if len(path) == 0 {
+			return fmt.Errorf("file tree has a file with no name")
+		}
+		entry, ok := leaf.(map[string]any)
+		if !ok {
+			return fmt.Errorf("file tree entry for %s is not a dict", strings.Join(path, "/"))
+		}
+		length, err := bencode.Get[int](entry, "length")
+		if err != nil || length < 0 {
+			return fmt.Errorf("file tree entry for %s has an invalid length", strings.Join(path, "/"))
+		}
+		pieces_root, err := bencode.Get[string](entry, "pieces root")
+		if length > 0 && (err != nil || len(pieces_root) != 32) {
+			return fmt.Errorf("file tree entry for %s has an invalid pieces root", strings.Join(path, "/"))
+		}
+		attr, symlink_path, err := parse_attributes(entry)
+		if err != nil {
+			return fmt.Errorf("file tree entry for %s: %v", strings.Join(path, "/"), err)
+		}
+		*result = append(*result, TorrentFile{
+			Path:        slices.Clone(path),
+			Length:      length,
+			PiecesRoot:  pieces_root,
+			Attr:        attr,
+			SymlinkPath: symlink_path,
+		})
+		return nil
+	}
+
+	// map iteration is random, but file order determines piece order, so walk keys in the (bencode) sorted order
+	keys := make([]string, 0, len(node))
+	for k := range node {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	for _, k := range keys {
+		child, ok := node[k].(map[string]any)
+		if !ok {
+			return fmt.Errorf("file tree entry for %s is not a dict", strings.Join(append(path, k), "/"))
+		}
+		err := walk_file_tree(child, append(path, k), result)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// attach_hybrid_roots matches the v2 files against the v1 file list, which must be in the same order but may
+// include padding files between them so that both versions share the same pieces
+func attach_hybrid_roots(metadata *TorrentMetadata, v2_files []TorrentFile) error {
+	if len(metadata.Pieces) != len(metadata.PiecesV2) {
+		return fmt.Errorf("hybrid torrent has %d v1 pieces but %d v2 pieces", len(metadata.Pieces), len(metadata.PiecesV2))
+	}
+	if len(metadata.Files) == 0 {
+		if len(v2_files) != 1 || v2_files[0].Length != metadata.Length {
+			return fmt.Errorf("hybrid torrent file lists do not match")
+		}
+		return nil
+	}
+
+	next := 0
+	for i, f := range metadata.Files {
+		if next < len(v2_files) && slices.Equal(f.Path, v2_files[next].Path) {
+			if f.Length != v2_files[next].Length {
+				return fmt.Errorf("hybrid torrent has different lengths for file %s", strings.Join(f.Path, "/"))
+			}
+			metadata.Files[i].PiecesRoot = v2_files[next].PiecesRoot
+			next++
+		}
+	}
+	if next != len(v2_files) {
+		return fmt.Errorf("hybrid torrent file lists do not match")
+	}
+	return nil
+}
+
+// LayerHashes answers a hash request from the piece layers, returning the requested hashes followed by the uncle
+// hashes that prove them against the file's pieces root. Only the piece layer itself can be served as a base layer
+func (m TorrentMetadata) LayerHashes(pieces_root string, base_layer, index, length, proof_layers int) ([]merkle.Hash, error) {
+	if !m.IsV2() {
+		return nil, fmt.Errorf("not a v2 torrent")
+	}
+	piece_layer := merkle.Log2(m.PieceLength / merkle.BlockSize)
+	if base_layer != piece_layer {
+		return nil, fmt.Errorf("only the piece layer (%d) can be served, not layer %d", piece_layer, base_layer)
+	}
+	layer, exists := m.PieceLayers[pieces_root]
+	if !exists {
+		return nil, fmt.Errorf("no piece layer for the requested pieces root")
+	}
+
+	tree := merkle.Tree(layer, merkle.NextPowerOfTwo(len(layer)), merkle.PadHash(piece_layer))
+	uncles, err := merkle.Proof(tree, index, length, proof_layers)
+	if err != nil {
+		return nil, err
+	}
+	return append(slices.Clone(tree[0][index:index+length]), uncles...), nil
+}
@@ -0,0 +1,255 @@
+package torrent_files
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"strings"
+	"testing"
+
+	"github.com/chrispritchard/gorrent/internal/bencode"
+	"github.com/chrispritchard/gorrent/internal/merkle"
+)
+
+const testPieceLength = 1 << 15 // two blocks per piece
+
+type testFile struct {
+	path []string
+	data []byte
+}
+
+func makeData(size int, seed byte) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i*13) + seed
+	}
+	return data
+}
+
+// v2Hashes returns the pieces root and piece layer (empty for files that fit in one piece) for data
+func v2Hashes(data []byte, piece_length int) (merkle.Hash, []merkle.Hash) {
+	leaves := merkle.HashBlocks(data)
+	if len(data) <= piece_length {
+		return merkle.Root(leaves, merkle.NextPowerOfTwo(len(leaves)), merkle.Hash{}), nil
+	}
+	per_piece := piece_length / merkle.BlockSize
+	layer := []merkle.Hash{}
+	for start := 0; start < len(leaves); start += per_piece {
+		layer = append(layer, merkle.Root(leaves[start:min(start+per_piece, len(leaves))], per_piece, merkle.Hash{}))
+	}
+	return merkle.Root(layer, merkle.NextPowerOfTwo(len(layer)), merkle.PadHash(merkle.Log2(per_piece))), layer
+}
+
+// buildV2Torrent bencodes a v2 torrent for the files, optionally adding the v1 keys (with padding) to make it hybrid
+func buildV2Torrent(t *testing.T, name string, files []testFile, hybrid bool) []byte {
+	t.Helper()
+	tree := map[string]any{}
+	layers := map[string]any{}
+	v1_files := []any{}
+	v1_data := []byte{}
+
+	for i, f := range files {
+		root, layer := v2Hashes(f.data, testPieceLength)
+		leaf := map[string]any{"length": len(f.data)}
+		if len(f.data) > 0 {
+			leaf["pieces root"] = string(root[:])
+		}
+		if len(layer) > 0 {
+			raw := []byte{}
+			for _, h := range layer {
+				raw = append(raw, h[:]...)
+			}
+			layers[string(root[:])] = string(raw)
+		}
+
+		node := tree
+		for _, p := range f.path {
+			child, exists := node[p].(map[string]any)
+			if !exists {
+				child = map[string]any{}
+				node[p] = child
+			}
+			node = child
+		}
+		node[""] = leaf
+
+		path := []any{}
+		for _, p := range f.path {
+			path = append(path, p)
+		}
+		v1_files = append(v1_files, map[string]any{"length": len(f.data), "path": path})
+		v1_data = append(v1_data, f.data...)
+		if pad := (testPieceLength - len(f.data)%testPieceLength) % testPieceLength; pad > 0 && i < len(files)-1 {
+			v1_files = append(v1_files, map[string]any{"length": pad, "path": []any{".pad", "pad"}, "attr": "p"})
+			v1_data = append(v1_data, make([]byte, pad)...)
+		}
+	}
+
+	info := map[string]any{
+		"name":         name,
+		"piece length": testPieceLength,
+		"meta version": 2,
+		"file tree":    tree,
+	}
+	if hybrid {
+		pieces := []byte{}
+		for start := 0; start < len(v1_data); start += testPieceLength {
+			h := sha1.Sum(v1_data[start:min(start+testPieceLength, len(v1_data))])
+			pieces = append(pieces, h[:]...)
+		}
+		info["pieces"] = string(pieces)
+		if len(files) == 1 && len(files[0].path) == 1 {
+			info["length"] = len(files[0].data)
+		} else {
+			info["files"] = v1_files
+		}
+	}
+
+	torrent := map[string]any{"announce": "http://tracker/announce", "info": info}
+	if len(layers) > 0 {
+		torrent["piece layers"] = layers
+	}
+	data, err := bencode.Encode(torrent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestParseTorrentFile_V2MultiFile(t *testing.T) {
+	files := []testFile{
+		{[]string{"b.bin"}, makeData(testPieceLength*2+500, 1)}, // three pieces
+		{[]string{"a", "c.bin"}, makeData(100, 2)},              // one short piece
+		{[]string{"empty.txt"}, []byte{}},                       // no pieces
+	}
+	data := buildV2Torrent(t, "set", files, false)
+
+	metadata, err := ParseTorrentFile(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !metadata.IsV2() || metadata.IsV1() || metadata.IsHybrid() {
+		t.Errorf("expected a v2 only torrent")
+	}
+	if metadata.PieceCount() != 4 {
+		t.Fatalf("expected 4 pieces, got %d", metadata.PieceCount())
+	}
+	if string(metadata.InfoHash[:]) != string(metadata.InfoHashV2[:20]) {
+		t.Errorf("v2 only torrents should use the truncated v2 hash on the wire")
+	}
+	hashes := metadata.SwarmHashes()
+	if len(hashes) != 1 || hashes[0] != metadata.InfoHash {
+		t.Errorf("v2 only torrents should join a single swarm")
+	}
+
+	// the file tree is walked in sorted order
+	if len(metadata.Files) != 3 || strings.Join(metadata.Files[0].Path, "/") != "a/c.bin" || metadata.Files[2].Path[0] != "empty.txt" {
+		t.Fatalf("unexpected files: %+v", metadata.Files)
+	}
+	if metadata.Length != testPieceLength*2+600 {
+		t.Errorf("unexpected length %d", metadata.Length)
+	}
+
+	// a/c.bin, then b.bin in three pieces
+	want_sizes := []int{100, testPieceLength, testPieceLength, 500}
+	sources := [][]byte{files[1].data, files[0].data[:testPieceLength], files[0].data[testPieceLength : testPieceLength*2], files[0].data[testPieceLength*2:]}
+	for i, want := range want_sizes {
+		if metadata.PieceSize(i) != want {
+			t.Errorf("piece %d size = %d, want %d", i, metadata.PieceSize(i), want)
+		}
+		if !metadata.VerifyPiece(i, sources[i]) {
+			t.Errorf("piece %d failed to verify", i)
+		}
+		corrupt := append([]byte{}, sources[i]...)
+		corrupt[len(corrupt)-1] ^= 0xff
+		if metadata.VerifyPiece(i, corrupt) {
+			t.Errorf("corrupt piece %d should not verify", i)
+		}
+	}
+}
+
+func TestParseTorrentFile_V2SingleFile(t *testing.T) {
+	content := makeData(testPieceLength+1, 3)
+	metadata, err := ParseTorrentFile(buildV2Torrent(t, "one.bin", []testFile{{[]string{"one.bin"}, content}}, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metadata.Files) != 0 || metadata.Length != len(content) || metadata.PieceCount() != 2 {
+		t.Errorf("expected a single file layout, got %+v", metadata.Files)
+	}
+}
+
+func TestParseTorrentFile_Hybrid(t *testing.T) {
+	files := []testFile{
+		{[]string{"a.bin"}, makeData(testPieceLength+300, 4)},
+		{[]string{"b.bin"}, makeData(testPieceLength*2, 5)},
+	}
+	metadata, err := ParseTorrentFile(buildV2Torrent(t, "hybrid", files, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !metadata.IsHybrid() {
+		t.Fatalf("expected a hybrid torrent")
+	}
+	hashes := metadata.SwarmHashes()
+	if len(hashes) != 2 || string(hashes[1][:]) != string(metadata.InfoHashV2[:20]) {
+		t.Errorf("hybrid torrents should join the v1 and v2 swarms")
+	}
+	if sha256.Sum256(nil) == metadata.InfoHashV2 {
+		t.Errorf("v2 info hash was not set")
+	}
+	if metadata.Files[0].PiecesRoot == "" || metadata.Files[1].PiecesRoot != "" || metadata.Files[2].PiecesRoot == "" {
+		t.Errorf("pieces roots should be attached to the real files only")
+	}
+
+	// the second piece is the tail of a.bin plus v1 padding, which must pass both v1 and v2 verification
+	piece := append(append([]byte{}, files[0].data[testPieceLength:]...), make([]byte, testPieceLength-300)...)
+	if metadata.PieceSize(1) != testPieceLength {
+		t.Errorf("hybrid pieces should include padding, got size %d", metadata.PieceSize(1))
+	}
+	if !metadata.VerifyPiece(1, piece) {
+		t.Errorf("padded hybrid piece failed to verify")
+	}
+}
+
+func TestParseTorrentFile_V2InvalidPieceLayer(t *testing.T) {
+	data := buildV2Torrent(t, "bad", []testFile{{[]string{"bad.bin"}, makeData(testPieceLength*3, 6)}}, false)
+	decoded, _, _ := bencode.Decode(data)
+	root := decoded.(map[string]any)
+	for k, v := range root["piece layers"].(map[string]any) {
+		raw := []byte(v.(string))
+		raw[0] ^= 1
+		root["piece layers"].(map[string]any)[k] = string(raw)
+	}
+	tampered, _ := bencode.Encode(root)
+
+	if _, err := ParseTorrentFile(tampered); err == nil {
+		t.Errorf("expected an error for a piece layer that does not match its root")
+	}
+}
+
+func TestLayerHashes(t *testing.T) {
+	content := makeData(testPieceLength*5, 7)
+	metadata, err := ParseTorrentFile(buildV2Torrent(t, "five.bin", []testFile{{[]string{"five.bin"}, content}}, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pieces_root, _ := v2Hashes(content, testPieceLength)
+	piece_layer := merkle.Log2(testPieceLength / merkle.BlockSize)
+
+	hashes, err := metadata.LayerHashes(string(pieces_root[:]), piece_layer, 4, 2, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !merkle.VerifyProof(hashes[:2], hashes[2:], 4, pieces_root) {
+		t.Errorf("served hashes did not verify against the pieces root")
+	}
+
+	if _, err := metadata.LayerHashes(string(pieces_root[:]), 0, 0, 1, 0); err == nil {
+		t.Errorf("expected an error for a layer other than the piece layer")
+	}
+	if _, err := metadata.LayerHashes(strings.Repeat("x", 32), piece_layer, 0, 1, 0); err == nil {
+		t.Errorf("expected an error for an unknown pieces root")
+	}
+}
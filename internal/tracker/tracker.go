@@ -1,6 +1,7 @@
 package tracker
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/binary"
 	"fmt"
@@ -8,51 +9,88 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"time"
 
 	"github.com/chrispritchard/gorrent/internal/bencode"
 	. "github.com/chrispritchard/gorrent/internal/torrent_files"
 )
 
+const peer_id_prefix = "-GR0001-"
+
+// DefaultTimeout is how long an announce may take by default
+const DefaultTimeout = 30 * time.Second
+
 func escape(data []byte) string {
 	return url.QueryEscape(string(data))
 }
 
-func CallTracker(metadata TorrentMetadata) (TrackerResponse, error) {
+// GeneratePeerID makes an Azureus-style peer id: a client prefix followed by random bytes
+func GeneratePeerID() ([]byte, error) {
 	id := make([]byte, 20)
-	_, err := rand.Read(id)
+	copy(id, peer_id_prefix)
+	_, err := rand.Read(id[len(peer_id_prefix):])
 	if err != nil {
-		return nil_resp, err
+		return nil, err
+	}
+	return id, nil
+}
+
+// CallTracker announces to the tracker in every swarm the torrent belongs to, combining the peers found. Ending ctx
+// abandons the announce. client makes the requests, bounding how long each takes, and may e.g. go through a proxy
+func CallTracker(ctx context.Context, client *http.Client, metadata TorrentMetadata, request AnnounceRequest) (TrackerResponse, error) {
+	if len(metadata.Announcers) == 0 {
+		return nil_resp, fmt.Errorf("torrent has no trackers")
 	}
 
-	port := 6881
+	result := TrackerResponse{
+		LocalID:   request.LocalID,
+		LocalPort: uint16(request.Port),
+	}
+
+	var last_err error
+	for _, info_hash := range metadata.SwarmHashes() {
+		peers, interval, err := announce(ctx, client, metadata.Announcers[0], info_hash, request)
+		if err != nil {
+			last_err = err
+			continue
+		}
+		for _, p := range peers {
+			p.InfoHash = info_hash
+			result.Peers = append(result.Peers, p)
+		}
+		result.Interval = interval
+	}
+	if result.Peers == nil && last_err != nil {
+		return nil_resp, last_err
+	}
+	return result, nil
+}
 
-	keys := fmt.Sprintf("info_hash=%s&peer_id=%s&port=%d&uploaded=%d&downloaded=%d&left=%d&event=%s&compact=1",
-		escape(metadata.InfoHash[:]), escape(id), port, 0, 0, metadata.Length, "started")
+func announce(ctx context.Context, client *http.Client, announcer string, info_hash [20]byte, request AnnounceRequest) ([]PeerInfo, int, error) {
+	keys := fmt.Sprintf("info_hash=%s&peer_id=%s&port=%d&uploaded=%d&downloaded=%d&left=%d&compact=1",
+		escape(info_hash[:]), escape(request.LocalID), request.Port, request.Uploaded, request.Downloaded, request.Left)
+	if request.Event != "" {
+		keys += "&event=" + request.Event
+	}
 
-	url := metadata.Announcers[0] + "?" + keys
-	client := &http.Client{}
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+	url := announcer + "?" + keys
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
-		return nil_resp, err
+		return nil, 0, err
 	}
 
 	resp, err := client.Do(req)
 	if err != nil {
-		return nil_resp, err
+		return nil, 0, err
 	}
+	defer resp.Body.Close()
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil_resp, err
+		return nil, 0, err
 	}
 
-	peers, interval, err := parse_tracker_response(body)
-	return TrackerResponse{
-		LocalID:   id,
-		LocalPort: uint16(port),
-		Peers:     peers,
-		Interval:  interval,
-	}, nil
+	return parse_tracker_response(body)
 }
 
 func parse_tracker_response(data []byte) ([]PeerInfo, int, error) {
@@ -1,9 +1,19 @@
 package tracker
 
 type PeerInfo struct {
-	Id   string
-	IP   string
-	Port uint16
+	Id       string
+	IP       string
+	Port     uint16
+	InfoHash [20]byte // the swarm the peer was found in, which for hybrid torrents may be v1 or v2
+}
+
+// AnnounceRequest is what we tell the tracker about ourselves. Event is "started", "completed", "stopped", or empty
+// for a regular update
+type AnnounceRequest struct {
+	LocalID                    []byte
+	Port                       int
+	Uploaded, Downloaded, Left int64
+	Event                      string
 }
 
 type TrackerResponse struct {
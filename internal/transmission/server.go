@@ -0,0 +1,424 @@
+// Package transmission serves the Transmission RPC protocol, so that clients, dashboards and web interfaces written for
+// Transmission can drive a gorrent client unchanged. The core methods are implemented: torrent-add, torrent-get,
+// torrent-set, torrent-set-location, torrent-start, torrent-stop, torrent-remove, session-get, session-set,
+// session-stats and blocklist-update.
+package transmission
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chrispritchard/gorrent/internal/logging"
+	"github.com/chrispritchard/gorrent/pkg/client"
+)
+
+const (
+	Path            = "/transmission/rpc"
+	SessionIDHeader = "X-Transmission-Session-Id"
+	DefaultAddress  = "127.0.0.1:9091"
+)
+
+const (
+	rpc_version         = 17
+	rpc_version_minimum = 14
+	rpc_version_semver  = "5.3.0"
+	version             = "4.0.0 (gorrent)" // clients enable features by version, so claim the one whose rpc we follow
+)
+
+const (
+	max_request_size = 16 << 20 // room for a large .torrent file, base64 encoded
+	kilo             = 1000     // transmission's speeds are in kB/s
+	recently         = time.Minute
+)
+
+type request struct {
+	Method    string          `json:"method"`
+	Arguments json.RawMessage `json:"arguments"`
+	Tag       json.RawMessage `json:"tag,omitempty"`
+}
+
+type response struct {
+	Result    string          `json:"result"`
+	Arguments map[string]any  `json:"arguments"`
+	Tag       json.RawMessage `json:"tag,omitempty"`
+}
+
+// Server answers Transmission RPC for a client. It is an http.Handler
+type Server struct {
+	client     *client.Client
+	password   string
+	session_id string
+	started    time.Time
+	log        *slog.Logger
+	methods    map[string]func(json.RawMessage) (map[string]any, error)
+
+	mutex   sync.Mutex
+	entries map[client.InfoHash]*entry
+	next_id int
+	removed []removal
+	limits  [2]int // the session's download and upload limits in kB/s, remembered while they are switched off
+	seed    seed_limits
+}
+
+// entry is what transmission knows of a torrent that we do not: a small integer id, and when it was added
+type entry struct {
+	id     int
+	added  time.Time
+	limits [2]int
+	seed   seed_limits
+	global [2]bool // whether the ratio and idle limits copied the session's, for a torrent with limits of its own
+}
+
+type removal struct {
+	id int
+	at time.Time
+}
+
+// NewServer creates a server for c. If password is not empty, requests must give it with http basic auth, with any
+// username. logger may be nil
+func NewServer(c *client.Client, password string, logger *slog.Logger) *Server {
+	s := &Server{
+		client:     c,
+		password:   password,
+		session_id: rand.Text(),
+		started:    time.Now(),
+		log:        logging.For(logger, logging.RPC).With("api", "transmission"),
+		entries:    map[client.InfoHash]*entry{},
+		seed:       default_seed_limits,
+	}
+	s.methods = map[string]func(json.RawMessage) (map[string]any, error){
+		"session-get":          s.session_get,
+		"session-set":          s.session_set,
+		"session-stats":        s.session_stats,
+		"blocklist-update":     s.blocklist_update,
+		"torrent-add":          s.torrent_add,
+		"torrent-get":          s.torrent_get,
+		"torrent-set":          s.torrent_set,
+		"torrent-set-location": s.torrent_set_location,
+		"torrent-start":        s.torrent_start,
+		"torrent-start-now":    s.torrent_start,
+		"torrent-stop":         s.torrent_stop,
+		"torrent-remove":       s.torrent_remove,
+	}
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.TrimSuffix(r.URL.Path, "/") != Path {
+		http.NotFound(w, r)
+		return
+	}
+	if s.password != "" {
+		_, password, ok := r.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(password), []byte(s.password)) != 1 {
+			s.log.Warn("rejected a request without a valid password", "remote", r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Basic realm="Transmission"`)
+			http.Error(w, "401: Unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	// the csrf handshake: clients learn the session id from a 409, then send it with every request
+	w.Header().Set(SessionIDHeader, s.session_id)
+	if r.Header.Get(SessionIDHeader) != s.session_id {
+		http.Error(w, "409: Conflict\nYour request had an invalid session-id header.", http.StatusConflict)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "405: Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	var req request
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, max_request_size)).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("400: Bad Request\n%v", err), http.StatusBadRequest)
+		return
+	}
+	resp := response{Result: "success", Arguments: map[string]any{}, Tag: req.Tag}
+	method, ok := s.methods[req.Method]
+	if !ok {
+		resp.Result = "method name not recognized"
+	} else if arguments, err := method(req.Arguments); err != nil {
+		resp.Result = err.Error()
+		s.log.Debug("call failed", "method", req.Method, "err", err)
+	} else {
+		if arguments != nil {
+			resp.Arguments = arguments
+		}
+		s.log.Debug("call", "method", req.Method)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func decode[T any](arguments json.RawMessage) (T, error) {
+	var result T
+	if len(arguments) == 0 {
+		return result, nil
+	}
+	if err := json.Unmarshal(arguments, &result); err != nil {
+		return result, fmt.Errorf("invalid arguments: %v", err)
+	}
+	return result, nil
+}
+
+// limit is a transmission speed limit, in kB/s: a value that is kept while the limit is switched off
+type limit struct {
+	value   int
+	enabled bool
+}
+
+func current_limit(rate, remembered int) limit {
+	if rate > 0 {
+		return limit{max(1, rate/kilo), true}
+	}
+	return limit{remembered, false}
+}
+
+// set applies the given parts of a change, either of which may be nil
+func (l limit) set(value *int, enabled *bool) (limit, error) {
+	if value != nil {
+		if *value < 0 {
+			return l, fmt.Errorf("speed limits cannot be negative")
+		}
+		l.value = *value
+	}
+	if enabled != nil {
+		l.enabled = *enabled
+	}
+	return l, nil
+}
+
+func (l limit) rate() int {
+	if !l.enabled {
+		return 0
+	}
+	return l.value * kilo
+}
+
+// seed_limits are a share ratio and an idle limit in minutes as transmission has them, each kept while switched off.
+// Limits on seeding time, which transmission does not have, pass through unchanged
+type seed_limits struct {
+	ratio    float64
+	ratio_on bool
+	idle     limit
+}
+
+var default_seed_limits = seed_limits{ratio: 2, idle: limit{value: 30}} // transmission's
+
+func current_seed_limits(l client.SeedLimits, remembered seed_limits) seed_limits {
+	current := seed_limits{ratio: remembered.ratio, idle: limit{value: remembered.idle.value}}
+	if l.Ratio > 0 {
+		current.ratio, current.ratio_on = l.Ratio, true
+	}
+	if l.Idle > 0 {
+		current.idle = limit{max(1, int(l.Idle/time.Minute)), true}
+	}
+	return current
+}
+
+// set applies the given parts of a change, any of which may be nil
+func (l seed_limits) set(ratio *float64, ratio_on *bool, idle *int, idle_on *bool) (seed_limits, error) {
+	if ratio != nil {
+		if *ratio < 0 {
+			return l, fmt.Errorf("seed ratio limits cannot be negative")
+		}
+		l.ratio = *ratio
+	}
+	if ratio_on != nil {
+		l.ratio_on = *ratio_on
+	}
+	var err error
+	l.idle, err = l.idle.set(idle, idle_on)
+	return l, err
+}
+
+// apply sets the ratio and idle limits of l, as far as they are switched on
+func (s seed_limits) apply(l client.SeedLimits) client.SeedLimits {
+	l.Ratio, l.Idle = 0, 0
+	if s.ratio_on {
+		l.Ratio = s.ratio
+	}
+	if s.idle.enabled {
+		l.Idle = time.Duration(s.idle.value) * time.Minute
+	}
+	return l
+}
+
+func (s *Server) session_limits() (limit, limit) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	download, upload := s.client.Rates()
+	return current_limit(download, s.limits[0]), current_limit(upload, s.limits[1])
+}
+
+func (s *Server) session_get(arguments json.RawMessage) (map[string]any, error) {
+	args, err := decode[struct {
+		Fields []string `json:"fields"`
+	}](arguments)
+	if err != nil {
+		return nil, err
+	}
+	download, upload := s.session_limits()
+	s.mutex.Lock()
+	seed := current_seed_limits(s.client.SeedLimits(), s.seed)
+	s.mutex.Unlock()
+	download_dir := s.client.DownloadDir()
+	if download_dir == "" {
+		download_dir = "."
+	}
+	units := map[string]any{
+		"speed-units":  []string{"kB/s", "MB/s", "GB/s", "TB/s"},
+		"speed-bytes":  kilo,
+		"size-units":   []string{"kB", "MB", "GB", "TB"},
+		"size-bytes":   kilo,
+		"memory-units": []string{"KiB", "MiB", "GiB", "TiB"},
+		"memory-bytes": 1024,
+	}
+	all := map[string]any{
+		"version":                    version,
+		"rpc-version":                rpc_version,
+		"rpc-version-minimum":        rpc_version_minimum,
+		"rpc-version-semver":         rpc_version_semver,
+		"session-id":                 s.session_id,
+		"download-dir":               download_dir,
+		"peer-port":                  s.client.Port(),
+		"speed-limit-down":           download.value,
+		"speed-limit-down-enabled":   download.enabled,
+		"speed-limit-up":             upload.value,
+		"speed-limit-up-enabled":     upload.enabled,
+		"alt-speed-enabled":          false,
+		"alt-speed-down":             0,
+		"alt-speed-up":               0,
+		"encryption":                 "tolerated",
+		"dht-enabled":                false,
+		"pex-enabled":                false,
+		"lpd-enabled":                false,
+		"utp-enabled":                false,
+		"port-forwarding-enabled":    false,
+		"start-added-torrents":       true,
+		"rename-partial-files":       false,
+		"incomplete-dir-enabled":     s.client.IncompleteDir() != "",
+		"incomplete-dir":             s.client.IncompleteDir(),
+		"download-queue-enabled":     false,
+		"seed-queue-enabled":         false,
+		"seedRatioLimit":             seed.ratio,
+		"seedRatioLimited":           seed.ratio_on,
+		"idle-seeding-limit":         seed.idle.value,
+		"idle-seeding-limit-enabled": seed.idle.enabled,
+		"blocklist-enabled":          s.client.BlocklistSize() > 0,
+		"blocklist-size":             s.client.BlocklistSize(),
+		"blocklist-url":              "",
+		"units":                      units,
+	}
+	if len(args.Fields) == 0 {
+		return all, nil
+	}
+	result := map[string]any{}
+	for _, field := range args.Fields {
+		if value, ok := all[field]; ok {
+			result[field] = value
+		}
+	}
+	return result, nil
+}
+
+// session_set changes the speed and seed limits. Other settings are left as they are
+func (s *Server) session_set(arguments json.RawMessage) (map[string]any, error) {
+	args, err := decode[struct {
+		DownloadLimit    *int     `json:"speed-limit-down"`
+		DownloadLimited  *bool    `json:"speed-limit-down-enabled"`
+		UploadLimit      *int     `json:"speed-limit-up"`
+		UploadLimited    *bool    `json:"speed-limit-up-enabled"`
+		SeedRatio        *float64 `json:"seedRatioLimit"`
+		SeedRatioLimited *bool    `json:"seedRatioLimited"`
+		IdleLimit        *int     `json:"idle-seeding-limit"`
+		IdleLimited      *bool    `json:"idle-seeding-limit-enabled"`
+	}](arguments)
+	if err != nil {
+		return nil, err
+	}
+	download, upload := s.session_limits()
+	if download, err = download.set(args.DownloadLimit, args.DownloadLimited); err != nil {
+		return nil, err
+	}
+	if upload, err = upload.set(args.UploadLimit, args.UploadLimited); err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	limits := s.client.SeedLimits()
+	seed, err := current_seed_limits(limits, s.seed).set(args.SeedRatio, args.SeedRatioLimited, args.IdleLimit, args.IdleLimited)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.client.SetSeedLimits(seed.apply(limits)); err != nil {
+		return nil, err
+	}
+	s.seed = seed
+	s.limits = [2]int{download.value, upload.value}
+	s.client.SetRates(download.rate(), upload.rate())
+	return nil, nil
+}
+
+// blocklist_update reloads the blocklist from its file, rather than the url Transmission would fetch it from
+func (s *Server) blocklist_update(json.RawMessage) (map[string]any, error) {
+	size, err := s.client.ReloadBlocklist()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{"blocklist-size": size}, nil
+}
+
+func (s *Server) session_stats(json.RawMessage) (map[string]any, error) {
+	torrents := s.sync()
+	var active, paused int
+	var download, upload float64
+	var downloaded, uploaded int64
+	for _, ref := range torrents {
+		status := ref.t.Status()
+		switch status.State {
+		case client.Paused:
+			paused++
+		case client.FetchingMetadata, client.Checking, client.Downloading:
+			active++
+		case client.Seeding:
+			if status.UploadRate > 0 {
+				active++
+			}
+		}
+		download += status.DownloadRate
+		upload += status.UploadRate
+		downloaded += status.Downloaded
+		uploaded += status.Uploaded
+	}
+
+	s.mutex.Lock()
+	added := s.next_id
+	s.mutex.Unlock()
+	// nothing outlives the process, so the cumulative figures are those of this session
+	totals := map[string]any{
+		"downloadedBytes": downloaded,
+		"uploadedBytes":   uploaded,
+		"filesAdded":      added,
+		"sessionCount":    1,
+		"secondsActive":   int64(time.Since(s.started).Seconds()),
+	}
+	return map[string]any{
+		"activeTorrentCount": active,
+		"pausedTorrentCount": paused,
+		"torrentCount":       len(torrents),
+		"downloadSpeed":      int64(download),
+		"uploadSpeed":        int64(upload),
+		"cumulative-stats":   totals,
+		"current-stats":      totals,
+	}, nil
+}
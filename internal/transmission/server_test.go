@@ -0,0 +1,206 @@
+package transmission
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/chrispritchard/gorrent/pkg/client"
+)
+
+// startServer serves transmission rpc for a new client whose download directory already holds a torrent's data
+func startServer(t *testing.T, password string) (*httptest.Server, *client.Client, string, []byte) {
+	t.Helper()
+	dir := t.TempDir()
+	source := filepath.Join(dir, "data.bin")
+	if err := os.WriteFile(source, make([]byte, 40_000), 0644); err != nil {
+		t.Fatal(err)
+	}
+	torrent, _, err := client.CreateTorrent(source, client.CreateOptions{PieceLength: 1 << 14})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := client.DefaultConfig()
+	config.ListenPort = 0
+	config.DownloadDir = dir
+	c, err := client.New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	server := httptest.NewServer(NewServer(c, password, nil))
+	t.Cleanup(server.Close)
+	return server, c, source, torrent
+}
+
+func post(t *testing.T, server *httptest.Server, session_id, password string, body any) *http.Response {
+	t.Helper()
+	encoded, _ := json.Marshal(body)
+	req, _ := http.NewRequest(http.MethodPost, server.URL+Path, bytes.NewReader(encoded))
+	if session_id != "" {
+		req.Header.Set(SessionIDHeader, session_id)
+	}
+	if password != "" {
+		req.SetBasicAuth("anyone", password)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// call makes a request the way transmission clients do, first learning the session id from a 409
+func call(t *testing.T, server *httptest.Server, method string, arguments any) map[string]any {
+	t.Helper()
+	body := map[string]any{"method": method, "arguments": arguments, "tag": 7}
+	resp := post(t, server, "", "", body)
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusConflict {
+		resp = post(t, server, resp.Header.Get(SessionIDHeader), "", body)
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Result    string         `json:"result"`
+		Arguments map[string]any `json:"arguments"`
+		Tag       int            `json:"tag"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Result != "success" || result.Tag != 7 {
+		t.Fatalf("%s failed: %s (tag %d)", method, result.Result, result.Tag)
+	}
+	return result.Arguments
+}
+
+func TestServer_Handshake(t *testing.T) {
+	server, _, _, _ := startServer(t, "secret")
+	body := map[string]any{"method": "session-get"}
+
+	resp := post(t, server, "", "wrong", body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected a wrong password to be refused, got %s", resp.Status)
+	}
+
+	resp = post(t, server, "", "secret", body)
+	resp.Body.Close()
+	session_id := resp.Header.Get(SessionIDHeader)
+	if resp.StatusCode != http.StatusConflict || session_id == "" {
+		t.Fatalf("expected a 409 giving the session id, got %s %q", resp.Status, session_id)
+	}
+
+	resp = post(t, server, session_id, "secret", body)
+	defer resp.Body.Close()
+	var result struct {
+		Result    string         `json:"result"`
+		Arguments map[string]any `json:"arguments"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+	if resp.StatusCode != http.StatusOK || result.Result != "success" || result.Arguments["rpc-version"] != float64(rpc_version) {
+		t.Errorf("expected the session, got %s %+v", resp.Status, result)
+	}
+}
+
+func TestServer_Torrents(t *testing.T) {
+	server, _, source, torrent := startServer(t, "")
+	metainfo := base64.StdEncoding.EncodeToString(torrent)
+
+	added := call(t, server, "torrent-add", map[string]any{"metainfo": metainfo})["torrent-added"].(map[string]any)
+	if added["id"] != float64(1) || added["name"] != "data.bin" {
+		t.Fatalf("unexpected torrent %+v", added)
+	}
+	if _, ok := call(t, server, "torrent-add", map[string]any{"metainfo": metainfo})["torrent-duplicate"]; !ok {
+		t.Errorf("expected adding again to report a duplicate")
+	}
+
+	fields := []string{"id", "hashString", "status", "percentDone", "files", "downloadLimit", "downloadLimited", "nonsense"}
+	var got map[string]any
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		got = call(t, server, "torrent-get", map[string]any{"ids": []any{1}, "fields": fields})["torrents"].([]any)[0].(map[string]any)
+		if got["status"] == float64(status_seed) {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if got["status"] != float64(status_seed) || got["percentDone"] != float64(1) || len(got["files"].([]any)) != 1 {
+		t.Fatalf("expected the torrent to be seeding, got %+v", got)
+	}
+	if _, ok := got["nonsense"]; ok {
+		t.Errorf("expected unknown fields to be left out")
+	}
+
+	hash := got["hashString"].(string)
+	call(t, server, "torrent-set", map[string]any{"ids": hash, "downloadLimit": 100, "downloadLimited": true})
+	table := call(t, server, "torrent-get", map[string]any{"fields": []string{"id", "downloadLimit", "downloadLimited"}, "format": "table"})["torrents"].([]any)
+	if len(table) != 2 || table[1].([]any)[1] != float64(100) || table[1].([]any)[2] != true {
+		t.Errorf("expected a table with the limit set, got %+v", table)
+	}
+
+	seed_fields := map[string]any{"ids": hash, "fields": []string{"seedRatioLimit", "seedRatioMode", "seedIdleLimit", "seedIdleMode"}}
+	call(t, server, "torrent-set", map[string]any{"ids": hash, "seedRatioLimit": 1.5, "seedRatioMode": seed_single, "seedIdleMode": seed_unlimited})
+	got = call(t, server, "torrent-get", seed_fields)["torrents"].([]any)[0].(map[string]any)
+	if got["seedRatioLimit"] != 1.5 || got["seedRatioMode"] != float64(seed_single) || got["seedIdleMode"] != float64(seed_unlimited) {
+		t.Errorf("expected the torrent's own ratio limit and no idle limit, got %+v", got)
+	}
+	call(t, server, "torrent-set", map[string]any{"ids": hash, "seedRatioMode": seed_global})
+	got = call(t, server, "torrent-get", seed_fields)["torrents"].([]any)[0].(map[string]any)
+	if got["seedRatioMode"] != float64(seed_global) || got["seedIdleMode"] != float64(seed_unlimited) {
+		t.Errorf("expected the ratio limit of the session, and still no idle limit, got %+v", got)
+	}
+
+	call(t, server, "torrent-stop", map[string]any{"ids": []any{1}})
+	got = call(t, server, "torrent-get", map[string]any{"ids": 1, "fields": []string{"status"}})["torrents"].([]any)[0].(map[string]any)
+	if got["status"] != float64(status_stopped) {
+		t.Errorf("expected the torrent to be stopped, got %+v", got)
+	}
+
+	call(t, server, "torrent-remove", map[string]any{"ids": []any{1}, "delete-local-data": true})
+	if _, err := os.Stat(source); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the data to be deleted, got %v", err)
+	}
+	recent := call(t, server, "torrent-get", map[string]any{"ids": "recently-active", "fields": []string{"id"}})
+	if len(recent["torrents"].([]any)) != 0 || len(recent["removed"].([]any)) != 1 {
+		t.Errorf("expected the torrent to be reported removed, got %+v", recent)
+	}
+}
+
+func TestServer_SessionLimits(t *testing.T) {
+	server, c, _, _ := startServer(t, "")
+
+	call(t, server, "session-set", map[string]any{"speed-limit-down": 50, "speed-limit-down-enabled": true})
+	if download, _ := c.Rates(); download != 50*kilo {
+		t.Errorf("expected a download limit of 50 kB/s, got %d", download)
+	}
+
+	call(t, server, "session-set", map[string]any{"speed-limit-down-enabled": false})
+	if download, _ := c.Rates(); download != 0 {
+		t.Errorf("expected no download limit, got %d", download)
+	}
+	session := call(t, server, "session-get", map[string]any{"fields": []string{"speed-limit-down", "speed-limit-down-enabled"}})
+	if session["speed-limit-down"] != float64(50) || session["speed-limit-down-enabled"] != false || len(session) != 2 {
+		t.Errorf("expected the limit to be remembered while off, got %+v", session)
+	}
+
+	call(t, server, "session-set", map[string]any{"seedRatioLimit": 3, "seedRatioLimited": true, "idle-seeding-limit-enabled": true})
+	if limits := c.SeedLimits(); limits.Ratio != 3 || limits.Idle != 30*time.Minute {
+		t.Errorf("expected a ratio limit of 3 and the default idle limit, got %+v", limits)
+	}
+	call(t, server, "session-set", map[string]any{"seedRatioLimited": false})
+	session = call(t, server, "session-get", map[string]any{"fields": []string{"seedRatioLimit", "seedRatioLimited"}})
+	if c.SeedLimits().Ratio != 0 || session["seedRatioLimit"] != float64(3) || session["seedRatioLimited"] != false {
+		t.Errorf("expected the ratio limit to be remembered while off, got %+v", session)
+	}
+}
@@ -0,0 +1,723 @@
+package transmission
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chrispritchard/gorrent/pkg/client"
+)
+
+// torrent_ref is a torrent with what transmission knows of it: its id, when it was added, its place in the list and its
+// speed and seed limits as they were remembered at the time
+type torrent_ref struct {
+	entry
+	position int
+	t        *client.Torrent
+}
+
+// sync gives ids to torrents added since the last call, by this api or any other, and notes those since removed
+func (s *Server) sync() []torrent_ref {
+	torrents := s.client.Torrents()
+	now := time.Now()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	result := []torrent_ref{}
+	present := map[client.InfoHash]bool{}
+	for _, t := range torrents {
+		e, ok := s.entries[t.InfoHash()]
+		if !ok {
+			s.next_id++
+			e = &entry{id: s.next_id, added: now, seed: default_seed_limits}
+			s.entries[t.InfoHash()] = e
+		}
+		present[t.InfoHash()] = true
+		result = append(result, torrent_ref{entry: *e, position: len(result), t: t})
+	}
+	for h, e := range s.entries {
+		if !present[h] {
+			s.removed = append(s.removed, removal{id: e.id, at: now})
+			delete(s.entries, h)
+		}
+	}
+	s.removed = slices.DeleteFunc(s.removed, func(r removal) bool { return now.Sub(r.at) > recently })
+	return result
+}
+
+// recently_removed lists the ids of torrents removed in the last minute, for clients polling "recently-active"
+func (s *Server) recently_removed() []int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	result := []int{}
+	for _, r := range s.removed {
+		result = append(result, r.id)
+	}
+	return result
+}
+
+// select_torrents resolves an ids argument: absent for every torrent, an id or info hash, a list of those, or
+// "recently-active". Ids that match nothing are ignored, as transmission does
+func (s *Server) select_torrents(ids json.RawMessage) ([]torrent_ref, bool, error) {
+	torrents := s.sync()
+	if len(ids) == 0 {
+		return torrents, false, nil
+	}
+	var single string
+	if json.Unmarshal(ids, &single) == nil && single == "recently-active" {
+		return torrents, true, nil // everything we have is recent enough to be worth refreshing
+	}
+
+	var list []json.RawMessage
+	if json.Unmarshal(ids, &list) != nil {
+		list = []json.RawMessage{ids}
+	}
+	wanted := map[string]bool{}
+	for _, raw := range list {
+		var id int
+		var hash string
+		switch {
+		case json.Unmarshal(raw, &id) == nil:
+			wanted[strconv.Itoa(id)] = true
+		case json.Unmarshal(raw, &hash) == nil:
+			wanted[strings.ToLower(hash)] = true
+		default:
+			return nil, false, fmt.Errorf("invalid id %s", raw)
+		}
+	}
+	return slices.DeleteFunc(torrents, func(ref torrent_ref) bool {
+		return !wanted[strconv.Itoa(ref.id)] && !wanted[ref.t.InfoHash().String()]
+	}), false, nil
+}
+
+func (s *Server) id_of(t *client.Torrent) torrent_ref {
+	for _, ref := range s.sync() {
+		if ref.t == t {
+			return ref
+		}
+	}
+	return torrent_ref{t: t}
+}
+
+func (s *Server) torrent_add(arguments json.RawMessage) (map[string]any, error) {
+	args, err := decode[struct {
+		Filename    string `json:"filename"`
+		Metainfo    string `json:"metainfo"`
+		DownloadDir string `json:"download-dir"`
+		Paused      bool   `json:"paused"`
+	}](arguments)
+	if err != nil {
+		return nil, err
+	}
+
+	var info client.Metainfo
+	magnet := strings.HasPrefix(args.Filename, "magnet:")
+	switch {
+	case args.Metainfo != "":
+		var data []byte
+		if data, err = base64.StdEncoding.DecodeString(args.Metainfo); err != nil {
+			return nil, fmt.Errorf("invalid metainfo: %v", err)
+		}
+		info, err = client.ParseTorrent(data)
+	case magnet:
+		info, err = client.ParseMagnet(args.Filename)
+	case strings.HasPrefix(args.Filename, "http://"), strings.HasPrefix(args.Filename, "https://"):
+		info, err = fetch_torrent(args.Filename)
+	case args.Filename != "":
+		info, err = client.LoadTorrentFile(args.Filename)
+	default:
+		return nil, fmt.Errorf("no filename or metainfo given")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if t, ok := s.client.Torrent(info.InfoHash); ok {
+		return map[string]any{"torrent-duplicate": added_torrent(s.id_of(t))}, nil
+	}
+	options := client.AddOptions{DownloadDir: args.DownloadDir, Paused: args.Paused}
+	var t *client.Torrent
+	if magnet {
+		t, err = s.client.AddMagnet(args.Filename, options)
+	} else {
+		t, err = s.client.AddTorrent(info, options)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.log.Info("added torrent", "torrent", t.Name(), "info_hash", t.InfoHash().String())
+	return map[string]any{"torrent-added": added_torrent(s.id_of(t))}, nil
+}
+
+func added_torrent(ref torrent_ref) map[string]any {
+	return map[string]any{"id": ref.id, "name": ref.t.Name(), "hashString": ref.t.InfoHash().String()}
+}
+
+// fetch_torrent downloads a .torrent file, as transmission accepts urls as well as paths
+func fetch_torrent(url string) (client.Metainfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return client.Metainfo{}, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return client.Metainfo{}, fmt.Errorf("unable to fetch torrent: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return client.Metainfo{}, fmt.Errorf("unable to fetch torrent: %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, max_request_size))
+	if err != nil {
+		return client.Metainfo{}, fmt.Errorf("unable to fetch torrent: %v", err)
+	}
+	return client.ParseTorrent(data)
+}
+
+func (s *Server) torrent_get(arguments json.RawMessage) (map[string]any, error) {
+	args, err := decode[struct {
+		IDs    json.RawMessage `json:"ids"`
+		Fields []string        `json:"fields"`
+		Format string          `json:"format"`
+	}](arguments)
+	if err != nil {
+		return nil, err
+	}
+	torrents, recent, err := s.select_torrents(args.IDs)
+	if err != nil {
+		return nil, err
+	}
+	fields := slices.DeleteFunc(slices.Clone(args.Fields), func(f string) bool { return torrent_fields[f] == nil })
+	if len(args.Fields) == 0 {
+		for f := range torrent_fields {
+			fields = append(fields, f)
+		}
+		slices.Sort(fields)
+	}
+
+	// objects by default, or as a table: a header row of field names followed by a row of values for each torrent
+	var result []any
+	if args.Format == "table" {
+		result = append(result, fields)
+	}
+	session := s.client.SeedLimits()
+	for _, ref := range torrents {
+		v := new_view(ref, session)
+		if args.Format == "table" {
+			row := []any{}
+			for _, f := range fields {
+				row = append(row, torrent_fields[f](v))
+			}
+			result = append(result, row)
+		} else {
+			object := map[string]any{}
+			for _, f := range fields {
+				object[f] = torrent_fields[f](v)
+			}
+			result = append(result, object)
+		}
+	}
+	if result == nil {
+		result = []any{}
+	}
+	response := map[string]any{"torrents": result}
+	if recent {
+		response["removed"] = s.recently_removed()
+	}
+	return response, nil
+}
+
+func (s *Server) torrent_start(arguments json.RawMessage) (map[string]any, error) {
+	return s.each(arguments, (*client.Torrent).Resume)
+}
+
+func (s *Server) torrent_stop(arguments json.RawMessage) (map[string]any, error) {
+	return s.each(arguments, (*client.Torrent).Pause)
+}
+
+func (s *Server) each(arguments json.RawMessage, action func(*client.Torrent)) (map[string]any, error) {
+	args, err := decode[struct {
+		IDs json.RawMessage `json:"ids"`
+	}](arguments)
+	if err != nil {
+		return nil, err
+	}
+	torrents, _, err := s.select_torrents(args.IDs)
+	if err != nil {
+		return nil, err
+	}
+	for _, ref := range torrents {
+		action(ref.t)
+	}
+	return nil, nil
+}
+
+func (s *Server) torrent_remove(arguments json.RawMessage) (map[string]any, error) {
+	args, err := decode[struct {
+		IDs        json.RawMessage `json:"ids"`
+		DeleteData bool            `json:"delete-local-data"`
+	}](arguments)
+	if err != nil {
+		return nil, err
+	}
+	torrents, _, err := s.select_torrents(args.IDs)
+	if err != nil {
+		return nil, err
+	}
+	for _, ref := range torrents {
+		if args.DeleteData {
+			err = s.client.Delete(ref.t)
+		} else {
+			err = s.client.Remove(ref.t)
+		}
+		if err != nil {
+			return nil, err
+		}
+		s.log.Info("removed torrent", "torrent", ref.t.Name(), "info_hash", ref.t.InfoHash().String(), "deleted_data", args.DeleteData)
+	}
+	s.sync()
+	return nil, nil
+}
+
+// torrent_set changes speed limits, seed limits and file priorities. Other settings, such as unwanted files, are left
+// as they are
+func (s *Server) torrent_set(arguments json.RawMessage) (map[string]any, error) {
+	args, err := decode[struct {
+		IDs             json.RawMessage `json:"ids"`
+		DownloadLimit   *int            `json:"downloadLimit"`
+		DownloadLimited *bool           `json:"downloadLimited"`
+		UploadLimit     *int            `json:"uploadLimit"`
+		UploadLimited   *bool           `json:"uploadLimited"`
+		SeedRatioLimit  *float64        `json:"seedRatioLimit"`
+		SeedRatioMode   *int            `json:"seedRatioMode"`
+		SeedIdleLimit   *int            `json:"seedIdleLimit"`
+		SeedIdleMode    *int            `json:"seedIdleMode"`
+		High            []int           `json:"priority-high"`
+		Normal          []int           `json:"priority-normal"`
+		Low             []int           `json:"priority-low"`
+	}](arguments)
+	if err != nil {
+		return nil, err
+	}
+	torrents, _, err := s.select_torrents(args.IDs)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ref := range torrents {
+		priorities := map[client.Priority][]int{client.High: args.High, client.Normal: args.Normal, client.Low: args.Low}
+		for priority, files := range priorities {
+			for _, file := range files {
+				if err := ref.t.SetFilePriority(file, priority); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		if args.SeedRatioLimit != nil || args.SeedRatioMode != nil || args.SeedIdleLimit != nil || args.SeedIdleMode != nil {
+			if err := s.set_seed_limits(ref, args.SeedRatioLimit, args.SeedRatioMode, args.SeedIdleLimit, args.SeedIdleMode); err != nil {
+				return nil, err
+			}
+		}
+
+		if args.DownloadLimit == nil && args.DownloadLimited == nil && args.UploadLimit == nil && args.UploadLimited == nil {
+			continue
+		}
+		download_rate, upload_rate := ref.t.Rates()
+		download, err := current_limit(download_rate, ref.limits[0]).set(args.DownloadLimit, args.DownloadLimited)
+		if err != nil {
+			return nil, err
+		}
+		upload, err := current_limit(upload_rate, ref.limits[1]).set(args.UploadLimit, args.UploadLimited)
+		if err != nil {
+			return nil, err
+		}
+		ref.t.SetRates(download.rate(), upload.rate())
+		s.mutex.Lock()
+		if e, ok := s.entries[ref.t.InfoHash()]; ok {
+			e.limits = [2]int{download.value, upload.value}
+		}
+		s.mutex.Unlock()
+	}
+	return nil, nil
+}
+
+// transmission's seed limit modes
+const (
+	seed_global    = 0
+	seed_single    = 1
+	seed_unlimited = 2
+)
+
+func seed_mode(own, on bool) int {
+	switch {
+	case !own:
+		return seed_global
+	case on:
+		return seed_single
+	}
+	return seed_unlimited
+}
+
+// seed_modes are the torrent's ratio and idle limit modes. A copy of the session's limit counts as following it for as
+// long as the two match
+func seed_modes(ref torrent_ref, limits client.SeedLimits, own bool, session client.SeedLimits) [2]int {
+	modes := [2]int{seed_mode(own, limits.Ratio > 0), seed_mode(own, limits.Idle > 0)}
+	if own && ref.global[0] && limits.Ratio == session.Ratio {
+		modes[0] = seed_global
+	}
+	if own && ref.global[1] && limits.Idle == session.Idle {
+		modes[1] = seed_global
+	}
+	return modes
+}
+
+// set_seed_limits applies the given parts of a change to a torrent's seed limits, any of which may be nil. A torrent's
+// limits are either its own or the session's as a whole, so one that follows the session for only one of its ratio and
+// idle limits takes a copy of the session's
+func (s *Server) set_seed_limits(ref torrent_ref, ratio *float64, ratio_mode *int, idle *int, idle_mode *int) error {
+	limits, own := ref.t.SeedLimits()
+	seed := current_seed_limits(limits, ref.seed)
+	modes := seed_modes(ref, limits, own, s.client.SeedLimits())
+	for i, mode := range []*int{ratio_mode, idle_mode} {
+		if mode == nil {
+			continue
+		}
+		if *mode < seed_global || *mode > seed_unlimited {
+			return fmt.Errorf("invalid seed limit mode %d", *mode)
+		}
+		modes[i] = *mode
+	}
+	seed, err := seed.set(ratio, nil, idle, nil)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if e, ok := s.entries[ref.t.InfoHash()]; ok {
+		e.seed, e.global = seed, [2]bool{modes[0] == seed_global, modes[1] == seed_global}
+	}
+	if modes == [2]int{seed_global, seed_global} {
+		return ref.t.SetSeedLimits(nil)
+	}
+	session := s.client.SeedLimits()
+	global := current_seed_limits(session, s.seed)
+	if !own {
+		limits = session
+	}
+	seed.ratio_on = modes[0] == seed_single
+	if modes[0] == seed_global {
+		seed.ratio, seed.ratio_on = global.ratio, global.ratio_on
+	}
+	seed.idle.enabled = modes[1] == seed_single
+	if modes[1] == seed_global {
+		seed.idle = global.idle
+	}
+	limits = seed.apply(limits)
+	return ref.t.SetSeedLimits(&limits)
+}
+
+// torrent_set_location moves torrents' files. Only moving is supported, not pointing a torrent at data already in the
+// new location
+func (s *Server) torrent_set_location(arguments json.RawMessage) (map[string]any, error) {
+	args, err := decode[struct {
+		IDs      json.RawMessage `json:"ids"`
+		Location string          `json:"location"`
+		Move     bool            `json:"move"`
+	}](arguments)
+	if err != nil {
+		return nil, err
+	}
+	if args.Location == "" {
+		return nil, fmt.Errorf("no location given")
+	}
+	if !args.Move {
+		return nil, fmt.Errorf("only moving the data to the new location is supported")
+	}
+	torrents, _, err := s.select_torrents(args.IDs)
+	if err != nil {
+		return nil, err
+	}
+	for _, ref := range torrents {
+		if err := ref.t.Move(args.Location); err != nil {
+			return nil, err
+		}
+		s.log.Info("moved torrent", "torrent", ref.t.Name(), "info_hash", ref.t.InfoHash().String(), "dir", args.Location)
+	}
+	return nil, nil
+}
+
+// view is a torrent as of one call, so that every field of it is read from the same status
+type view struct {
+	torrent_ref
+	status   client.Status
+	info     client.Metainfo
+	has_info bool
+	download limit
+	upload   limit
+	seed     seed_limits
+	limits   client.SeedLimits
+	modes    [2]int
+}
+
+func new_view(ref torrent_ref, session client.SeedLimits) view {
+	v := view{torrent_ref: ref, status: ref.t.Status()}
+	v.info, v.has_info = ref.t.Info()
+	download, upload := ref.t.Rates()
+	v.download, v.upload = current_limit(download, ref.limits[0]), current_limit(upload, ref.limits[1])
+	limits, own := ref.t.SeedLimits()
+	v.limits, v.seed = limits, current_seed_limits(limits, ref.seed)
+	v.modes = seed_modes(ref, limits, own, session)
+	return v
+}
+
+// transmission's torrent states
+const (
+	status_stopped  = 0
+	status_checking = 2
+	status_download = 4
+	status_seed     = 6
+)
+
+// transmission's error kinds
+const (
+	error_none    = 0
+	error_tracker = 2
+	error_local   = 3
+)
+
+func status_code(state client.State) int {
+	switch state {
+	case client.Checking:
+		return status_checking
+	case client.FetchingMetadata, client.Downloading:
+		return status_download
+	case client.Seeding:
+		return status_seed
+	}
+	return status_stopped
+}
+
+func (v view) error() (int, string) {
+	switch {
+	case v.status.Err != nil:
+		return error_local, v.status.Err.Error()
+	case v.status.TrackerErr != nil:
+		return error_tracker, v.status.TrackerErr.Error()
+	}
+	return error_none, ""
+}
+
+func (v view) eta() int64 {
+	if v.status.ETA < 0 || v.status.State == client.Seeding {
+		return -1
+	}
+	return int64(v.status.ETA.Seconds())
+}
+
+// finished is whether the torrent stopped seeding on reaching a limit. Idle limits are not counted, as how long it was
+// idle is not kept once it stops
+func (v view) finished() bool {
+	if v.status.State != client.Paused || v.status.Progress < 1 {
+		return false
+	}
+	return (v.limits.Ratio > 0 && v.status.Ratio >= v.limits.Ratio) || (v.limits.Time > 0 && v.status.SeedingTime >= v.limits.Time)
+}
+
+func (v view) peers_where(match func(client.PeerStatus) bool) int {
+	count := 0
+	for _, p := range v.t.Peers() {
+		if match(p) {
+			count++
+		}
+	}
+	return count
+}
+
+func downloading_from(p client.PeerStatus) bool {
+	return p.AmInterested && !p.Choked
+}
+
+func uploading_to(p client.PeerStatus) bool {
+	return p.Interested && !p.Choking
+}
+
+// pieces is the bitfield of pieces we have, base64 encoded
+func (v view) pieces() string {
+	pieces := v.t.Pieces()
+	bitfield := make([]byte, (len(pieces)+7)/8)
+	for i, p := range pieces {
+		if p.Have {
+			bitfield[i/8] |= 0x80 >> (i % 8)
+		}
+	}
+	return base64.StdEncoding.EncodeToString(bitfield)
+}
+
+func (v view) files() []any {
+	result := []any{}
+	for _, f := range v.t.Files() {
+		result = append(result, map[string]any{"name": f.Path, "length": f.Length, "bytesCompleted": f.BytesCompleted})
+	}
+	return result
+}
+
+func (v view) file_stats() []any {
+	result := []any{}
+	for _, f := range v.t.Files() {
+		result = append(result, map[string]any{"bytesCompleted": f.BytesCompleted, "wanted": true, "priority": int(f.Priority)})
+	}
+	return result
+}
+
+func (v view) priorities() []int {
+	result := []int{}
+	for _, f := range v.t.Files() {
+		result = append(result, int(f.Priority))
+	}
+	return result
+}
+
+func (v view) wanted() []int {
+	result := []int{}
+	for range v.t.Files() {
+		result = append(result, 1) // every file is downloaded, if only at low priority
+	}
+	return result
+}
+
+func (v view) peers() []any {
+	result := []any{}
+	for _, p := range v.t.Peers() {
+		host, port, _ := net.SplitHostPort(p.Address)
+		port_number, _ := strconv.Atoi(port)
+		result = append(result, map[string]any{
+			"address":            host,
+			"port":               port_number,
+			"clientName":         p.Client,
+			"clientIsChoked":     p.Choked,
+			"clientIsInterested": p.AmInterested,
+			"peerIsChoked":       p.Choking,
+			"peerIsInterested":   p.Interested,
+			"isDownloadingFrom":  downloading_from(p),
+			"isUploadingTo":      uploading_to(p),
+			"isEncrypted":        false,
+			"isUTP":              false,
+			"rateToClient":       int64(p.DownloadRate),
+			"rateToPeer":         int64(p.UploadRate),
+			"flagStr":            flags(p),
+		})
+	}
+	return result
+}
+
+// flags describes a peer the way transmission does: D or d for downloading from it or wanting to while choked, and U
+// or u for uploading to it or it wanting us to while we choke it
+func flags(p client.PeerStatus) string {
+	result := ""
+	switch {
+	case downloading_from(p):
+		result += "D"
+	case p.AmInterested:
+		result += "d"
+	}
+	switch {
+	case uploading_to(p):
+		result += "U"
+	case p.Interested:
+		result += "u"
+	}
+	return result
+}
+
+func (v view) trackers() []any {
+	result := []any{}
+	for i, announce := range v.info.Trackers {
+		result = append(result, map[string]any{"id": i, "announce": announce, "scrape": "", "tier": i})
+	}
+	return result
+}
+
+// torrent_fields are the fields torrent-get can return. Others that clients ask for are left out
+var torrent_fields = map[string]func(v view) any{
+	"id":         func(v view) any { return v.id },
+	"hashString": func(v view) any { return v.t.InfoHash().String() },
+	"name":       func(v view) any { return v.t.Name() },
+	"status":     func(v view) any { return status_code(v.status.State) },
+	"error": func(v view) any {
+		code, _ := v.error()
+		return code
+	},
+	"errorString": func(v view) any {
+		_, message := v.error()
+		return message
+	},
+	"percentDone": func(v view) any { return v.status.Progress },
+	"metadataPercentComplete": func(v view) any {
+		if v.has_info {
+			return 1
+		}
+		return 0
+	},
+	"recheckProgress": func(v view) any {
+		if v.status.State == client.Checking {
+			return v.status.Progress
+		}
+		return 0
+	},
+	"totalSize":           func(v view) any { return v.status.BytesTotal },
+	"sizeWhenDone":        func(v view) any { return v.status.BytesTotal },
+	"leftUntilDone":       func(v view) any { return v.status.BytesTotal - v.status.BytesCompleted },
+	"haveValid":           func(v view) any { return v.status.BytesCompleted },
+	"haveUnchecked":       func(v view) any { return 0 },
+	"downloadedEver":      func(v view) any { return v.status.Downloaded },
+	"uploadedEver":        func(v view) any { return v.status.Uploaded },
+	"corruptEver":         func(v view) any { return v.status.Wasted },
+	"rateDownload":        func(v view) any { return int64(v.status.DownloadRate) },
+	"rateUpload":          func(v view) any { return int64(v.status.UploadRate) },
+	"uploadRatio":         func(v view) any { return v.status.Ratio },
+	"eta":                 func(v view) any { return v.eta() },
+	"peersConnected":      func(v view) any { return v.status.Peers },
+	"peersSendingToUs":    func(v view) any { return v.peers_where(downloading_from) },
+	"peersGettingFromUs":  func(v view) any { return v.peers_where(uploading_to) },
+	"webseedsSendingToUs": func(v view) any { return 0 },
+	"downloadDir":         func(v view) any { return v.t.DownloadDir() },
+	"addedDate":           func(v view) any { return v.added.Unix() },
+	"isFinished":          func(v view) any { return v.finished() },
+	"isStalled":           func(v view) any { return false },
+	"magnetLink":          func(v view) any { return v.t.MagnetLink() },
+	"pieceCount":          func(v view) any { return v.info.PieceCount },
+	"pieceSize":           func(v view) any { return v.info.PieceLength },
+	"pieces":              func(v view) any { return v.pieces() },
+	"files":               func(v view) any { return v.files() },
+	"fileStats":           func(v view) any { return v.file_stats() },
+	"priorities":          func(v view) any { return v.priorities() },
+	"wanted":              func(v view) any { return v.wanted() },
+	"peers":               func(v view) any { return v.peers() },
+	"trackers":            func(v view) any { return v.trackers() },
+	"webseeds":            func(v view) any { return v.info.WebSeeds },
+	"downloadLimit":       func(v view) any { return v.download.value },
+	"downloadLimited":     func(v view) any { return v.download.enabled },
+	"uploadLimit":         func(v view) any { return v.upload.value },
+	"uploadLimited":       func(v view) any { return v.upload.enabled },
+	"honorsSessionLimits": func(v view) any { return true },
+	"bandwidthPriority":   func(v view) any { return 0 },
+	"queuePosition":       func(v view) any { return v.position },
+	"seedRatioLimit":      func(v view) any { return v.seed.ratio },
+	"seedRatioMode":       func(v view) any { return v.modes[0] },
+	"seedIdleLimit":       func(v view) any { return v.seed.idle.value },
+	"seedIdleMode":        func(v view) any { return v.modes[1] },
+	"secondsSeeding":      func(v view) any { return int64(v.status.SeedingTime.Seconds()) },
+	"labels":              func(v view) any { return []string{} },
+}
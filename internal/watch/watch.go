@@ -0,0 +1,170 @@
+// Package watch adds torrents dropped into a directory: .torrent files, and .magnet files holding a magnet link. Each
+// is read once it has stopped changing, then renamed with .added, or with .invalid alongside a .error file saying why.
+package watch
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/chrispritchard/gorrent/internal/logging"
+	"github.com/chrispritchard/gorrent/pkg/client"
+)
+
+const (
+	AddedSuffix   = ".added"
+	InvalidSuffix = ".invalid"
+	ErrorSuffix   = ".error"
+)
+
+const (
+	DefaultInterval = 2 * time.Second
+	DefaultSettle   = 3 * time.Second
+)
+
+type Config struct {
+	Dir         string
+	DownloadDir string        // where added torrents are saved, the client's download directory if empty
+	Interval    time.Duration // between scans of the directory
+	Settle      time.Duration // how long a file must go unchanged before it is read, so it is not read half written
+	Logger      *slog.Logger
+}
+
+// Watcher scans a directory for torrents to add to a client
+type Watcher struct {
+	client *client.Client
+	config Config
+	log    *slog.Logger
+	seen   map[string]candidate
+}
+
+// candidate is a file waiting to settle: its size and modification time when last scanned, and since when they
+// have been the same
+type candidate struct {
+	size     int64
+	mod_time time.Time
+	since    time.Time
+}
+
+func New(c *client.Client, config Config) *Watcher {
+	if config.Interval <= 0 {
+		config.Interval = DefaultInterval
+	}
+	if config.Settle <= 0 {
+		config.Settle = DefaultSettle
+	}
+	return &Watcher{
+		client: c,
+		config: config,
+		log:    logging.For(config.Logger, logging.Watch).With("dir", config.Dir),
+		seen:   map[string]candidate{},
+	}
+}
+
+// Run scans the directory every interval until ctx is done. It fails at once if the directory cannot be read
+func (w *Watcher) Run(ctx context.Context) error {
+	if err := w.Scan(time.Now()); err != nil {
+		return err
+	}
+	ticker := time.NewTicker(w.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case now := <-ticker.C:
+			if err := w.Scan(now); err != nil {
+				w.log.Warn("failed to scan", "err", err)
+			}
+		}
+	}
+}
+
+// Scan adds every torrent file in the directory that has been unchanged for the settle time as of now
+func (w *Watcher) Scan(now time.Time) error {
+	entries, err := os.ReadDir(w.config.Dir)
+	if err != nil {
+		return fmt.Errorf("unable to read watch directory: %v", err)
+	}
+	present := map[string]bool{}
+	for _, entry := range entries {
+		name := entry.Name()
+		extension := strings.ToLower(filepath.Ext(name))
+		if entry.IsDir() || strings.HasPrefix(name, ".") || (extension != ".torrent" && extension != ".magnet") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue // removed since the directory was read
+		}
+		present[name] = true
+
+		last, ok := w.seen[name]
+		if !ok || last.size != info.Size() || !last.mod_time.Equal(info.ModTime()) {
+			w.seen[name] = candidate{size: info.Size(), mod_time: info.ModTime(), since: now}
+			continue
+		}
+		if now.Sub(last.since) < w.config.Settle {
+			continue
+		}
+		delete(w.seen, name)
+		w.add(filepath.Join(w.config.Dir, name), extension == ".magnet")
+	}
+	for name := range w.seen {
+		if !present[name] {
+			delete(w.seen, name)
+		}
+	}
+	return nil
+}
+
+// add adds the torrent at path, then renames the file to show how that went
+func (w *Watcher) add(path string, magnet bool) {
+	t, err := w.add_file(path, magnet)
+	if err != nil {
+		w.log.Warn("invalid torrent", "file", filepath.Base(path), "err", err)
+		if err := os.Rename(path, path+InvalidSuffix); err != nil {
+			w.log.Warn("failed to rename", "file", filepath.Base(path), "err", err)
+			return
+		}
+		os.WriteFile(path+InvalidSuffix+ErrorSuffix, []byte(err.Error()+"\n"), 0644)
+		return
+	}
+	w.log.Info("added torrent", "file", filepath.Base(path), "torrent", t.Name(), "info_hash", t.InfoHash().String())
+	if err := os.Rename(path, path+AddedSuffix); err != nil {
+		w.log.Warn("failed to rename", "file", filepath.Base(path), "err", err)
+	}
+}
+
+func (w *Watcher) add_file(path string, magnet bool) (*client.Torrent, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	options := client.AddOptions{DownloadDir: w.config.DownloadDir}
+	if magnet {
+		link, _, _ := strings.Cut(strings.TrimSpace(string(data)), "\n")
+		link = strings.TrimSpace(link)
+		info, err := client.ParseMagnet(link)
+		if err != nil {
+			return nil, err
+		}
+		if t, ok := w.client.Torrent(info.InfoHash); ok {
+			return t, nil // already running, which is what was asked for
+		}
+		return w.client.AddMagnet(link, options)
+	}
+
+	info, err := client.ParseTorrent(data)
+	if err != nil {
+		return nil, err
+	}
+	if t, ok := w.client.Torrent(info.InfoHash); ok {
+		return t, nil
+	}
+	return w.client.AddTorrent(info, options)
+}
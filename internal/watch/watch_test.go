@@ -0,0 +1,140 @@
+package watch
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chrispritchard/gorrent/pkg/client"
+)
+
+// newWatcher watches a temp dir for a client that saves into another, returning both dirs and a valid torrent
+func newWatcher(t *testing.T) (*Watcher, *client.Client, string, []byte) {
+	t.Helper()
+	data := t.TempDir()
+	source := filepath.Join(data, "data.bin")
+	if err := os.WriteFile(source, make([]byte, 40_000), 0644); err != nil {
+		t.Fatal(err)
+	}
+	torrent, _, err := client.CreateTorrent(source, client.CreateOptions{PieceLength: 1 << 14})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := client.DefaultConfig()
+	config.ListenPort = 0
+	c, err := client.New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	dir := t.TempDir()
+	return New(c, Config{Dir: dir, DownloadDir: data, Settle: time.Second}), c, dir, torrent
+}
+
+func write(t *testing.T, path string, data []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func TestScan(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content func(torrent []byte) []byte
+		added   bool
+	}{
+		{name: "torrent file", file: "a.torrent", content: func(torrent []byte) []byte { return torrent }, added: true},
+		{name: "upper case extension", file: "b.TORRENT", content: func(torrent []byte) []byte { return torrent }, added: true},
+		{name: "magnet file", file: "c.magnet", content: func([]byte) []byte {
+			return []byte("magnet:?xt=urn:btih:0123456789abcdef0123456789abcdef01234567&dn=linked\n")
+		}, added: true},
+		{name: "invalid torrent", file: "d.torrent", content: func(torrent []byte) []byte { return torrent[:len(torrent)/2] }},
+		{name: "invalid magnet", file: "e.magnet", content: func([]byte) []byte { return []byte("not a link") }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, c, dir, torrent := newWatcher(t)
+			path := filepath.Join(dir, tt.file)
+			write(t, path, tt.content(torrent))
+
+			start := time.Now()
+			if err := w.Scan(start); err != nil {
+				t.Fatal(err)
+			}
+			if !exists(path) || len(c.Torrents()) != 0 {
+				t.Fatalf("expected nothing to be added before the file settles")
+			}
+			if err := w.Scan(start.Add(time.Second)); err != nil {
+				t.Fatal(err)
+			}
+
+			switch {
+			case tt.added:
+				if !exists(path+AddedSuffix) || len(c.Torrents()) != 1 {
+					t.Errorf("expected the torrent to be added and the file renamed, got %d torrents", len(c.Torrents()))
+				}
+			default:
+				reason, err := os.ReadFile(path + InvalidSuffix + ErrorSuffix)
+				if !exists(path+InvalidSuffix) || err != nil || len(reason) == 0 || len(c.Torrents()) != 0 {
+					t.Errorf("expected the file to be marked invalid with a reason, got %q, %v", reason, err)
+				}
+			}
+			if exists(path) {
+				t.Errorf("expected the original to be renamed")
+			}
+		})
+	}
+}
+
+func TestScan_WaitsForWritesToFinish(t *testing.T) {
+	w, c, dir, torrent := newWatcher(t)
+	path := filepath.Join(dir, "slow.torrent")
+	start := time.Now()
+
+	// written in two halves, a scan apart, so that the first half never settles
+	write(t, path, torrent[:len(torrent)/2])
+	w.Scan(start)
+	w.Scan(start.Add(500 * time.Millisecond))
+	write(t, path, torrent)
+	os.Chtimes(path, start.Add(time.Second), start.Add(time.Second))
+	w.Scan(start.Add(1200 * time.Millisecond))
+	if !exists(path) {
+		t.Fatalf("expected the growing file to be left alone")
+	}
+
+	w.Scan(start.Add(2200 * time.Millisecond))
+	if !exists(path+AddedSuffix) || len(c.Torrents()) != 1 {
+		t.Errorf("expected the file to be added once it settled")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 || !strings.HasSuffix(entries[0].Name(), AddedSuffix) {
+		t.Errorf("expected only the renamed file, got %v", entries)
+	}
+}
+
+func TestScan_DuplicateIsAdded(t *testing.T) {
+	w, c, dir, torrent := newWatcher(t)
+	info, _ := client.ParseTorrent(torrent)
+	if _, err := c.AddTorrent(info, client.AddOptions{Paused: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "again.torrent")
+	write(t, path, torrent)
+	start := time.Now()
+	w.Scan(start)
+	w.Scan(start.Add(time.Second))
+	if !exists(path+AddedSuffix) || len(c.Torrents()) != 1 {
+		t.Errorf("expected a torrent already running to count as added")
+	}
+}
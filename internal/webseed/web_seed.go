@@ -0,0 +1,216 @@
+package webseed
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/chrispritchard/gorrent/internal/logging"
+	"github.com/chrispritchard/gorrent/internal/messaging"
+	. "github.com/chrispritchard/gorrent/internal/torrent_files"
+)
+
+// Web seeds (BEP 19) are http mirrors of the torrent's files, listed in its 'url-list'. They are treated as a special
+// kind of peer: whole pieces are fetched with range requests, verified, then fed into the same channel as peer messages.
+
+const DefaultTimeout = 30 * time.Second
+
+const (
+	IDLE_WAIT    = 1 * time.Second
+	BASE_BACKOFF = 5 * time.Second
+	MAX_BACKOFF  = 5 * time.Minute
+)
+
+// PieceClaimer hands out pieces for web seeds to fetch, so that two seeds never fetch the same piece at once
+type PieceClaimer interface {
+	ClaimWebSeedPiece() (int, bool)
+	ReleaseWebSeedPiece(index int)
+}
+
+type WebSeed struct {
+	Id       string
+	base_url string
+	metadata TorrentMetadata
+	spans    []FileSpan
+	client   *http.Client
+	failures atomic.Int64 // written by the fetching goroutine, read by Failures
+	log      *slog.Logger
+}
+
+// NewWebSeed creates a web seed for the mirror at raw_url, giving up on any request that takes longer than timeout.
+// logger may be nil
+func NewWebSeed(raw_url string, metadata TorrentMetadata, timeout time.Duration, logger *slog.Logger) (*WebSeed, error) {
+	parsed, err := url.Parse(raw_url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid web seed url %s: %v", raw_url, err)
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported web seed scheme %s in %s, only http and https mirrors are used", parsed.Scheme, raw_url)
+	}
+
+	return &WebSeed{
+		Id:       raw_url,
+		base_url: raw_url,
+		metadata: metadata,
+		spans:    metadata.FileSpans(),
+		client:   &http.Client{Timeout: timeout},
+		log:      logging.For(logger, logging.WebSeed).With("url", raw_url),
+	}, nil
+}
+
+// WithTransport makes the seed's requests through transport, e.g. one that goes through a proxy
+func (ws *WebSeed) WithTransport(transport http.RoundTripper) *WebSeed {
+	ws.client.Transport = transport
+	return ws
+}
+
+// Failures returns the number of consecutive failed fetches. Each one doubles the time before the seed is used again
+func (ws *WebSeed) Failures() int {
+	return int(ws.failures.Load())
+}
+
+// file_url follows BEP 19: a single file torrent's url is used as is unless it names a directory, while multi-file
+// torrents always append the torrent name and the file's path
+func (ws *WebSeed) file_url(span FileSpan) string {
+	base := ws.base_url
+	if len(ws.metadata.Files) == 0 {
+		if strings.HasSuffix(base, "/") {
+			return base + url.PathEscape(ws.metadata.Name)
+		}
+		return base
+	}
+
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+	escaped := []string{url.PathEscape(ws.metadata.Name)}
+	for _, p := range span.File.Path {
+		escaped = append(escaped, url.PathEscape(p))
+	}
+	return base + strings.Join(escaped, "/")
+}
+
+// FetchPiece downloads a piece, with one range request per file it spans, and verifies it against the piece hash
+func (ws *WebSeed) FetchPiece(ctx context.Context, index int) ([]byte, error) {
+	piece_start := index * ws.metadata.PieceLength
+	piece_end := piece_start + ws.metadata.PieceSize(index)
+	data := make([]byte, piece_end-piece_start)
+
+	for _, span := range ws.spans {
+		if span.Start >= piece_end || span.End <= piece_start || span.File.IsVirtual() {
+			continue // padding is zeroes, and symlinks have no data of their own
+		}
+
+		overlap_start := max(piece_start, span.Start)
+		overlap_end := min(piece_end, span.End)
+		if overlap_end <= overlap_start {
+			continue
+		}
+
+		target := data[overlap_start-piece_start : overlap_end-piece_start]
+		err := ws.fetch_range(ctx, ws.file_url(span), overlap_start-span.Start, target)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !ws.metadata.VerifyPiece(index, data) {
+		return nil, fmt.Errorf("piece %d from web seed %s failed verification", index, ws.Id)
+	}
+	return data, nil
+}
+
+func (ws *WebSeed) fetch_range(ctx context.Context, file_url string, from int, into []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, file_url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", from, from+len(into)-1))
+
+	resp, err := ws.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent:
+	case resp.StatusCode == http.StatusOK && from == 0:
+		// the server ignored the range, but the start of the full body is still what was asked for
+	default:
+		return fmt.Errorf("web seed %s returned status %s for %s", ws.Id, resp.Status, file_url)
+	}
+
+	_, err = io.ReadFull(resp.Body, into)
+	if err != nil {
+		return fmt.Errorf("web seed %s returned too little data for %s: %v", ws.Id, file_url, err)
+	}
+	return nil
+}
+
+// demote records a failure, returning how long to wait before using the seed again
+func (ws *WebSeed) demote() time.Duration {
+	failures := ws.failures.Add(1)
+	backoff := BASE_BACKOFF
+	for i := int64(1); i < failures && backoff < MAX_BACKOFF; i++ {
+		backoff *= 2
+	}
+	return min(backoff, MAX_BACKOFF)
+}
+
+// StartReceiving fetches claimed pieces until the context ends, passing each verified piece on as block sized
+// piece messages, just as a peer would send them
+func (ws *WebSeed) StartReceiving(ctx context.Context, claimer PieceClaimer, block_size int, received_channel chan<- messaging.Received) {
+	go func() {
+		for {
+			index, claimed := claimer.ClaimWebSeedPiece()
+			if !claimed {
+				if !wait(ctx, IDLE_WAIT) {
+					return
+				}
+				continue
+			}
+
+			data, err := ws.FetchPiece(ctx, index)
+			if err != nil {
+				claimer.ReleaseWebSeedPiece(index)
+				if ctx.Err() != nil {
+					return
+				}
+				backoff := ws.demote()
+				ws.log.Warn("web seed demoted", "backoff", backoff, "failures", ws.Failures(), "err", err)
+				if !wait(ctx, backoff) {
+					return
+				}
+				continue
+			}
+			ws.failures.Store(0)
+			ws.log.Debug("received piece", "piece", index)
+
+			for begin := 0; begin < len(data); begin += block_size {
+				block := data[begin:min(begin+block_size, len(data))]
+				select {
+				case <-ctx.Done():
+					return
+				case received_channel <- messaging.Received{Kind: messaging.MSG_PIECE, Data: messaging.EncodePiece(index, begin, block)}:
+				}
+			}
+			claimer.ReleaseWebSeedPiece(index)
+		}
+	}()
+}
+
+func wait(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
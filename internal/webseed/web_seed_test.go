@@ -0,0 +1,235 @@
+package webseed
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chrispritchard/gorrent/internal/messaging"
+	. "github.com/chrispritchard/gorrent/internal/torrent_files"
+)
+
+// setupMirror creates a multi-file torrent of the given file sizes, served by an http file server
+func setupMirror(t *testing.T, sizes map[string]int) (TorrentMetadata, map[string][]byte, *httptest.Server) {
+	t.Helper()
+	root := t.TempDir()
+	dir := filepath.Join(root, "data set")
+	contents := map[string][]byte{}
+	for name, size := range sizes {
+		content := make([]byte, size)
+		for i := range content {
+			content[i] = byte(i*17) + byte(len(name))
+		}
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+		contents[name] = content
+	}
+
+	_, metadata, err := CreateTorrent(dir, CreateOptions{PieceLength: 16384})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.FileServer(http.Dir(root)))
+	t.Cleanup(server.Close)
+	return metadata, contents, server
+}
+
+func allData(metadata TorrentMetadata, contents map[string][]byte) []byte {
+	result := []byte{}
+	for _, f := range metadata.Files {
+		name := filepath.ToSlash(filepath.Join(f.Path...))
+		result = append(result, contents[name]...)
+	}
+	return result
+}
+
+func TestFetchPiece_SpansFiles(t *testing.T) {
+	metadata, contents, server := setupMirror(t, map[string]int{
+		"a.bin":     10000,
+		"sub/b.bin": 30000,
+		"z.bin":     5,
+	})
+	all := allData(metadata, contents)
+
+	ws, err := NewWebSeed(server.URL, metadata, DefaultTimeout, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range metadata.PieceCount() {
+		data, err := ws.FetchPiece(context.Background(), i)
+		if err != nil {
+			t.Fatalf("piece %d: %v", i, err)
+		}
+		start := i * metadata.PieceLength
+		if string(data) != string(all[start:start+len(data)]) {
+			t.Errorf("piece %d content mismatch", i)
+		}
+	}
+}
+
+func TestFetchPiece_CorruptMirrorFailsVerification(t *testing.T) {
+	metadata, _, _ := setupMirror(t, map[string]int{"a.bin": 20000})
+	corrupt := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write(make([]byte, 20000))
+	}))
+	defer corrupt.Close()
+
+	ws, _ := NewWebSeed(corrupt.URL, metadata, DefaultTimeout, nil)
+	if _, err := ws.FetchPiece(context.Background(), 0); err == nil {
+		t.Errorf("expected verification to fail for zeroed data")
+	}
+}
+
+func TestFetchPiece_ErrorStatus(t *testing.T) {
+	metadata, _, _ := setupMirror(t, map[string]int{"a.bin": 20000})
+	missing := httptest.NewServer(http.NotFoundHandler())
+	defer missing.Close()
+
+	ws, _ := NewWebSeed(missing.URL, metadata, DefaultTimeout, nil)
+	if _, err := ws.FetchPiece(context.Background(), 1); err == nil {
+		t.Errorf("expected an error for a 404")
+	}
+}
+
+func TestNewWebSeed_RejectsUnsupportedSchemes(t *testing.T) {
+	if _, err := NewWebSeed("ftp://mirror/data", TorrentMetadata{}, DefaultTimeout, nil); err == nil {
+		t.Errorf("expected ftp to be rejected")
+	}
+}
+
+func TestFileURL(t *testing.T) {
+	single := TorrentMetadata{Name: "file name.iso", Length: 10}
+	multi := TorrentMetadata{Name: "set", Files: []TorrentFile{{Path: []string{"dir", "a b.txt"}, Length: 1}}}
+
+	tests := []struct {
+		name     string
+		base     string
+		metadata TorrentMetadata
+		want     string
+	}{
+		{"single file exact url", "http://m/files/other.iso", single, "http://m/files/other.iso"},
+		{"single file directory url", "http://m/files/", single, "http://m/files/file%20name.iso"},
+		{"multi file without slash", "http://m/files", multi, "http://m/files/set/dir/a%20b.txt"},
+		{"multi file with slash", "http://m/files/", multi, "http://m/files/set/dir/a%20b.txt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ws, err := NewWebSeed(tt.base, tt.metadata, DefaultTimeout, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := ws.file_url(tt.metadata.FileSpans()[0]); got != tt.want {
+				t.Errorf("file_url() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDemoteBacksOff(t *testing.T) {
+	ws := &WebSeed{}
+	want := []time.Duration{BASE_BACKOFF, BASE_BACKOFF * 2, BASE_BACKOFF * 4}
+	for i, w := range want {
+		if got := ws.demote(); got != w {
+			t.Errorf("failure %d: backoff = %v, want %v", i+1, got, w)
+		}
+	}
+	for range 20 {
+		ws.demote()
+	}
+	if got := ws.demote(); got != MAX_BACKOFF {
+		t.Errorf("backoff should be capped at %v, got %v", MAX_BACKOFF, got)
+	}
+}
+
+type testClaimer struct {
+	mutex    sync.Mutex
+	pending  []int
+	released []int
+}
+
+func (c *testClaimer) ClaimWebSeedPiece() (int, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(c.pending) == 0 {
+		return 0, false
+	}
+	index := c.pending[0]
+	c.pending = c.pending[1:]
+	return index, true
+}
+
+func (c *testClaimer) ReleaseWebSeedPiece(index int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.released = append(c.released, index)
+}
+
+func TestStartReceiving_DeliversBlocks(t *testing.T) {
+	metadata, contents, server := setupMirror(t, map[string]int{"a.bin": 20000, "b.bin": 20000})
+	all := allData(metadata, contents)
+	ws, _ := NewWebSeed(server.URL+"/", metadata, DefaultTimeout, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	claimer := &testClaimer{pending: []int{1}}
+	received := make(chan messaging.Received)
+	ws.StartReceiving(ctx, claimer, 4096, received)
+
+	got := []byte{}
+	for len(got) < 16384 {
+		select {
+		case r := <-received:
+			index, begin, block := r.AsPiece()
+			if index != 1 || begin != len(got) {
+				t.Fatalf("unexpected block: index %d begin %d", index, begin)
+			}
+			got = append(got, block...)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for blocks")
+		}
+	}
+	if string(got) != string(all[16384:32768]) {
+		t.Errorf("delivered piece content mismatch")
+	}
+}
+
+func TestStartReceiving_DemotesFailingMirror(t *testing.T) {
+	metadata, _, _ := setupMirror(t, map[string]int{"a.bin": 20000})
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	ws, _ := NewWebSeed(failing.URL, metadata, DefaultTimeout, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	claimer := &testClaimer{pending: []int{0}}
+	ws.StartReceiving(ctx, claimer, 16384, make(chan messaging.Received))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		claimer.mutex.Lock()
+		released := len(claimer.released)
+		claimer.mutex.Unlock()
+		if released > 0 {
+			cancel()
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("failed piece was never released for other sources")
+}
@@ -0,0 +1,296 @@
+// Package client is the public API for running torrents from Go: a Client downloads and seeds any number of torrents,
+// added from torrent files or magnet links, reporting on them through per torrent handles and event channels.
+package client
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/chrispritchard/gorrent/internal/downloading"
+	"github.com/chrispritchard/gorrent/internal/peer"
+	"github.com/chrispritchard/gorrent/internal/session"
+	"github.com/chrispritchard/gorrent/internal/torrent_files"
+)
+
+type Config struct {
+	ListenPort       int        // 0 picks any free port, otherwise the next free one in the following few is used
+	DownloadDir      string     // where torrents are saved unless AddOptions says otherwise, the working directory if empty
+	IncompleteDir    string     // optional, where torrents download to before their files are moved to their download directory
+	ResumeDir        string     // optional, where what each torrent has and has transferred is kept, so a restart need only check changed files
+	SeedLimits       SeedLimits // for torrents without limits of their own
+	SuperSeed        bool       // whether torrents super-seed, see Torrent.SetSuperSeeding
+	Blocklist        string     // optional, a file of address ranges never to connect to, see ReloadBlocklist
+	Proxy            string     // optional, a socks5:// or http:// url, with any credentials, to reach peers, trackers and web seeds through
+	ProxyOnly        bool       // refuse inbound peer connections, as they cannot come through the proxy
+	MaxPeers         int        // across all torrents
+	MaxTorrentPeers  int
+	UploadSlots      int // peers unchoked at once, per torrent
+	DownloadRate     int // bytes per second across all torrents, 0 for unlimited
+	UploadRate       int
+	PeerDownloadRate int // bytes per second for each peer connection, 0 for unlimited
+	PeerUploadRate   int
+	ConnectTimeout   time.Duration // to dial a peer, and for each step of the handshake. Durations take their defaults where zero
+	IdleTimeout      time.Duration // before dropping a peer that has sent nothing
+	MetadataTimeout  time.Duration // to fetch a magnet link's metadata from one peer
+	WebSeedTimeout   time.Duration // for each request to a web seed
+	AnnounceTimeout  time.Duration // for each announce to a tracker
+	BlockSize        int           // bytes requested at a time, a power of two from 1 KiB to 16 KiB. 0 for 16 KiB
+	RequestInterval  time.Duration // between block requests
+	RequestTimeout   time.Duration // after which an unanswered block request is made again
+	Logger           *slog.Logger  // optional, for diagnostics. Records carry a "subsystem" attribute, see NewLogger
+}
+
+func DefaultConfig() Config {
+	defaults := session.DefaultConfig()
+	return Config{
+		ListenPort:      defaults.Port,
+		MaxPeers:        defaults.MaxPeers,
+		MaxTorrentPeers: defaults.MaxTorrentPeers,
+		UploadSlots:     defaults.UploadSlots,
+		ConnectTimeout:  defaults.Timeouts.Connect,
+		IdleTimeout:     defaults.Timeouts.Idle,
+		MetadataTimeout: defaults.Timeouts.Metadata,
+		WebSeedTimeout:  defaults.WebSeedTimeout,
+		AnnounceTimeout: defaults.Intervals.Announce,
+		BlockSize:       defaults.Download.BlockSize,
+		RequestInterval: defaults.Download.RequestInterval,
+		RequestTimeout:  defaults.Download.RequestMaxAge,
+	}
+}
+
+type AddOptions struct {
+	DownloadDir  string // overrides Config.DownloadDir
+	Paused       bool   // add without starting
+	DownloadRate int    // bytes per second for this torrent, 0 for unlimited. The client's limits still apply
+	UploadRate   int
+	SeedLimits   *SeedLimits // overrides Config.SeedLimits
+	SuperSeed    bool        // super-seed this torrent, whatever Config.SuperSeed
+}
+
+// Client runs torrents side by side, sharing one listening port, a cap on peer connections and the bandwidth limits
+type Client struct {
+	config      Config
+	session     *session.Session
+	ctx         context.Context
+	cancel      context.CancelFunc
+	mutex       sync.Mutex
+	closed      bool
+	handles     map[*session.Torrent]*Torrent
+	subscribers map[*subscriber]struct{}
+}
+
+func New(config Config) (*Client, error) {
+	c := &Client{
+		config:      config,
+		handles:     map[*session.Torrent]*Torrent{},
+		subscribers: map[*subscriber]struct{}{},
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+
+	s, err := session.NewSession(session.Config{
+		Port:             config.ListenPort,
+		MaxPeers:         config.MaxPeers,
+		MaxTorrentPeers:  config.MaxTorrentPeers,
+		UploadSlots:      config.UploadSlots,
+		DownloadRate:     config.DownloadRate,
+		UploadRate:       config.UploadRate,
+		PeerDownloadRate: config.PeerDownloadRate,
+		PeerUploadRate:   config.PeerUploadRate,
+		Timeouts: peer.Timeouts{
+			Connect:  config.ConnectTimeout,
+			Idle:     config.IdleTimeout,
+			Metadata: config.MetadataTimeout,
+		},
+		WebSeedTimeout: config.WebSeedTimeout,
+		Intervals:      session.Intervals{Announce: config.AnnounceTimeout},
+		Download: downloading.Config{
+			BlockSize:       config.BlockSize,
+			RequestInterval: config.RequestInterval,
+			RequestMaxAge:   config.RequestTimeout,
+		},
+		IncompleteDir: config.IncompleteDir,
+		ResumeDir:     config.ResumeDir,
+		SeedLimits:    config.SeedLimits,
+		SuperSeed:     config.SuperSeed,
+		Blocklist:     config.Blocklist,
+		Proxy:         config.Proxy,
+		ProxyOnly:     config.ProxyOnly,
+		Logger:        config.Logger,
+		OnEvent:       c.publish,
+	})
+	if err != nil {
+		c.cancel()
+		return nil, fmt.Errorf("failed to start session: %v", err)
+	}
+	c.session = s
+	return c, nil
+}
+
+// Close stops every torrent, waiting for their files to be closed, and ends all event subscriptions
+func (c *Client) Close() error {
+	c.mutex.Lock()
+	c.closed = true
+	c.mutex.Unlock()
+
+	err := c.session.Close()
+	c.cancel()
+	return err
+}
+
+// Port is the port listened on for peers
+func (c *Client) Port() int {
+	return c.session.Port()
+}
+
+// DownloadDir is where torrents are saved unless added with a directory of their own
+func (c *Client) DownloadDir() string {
+	return c.config.DownloadDir
+}
+
+// IncompleteDir is where torrents download to before they complete, or empty if they download in place
+func (c *Client) IncompleteDir() string {
+	return c.config.IncompleteDir
+}
+
+// ReloadBlocklist reads Config.Blocklist again, returning the number of ranges it blocks, and disconnects peers it now
+// blocks. The file holds PeerGuardian P2P, eMule DAT or CIDR lines, optionally gzipped. The list in use is kept if the
+// file cannot be read
+func (c *Client) ReloadBlocklist() (int, error) {
+	return c.session.ReloadBlocklist()
+}
+
+// BlocklistSize is the number of address ranges blocked, 0 without a blocklist
+func (c *Client) BlocklistSize() int {
+	return c.session.BlocklistSize()
+}
+
+// SetRates changes the bandwidth limits, in bytes per second with 0 for unlimited
+func (c *Client) SetRates(download, upload int) {
+	c.session.SetRates(download, upload)
+}
+
+func (c *Client) Rates() (download, upload int) {
+	return c.session.Rates()
+}
+
+// SetSeedLimits changes the seed limits of every torrent without limits of its own
+func (c *Client) SetSeedLimits(limits SeedLimits) error {
+	return c.session.SetSeedLimits(limits)
+}
+
+func (c *Client) SeedLimits() SeedLimits {
+	return c.session.SeedLimits()
+}
+
+// SetPeerRates changes the bandwidth limits of every peer connection, existing and future
+func (c *Client) SetPeerRates(download, upload int) {
+	c.session.SetPeerRates(download, upload)
+}
+
+func (c *Client) PeerRates() (download, upload int) {
+	return c.session.PeerRates()
+}
+
+func (c *Client) AddTorrent(info Metainfo, options AddOptions) (*Torrent, error) {
+	if err := options.validate(); err != nil {
+		return nil, err
+	}
+	t, err := c.session.Add(info.metadata, c.download_dir(options), true)
+	if err != nil {
+		return nil, err
+	}
+	return c.start(t, options), nil
+}
+
+// AddMagnet adds a torrent by magnet link. Its metadata is fetched from peers once it starts, until which Info
+// reports only what the link itself holds
+func (c *Client) AddMagnet(uri string, options AddOptions) (*Torrent, error) {
+	if err := options.validate(); err != nil {
+		return nil, err
+	}
+	magnet, err := torrent_files.ParseMagnet(uri)
+	if err != nil {
+		return nil, err
+	}
+	t, err := c.session.AddMagnet(magnet, c.download_dir(options), true)
+	if err != nil {
+		return nil, err
+	}
+	return c.start(t, options), nil
+}
+
+func (o AddOptions) validate() error {
+	if o.SeedLimits != nil {
+		return o.SeedLimits.Validate()
+	}
+	return nil
+}
+
+// start applies the options to a torrent added paused, so its limits are in place before any peer connects
+func (c *Client) start(t *session.Torrent, options AddOptions) *Torrent {
+	t.SetRates(options.DownloadRate, options.UploadRate)
+	t.SetSeedLimits(options.SeedLimits) // validated by validate
+	if options.SuperSeed {
+		t.SetSuperSeeding(true)
+	}
+	if !options.Paused {
+		t.Resume()
+	}
+	return c.handle(t)
+}
+
+// Torrents returns every torrent in the order they were added
+func (c *Client) Torrents() []*Torrent {
+	result := []*Torrent{}
+	for _, t := range c.session.Torrents() {
+		result = append(result, c.handle(t))
+	}
+	return result
+}
+
+// Torrent looks a torrent up by any of its info hashes
+func (c *Client) Torrent(info_hash InfoHash) (*Torrent, bool) {
+	t, ok := c.session.Find(info_hash)
+	if !ok {
+		return nil, false
+	}
+	return c.handle(t), true
+}
+
+// Remove stops the torrent and forgets it. Downloaded files are left in place
+func (c *Client) Remove(t *Torrent) error {
+	return c.session.Remove(t.torrent)
+}
+
+// Delete stops the torrent, forgets it and deletes its downloaded files
+func (c *Client) Delete(t *Torrent) error {
+	return c.session.Delete(t.torrent)
+}
+
+func (c *Client) download_dir(options AddOptions) string {
+	if options.DownloadDir != "" {
+		return options.DownloadDir
+	}
+	return c.config.DownloadDir
+}
+
+// handle returns the one handle for a session torrent, so handles can be compared and used as map keys
+func (c *Client) handle(t *session.Torrent) *Torrent {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	h, ok := c.handles[t]
+	if !ok {
+		h = &Torrent{client: c, torrent: t}
+		c.handles[t] = h
+	}
+	return h
+}
+
+func (c *Client) forget(t *session.Torrent) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.handles, t)
+}
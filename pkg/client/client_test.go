@@ -0,0 +1,183 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chrispritchard/gorrent/internal/bencode"
+)
+
+// startTracker serves compact peer lists of everyone who has announced for each info hash, bar the one asking. It
+// also returns how many have announced, across all info hashes
+func startTracker(t *testing.T) (string, func() int) {
+	var mutex sync.Mutex
+	swarms := map[string]map[int]struct{}{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info_hash := r.URL.Query().Get("info_hash")
+		port, _ := strconv.Atoi(r.URL.Query().Get("port"))
+
+		mutex.Lock()
+		if swarms[info_hash] == nil {
+			swarms[info_hash] = map[int]struct{}{}
+		}
+		swarms[info_hash][port] = struct{}{}
+		peers := []byte{}
+		for p := range swarms[info_hash] {
+			if p != port {
+				peers = append(peers, 127, 0, 0, 1)
+				peers = binary.BigEndian.AppendUint16(peers, uint16(p))
+			}
+		}
+		mutex.Unlock()
+
+		data, _ := bencode.Encode(map[string]any{"interval": 1, "peers": peers})
+		w.Write(data)
+	}))
+	t.Cleanup(server.Close)
+	announced := func() int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		count := 0
+		for _, swarm := range swarms {
+			count += len(swarm)
+		}
+		return count
+	}
+	return server.URL + "/announce", announced
+}
+
+func newTestClient(t *testing.T, download_dir string) *Client {
+	config := DefaultConfig()
+	config.ListenPort = 0
+	config.DownloadDir = download_dir
+	c, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestClient_DownloadsFromMagnetLink(t *testing.T) {
+	announce, announced := startTracker(t)
+	seed_dir, leech_dir := t.TempDir(), t.TempDir()
+
+	data := make([]byte, 90_000)
+	rand.Read(data)
+	if err := os.WriteFile(filepath.Join(seed_dir, "data.bin"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, info, err := CreateTorrent(filepath.Join(seed_dir, "data.bin"), CreateOptions{PieceLength: 1 << 14, Announce: [][]string{{announce}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	seeder := newTestClient(t, seed_dir)
+	seeding, err := seeder.AddTorrent(info, AddOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := seeding.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for announced() == 0 { // so the leecher's first announce finds the seeder
+		select {
+		case <-ctx.Done():
+			t.Fatal("the seeder never announced")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	leecher := newTestClient(t, leech_dir)
+	events := leecher.Subscribe(ctx)
+	torrent, err := leecher.AddMagnet(info.MagnetLink(), AddOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := torrent.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(leech_dir, "data.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("downloaded data does not match the seeded data")
+	}
+
+	if status := torrent.Status(); status.Progress != 1 || status.BytesCompleted != int64(len(data)) {
+		t.Errorf("expected complete progress, got %+v", status)
+	}
+	files := torrent.Files()
+	if len(files) != 1 || files[0].Path != "data.bin" || files[0].BytesCompleted != int64(len(data)) {
+		t.Errorf("unexpected files: %+v", files)
+	}
+	if found, ok := leecher.Torrent(info.InfoHash); !ok || found != torrent {
+		t.Error("expected the torrent to be found by info hash, as the same handle")
+	}
+
+	seen := map[EventKind]bool{}
+	for !seen[TorrentCompleted] {
+		select {
+		case e := <-events:
+			if e.Torrent != torrent {
+				t.Errorf("event for an unexpected torrent: %+v", e)
+			}
+			seen[e.Kind] = true
+		case <-ctx.Done():
+			t.Fatalf("did not see completion, saw %v", seen)
+		}
+	}
+	for _, kind := range []EventKind{TorrentAdded, MetadataReceived, StateChanged, PieceVerified} {
+		if !seen[kind] {
+			t.Errorf("expected a %s event", kind)
+		}
+	}
+}
+
+func TestClient_SubscriptionsEnd(t *testing.T) {
+	c := newTestClient(t, t.TempDir())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := c.Subscribe(ctx)
+	closed := c.Subscribe(context.Background())
+
+	cancel()
+	waitForClose(t, cancelled)
+
+	c.Close()
+	waitForClose(t, closed)
+
+	if _, ok := <-c.Subscribe(context.Background()); ok {
+		t.Error("expected subscribing to a closed client to give a closed channel")
+	}
+}
+
+func waitForClose(t *testing.T, events <-chan Event) {
+	t.Helper()
+	for {
+		select {
+		case _, ok := <-events:
+			if !ok {
+				return
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected the event channel to be closed")
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package client
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/chrispritchard/gorrent/internal/session"
+)
+
+type EventKind int
+
+const (
+	TorrentAdded     = EventKind(session.TorrentAdded)
+	MetadataReceived = EventKind(session.MetadataReceived)
+	StateChanged     = EventKind(session.StateChanged)
+	PieceVerified    = EventKind(session.PieceVerified)
+	PeerConnected    = EventKind(session.PeerConnected)
+	PeerDisconnected = EventKind(session.PeerDisconnected)
+	TorrentCompleted = EventKind(session.TorrentCompleted)
+	TorrentRemoved   = EventKind(session.TorrentRemoved)
+)
+
+func (k EventKind) String() string {
+	return session.EventKind(k).String()
+}
+
+// Event reports something that happened to a torrent. Only the fields relevant to the kind are set
+type Event struct {
+	Kind    EventKind
+	Time    time.Time
+	Torrent *Torrent
+	State   State  // for StateChanged
+	Err     error  // for StateChanged to Failed
+	Piece   int    // for PieceVerified
+	Peer    string // for PeerConnected and PeerDisconnected
+}
+
+// subscriber queues events without limit, so a slow reader never holds up the torrents
+type subscriber struct {
+	mutex  sync.Mutex
+	queue  []Event
+	signal chan struct{}
+	out    chan Event
+}
+
+// Subscribe returns a channel of every event from now on. It is closed once ctx ends, or once the client is closed and
+// the events from before then have been read
+func (c *Client) Subscribe(ctx context.Context) <-chan Event {
+	sub := &subscriber{signal: make(chan struct{}, 1), out: make(chan Event)}
+
+	c.mutex.Lock()
+	if c.closed {
+		c.mutex.Unlock()
+		close(sub.out)
+		return sub.out
+	}
+	c.subscribers[sub] = struct{}{}
+	c.mutex.Unlock()
+
+	go func() {
+		defer close(sub.out)
+		defer c.unsubscribe(sub)
+		closing := false // the client has closed, so what is queued is the last
+		for {
+			sub.mutex.Lock()
+			pending := sub.queue
+			sub.queue = nil
+			sub.mutex.Unlock()
+
+			for _, event := range pending {
+				select {
+				case sub.out <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+			if closing {
+				if len(pending) == 0 {
+					return
+				}
+				continue
+			}
+
+			select {
+			case <-sub.signal:
+			case <-ctx.Done():
+				return
+			case <-c.ctx.Done():
+				closing = true
+			}
+		}
+	}()
+	return sub.out
+}
+
+func (c *Client) unsubscribe(sub *subscriber) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.subscribers, sub)
+}
+
+// publish is the session's event handler, so is never called holding a session or torrent lock
+func (c *Client) publish(e session.Event) {
+	event := Event{
+		Kind:    EventKind(e.Kind),
+		Time:    e.Time,
+		Torrent: c.handle(e.Torrent),
+		State:   State(e.State),
+		Err:     e.Err,
+		Piece:   e.Piece,
+		Peer:    e.Peer,
+	}
+	if e.Kind == session.TorrentRemoved {
+		c.forget(e.Torrent)
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for sub := range c.subscribers {
+		sub.mutex.Lock()
+		sub.queue = append(sub.queue, event)
+		sub.mutex.Unlock()
+		select {
+		case sub.signal <- struct{}{}:
+		default:
+		}
+	}
+}
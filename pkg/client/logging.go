@@ -0,0 +1,22 @@
+package client
+
+import (
+	"io"
+	"log/slog"
+
+	"github.com/chrispritchard/gorrent/internal/logging"
+)
+
+// LogLevels is a default log level and overrides for particular subsystems: session, torrent, peer, download, webseed
+// and tracker
+type LogLevels = logging.Levels
+
+// ParseLogLevels reads levels such as "info,peer=debug,tracker=warn"
+func ParseLogLevels(spec string) (LogLevels, error) {
+	return logging.ParseLevels(spec)
+}
+
+// NewLogger creates a logger for Config.Logger, writing "text" or "json" records to out at the given levels
+func NewLogger(out io.Writer, format string, levels LogLevels) (*slog.Logger, error) {
+	return logging.New(out, format, levels)
+}
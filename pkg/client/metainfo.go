@@ -0,0 +1,108 @@
+package client
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/chrispritchard/gorrent/internal/torrent_files"
+)
+
+// InfoHash identifies a torrent's swarm. For v2 only torrents it is the truncated sha256 used on the wire
+type InfoHash [20]byte
+
+func (h InfoHash) String() string {
+	return hex.EncodeToString(h[:])
+}
+
+// ParseInfoHash reads an info hash written as 40 hex characters
+func ParseInfoHash(s string) (InfoHash, error) {
+	var h InfoHash
+	decoded, err := hex.DecodeString(s)
+	if err != nil || len(decoded) != len(h) {
+		return h, fmt.Errorf("invalid info hash %q, expected 40 hex characters", s)
+	}
+	copy(h[:], decoded)
+	return h, nil
+}
+
+// Metainfo describes a torrent, as read from a .torrent file or received from peers for a magnet link
+type Metainfo struct {
+	InfoHash    InfoHash
+	Name        string
+	PieceLength int
+	PieceCount  int
+	Length      int64
+	Files       []File // padding files are left out
+	Trackers    []string
+	WebSeeds    []string
+	metadata    torrent_files.TorrentMetadata
+}
+
+// File is a file within a torrent, with its path relative to the download directory using forward slashes
+type File struct {
+	Path   string
+	Length int64
+}
+
+// CreateOptions control how CreateTorrent builds a torrent
+type CreateOptions = torrent_files.CreateOptions
+
+func ParseTorrent(data []byte) (Metainfo, error) {
+	metadata, err := torrent_files.ParseTorrentFile(data)
+	if err != nil {
+		return Metainfo{}, fmt.Errorf("unable to parse torrent file: %v", err)
+	}
+	return new_metainfo(metadata), nil
+}
+
+// ParseMagnet reads what a magnet link says about its torrent: the info hash, and any name, trackers and web seeds
+func ParseMagnet(uri string) (Metainfo, error) {
+	magnet, err := torrent_files.ParseMagnet(uri)
+	if err != nil {
+		return Metainfo{}, err
+	}
+	return new_metainfo(magnet.Metadata()), nil
+}
+
+func LoadTorrentFile(path string) (Metainfo, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Metainfo{}, fmt.Errorf("unable to read file at path %s: %v", path, err)
+	}
+	return ParseTorrent(data)
+}
+
+// CreateTorrent hashes the file or directory at root, returning the encoded torrent file along with its description
+func CreateTorrent(root string, options CreateOptions) ([]byte, Metainfo, error) {
+	data, metadata, err := torrent_files.CreateTorrent(root, options)
+	if err != nil {
+		return nil, Metainfo{}, err
+	}
+	return data, new_metainfo(metadata), nil
+}
+
+func (m Metainfo) MagnetLink() string {
+	return torrent_files.MagnetLink(m.metadata)
+}
+
+func new_metainfo(metadata torrent_files.TorrentMetadata) Metainfo {
+	result := Metainfo{
+		InfoHash:    InfoHash(metadata.InfoHash),
+		Name:        metadata.Name,
+		PieceLength: metadata.PieceLength,
+		PieceCount:  metadata.PieceCount(),
+		Length:      int64(metadata.Length),
+		Trackers:    metadata.Announcers,
+		WebSeeds:    metadata.WebSeeds,
+		metadata:    metadata,
+	}
+	for _, span := range metadata.FileSpans() {
+		if span.File.IsPadding() {
+			continue
+		}
+		result.Files = append(result.Files, File{Path: strings.Join(span.File.Path, "/"), Length: int64(span.File.Length)})
+	}
+	return result
+}
@@ -0,0 +1,347 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/chrispritchard/gorrent/internal/session"
+	"github.com/chrispritchard/gorrent/internal/stats"
+)
+
+type State int
+
+const (
+	Paused           = State(session.Paused)
+	FetchingMetadata = State(session.FetchingMetadata)
+	Checking         = State(session.Checking)
+	Downloading      = State(session.Downloading)
+	Seeding          = State(session.Seeding)
+	Failed           = State(session.Failed)
+)
+
+func (s State) String() string {
+	return session.State(s).String()
+}
+
+type Status struct {
+	State           State
+	Err             error // why the torrent failed
+	TrackerErr      error // the last announce failure, cleared by a success
+	Progress        float64
+	CompletedPieces int
+	TotalPieces     int
+	BytesCompleted  int64
+	BytesTotal      int64
+	Peers           int
+	Downloaded      int64 // block data, since the torrent was added
+	Uploaded        int64
+	Wasted          int64   // downloaded but discarded, as duplicates or failing verification
+	DownloadRate    float64 // bytes per second, over the last few seconds
+	UploadRate      float64
+	Ratio           float64       // uploaded over downloaded less wasted, or over the data we have if we downloaded none
+	ETA             time.Duration // 0 once complete, -1 if unknown
+	SeedingTime     time.Duration // since the torrent was added
+	HashFailures    int64         // pieces that failed verification, and were fetched again
+	DiskWrites      Histogram     // how long verified pieces took to write
+	Announces       Histogram     // how long announces to the trackers took, successful or not
+	AnnounceErrors  int64
+	BannedPeers     int // hosts refused for sending data that failed verification
+}
+
+// SeedLimits say when a complete torrent stops seeding: once its ratio reaches Ratio, it has seeded for Time, or no
+// peer has been interested in it for Idle. Zero values are no limit. A torrent stopped by a limit is stopped again if
+// resumed, until the limit is raised
+type SeedLimits = session.SeedLimits
+
+// SeedAction is what happens to a torrent once it reaches a seed limit
+type SeedAction = session.SeedAction
+
+const (
+	SeedStop   = session.SeedStop   // pause the torrent
+	SeedRemove = session.SeedRemove // remove it, leaving the files
+	SeedDelete = session.SeedDelete // remove it and delete the files
+)
+
+// ParseSeedAction reads stop, remove or delete
+func ParseSeedAction(s string) (SeedAction, error) {
+	return session.ParseSeedAction(s)
+}
+
+// Histogram counts durations by the least of its bounds that each is within, with a final count for the rest. It may be
+// empty, without bounds, if nothing has been counted
+type Histogram = stats.Histogram
+
+// PeerStatus describes a connected peer. Choked means the peer is refusing our requests, Choking that we are
+// refusing theirs
+type PeerStatus struct {
+	Address      string
+	ID           [20]byte
+	Client       string // decoded from the peer id
+	Requests     int    // blocks requested from the peer and not yet received
+	Choked       bool
+	Interested   bool // the peer wants pieces from us
+	Choking      bool
+	AmInterested bool
+	Downloaded   int64
+	Uploaded     int64
+	DownloadRate float64
+	UploadRate   float64
+}
+
+// FileProgress is a file within the torrent along with how much of it has been downloaded and verified
+type FileProgress struct {
+	File
+	BytesCompleted int64
+	Priority       Priority
+}
+
+// Priority orders downloading between files: pieces of higher priority files are fetched first
+type Priority int
+
+const (
+	Low    = Priority(session.Low)
+	Normal = Priority(session.Normal)
+	High   = Priority(session.High)
+)
+
+func (p Priority) String() string {
+	return session.Priority(p).String()
+}
+
+// PieceState is whether we have a piece, and how many connected peers do
+type PieceState struct {
+	Have  bool
+	Peers int
+}
+
+// Torrent is a handle to a torrent in the client. Handles stay valid after removal, but then no longer change
+type Torrent struct {
+	client  *Client
+	torrent *session.Torrent
+}
+
+func (t *Torrent) InfoHash() InfoHash {
+	return InfoHash(t.torrent.Metadata().InfoHash)
+}
+
+func (t *Torrent) Name() string {
+	return t.torrent.Metadata().Name
+}
+
+// Info describes the torrent, returning false while the metadata of a torrent added by magnet link is outstanding
+func (t *Torrent) Info() (Metainfo, bool) {
+	return new_metainfo(t.torrent.Metadata()), t.torrent.HasMetadata()
+}
+
+// DownloadDir is where the torrent's files are saved once complete
+func (t *Torrent) DownloadDir() string {
+	return t.torrent.OutputDir()
+}
+
+// DataDir is where the torrent's files are now, which is the client's incomplete directory until it completes, if it
+// has one
+func (t *Torrent) DataDir() string {
+	return t.torrent.DataDir()
+}
+
+// Move moves the torrent's files into dir, which becomes its download directory. Files are renamed, or copied and
+// checked where dir is on another filesystem. A running torrent keeps running, reading and writing in the new place
+func (t *Torrent) Move(dir string) error {
+	return t.torrent.Move(dir)
+}
+
+func (t *Torrent) MagnetLink() string {
+	info, _ := t.Info()
+	return info.MagnetLink()
+}
+
+func (t *Torrent) Status() Status {
+	status := t.torrent.Status()
+	result := Status{
+		State:           State(status.State),
+		Err:             status.Err,
+		TrackerErr:      status.TrackerErr,
+		CompletedPieces: status.CompletedPieces,
+		TotalPieces:     status.TotalPieces,
+		Peers:           status.Peers,
+		Downloaded:      status.Downloaded,
+		Uploaded:        status.Uploaded,
+		Wasted:          status.Wasted,
+		DownloadRate:    status.DownloadRate,
+		UploadRate:      status.UploadRate,
+		Ratio:           status.Ratio,
+		ETA:             status.ETA,
+		SeedingTime:     status.SeedingTime,
+		HashFailures:    status.HashFailures,
+		DiskWrites:      status.DiskWrites,
+		Announces:       status.Announces,
+		AnnounceErrors:  status.AnnounceErrors,
+		BannedPeers:     status.BannedPeers,
+	}
+	if !t.torrent.HasMetadata() {
+		return result
+	}
+
+	metadata := t.torrent.Metadata()
+	result.BytesTotal = int64(metadata.Length)
+	if bitfield, ok := t.torrent.Bitfield(); ok {
+		for i := range metadata.PieceCount() {
+			if bitfield.Get(i) {
+				result.BytesCompleted += int64(metadata.PieceSize(i))
+			}
+		}
+	}
+	if result.BytesTotal > 0 {
+		result.Progress = float64(result.BytesCompleted) / float64(result.BytesTotal)
+	} else if result.TotalPieces > 0 {
+		result.Progress = float64(result.CompletedPieces) / float64(result.TotalPieces)
+	}
+	return result
+}
+
+func (t *Torrent) Peers() []PeerStatus {
+	result := []PeerStatus{}
+	for _, p := range t.torrent.Peers() {
+		result = append(result, PeerStatus{
+			Address:      p.Address,
+			ID:           p.ID,
+			Client:       p.Client,
+			Requests:     p.Requests,
+			Choked:       p.Choked,
+			Interested:   p.Interested,
+			Choking:      p.Choking,
+			AmInterested: p.AmInterested,
+			Downloaded:   p.Downloaded,
+			Uploaded:     p.Uploaded,
+			DownloadRate: p.DownloadRate,
+			UploadRate:   p.UploadRate,
+		})
+	}
+	return result
+}
+
+// Files lists the torrent's files, empty until the metadata is known
+func (t *Torrent) Files() []FileProgress {
+	if !t.torrent.HasMetadata() {
+		return nil
+	}
+	metadata := t.torrent.Metadata()
+	bitfield, checked := t.torrent.Bitfield()
+
+	result := []FileProgress{}
+	files := new_metainfo(metadata).Files
+	for i, span := range metadata.FileSpans() {
+		if span.File.IsPadding() {
+			continue
+		}
+		progress := FileProgress{File: files[len(result)], Priority: Priority(t.torrent.FilePriority(i))}
+		if checked && metadata.PieceLength > 0 {
+			for i := span.Start / metadata.PieceLength; i*metadata.PieceLength < span.End; i++ {
+				if !bitfield.Get(i) {
+					continue
+				}
+				start := max(span.Start, i*metadata.PieceLength)
+				end := min(span.End, (i+1)*metadata.PieceLength)
+				progress.BytesCompleted += int64(end - start)
+			}
+		}
+		result = append(result, progress)
+	}
+	return result
+}
+
+// SetFilePriority changes the priority of the file at index in Files
+func (t *Torrent) SetFilePriority(index int, priority Priority) error {
+	visible := 0
+	for i, span := range t.torrent.Metadata().FileSpans() {
+		if span.File.IsPadding() {
+			continue
+		}
+		if visible == index {
+			return t.torrent.SetFilePriority(i, session.Priority(priority))
+		}
+		visible++
+	}
+	return fmt.Errorf("no file with index %d", index)
+}
+
+// Pieces describes every piece, for drawing a map of progress and availability. Empty until the files are checked
+func (t *Torrent) Pieces() []PieceState {
+	result := []PieceState{}
+	for _, p := range t.torrent.Pieces() {
+		result = append(result, PieceState{Have: p.Have, Peers: p.Peers})
+	}
+	return result
+}
+
+// SetRates changes this torrent's bandwidth limits, in bytes per second with 0 for unlimited. The client's limits still
+// apply on top
+func (t *Torrent) SetRates(download, upload int) {
+	t.torrent.SetRates(download, upload)
+}
+
+func (t *Torrent) Rates() (download, upload int) {
+	return t.torrent.Rates()
+}
+
+// SetSeedLimits gives the torrent seed limits of its own, or with nil, has it follow the client's
+func (t *Torrent) SetSeedLimits(limits *SeedLimits) error {
+	return t.torrent.SetSeedLimits(limits)
+}
+
+// SeedLimits returns the limits that apply to the torrent, and whether they are its own rather than the client's
+func (t *Torrent) SeedLimits() (SeedLimits, bool) {
+	return t.torrent.SeedLimits()
+}
+
+// SetSuperSeeding turns super-seeding (BEP 16) on or off. A super-seeding torrent tells peers that connect while it is
+// seeding that it has nothing, then offers each one piece at a time, offering the next once the last has spread to
+// another peer, so that no piece is uploaded twice before the swarm has it. It suits a single origin seeding new data to
+// many peers, and slows a swarm with other seeds
+func (t *Torrent) SetSuperSeeding(on bool) {
+	t.torrent.SetSuperSeeding(on)
+}
+
+func (t *Torrent) SuperSeeding() bool {
+	return t.torrent.SuperSeeding()
+}
+
+// Pause stops the torrent, disconnecting its peers and closing its files, and waits for that to finish
+func (t *Torrent) Pause() {
+	t.torrent.Pause()
+}
+
+// Resume starts a paused torrent, or restarts a failed one
+func (t *Torrent) Resume() {
+	t.torrent.Resume()
+}
+
+// Wait blocks until the torrent has downloaded everything and is seeding, returning an error if it fails or ctx ends
+func (t *Torrent) Wait(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	events := t.client.Subscribe(ctx) // before checking, so no change of state can be missed
+
+	for {
+		status := t.torrent.Status()
+		switch status.State {
+		case session.Seeding:
+			return nil
+		case session.Failed:
+			return fmt.Errorf("%s: %v", t.Name(), status.Err)
+		}
+
+		select {
+		case _, ok := <-events:
+			if !ok {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				return fmt.Errorf("client closed")
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}